@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+
+	"external_payments/types"
+)
+
+func export(t *testing.T, r *gin.Engine, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	day := time.Now().Format(time.DateOnly)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments/export?from="+day+"&to="+day+query, nil))
+	return w
+}
+
+func TestExportPaymentsCsv(t *testing.T) {
+	r, store := newEngine(t, site)
+	r.GET("/payments/export", ExportPayments)
+	store.UpdateRequest(types.PaymentResponse{
+		UserKey: "u-2", TransactionId: "tx-2", VoucherId: "v-2", CreditCardBrand: "2",
+		CreditCardNumber: "458045******4242", TotalPayments: "3",
+	})
+
+	w := export(t, r, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "458045") {
+		t.Error("export carries more of the card than the last four digits")
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0][0] != "Date" {
+		t.Fatalf("records %v", records)
+	}
+	// Oldest first, and only the caller's.
+	u2 := records[2]
+	if u2[3] != "u-2" || u2[7] != "tx-2" || u2[10] != "3" || u2[12] != "2" || u2[13] != "4242" || u2[14] != "v-2" {
+		t.Errorf("u-2 row %v", u2)
+	}
+	for _, record := range records[1:] {
+		if !strings.HasPrefix(record[2], "1fam-") || record[1] != "ben2" {
+			t.Errorf("exported someone else's payment: %v", record)
+		}
+	}
+}
+
+func TestExportPaymentsXlsx(t *testing.T) {
+	r, _ := newEngine(t, site)
+	r.GET("/payments/export", ExportPayments)
+
+	w := export(t, r, "&format=xlsx&sku=book")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body.String())
+	}
+	f, err := excelize.OpenReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows("Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1][3] != "u-1" || rows[2][3] != "u-3" {
+		t.Errorf("rows %v", rows)
+	}
+}
+
+func TestExportPaymentsNeedsRange(t *testing.T) {
+	r, _ := newEngine(t, site)
+	r.GET("/payments/export", ExportPayments)
+
+	for _, path := range []string{"/payments/export", "/payments/export?from=2026-01-01", "/payments/export?from=2026-01-01&to=2026-01-31&format=pdf"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", path, w.Code)
+		}
+	}
+}
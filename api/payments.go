@@ -0,0 +1,267 @@
+// Package api answers a client's questions about its own payments from our
+// records, so a plugin can reconcile its orders without database access.
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json/v2"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/types"
+	"external_payments/utils"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+// Payment is a request as the API shows it: what was asked for, how it
+// stands, and what the gateway answered, in the same shape whichever gateway
+// took it.
+type Payment struct {
+	UserKey      string         `json:"user_key"`
+	Reference    string         `json:"reference"`
+	Organization string         `json:"organization"`
+	Status       string         `json:"status"`
+	Amount       float64        `json:"amount"`
+	Currency     string         `json:"currency"`
+	SKU          string         `json:"sku"`
+	CreatedAt    string         `json:"created_at"`
+	Gateway      Gateway        `json:"gateway"`
+	History      []StatusChange `json:"history,omitempty"`
+}
+
+// Gateway is the gateway's side of a payment. TransactionId is the id the
+// gateway knows it by: Pelecard's transaction, or the PayPal order. The card
+// is shown by its last four digits only.
+type Gateway struct {
+	Name          string  `json:"name"`
+	TransactionId string  `json:"transaction_id,omitempty"`
+	VoucherId     string  `json:"voucher_id,omitempty"`
+	CardLast4     string  `json:"card_last4,omitempty"`
+	Installments  int     `json:"installments,omitzero"`
+	Amount        float64 `json:"amount,omitzero"`
+}
+
+// StatusChange is one move in a payment's history.
+type StatusChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	At   string `json:"at"`
+}
+
+type page struct {
+	Payments   []Payment `json:"payments"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// ListPayments answers GET /api/payments with the caller's requests, newest
+// first. Query parameters narrow it down:
+//
+//	organization  reference  status  currency  sku
+//	from, to      YYYY-MM-DD (to includes the day) or RFC 3339
+//	limit         at most 200, 50 if not given
+//	cursor        next_cursor of the previous page
+//
+// reference matches by prefix. A page that is not the last carries
+// next_cursor.
+func ListPayments(c *gin.Context) {
+	q, err := parseQuery(c)
+	if err != nil {
+		utils.ErrorJson(http.StatusBadRequest, err.Error(), c)
+		return
+	}
+	result := page{Payments: []Payment{}}
+	if scope(c, &q) {
+		// Ask for one more than the page to know whether there is another.
+		limit := q.Limit
+		q.Limit++
+		rows, err := db.QueryRequests(q)
+		if err != nil {
+			utils.ErrorJson(http.StatusInternalServerError, "QueryRequests "+err.Error(), c)
+			return
+		}
+		if len(rows) > limit {
+			rows = rows[:limit]
+			result.NextCursor = encodeCursor(rows[limit-1].Id)
+		}
+		for _, r := range rows {
+			result.Payments = append(result.Payments, payment(r))
+		}
+	}
+	writeJson(c, result)
+}
+
+// GetPayment answers GET /api/payments/:userKey with the request, the
+// gateway's response to it and its status history. A request outside the
+// caller's organization or prefix is not found.
+func GetPayment(c *gin.Context) {
+	q := types.RequestQuery{UserKey: c.Param("userKey"), Limit: 1}
+	var rows []types.RequestSummary
+	if scope(c, &q) {
+		var err error
+		if rows, err = db.QueryRequests(q); err != nil {
+			utils.ErrorJson(http.StatusInternalServerError, "QueryRequests "+err.Error(), c)
+			return
+		}
+	}
+	if len(rows) == 0 {
+		utils.ErrorJson(http.StatusNotFound, "no payment "+q.UserKey, c)
+		return
+	}
+	result := payment(rows[0])
+
+	var response types.PaymentResponse
+	err := db.LoadPaymentResponse(q.UserKey, &response)
+	switch {
+	case err == nil:
+		normalize(&result.Gateway, response)
+	case !errors.Is(err, sql.ErrNoRows):
+		utils.ErrorJson(http.StatusInternalServerError, "LoadPaymentResponse "+err.Error(), c)
+		return
+	}
+
+	history, err := db.StatusHistory(q.UserKey)
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, "StatusHistory "+err.Error(), c)
+		return
+	}
+	for _, h := range history {
+		result.History = append(result.History, StatusChange{From: h.From, To: h.To, At: h.CreatedAt})
+	}
+	writeJson(c, result)
+}
+
+// scope narrows q to what the caller may see: its key's organization and
+// reference prefix. The prefix applies whatever the key's prefix mode, which
+// only decides whether a charge outside it is refused. The internal key sees
+// everything. scope reports false when the caller's own filters fall outside
+// its scope, so nothing can match.
+func scope(c *gin.Context, q *types.RequestQuery) bool {
+	client, ok := utils.APIClientFor(c)
+	if !ok || client.Internal {
+		return true
+	}
+	if client.Organization != "" {
+		if q.Organization != "" && q.Organization != client.Organization {
+			return false
+		}
+		q.Organization = client.Organization
+	}
+	switch {
+	case strings.HasPrefix(q.ReferencePrefix, client.Prefix):
+	case strings.HasPrefix(client.Prefix, q.ReferencePrefix):
+		q.ReferencePrefix = client.Prefix
+	default:
+		return false
+	}
+	return true
+}
+
+func parseQuery(c *gin.Context) (q types.RequestQuery, err error) {
+	q = types.RequestQuery{
+		Organization:    c.Query("organization"),
+		ReferencePrefix: c.Query("reference"),
+		Status:          c.Query("status"),
+		Currency:        c.Query("currency"),
+		SKU:             c.Query("sku"),
+		Limit:           defaultLimit,
+	}
+	if q.Status != "" && !slices.Contains(db.Statuses, db.Status(q.Status)) {
+		return q, errors.New("unknown status " + q.Status)
+	}
+	if s := c.Query("from"); s != "" {
+		if q.From, err = parseTime(s, false); err != nil {
+			return q, errors.New("from: " + err.Error())
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if q.To, err = parseTime(s, true); err != nil {
+			return q, errors.New("to: " + err.Error())
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > maxLimit {
+			return q, errors.New("limit must be 1 to " + strconv.Itoa(maxLimit))
+		}
+	}
+	if s := c.Query("cursor"); s != "" {
+		if q.After, err = decodeCursor(s); err != nil {
+			return q, errors.New("bad cursor")
+		}
+	}
+	return q, nil
+}
+
+// parseTime reads a date or an RFC 3339 time in the server's zone, which is
+// the zone created_at is written in. A date that ends a range includes the day.
+func parseTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t.In(time.Local), err
+}
+
+// A cursor is the id of the last request on a page. It is encoded so that
+// callers pass it back rather than build one.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(s string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func payment(r types.RequestSummary) Payment {
+	p := Payment{
+		UserKey: r.UserKey, Reference: r.Reference, Organization: r.Organization, Status: r.Status,
+		Amount: r.Price, Currency: r.Currency, SKU: r.SKU, CreatedAt: r.CreatedAt,
+		Gateway: Gateway{Name: r.Gateway, TransactionId: r.TransactionId},
+	}
+	if r.Gateway == "paypal" && r.PaypalOrderId != "" {
+		p.Gateway.TransactionId = r.PaypalOrderId
+	}
+	return p
+}
+
+// normalize fills g from Pelecard's stored response. The card number is
+// stored masked to first six and last four; only the last four are shown.
+// DebitTotal is in agorot or cents.
+func normalize(g *Gateway, r types.PaymentResponse) {
+	if g.TransactionId == "" {
+		g.TransactionId = r.TransactionId
+	}
+	g.VoucherId = r.VoucherId
+	if n := r.CreditCardNumber; len(n) >= 4 {
+		g.CardLast4 = n[len(n)-4:]
+	}
+	g.Installments, _ = strconv.Atoi(r.TotalPayments)
+	if total, err := strconv.ParseFloat(r.DebitTotal, 64); err == nil {
+		g.Amount = total / 100
+	}
+}
+
+func writeJson(c *gin.Context, v any) {
+	body, _ := json.Marshal(v)
+	c.Header("Content-Type", "application/json")
+	c.Writer.WriteHeader(http.StatusOK)
+	_, _ = c.Writer.Write(body)
+}
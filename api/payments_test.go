@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/types"
+	"external_payments/utils"
+)
+
+var site = db.APIClient{Name: "site", Organization: "ben2", Prefix: "1fam-", PrefixMode: db.PrefixObserve}
+
+func newEngine(t *testing.T, client db.APIClient) (*gin.Engine, *dbtest.Store) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+
+	for _, r := range []types.PaymentRequest{
+		{UserKey: "u-1", Reference: "1fam-1", Organization: "ben2", Price: 10, Currency: "USD", SKU: "book"},
+		{UserKey: "u-2", Reference: "1fam-2", Organization: "ben2", Price: 20, Currency: "ILS", SKU: "course"},
+		{UserKey: "u-3", Reference: "1fam-3", Organization: "ben2", Price: 30, Currency: "USD", SKU: "book"},
+		{UserKey: "u-other-site", Reference: "2shop-1", Organization: "ben2", Price: 40, Currency: "USD"},
+		{UserKey: "u-other-org", Reference: "1fam-4", Organization: "meshp18", Price: 50, Currency: "USD"},
+	} {
+		if err := store.StoreRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(utils.APIClientKey, client) })
+	r.GET("/api/payments", ListPayments)
+	r.GET("/api/payments/:userKey", GetPayment)
+	return r, store
+}
+
+func get(t *testing.T, r *gin.Engine, path string, v any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v %s", path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func userKeys(p page) (keys []string) {
+	for _, payment := range p.Payments {
+		keys = append(keys, payment.UserKey)
+	}
+	return
+}
+
+func TestListPaymentsScoped(t *testing.T) {
+	r, _ := newEngine(t, site)
+
+	var p page
+	if code := get(t, r, "/api/payments", &p); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if got := userKeys(p); len(got) != 3 || got[0] != "u-3" || got[2] != "u-1" {
+		t.Errorf("listed %v, want u-3 u-2 u-1", got)
+	}
+
+	// Filters cannot widen the scope.
+	for _, path := range []string{"/api/payments?organization=meshp18", "/api/payments?reference=2shop"} {
+		p = page{}
+		if code := get(t, r, path, &p); code != http.StatusOK || len(p.Payments) != 0 {
+			t.Errorf("%s: %d %v", path, code, userKeys(p))
+		}
+	}
+}
+
+func TestListPaymentsFilters(t *testing.T) {
+	r, store := newEngine(t, site)
+	store.SetStatus("u-1", "valid")
+
+	cases := map[string][]string{
+		"/api/payments?status=valid":             {"u-1"},
+		"/api/payments?currency=USD&sku=book":    {"u-3", "u-1"},
+		"/api/payments?reference=1fam-2":         {"u-2"},
+		"/api/payments?from=2000-01-01&to=today": nil,
+	}
+	for path, want := range cases {
+		var p page
+		code := get(t, r, path, &p)
+		if want == nil {
+			if code != http.StatusBadRequest {
+				t.Errorf("%s: %d, want 400", path, code)
+			}
+			continue
+		}
+		if got := userKeys(p); code != http.StatusOK || len(got) != len(want) || got[0] != want[0] {
+			t.Errorf("%s: %d %v, want %v", path, code, got, want)
+		}
+	}
+}
+
+func TestListPaymentsCursor(t *testing.T) {
+	r, _ := newEngine(t, site)
+
+	var first, second page
+	get(t, r, "/api/payments?limit=2", &first)
+	if got := userKeys(first); len(got) != 2 || first.NextCursor == "" {
+		t.Fatalf("first page %v cursor %q", got, first.NextCursor)
+	}
+	get(t, r, "/api/payments?limit=2&cursor="+first.NextCursor, &second)
+	if got := userKeys(second); len(got) != 1 || got[0] != "u-1" || second.NextCursor != "" {
+		t.Errorf("second page %v cursor %q", got, second.NextCursor)
+	}
+}
+
+func TestListPaymentsInternal(t *testing.T) {
+	r, _ := newEngine(t, db.APIClient{Name: "internal", Internal: true})
+
+	var p page
+	get(t, r, "/api/payments", &p)
+	if len(p.Payments) != 5 {
+		t.Errorf("internal key sees %v", userKeys(p))
+	}
+	p = page{}
+	get(t, r, "/api/payments?organization=meshp18", &p)
+	if got := userKeys(p); len(got) != 1 || got[0] != "u-other-org" {
+		t.Errorf("organization filter: %v", got)
+	}
+}
+
+func TestGetPayment(t *testing.T) {
+	r, store := newEngine(t, site)
+	if err := store.UpdateRequest(types.PaymentResponse{
+		UserKey: "u-2", TransactionId: "tx-2", VoucherId: "v-2",
+		CreditCardNumber: "458045******4242", DebitTotal: "2000", TotalPayments: "3",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Transition("u-2", db.StatusValid, "test", "")
+
+	var p Payment
+	if code := get(t, r, "/api/payments/u-2", &p); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	want := Gateway{Name: "pelecard", TransactionId: "tx-2", VoucherId: "v-2", CardLast4: "4242", Installments: 3, Amount: 20}
+	if p.Gateway != want {
+		t.Errorf("gateway %+v, want %+v", p.Gateway, want)
+	}
+	if p.Status != "valid" || len(p.History) != 1 || p.History[0].To != "valid" {
+		t.Errorf("payment %+v", p)
+	}
+
+	for _, userKey := range []string{"u-other-site", "u-other-org", "u-missing"} {
+		if code := get(t, r, "/api/payments/"+userKey, &p); code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", userKey, code)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/settlement"
+	"external_payments/types"
+	"external_payments/utils"
+)
+
+// DailyReport answers GET /payments/report/daily?date=2006-01-02 with the
+// day's settlement summary, as JSON or, with format=xlsx, a spreadsheet. The
+// caller sees its own payments, as in ListPayments, and the internal key may
+// name an organization.
+func DailyReport(c *gin.Context) {
+	day, err := time.ParseInLocation(time.DateOnly, c.Query("date"), time.Local)
+	if err != nil {
+		utils.ErrorJson(http.StatusBadRequest, "date must be YYYY-MM-DD", c)
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "xlsx" {
+		utils.ErrorJson(http.StatusBadRequest, "format must be json or xlsx", c)
+		return
+	}
+
+	report := settlement.Report{Date: day.Format(time.DateOnly), Groups: []settlement.Group{}}
+	q := types.RequestQuery{Organization: c.Query("organization")}
+	if scope(c, &q) {
+		if report, err = settlement.Daily(day, q); err != nil {
+			utils.ErrorJson(http.StatusInternalServerError, "Daily "+err.Error(), c)
+			return
+		}
+	}
+
+	if format == "json" {
+		writeJson(c, report)
+		return
+	}
+	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	c.Header("Content-Disposition", "attachment; filename=settlement_"+report.Date+".xlsx")
+	if err = report.WriteXlsx(c.Writer); err != nil {
+		log.Printf("[payments/report] write error: %v", err)
+	}
+}
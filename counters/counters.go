@@ -8,11 +8,20 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"external_payments/currency"
 	"external_payments/db"
 	"external_payments/types"
 	"external_payments/utils"
 )
 
+// The project queries. Tests replace them.
+var (
+	getProject       = db.GetProject
+	projectTotals    = db.GetProjectTotals
+	projectRanges    = db.GetProjectRanges
+	projectByCountry = db.GetProjectByCountry
+)
+
 var translations = map[string]map[string]string{
 	"en": {
 		"contributors":      "contributors",
@@ -82,13 +91,14 @@ func Counter(c *gin.Context) {
 	if tr, has := translations[language]; has {
 		words = tr
 	}
-	project, err := db.GetProject(projectName)
+	project, err := getProject(projectName)
 	if err != nil {
 		project.Target = 1_000_000
 		project.StartDate = "2023-08-01 00:00:00"
 	}
-	donors, amount := CalculateTotals(project.Name, project.StartDate)
-	percent := fmt.Sprint(math.Round(amount*100/project.Target*100) / 100)
+	display := displayCurrency(project)
+	donors, amount := CalculateTotals(project.Name, display.Code, project.StartDate)
+	percent := fmt.Sprint(percentOf(amount, project.Target))
 	var urls map[string]string
 	json.Unmarshal([]byte(project.Url), &urls)
 	url := "https://neworg.kbb1.com/en/node/1050"
@@ -102,6 +112,7 @@ func Counter(c *gin.Context) {
 		"bgcolor":      bgcolor,
 		"donors":       donors,
 		"amount":       amount,
+		"symbol":       display.Symbol,
 		"target":       project.Target,
 		"percent":      percent,
 		"contributors": words["contributors"],
@@ -112,31 +123,37 @@ func Counter(c *gin.Context) {
 	})
 }
 
-func CalculateTotals(projectName, startDate string) (donors float64, total float64) {
-	totalUSD, err := db.GetProjectTotals(projectName, "USD", startDate)
+// CalculateTotals counts a project's contributors and sums what they gave in
+// currency, each contribution at the exchange rates of the day it came in.
+func CalculateTotals(projectName, currency, startDate string) (donors float64, total float64) {
+	totals, err := projectTotals(projectName, currency, startDate)
 	if err != nil {
-		totalUSD = types.ProjectTotals{
-			Contributors: 0,
-			Total:        0,
-		}
+		utils.LogMessage(fmt.Sprint("======> GetProjectTotals", err.Error()))
+		return 0, 0
 	}
-	totalEUR, err := db.GetProjectTotals(projectName, "EUR", startDate)
-	if err != nil {
-		totalEUR = types.ProjectTotals{
-			Contributors: 0,
-			Total:        0,
-		}
+	if totals.Unconverted > 0 {
+		utils.LogMessage(fmt.Sprintf("======> %s: %v contributions without an exchange rate left out of the totals",
+			projectName, totals.Unconverted))
 	}
-	totalILS, err := db.GetProjectTotals(projectName, "ILS", startDate)
-	if err != nil {
-		totalILS = types.ProjectTotals{
-			Contributors: 0,
-			Total:        0,
-		}
+	return totals.Contributors, totals.Total
+}
+
+// percentOf is how much of target amount is, in percent to two decimals.
+func percentOf(amount, target float64) float64 {
+	if target <= 0 {
+		return 0
 	}
-	donors = totalILS.Contributors + totalEUR.Contributors + totalUSD.Contributors
-	total = totalUSD.Total + totalEUR.Total*1.1 + totalILS.Total/4.13
-	return
+	return math.Round(amount*100/target*100) / 100
+}
+
+// displayCurrency is the currency a project is shown in: dollars, unless the
+// project names another currency we know.
+func displayCurrency(project types.Project) currency.Currency {
+	if c, err := currency.Lookup(project.DisplayCurrency); err == nil {
+		return c
+	}
+	c, _ := currency.Lookup("USD")
+	return c
 }
 
 func Statistics(c *gin.Context) {
@@ -157,12 +174,13 @@ func Statistics(c *gin.Context) {
 	if tr, has := translations[language]; has {
 		words = tr
 	}
-	project, err := db.GetProject(projectName)
+	project, err := getProject(projectName)
 	if err != nil {
 		project.Target = 1_000_000
 		project.StartDate = "2023-08-01 00:00:00"
 	}
-	ranges, err := db.GetProjectRanges(project.Name, project.StartDate)
+	display := displayCurrency(project)
+	ranges, err := projectRanges(project.Name, display.Code, project.StartDate)
 	if err != nil {
 		utils.LogMessage(fmt.Sprint("======> GetProjectRanges", err.Error()))
 		ranges = []types.ProjectRange{
@@ -176,7 +194,7 @@ func Statistics(c *gin.Context) {
 			{Start: 1000000, Finish: 9999999, Contributors: 12},
 		}
 	}
-	byCountry, err := db.GetProjectByCountry(project.Name, project.StartDate)
+	byCountry, err := projectByCountry(project.Name, display.Code, project.StartDate)
 	if err != nil {
 		utils.LogMessage(fmt.Sprint("======> GetProjectByCountry", err.Error()))
 		byCountry = []types.ProjectByCountry{}
@@ -191,6 +209,7 @@ func Statistics(c *gin.Context) {
 		"all_countries": words["all countries"],
 		"to":            words["to"],
 		"ranges":        ranges,
+		"symbol":        display.Symbol,
 		"countries":     byCountry,
 	})
 }
@@ -0,0 +1,145 @@
+package counters
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/types"
+	"external_payments/utils"
+)
+
+// cacheControl lets browsers and CDNs keep a counter for a minute, and serve
+// a stale one for five more while they fetch the next: the totals move slowly
+// and every landing page view would otherwise query CiviCRM.
+const cacheControl = "public, max-age=60, stale-while-revalidate=300"
+
+// CounterData is a project's thermometer. Amount and Target are in Currency.
+type CounterData struct {
+	Project  string  `json:"project"`
+	Currency string  `json:"currency"`
+	Donors   int     `json:"donors"`
+	Amount   float64 `json:"amount"`
+	Target   float64 `json:"target"`
+	Percent  float64 `json:"percent"`
+}
+
+// StatisticsData is a project's contributors by the size of their
+// contribution and by country. Amounts are in Currency.
+type StatisticsData struct {
+	Project   string        `json:"project"`
+	Currency  string        `json:"currency"`
+	Ranges    []RangeData   `json:"ranges"`
+	Countries []CountryData `json:"countries"`
+}
+
+type RangeData struct {
+	From         float64 `json:"from"`
+	To           float64 `json:"to"`
+	Contributors int     `json:"contributors"`
+}
+
+type CountryData struct {
+	Country      string  `json:"country"`
+	Contributors int     `json:"contributors"`
+	Sum          float64 `json:"sum"`
+}
+
+// CounterJSON answers GET /projects/:project_name/counter.json with what the
+// counter widget shows, for a page that draws its own.
+func CounterJSON(c *gin.Context) {
+	project, ok := loadProject(c)
+	if !ok {
+		return
+	}
+	display := displayCurrency(project)
+	totals, err := projectTotals(project.Name, display.Code, project.StartDate)
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, "GetProjectTotals "+err.Error(), c)
+		return
+	}
+	writeCached(c, CounterData{
+		Project:  project.Name,
+		Currency: display.Code,
+		Donors:   int(totals.Contributors),
+		Amount:   totals.Total,
+		Target:   project.Target,
+		Percent:  percentOf(totals.Total, project.Target),
+	})
+}
+
+// StatisticsJSON answers GET /projects/:project_name/statistics.json with
+// what the statistics widget shows.
+func StatisticsJSON(c *gin.Context) {
+	project, ok := loadProject(c)
+	if !ok {
+		return
+	}
+	display := displayCurrency(project)
+	ranges, err := projectRanges(project.Name, display.Code, project.StartDate)
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, "GetProjectRanges "+err.Error(), c)
+		return
+	}
+	byCountry, err := projectByCountry(project.Name, display.Code, project.StartDate)
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, "GetProjectByCountry "+err.Error(), c)
+		return
+	}
+
+	result := StatisticsData{
+		Project: project.Name, Currency: display.Code,
+		Ranges: []RangeData{}, Countries: []CountryData{},
+	}
+	for _, r := range ranges {
+		result.Ranges = append(result.Ranges, RangeData{From: r.Start, To: r.Finish, Contributors: int(r.Contributors)})
+	}
+	for _, country := range byCountry {
+		result.Countries = append(result.Countries, CountryData{
+			Country: country.Country, Contributors: int(country.Contributors), Sum: country.Sum,
+		})
+	}
+	writeCached(c, result)
+}
+
+// loadProject finds the project the path names. Unlike the widgets, which
+// draw a default counter for a name they do not know, it answers 404.
+func loadProject(c *gin.Context) (types.Project, bool) {
+	name := c.Param("project_name")
+	project, err := getProject(name)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		utils.ErrorJson(http.StatusNotFound, "no project "+name, c)
+		return project, false
+	case err != nil:
+		utils.ErrorJson(http.StatusInternalServerError, "GetProject "+err.Error(), c)
+		return project, false
+	}
+	return project, true
+}
+
+// writeCached writes v with cacheControl and an ETag of its body, and answers
+// a request that already has that body with 304.
+func writeCached(c *gin.Context, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, err.Error(), c)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, base64.RawURLEncoding.EncodeToString(sum[:12]))
+
+	c.Header("Cache-Control", cacheControl)
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json", body)
+}
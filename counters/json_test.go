@@ -0,0 +1,120 @@
+package counters
+
+import (
+	"database/sql"
+	"encoding/json/v2"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/types"
+)
+
+// stubProjects answers the project queries for "campaign" only.
+func stubProjects(t *testing.T) {
+	t.Helper()
+	g, pt, pr, pc := getProject, projectTotals, projectRanges, projectByCountry
+	t.Cleanup(func() { getProject, projectTotals, projectRanges, projectByCountry = g, pt, pr, pc })
+
+	getProject = func(name string) (types.Project, error) {
+		if name != "campaign" {
+			return types.Project{}, sql.ErrNoRows
+		}
+		return types.Project{Name: name, Target: 30000, StartDate: "2024-01-01", DisplayCurrency: "EUR"}, nil
+	}
+	projectTotals = func(name, code, _ string) (types.ProjectTotals, error) {
+		if code != "EUR" {
+			return types.ProjectTotals{}, errors.New("currency " + code)
+		}
+		return types.ProjectTotals{Contributors: 12, Total: 10000}, nil
+	}
+	projectRanges = func(string, string, string) ([]types.ProjectRange, error) {
+		return []types.ProjectRange{{Start: 1, Finish: 9, Contributors: 4}, {Start: 10, Finish: 99, Contributors: 8}}, nil
+	}
+	projectByCountry = func(string, string, string) ([]types.ProjectByCountry, error) {
+		return nil, nil
+	}
+}
+
+func newEngine() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/projects/:project_name/counter.json", CounterJSON)
+	r.GET("/projects/:project_name/statistics.json", StatisticsJSON)
+	return r
+}
+
+func serve(r *gin.Engine, path, etag string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCounterJSON(t *testing.T) {
+	stubProjects(t)
+	r := newEngine()
+
+	w := serve(r, "/projects/campaign/counter.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body.String())
+	}
+	var got CounterData
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := CounterData{Project: "campaign", Currency: "EUR", Donors: 12, Amount: 10000, Target: 30000, Percent: 33.33}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cacheControl {
+		t.Errorf("Cache-Control %q", cc)
+	}
+
+	// The same counter again is not sent again.
+	etag := w.Header().Get("ETag")
+	if w = serve(r, "/projects/campaign/counter.json", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidated: %d %q", w.Code, w.Body.String())
+	}
+	if w = serve(r, "/projects/campaign/counter.json", `"stale"`); w.Code != http.StatusOK {
+		t.Errorf("stale etag: %d", w.Code)
+	}
+
+	if w = serve(r, "/projects/nope/counter.json", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown project: %d", w.Code)
+	}
+}
+
+func TestStatisticsJSON(t *testing.T) {
+	stubProjects(t)
+	r := newEngine()
+
+	w := serve(r, "/projects/campaign/statistics.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body.String())
+	}
+	var got StatisticsData
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Currency != "EUR" || len(got.Ranges) != 2 || got.Ranges[1] != (RangeData{From: 10, To: 99, Contributors: 8}) {
+		t.Errorf("got %+v", got)
+	}
+	// No countries yet is an empty list, not null.
+	if got.Countries == nil {
+		t.Errorf("countries %s", w.Body.String())
+	}
+
+	projectRanges = func(string, string, string) ([]types.ProjectRange, error) {
+		return nil, errors.New("gone away")
+	}
+	if w = serve(r, "/projects/campaign/statistics.json", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("failed query: %d", w.Code)
+	}
+}
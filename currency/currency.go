@@ -0,0 +1,108 @@
+// Package currency is the one table of the currencies we take: their ISO 4217
+// codes, how many decimals they have, and what each gateway calls them. A
+// currency that is not here, or that a gateway does not take, is refused with
+// an error rather than charged as something else.
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupported is returned, wrapped, for a currency we do not take, or that
+// the gateway asked for does not.
+var ErrUnsupported = errors.New("unsupported currency")
+
+// Currency is one row of the table.
+type Currency struct {
+	// Code is the ISO 4217 code.
+	Code string
+	// Digits is the number of decimals, 2 for the agora and the cent.
+	Digits int
+	// Pelecard is Pelecard's code for the currency; 0 if Pelecard does not
+	// take it.
+	Pelecard int
+	// PayPal reports whether PayPal takes the currency.
+	PayPal bool
+	// Symbol is written before an amount on pages we draw.
+	Symbol string
+}
+
+var table = map[string]Currency{
+	"ILS": {Code: "ILS", Digits: 2, Pelecard: 1, PayPal: true, Symbol: "₪"},
+	"USD": {Code: "USD", Digits: 2, Pelecard: 2, PayPal: true, Symbol: "$"},
+	"EUR": {Code: "EUR", Digits: 2, Pelecard: 978, PayPal: true, Symbol: "€"},
+	"GBP": {Code: "GBP", Digits: 2, PayPal: true, Symbol: "£"},
+	"CAD": {Code: "CAD", Digits: 2, PayPal: true, Symbol: "CA$"},
+	"AUD": {Code: "AUD", Digits: 2, PayPal: true, Symbol: "A$"},
+	"CHF": {Code: "CHF", Digits: 2, PayPal: true, Symbol: "CHF "},
+	"RUB": {Code: "RUB", Digits: 2, PayPal: true, Symbol: "₽"},
+	"JPY": {Code: "JPY", Digits: 0, PayPal: true, Symbol: "¥"},
+}
+
+// Normalize is code as the table has it: upper case, and NIS, which callers
+// send for the shekel, as ILS. It does not check that the code is known.
+func Normalize(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "NIS" {
+		return "ILS"
+	}
+	return code
+}
+
+// Lookup returns the currency for a code, which may be NIS for ILS.
+func Lookup(code string) (Currency, error) {
+	c, ok := table[Normalize(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("%w %q", ErrUnsupported, code)
+	}
+	return c, nil
+}
+
+// Supported reports whether code is a currency we take.
+func Supported(code string) bool {
+	_, err := Lookup(code)
+	return err == nil
+}
+
+// Codes are the currencies we take, sorted.
+func Codes() []string {
+	codes := make([]string, 0, len(table))
+	for code := range table {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// MinorUnits converts an amount to the currency's smallest unit, agorot or
+// cents, rounding rather than truncating: 19.99*100 is 1998.9999999999998 in
+// floating point.
+func (c Currency) MinorUnits(amount float64) int {
+	return int(math.Round(amount * math.Pow10(c.Digits)))
+}
+
+// Format writes an amount with the currency's decimals, as PayPal expects it.
+func (c Currency) Format(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', c.Digits, 64)
+}
+
+// PelecardCode is Pelecard's code for the currency.
+func (c Currency) PelecardCode() (int, error) {
+	if c.Pelecard == 0 {
+		return 0, fmt.Errorf("%w %s on Pelecard", ErrUnsupported, c.Code)
+	}
+	return c.Pelecard, nil
+}
+
+// PaypalCode is the code PayPal expects for the currency.
+func (c Currency) PaypalCode() (string, error) {
+	if !c.PayPal {
+		return "", fmt.Errorf("%w %s on PayPal", ErrUnsupported, c.Code)
+	}
+	return c.Code, nil
+}
@@ -0,0 +1,58 @@
+package currency
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for code, want := range map[string]int{"ILS": 1, "NIS": 1, "nis": 1, "USD": 2, "EUR": 978} {
+		c, err := Lookup(code)
+		if err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+		if got, err := c.PelecardCode(); got != want || err != nil {
+			t.Errorf("Pelecard %s = %d %v, want %d", code, got, err, want)
+		}
+	}
+	if c, _ := Lookup("NIS"); c.Code != "ILS" {
+		t.Errorf("NIS is %q", c.Code)
+	}
+
+	for _, code := range []string{"", "XYZ", "shekel"} {
+		if _, err := Lookup(code); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%q: %v", code, err)
+		}
+	}
+}
+
+func TestGatewayCodes(t *testing.T) {
+	gbp, _ := Lookup("GBP")
+	if _, err := gbp.PelecardCode(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("GBP on Pelecard: %v", err)
+	}
+	if code, err := gbp.PaypalCode(); code != "GBP" || err != nil {
+		t.Errorf("GBP on PayPal: %q %v", code, err)
+	}
+	ils, _ := Lookup("NIS")
+	if code, _ := ils.PaypalCode(); code != "ILS" {
+		t.Errorf("PayPal NIS = %q", code)
+	}
+}
+
+func TestMinorUnits(t *testing.T) {
+	usd, _ := Lookup("USD")
+	jpy, _ := Lookup("JPY")
+	if got := usd.MinorUnits(19.99); got != 1999 {
+		t.Errorf("MinorUnits(19.99) = %d", got)
+	}
+	if got := jpy.MinorUnits(1500); got != 1500 {
+		t.Errorf("JPY MinorUnits(1500) = %d", got)
+	}
+	if got := usd.Format(5); got != "5.00" {
+		t.Errorf("USD Format(5) = %q", got)
+	}
+	if got := jpy.Format(1500.4); got != "1500" {
+		t.Errorf("JPY Format(1500.4) = %q", got)
+	}
+}
@@ -1,10 +1,18 @@
 package db
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // APIClient is one row of civicrm_bb_ext_api_clients, minus the secret. The
@@ -12,14 +20,57 @@ import (
 // not recovered. Keys are high-entropy, so a fast hash is appropriate here; a
 // password KDF would only add latency to the payment path.
 type APIClient struct {
+	ID           int64  `db:"id"`
 	Name         string `db:"name"`
 	Organization string `db:"organization"`
-	// Prefix is the caller's reference prefix, required on every client.
-	// Recorded now, not yet enforced: once every caller has a key, a reference
-	// that does not start with the client's prefix is one site claiming
-	// another's payment.
-	Prefix      string `db:"prefix"`
+	// Prefix is the caller's reference prefix, required on every client. A
+	// reference that does not start with it is one site claiming another's
+	// payment; PrefixMode says whether that is logged or refused.
+	Prefix     string `db:"prefix"`
+	PrefixMode string `db:"prefix_mode"`
+	// Scopes is the comma-separated list of what the key may do; see HasScope.
+	Scopes      string `db:"scopes"`
 	TokenSHA256 string `db:"token_sha256"`
+	// ExpiresAt is when the token stops working, as a Unix time; 0 is never.
+	// A rotated key's old token is given one, so callers can move over.
+	ExpiresAt int64 `db:"expires_at"`
+	// RequireSignature refuses the bearer token on its own: the client must
+	// sign each request, see utils.VerifySignature.
+	RequireSignature bool `db:"require_signature"`
+	// CallbackURL is where webhooks for the client's requests go. A request
+	// cannot name another.
+	CallbackURL string `db:"callback_url"`
+	// WebhookSalt is issued with the callback, and with CLIENT_SECRET_KEY
+	// gives the secret the client's webhooks are signed with.
+	WebhookSalt string `db:"webhook_salt"`
+	// Internal marks the shared INTERNAL_API_TOKEN, which has no row.
+	Internal bool `db:"-"`
+}
+
+// Prefix modes. A client starts in observe, where a reference outside its
+// prefix is logged and the request goes through; it is moved to enforce, where
+// the request is refused, once the log shows it sends only its own.
+const (
+	PrefixObserve = "observe"
+	PrefixEnforce = "enforce"
+)
+
+// Scopes a key can carry, one per kind of operation. A route names the scope
+// it needs; a key without it is refused there, whatever else it may do.
+const (
+	ScopeCharge          = "charge"
+	ScopeTransactionRead = "transaction:read"
+	ScopeMuhlafimRead    = "muhlafim:read"
+	ScopeRefund          = "refund"
+)
+
+// AllScopes is every scope, in the order -listkeys shows them.
+var AllScopes = []string{ScopeCharge, ScopeTransactionRead, ScopeMuhlafimRead, ScopeRefund}
+
+// HasScope reports whether the client may use routes that need scope. The
+// internal token has no row and no scopes column; it may do everything.
+func (c APIClient) HasScope(scope string) bool {
+	return c.Internal || slices.Contains(strings.Split(c.Scopes, ","), scope)
 }
 
 var (
@@ -27,21 +78,30 @@ var (
 	apiClients   = map[string]APIClient{}
 )
 
-// LoadAPIClients reads the enabled clients into memory. Called at startup, so
-// there is no database round trip on the request path.
-//
-// The consequence is that adding or revoking a key needs a restart. If that
-// becomes awkward, call this again on a ticker — the map is swapped under a
-// write lock, so it is safe to do while serving.
-func LoadAPIClients() (int, error) {
+// APIClientChanges is what a load did to the clients in memory, counted by
+// key: a key is added or removed, or still there with its row changed.
+type APIClientChanges struct {
+	Total   int
+	Added   int
+	Removed int
+	Changed int
+}
+
+// LoadAPIClients reads the enabled clients into memory, so there is no
+// database round trip on the request path. It runs at startup and again
+// whenever the server reloads; the map is swapped under a write lock, so that
+// is safe while serving. On error the clients already loaded stay in place.
+func LoadAPIClients() (APIClientChanges, error) {
 	var rows []APIClient
 	err := db.Select(&rows, `
-		SELECT name, organization, prefix, token_sha256
+		SELECT id, name, organization, prefix, prefix_mode, scopes, token_sha256,
+		       COALESCE(UNIX_TIMESTAMP(expires_at), 0) AS expires_at, require_signature, callback_url,
+		       webhook_salt
 		FROM civicrm_bb_ext_api_clients
-		WHERE enabled = 1
+		WHERE enabled = 1 AND (expires_at IS NULL OR expires_at > NOW())
 	`)
 	if err != nil {
-		return 0, err
+		return APIClientChanges{}, err
 	}
 
 	next := make(map[string]APIClient, len(rows))
@@ -50,10 +110,49 @@ func LoadAPIClients() (int, error) {
 	}
 
 	apiClientsMu.Lock()
+	changes := diffAPIClients(apiClients, next)
+	apiClients = next
+	apiClientsMu.Unlock()
+
+	return changes, nil
+}
+
+// UseAPIClients puts clients in memory in place of the table's, and returns a
+// func that puts the previous ones back. It is for tests of the middleware,
+// which have no database to load from.
+func UseAPIClients(clients ...APIClient) (restore func()) {
+	next := make(map[string]APIClient, len(clients))
+	for _, c := range clients {
+		next[c.TokenSHA256] = c
+	}
+	apiClientsMu.Lock()
+	previous := apiClients
 	apiClients = next
 	apiClientsMu.Unlock()
+	return func() {
+		apiClientsMu.Lock()
+		apiClients = previous
+		apiClientsMu.Unlock()
+	}
+}
 
-	return len(next), nil
+func diffAPIClients(previous, next map[string]APIClient) APIClientChanges {
+	changes := APIClientChanges{Total: len(next)}
+	for hash, client := range next {
+		old, ok := previous[hash]
+		switch {
+		case !ok:
+			changes.Added++
+		case old != client:
+			changes.Changed++
+		}
+	}
+	for hash := range previous {
+		if _, ok := next[hash]; !ok {
+			changes.Removed++
+		}
+	}
+	return changes
 }
 
 // TokenHash is the value stored in token_sha256.
@@ -62,8 +161,37 @@ func TokenHash(token string) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// clientSecret derives a secret a client shares with us, for purpose, from
+// value and CLIENT_SECRET_KEY. The key is the server's and never stored, so
+// the client table alone does not give up any client's secrets. It returns ""
+// when the key is not set.
+func clientSecret(purpose, value string) string {
+	key := os.Getenv("CLIENT_SECRET_KEY")
+	if key == "" || value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose + "\n" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SigningKey is the key the client whose token hashes to tokenSHA256 signs
+// its requests with; see utils.Sign. It is handed out with the token, and a
+// rotated token comes with a new one. It is "" without CLIENT_SECRET_KEY.
+func SigningKey(tokenSHA256 string) string {
+	return clientSecret("signing", tokenSHA256)
+}
+
+// WebhookSecret is the secret webhooks are signed with for the client whose
+// callback was issued salt. Each client has its own, so one that receives
+// webhooks cannot forge them for another. It is "" without CLIENT_SECRET_KEY.
+func WebhookSecret(salt string) string {
+	return clientSecret("webhook", salt)
+}
+
 // LookupAPIClient resolves a presented token. Comparison is a map lookup on the
-// hash, so it does not leak the token through timing.
+// hash, so it does not leak the token through timing. A token past its
+// ExpiresAt is refused here, not left until the next reload drops it.
 func LookupAPIClient(token string) (APIClient, bool) {
 	if token == "" {
 		return APIClient{}, false
@@ -71,7 +199,62 @@ func LookupAPIClient(token string) (APIClient, bool) {
 	apiClientsMu.RLock()
 	defer apiClientsMu.RUnlock()
 	c, ok := apiClients[TokenHash(token)]
-	return c, ok
+	if !ok || c.expired() {
+		return APIClient{}, false
+	}
+	return c, true
+}
+
+// LookupAPIClientByID resolves the key id a signed request names. A signed
+// request does not carry the token, only a signature made with its
+// SigningKey.
+func LookupAPIClientByID(id int64) (APIClient, bool) {
+	apiClientsMu.RLock()
+	defer apiClientsMu.RUnlock()
+	for _, c := range apiClients {
+		if c.ID == id && !c.expired() {
+			return c, true
+		}
+	}
+	return APIClient{}, false
+}
+
+func (c APIClient) expired() bool {
+	return c.ExpiresAt != 0 && time.Now().Unix() >= c.ExpiresAt
+}
+
+// touchInterval is how often a client's last_used_at is written at most. The
+// column answers "is this token still in use", for which a minute is exact
+// enough; writing it on every request would put a database write back on the
+// request path.
+const touchInterval = time.Minute
+
+var (
+	touchedMu sync.Mutex
+	touched   = map[int64]time.Time{}
+)
+
+// TouchAPIClient records that a client's token was used, from ip. The write
+// happens in the background, and at most once per touchInterval per client.
+func TouchAPIClient(id int64, ip string) {
+	if id == 0 || db == nil {
+		return
+	}
+	now := time.Now()
+	touchedMu.Lock()
+	if now.Sub(touched[id]) < touchInterval {
+		touchedMu.Unlock()
+		return
+	}
+	touched[id] = now
+	touchedMu.Unlock()
+
+	go func() {
+		_, err := db.Exec(`UPDATE civicrm_bb_ext_api_clients SET last_used_at = NOW(), last_used_ip = ? WHERE id = ?`, ip, id)
+		if err != nil {
+			log.Printf("api clients: touch %d: %v", id, err)
+		}
+	}()
 }
 
 // APIClientCount reports how many clients are loaded, for the startup log.
@@ -82,12 +265,13 @@ func APIClientCount() int {
 }
 
 // CreateAPIClient stores a new client and returns the row id. The caller keeps
-// the token; it cannot be read back afterwards.
-func CreateAPIClient(name, organization, prefix, token, notes string) (int64, error) {
+// the token; it cannot be read back afterwards. scopes is a list of Scope*
+// values.
+func CreateAPIClient(name, organization, prefix string, scopes []string, token, notes string) (int64, error) {
 	res, err := db.Exec(`
-		INSERT INTO civicrm_bb_ext_api_clients (name, token_sha256, organization, prefix, notes)
-		VALUES (?, ?, ?, ?, NULLIF(?, ''))
-	`, name, TokenHash(token), organization, prefix, notes)
+		INSERT INTO civicrm_bb_ext_api_clients (name, token_sha256, organization, prefix, scopes, notes)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))
+	`, name, TokenHash(token), organization, prefix, strings.Join(scopes, ","), notes)
 	if err != nil {
 		return 0, fmt.Errorf("insert api client: %w", err)
 	}
@@ -101,23 +285,89 @@ type APIClientRow struct {
 	Name         string  `db:"name"`
 	Organization string  `db:"organization"`
 	Prefix       string  `db:"prefix"`
+	PrefixMode   string  `db:"prefix_mode"`
+	Scopes       string  `db:"scopes"`
+	Signed       bool    `db:"require_signature"`
+	CallbackURL  string  `db:"callback_url"`
 	Enabled      bool    `db:"enabled"`
+	Expired      bool    `db:"expired"`
 	CreatedAt    string  `db:"created_at"`
 	LastUsedAt   *string `db:"last_used_at"`
+	LastUsedIP   *string `db:"last_used_ip"`
+	ExpiresAt    *string `db:"expires_at"`
+	RotatedFrom  *int64  `db:"rotated_from"`
 	Notes        string  `db:"notes"`
 }
 
 // ListAPIClients returns every client, revoked ones included.
 func ListAPIClients() (rows []APIClientRow, err error) {
 	err = db.Select(&rows, `
-		SELECT id, name, organization, prefix, enabled,
-		       created_at, last_used_at, COALESCE(notes, '') AS notes
+		SELECT id, name, organization, prefix, prefix_mode, scopes, require_signature, callback_url, enabled,
+		       COALESCE(expires_at <= NOW(), 0) AS expired,
+		       created_at, last_used_at, last_used_ip, expires_at, rotated_from,
+		       COALESCE(notes, '') AS notes
 		FROM civicrm_bb_ext_api_clients
 		ORDER BY id
 	`)
 	return
 }
 
+// rotatedColumns are the settings a rotated key keeps. Everything the server
+// loads for a client is among them, bar the token and its expiry: a rotation
+// that dropped one would change what the client may do, unannounced.
+var rotatedColumns = []string{
+	"name", "organization", "prefix", "prefix_mode", "scopes", "require_signature", "callback_url", "webhook_salt",
+	"notes",
+}
+
+// RotateAPIClient issues token to the client with row id, as a new row with
+// the same settings, and returns the new row's id.
+// The old token keeps working for grace, then expires; until then the caller
+// can deploy the new one without an outage. A zero grace ends the old token
+// at once.
+//
+// It returns sql.ErrNoRows if there is no enabled client with that id.
+func RotateAPIClient(id int64, token string, grace time.Duration) (newID int64, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := strings.Join(rotatedColumns, ", ")
+	res, err := tx.Exec(`
+		INSERT INTO civicrm_bb_ext_api_clients (token_sha256, rotated_from, `+columns+`)
+		SELECT ?, id, `+columns+`
+		FROM civicrm_bb_ext_api_clients
+		WHERE id = ? AND enabled = 1
+	`, TokenHash(token), id)
+	if err != nil {
+		return 0, fmt.Errorf("insert rotated api client: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, sql.ErrNoRows
+	}
+	if newID, err = res.LastInsertId(); err != nil {
+		return 0, err
+	}
+
+	// An earlier expiry already set is kept: rotating twice must not extend
+	// the life of the first token.
+	_, err = tx.Exec(`
+		UPDATE civicrm_bb_ext_api_clients
+		SET expires_at = LEAST(COALESCE(expires_at, NOW() + INTERVAL ? SECOND), NOW() + INTERVAL ? SECOND)
+		WHERE id = ?
+	`, int64(grace.Seconds()), int64(grace.Seconds()), id)
+	if err != nil {
+		return 0, fmt.Errorf("expire rotated api client: %w", err)
+	}
+	return newID, tx.Commit()
+}
+
 // RevokeAPIClient disables a client. The row is kept so the audit trail
 // survives; deleting it would lose who held the key and when it was issued.
 func RevokeAPIClient(id int64) (bool, error) {
@@ -128,3 +378,53 @@ func RevokeAPIClient(id int64) (bool, error) {
 	n, _ := res.RowsAffected()
 	return n > 0, nil
 }
+
+// SetAPIClientRequireSignature makes a client sign every request, or lets it
+// use the bearer token alone again, and reports whether the client exists.
+func SetAPIClientRequireSignature(id int64, required bool) (bool, error) {
+	return updateAPIClient(id, `UPDATE civicrm_bb_ext_api_clients SET require_signature = ? WHERE id = ?`, required, id)
+}
+
+// SetAPIClientCallbackURL sets where the client's webhooks go; "" stops them.
+// A client's first callback is issued a salt for its webhook secret, which it
+// keeps from then on. It returns the salt, and reports whether the client
+// exists.
+func SetAPIClientCallbackURL(id int64, callbackURL string) (salt string, found bool, err error) {
+	raw := make([]byte, 16)
+	if _, err = rand.Read(raw); err != nil {
+		return "", false, err
+	}
+	found, err = updateAPIClient(id, `
+		UPDATE civicrm_bb_ext_api_clients
+		SET callback_url = ?, webhook_salt = IF(webhook_salt = '', ?, webhook_salt)
+		WHERE id = ?
+	`, callbackURL, hex.EncodeToString(raw), id)
+	if err != nil || !found {
+		return "", found, err
+	}
+	err = db.Get(&salt, `SELECT webhook_salt FROM civicrm_bb_ext_api_clients WHERE id = ?`, id)
+	return salt, true, err
+}
+
+// SetAPIClientPrefixMode switches a client between PrefixObserve and
+// PrefixEnforce, and reports whether the client exists.
+func SetAPIClientPrefixMode(id int64, mode string) (bool, error) {
+	return updateAPIClient(id, `UPDATE civicrm_bb_ext_api_clients SET prefix_mode = ? WHERE id = ?`, mode, id)
+}
+
+// updateAPIClient runs an UPDATE of client id and reports whether the client
+// exists.
+func updateAPIClient(id int64, query string, args ...any) (bool, error) {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+	// MySQL counts changed rows, not matched ones: a client already set this
+	// way affects none.
+	var found int
+	err = db.Get(&found, `SELECT COUNT(*) FROM civicrm_bb_ext_api_clients WHERE id = ?`, id)
+	return found > 0, err
+}
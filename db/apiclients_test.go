@@ -0,0 +1,77 @@
+package db
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A reload reports keys by hash: a new hash is added, a missing one removed,
+// and the same hash with another organization or prefix changed.
+func TestDiffAPIClients(t *testing.T) {
+	previous := map[string]APIClient{
+		"h1": {Name: "kept", Organization: "ben2", Prefix: "a", TokenSHA256: "h1"},
+		"h2": {Name: "revoked", Organization: "ben2", Prefix: "b", TokenSHA256: "h2"},
+		"h3": {Name: "moved", Organization: "ben2", Prefix: "c", TokenSHA256: "h3"},
+	}
+	next := map[string]APIClient{
+		"h1": previous["h1"],
+		"h3": {Name: "moved", Organization: "meshp18", Prefix: "c", TokenSHA256: "h3"},
+		"h4": {Name: "issued", Organization: "meshp18", Prefix: "d", TokenSHA256: "h4"},
+	}
+
+	got := diffAPIClients(previous, next)
+	want := APIClientChanges{Total: 3, Added: 1, Removed: 1, Changed: 1}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// A scope is matched whole: transaction:read does not grant "transaction".
+func TestHasScope(t *testing.T) {
+	c := APIClient{Scopes: "transaction:read,refund"}
+	for scope, want := range map[string]bool{
+		ScopeTransactionRead: true,
+		ScopeRefund:          true,
+		ScopeCharge:          false,
+		"transaction":        false,
+	} {
+		if got := c.HasScope(scope); got != want {
+			t.Errorf("HasScope(%q) = %t, want %t", scope, got, want)
+		}
+	}
+}
+
+// A rotated key's old token stops at its expiry, even before a reload drops
+// the row.
+func TestLookupAPIClientExpiry(t *testing.T) {
+	t.Cleanup(UseAPIClients(
+		APIClient{ID: 2, Name: "1family", TokenSHA256: TokenHash("current")},
+		APIClient{ID: 1, Name: "1family", TokenSHA256: TokenHash("grace"), ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		APIClient{ID: 3, Name: "1family", TokenSHA256: TokenHash("expired"), ExpiresAt: time.Now().Add(-time.Second).Unix()},
+	))
+
+	for token, want := range map[string]bool{"current": true, "grace": true, "expired": false} {
+		if _, ok := LookupAPIClient(token); ok != want {
+			t.Errorf("LookupAPIClient(%q) = %t, want %t", token, ok, want)
+		}
+	}
+}
+
+// Rotating a key carries over every setting the server loads for the client:
+// a dropped require_signature would let the new token in unsigned, a dropped
+// callback_url would stop its webhooks.
+func TestRotatedColumns(t *testing.T) {
+	own := []string{"id", "token_sha256", "expires_at"}
+	fields := reflect.TypeFor[APIClient]()
+	for i := range fields.NumField() {
+		column := fields.Field(i).Tag.Get("db")
+		if column == "-" || slices.Contains(own, column) {
+			continue
+		}
+		if !slices.Contains(rotatedColumns, column) {
+			t.Errorf("rotation drops %s", column)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/go-sql-driver/mysql"
@@ -160,10 +162,17 @@ func initDB() (err error) {
 		token_sha256	CHAR(64) NOT NULL,
 		organization	VARCHAR(255) NOT NULL,
 		prefix			VARCHAR(255) NOT NULL,
+		prefix_mode		VARCHAR(16) NOT NULL DEFAULT 'observe',
+		scopes			VARCHAR(255) NOT NULL DEFAULT 'charge,transaction:read,muhlafim:read,refund',
 		enabled			TINYINT(1) NOT NULL DEFAULT 1,
 		created_at		DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		last_used_at	DATETIME NULL,
 		last_used_ip	VARCHAR(64) NULL,
+		expires_at		DATETIME NULL,
+		rotated_from	BIGINT NULL,
+		require_signature	TINYINT(1) NOT NULL DEFAULT 0,
+		callback_url	VARCHAR(1024) NOT NULL DEFAULT '',
+		webhook_salt	CHAR(32) NOT NULL DEFAULT '',
 		notes			VARCHAR(255),
 		UNIQUE KEY token_sha256 (token_sha256)
 	) engine=InnoDB default charset utf8;`),
@@ -194,6 +203,112 @@ func initDB() (err error) {
 		transaction_pelecard_id 	VARCHAR(255),
 		debit_currency 				VARCHAR(255)
 	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	CREATE TABLE IF NOT EXISTS civicrm_bb_ext_refunds (
+		id           	BIGINT PRIMARY KEY AUTO_INCREMENT,
+		user_key	 	VARCHAR(255) NOT NULL,
+		gateway			VARCHAR(16) NOT NULL,
+		transaction_id	VARCHAR(255) NOT NULL,
+		amount			REAL NOT NULL,
+		currency		VARCHAR(255) NOT NULL,
+		refund_id		VARCHAR(255),
+		status			VARCHAR(16) NOT NULL DEFAULT 'pending',
+		error			VARCHAR(255),
+		client			VARCHAR(255),
+		created_at		TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		KEY gateway_transaction (gateway, transaction_id),
+		KEY user_key (user_key)
+	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_refunds ADD COLUMN IF NOT EXISTS reference VARCHAR(255);`),
+		heredoc.Doc(`
+	DROP INDEX IF EXISTS ux_refund_reference ON civicrm_bb_ext_refunds;`),
+		heredoc.Doc(`
+	CREATE UNIQUE INDEX IF NOT EXISTS ux_refund_client_reference ON civicrm_bb_ext_refunds(gateway, client, reference);`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_requests ADD COLUMN IF NOT EXISTS callback_url VARCHAR(1024) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	CREATE TABLE IF NOT EXISTS civicrm_bb_ext_webhooks (
+		id           	BIGINT PRIMARY KEY AUTO_INCREMENT,
+		event_id		CHAR(32) NOT NULL,
+		user_key	 	VARCHAR(255) NOT NULL,
+		url				TEXT NOT NULL,
+		webhook_salt	CHAR(32) NOT NULL DEFAULT '',
+		payload			TEXT NOT NULL,
+		status			VARCHAR(16) NOT NULL DEFAULT 'pending',
+		attempts		INT NOT NULL DEFAULT 0,
+		last_error		VARCHAR(255) NOT NULL DEFAULT '',
+		next_attempt_at	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at		TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		KEY due (status, next_attempt_at),
+		KEY user_key (user_key)
+	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_requests ADD COLUMN IF NOT EXISTS webhook_salt CHAR(32) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_webhooks ADD COLUMN IF NOT EXISTS webhook_salt CHAR(32) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	CREATE TABLE IF NOT EXISTS civicrm_bb_ext_idempotency (
+		id           	BIGINT PRIMARY KEY AUTO_INCREMENT,
+		client			VARCHAR(255) NOT NULL,
+		idem_key		VARCHAR(255) NOT NULL,
+		endpoint		VARCHAR(64) NOT NULL,
+		fingerprint		CHAR(64) NOT NULL,
+		status			VARCHAR(16) NOT NULL DEFAULT 'pending',
+		http_status		INT NOT NULL DEFAULT 0,
+		body			MEDIUMTEXT,
+		created_at		TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY client_key (client, idem_key)
+	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_idempotency ADD COLUMN IF NOT EXISTS leased_until TIMESTAMP NULL;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_idempotency ADD COLUMN IF NOT EXISTS user_key VARCHAR(255) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_payment_responses ADD COLUMN IF NOT EXISTS token_sha256 CHAR(64) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	CREATE TABLE IF NOT EXISTS civicrm_bb_ext_request_status_history (
+		id           	BIGINT PRIMARY KEY AUTO_INCREMENT,
+		request_id		BIGINT NOT NULL,
+		user_key	 	VARCHAR(255) NOT NULL,
+		from_status		VARCHAR(32) NOT NULL,
+		to_status		VARCHAR(32) NOT NULL,
+		actor			VARCHAR(64) NOT NULL,
+		reason			VARCHAR(255) NOT NULL DEFAULT '',
+		created_at		TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		KEY user_key (user_key),
+		KEY request_id (request_id)
+	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_requests ADD COLUMN IF NOT EXISTS terminal VARCHAR(16) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	CREATE TABLE IF NOT EXISTS civicrm_bb_ext_exchange_rates (
+		rate_date		DATE NOT NULL,
+		currency		CHAR(3) NOT NULL,
+		usd				DOUBLE NOT NULL,
+		source			VARCHAR(16) NOT NULL DEFAULT '',
+		created_at		TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (currency, rate_date)
+	) engine=InnoDB default charset utf8;`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_payment_responses ADD COLUMN IF NOT EXISTS id BIGINT PRIMARY KEY AUTO_INCREMENT FIRST;`),
+		heredoc.Doc(`
+	CREATE INDEX IF NOT EXISTS idx_ext_responses_user_key ON civicrm_bb_ext_payment_responses(user_key);`),
+		heredoc.Doc(`
+	ALTER TABLE civicrm_bb_ext_paypal ADD COLUMN IF NOT EXISTS user_key VARCHAR(255) NOT NULL DEFAULT '';`),
+		heredoc.Doc(`
+	CREATE INDEX IF NOT EXISTS idx_ext_paypal_user_key ON civicrm_bb_ext_paypal(user_key);`),
+		// Captures stored before they carried the user key, where a single
+		// paid request has their reference.
+		heredoc.Doc(`
+	UPDATE civicrm_bb_ext_paypal pp
+	SET user_key = COALESCE((
+		SELECT MIN(r.user_key) FROM civicrm_bb_ext_requests r
+		WHERE r.reference = pp.reference AND r.organization = pp.organization
+		  AND r.status IN ('valid', 'partially-refunded', 'refunded')
+		HAVING COUNT(*) = 1
+	), '')
+	WHERE pp.user_key = '';`),
 	}
 	for idx, schema := range schemas {
 		if _, err = db.Exec(schema); err != nil {
@@ -211,6 +326,16 @@ func initDB() (err error) {
 var migrations = []string{
 	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN prefix VARCHAR(255) NOT NULL`,
 	`ALTER TABLE civicrm_bb_ext_api_clients MODIFY prefix VARCHAR(255) NOT NULL`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN prefix_mode VARCHAR(16) NOT NULL DEFAULT 'observe'`,
+	// Keys issued before scopes keep everything they could already reach.
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN scopes VARCHAR(255) NOT NULL DEFAULT 'charge,transaction:read,muhlafim:read,refund'`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN expires_at DATETIME NULL`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN rotated_from BIGINT NULL`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN require_signature TINYINT(1) NOT NULL DEFAULT 0`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN callback_url VARCHAR(1024) NOT NULL DEFAULT ''`,
+	`ALTER TABLE civicrm_bb_ext_api_clients ADD COLUMN webhook_salt CHAR(32) NOT NULL DEFAULT ''`,
+	// Projects are CiviCRM's table; counters showed dollars before it had this.
+	`ALTER TABLE civicrm_bb_projects ADD COLUMN display_currency CHAR(3) NOT NULL DEFAULT 'USD'`,
 }
 
 // mysqlDuplicateColumn is returned when the column is already there, which is
@@ -299,15 +424,15 @@ func StorePaypal(p types.PaypalRegister) {
 	return
 }
 
-func StoreRequest(p types.PaymentRequest) (err error) {
+func (mysqlStore) StoreRequest(p types.PaymentRequest) (err error) {
 	request := heredoc.Doc(`
 		INSERT INTO civicrm_bb_ext_requests (
 			user_key, good_url, error_url, cancel_url,
 			name, price, currency, email, phone,
 			street, city, country, participants, details, sku, vat, installments, language,
-			reference, organization, is_visual, is_recurring, tax_type, tax_id
+			reference, organization, is_visual, is_recurring, tax_type, tax_id, callback_url, webhook_salt
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 		)
 	`)
 
@@ -315,45 +440,109 @@ func StoreRequest(p types.PaymentRequest) (err error) {
 		p.UserKey, p.GoodURL, p.ErrorURL, p.CancelURL,
 		p.Name, p.Price, p.Currency, p.Email, p.Phone, p.Street, p.City, p.Country,
 		p.Participans, p.Details, p.SKU, p.VAT, p.Installments, p.Language, p.Reference,
-		p.Organization, p.IsVisual, p.IsRecurring, p.TaxType, p.TaxId,
+		p.Organization, p.IsVisual, p.IsRecurring, p.TaxType, p.TaxId, p.CallbackURL, p.WebhookSalt,
 	)
 	return
 }
 
-func SetStatus(userKey string, value string) {
-	request := heredoc.Doc(`
-		UPDATE civicrm_bb_ext_requests SET status = ?, pstatus = ? 
-		WHERE user_key = ?
-		ORDER BY id DESC
-		LIMIT 1
-	`)
+// requestSummary selects a types.RequestSummary from civicrm_bb_ext_requests
+// r. A request is PayPal's if it opened a PayPal order or a PayPal capture
+// carries its user key; anything else went to Pelecard.
+var requestSummary = heredoc.Doc(`
+	SELECT r.id, r.user_key, r.reference, r.organization, r.status, r.price, r.currency, r.sku, r.created_at,
+		COALESCE((
+			SELECT pr.transaction_id FROM civicrm_bb_ext_payment_responses pr
+			WHERE pr.user_key = r.user_key ORDER BY pr.id DESC LIMIT 1
+		), '') AS transaction_id,
+		CASE WHEN r.paypal_order_id IS NOT NULL
+			OR EXISTS (SELECT 1 FROM civicrm_bb_ext_paypal pp WHERE pp.user_key = r.user_key)
+		THEN 'paypal' ELSE 'pelecard' END AS gateway,
+		COALESCE(r.paypal_order_id, '') AS paypal_order_id
+	FROM civicrm_bb_ext_requests r
+`)
+
+// ListRequests lists requests by creation time. Times are compared in the
+// server's zone, as created_at is written.
+func (mysqlStore) ListRequests(from, to time.Time) (rows []types.RequestSummary, err error) {
+	err = db.Select(&rows, requestSummary+heredoc.Doc(`
+		WHERE r.created_at >= ? AND r.created_at < ?
+		ORDER BY r.id
+	`), from.Format(time.DateTime), to.Format(time.DateTime))
+	return
+}
 
-	_ = execInTx(request, value, value, userKey)
+// QueryRequests lists the requests q selects, newest first.
+func (mysqlStore) QueryRequests(q types.RequestQuery) (rows []types.RequestSummary, err error) {
+	where, args := requestFilter(q)
+	if q.After > 0 {
+		where += " AND r.id < ?"
+		args = append(args, q.After)
+	}
+	args = append(args, q.Limit)
+	err = db.Select(&rows, requestSummary+"WHERE "+where+"\nORDER BY r.id DESC\nLIMIT ?\n", args...)
+	return
 }
 
-// ClaimProcessing atomically transitions status from "new" to "in-process".
-// Returns false if the record was already claimed (concurrent duplicate callback).
-func ClaimProcessing(userKey string) bool {
-	res, err := db.Exec(
-		`UPDATE civicrm_bb_ext_requests SET status='in-process', pstatus='in-process'
-		 WHERE user_key=? AND status='new' ORDER BY id DESC LIMIT 1`,
-		userKey,
-	)
-	if err != nil {
-		return false
+// requestFilter is the WHERE clause on civicrm_bb_ext_requests r for q's
+// filters, without its paging.
+func requestFilter(q types.RequestQuery) (string, []any) {
+	where, args := []string{"1 = 1"}, []any{}
+	match := func(condition string, arg any) {
+		where = append(where, condition)
+		args = append(args, arg)
+	}
+	if q.UserKey != "" {
+		match("r.user_key = ?", q.UserKey)
+	}
+	if q.Organization != "" {
+		match("r.organization = ?", q.Organization)
+	}
+	if q.ReferencePrefix != "" {
+		match("r.reference LIKE ?", likePrefix(q.ReferencePrefix))
+	}
+	if q.Status != "" {
+		match("r.status = ?", q.Status)
 	}
-	n, _ := res.RowsAffected()
-	return n > 0
+	if q.Currency != "" {
+		match("r.currency = ?", q.Currency)
+	}
+	if q.SKU != "" {
+		match("r.sku = ?", q.SKU)
+	}
+	if !q.From.IsZero() {
+		match("r.created_at >= ?", q.From.Format(time.DateTime))
+	}
+	if !q.To.IsZero() {
+		match("r.created_at < ?", q.To.Format(time.DateTime))
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// likePrefix is a LIKE pattern for values starting with prefix: a reference
+// may itself contain _ or %.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// SetTerminal records which Pelecard terminal userKey's latest request went
+// to.
+func (mysqlStore) SetTerminal(userKey, terminal string) error {
+	return execInTx(heredoc.Doc(`
+		UPDATE civicrm_bb_ext_requests SET terminal = ?
+		WHERE user_key = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`), terminal, userKey)
 }
 
-func LoadRequest(userKey string, p *types.PaymentRequest) (err error) {
+func (mysqlStore) LoadRequest(userKey string, p *types.PaymentRequest) (err error) {
 	err = db.Get(p, "SELECT * FROM civicrm_bb_ext_requests WHERE user_key = ? ORDER BY id DESC LIMIT 1", userKey)
 	return
 }
 
 // FindRecentSuccessfulCharge returns true if a successful charge for this reference
 // exists within the last hour — suppresses Action Scheduler retry double-charges.
-func FindRecentSuccessfulCharge(reference string) bool {
+func (mysqlStore) FindRecentSuccessfulCharge(reference string) bool {
 	if reference == "" {
 		return false
 	}
@@ -368,12 +557,12 @@ func FindRecentSuccessfulCharge(reference string) bool {
 	return err == nil && exists
 }
 
-func GetStatus(userKey string) (status string, err error) {
+func (mysqlStore) GetStatus(userKey string) (status string, err error) {
 	err = db.Get(&status, "SELECT COALESCE(status,'') FROM civicrm_bb_ext_requests WHERE user_key = ? ORDER BY id DESC LIMIT 1", userKey)
 	return
 }
 
-func GetOrganization(userKey string) (org string, err error) {
+func (mysqlStore) GetOrganization(userKey string) (org string, err error) {
 	err = db.Get(&org,
 		heredoc.Doc(`
 			SELECT organization 
@@ -385,7 +574,7 @@ func GetOrganization(userKey string) (org string, err error) {
 	return
 }
 
-func Confirm(p *types.ConfirmRequest) bool {
+func (mysqlStore) Confirm(p *types.ConfirmRequest) bool {
 	request := types.PaymentRequest{}
 	err := db.Get(&request,
 		heredoc.Doc(`
@@ -401,7 +590,7 @@ func Confirm(p *types.ConfirmRequest) bool {
 	return err == nil
 }
 
-func UpdateRequestTemp(userKey string, p types.PeleCardResponse) (err error) {
+func (mysqlStore) UpdateRequestTemp(userKey string, p types.PeleCardResponse) (err error) {
 	request := heredoc.Doc(`
 		INSERT INTO civicrm_bb_ext_pelecard_responses (
 			user_key, pelecard_transaction_id, pelecard_status_code, confirmation_key, param_x
@@ -416,7 +605,7 @@ func UpdateRequestTemp(userKey string, p types.PeleCardResponse) (err error) {
 	return
 }
 
-func UpdateRequest(p types.PaymentResponse) (err error) {
+func (mysqlStore) UpdateRequest(p types.PaymentResponse) (err error) {
 	request := heredoc.Doc(`
 		INSERT INTO civicrm_bb_ext_payment_responses (
 			user_key,
@@ -425,9 +614,9 @@ func UpdateRequest(p types.PaymentResponse) (err error) {
 			additional_details_param_x, credit_card_company_issuer, debit_code, fixed_payment_total,
 			credit_card_number, credit_card_exp_date, credit_card_company_clearer, debit_total,
 			total_payments, debit_type, transaction_init_time, j_param, transaction_pelecard_id,
-			debit_currency
+			debit_currency, token_sha256
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 		)
 	`)
 
@@ -438,7 +627,7 @@ func UpdateRequest(p types.PaymentResponse) (err error) {
 		p.AdditionalDetailsParamX, p.CreditCardCompanyIssuer, p.DebitCode, p.FixedPaymentTotal,
 		p.CreditCardNumber, p.CreditCardExpDate, p.CreditCardCompanyClearer,
 		p.DebitTotal, p.TotalPayments, p.DebitType, p.TransactionInitTime, p.JParam,
-		p.TransactionPelecardId, p.DebitCurrency)
+		p.TransactionPelecardId, p.DebitCurrency, p.TokenSHA256)
 	return
 }
 
@@ -475,26 +664,34 @@ func GetProject(projectName string) (project types.Project, err error) {
 	return
 }
 
+// GetProjectTotals counts a project's contributions since date and sums them
+// in currency, each at the rates of its receive_date. A contribution in a
+// currency with no rate is left out of both, and counted in Unconverted.
 func GetProjectTotals(projectName string, currency string, date string) (project types.ProjectTotals, err error) {
 	err = db.Get(&project,
-		heredoc.Doc(`
-SELECT count(1) AS contributors, sum(co.total_amount) AS total
-FROM civicrm_contribution co
-INNER JOIN civicrm_value_maser_55 pr ON pr.entity_id = co.id AND pr.event_for_activity_1417 = ?
-WHERE (co.contribution_status_id IN (1, 6)) 
-  AND (co.financial_type_id = 21)
-  AND (co.receive_date >= ?)
-  AND (co.currency = ?);
-		`), projectName, date, currency)
+		heredoc.Docf(`
+WITH a AS (
+	SELECT %s AS amount
+	FROM civicrm_contribution co
+	CROSS JOIN (SELECT ? AS code) d
+	INNER JOIN civicrm_value_maser_55 pr ON pr.entity_id = co.id AND pr.event_for_activity_1417 = ?
+	WHERE (co.contribution_status_id IN (1, 6)) 
+	  AND (co.financial_type_id = 21)
+	  AND (co.receive_date >= ?)
+)
+SELECT count(amount) AS contributors, COALESCE(sum(amount), 0) AS total, count(1) - count(amount) AS unconverted
+FROM a;
+		`, convertedAmount), currency, projectName, date)
 	return
 }
 
-func GetProjectRanges(projectName string, date string) (prange []types.ProjectRange, err error) {
+func GetProjectRanges(projectName string, currency string, date string) (prange []types.ProjectRange, err error) {
 	err = db.Select(&prange,
-		heredoc.Doc(`
+		heredoc.Docf(`
 WITH a AS (
-	SELECT IF(co.currency = 'USD', total_amount, IF(co.currency = 'EUR', total_amount * 1.1, total_amount / 4.13)) AS amount
+	SELECT %s AS amount
 	FROM civicrm_contribution co
+	CROSS JOIN (SELECT ? AS code) d
 	INNER JOIN civicrm_value_maser_55 pr ON pr.entity_id = co.id AND pr.event_for_activity_1417 = ?
 	WHERE (co.contribution_status_id IN (1, 6)) AND (co.financial_type_id = 21) AND (co.receive_date >= ?)
 )
@@ -513,12 +710,12 @@ UNION
 SELECT 100000 AS start, 999999 AS finish, COALESCE(sum(1), 0) AS contributors FROM a WHERE a.amount BETWEEN 100000 AND 999999
 UNION
 SELECT 1000000 AS start, 9999999 AS finish, COALESCE(sum(1), 0) AS contributors FROM a WHERE a.amount BETWEEN 1000000 AND 9999999
-		`), projectName, date)
+		`, convertedAmount), currency, projectName, date)
 	return
 }
 
-func GetProjectByCountry(projectName string, date string) (byCountry []types.ProjectByCountry, err error) {
-	sql := heredoc.Doc(`
+func GetProjectByCountry(projectName string, currency string, date string) (byCountry []types.ProjectByCountry, err error) {
+	sql := heredoc.Docf(`
 WITH a AS (
 	SELECT COALESCE(
 			(SELECT country.name FROM civicrm_country country WHERE country.iso_code = 
@@ -529,16 +726,18 @@ WITH a AS (
 			LIMIT 1),
 			''
 		) AS country,
-		IF(co.currency = 'USD', total_amount, IF(co.currency = 'EUR', total_amount * 1.1, total_amount / 4.13)) AS amount
+		%s AS amount
 	FROM civicrm_contribution co
+	CROSS JOIN (SELECT ? AS code) d
 	INNER JOIN civicrm_value_maser_55 pr ON pr.entity_id = co.id AND pr.event_for_activity_1417 = ?
 	WHERE co.contribution_status_id IN (1, 6) AND co.financial_type_id = 21 AND co.receive_date >= ?
 )
-SELECT country, CONVERT(sum(amount), INTEGER) as sum, count(1) contributors
+SELECT country, CONVERT(COALESCE(sum(amount), 0), INTEGER) as sum, count(1) contributors
 FROM a
+WHERE amount IS NOT NULL
 GROUP BY country
 ORDER BY SUM DESC
-	`)
-	err = db.Select(&byCountry, sql, projectName, date)
+	`, convertedAmount)
+	err = db.Select(&byCountry, sql, currency, projectName, date)
 	return
 }
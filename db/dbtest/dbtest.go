@@ -0,0 +1,459 @@
+// Package dbtest is an in-memory db.Store, so handler tests run without MySQL.
+//
+// It keeps the rows the MySQL store keeps and answers the same questions the
+// same way: a user key names its latest request, statuses start at "new", and
+// lookups that find nothing return sql.ErrNoRows.
+package dbtest
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"external_payments/db"
+	"external_payments/types"
+)
+
+var _ db.Store = (*Store)(nil)
+
+// Store holds requests and gateway responses in memory. The zero value is not
+// usable; call New.
+type Store struct {
+	mu        sync.Mutex
+	requests  []request
+	callbacks []types.PeleCardResponse
+	responses []types.PaymentResponse
+	keys      []idempotencyKey
+	webhooks  []webhook
+	history   []types.StatusChange
+}
+
+type webhook struct {
+	types.Webhook
+	due time.Time
+}
+
+type idempotencyKey struct {
+	types.IdempotencyRecord
+	leasedUntil time.Time
+}
+
+type request struct {
+	types.PaymentRequest
+	created time.Time
+}
+
+func New() *Store {
+	return &Store{}
+}
+
+// latest returns the newest request for userKey, or nil. The caller holds mu.
+func (s *Store) latest(userKey string) *request {
+	for i := len(s.requests) - 1; i >= 0; i-- {
+		if s.requests[i].UserKey == userKey {
+			return &s.requests[i]
+		}
+	}
+	return nil
+}
+
+func (s *Store) StoreRequest(p types.PaymentRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	p.Id = uint64(len(s.requests) + 1)
+	p.Status = "new"
+	p.PStatus = "new"
+	p.CreatedAt = now.Format(time.DateTime)
+	s.requests = append(s.requests, request{PaymentRequest: p, created: now})
+	return nil
+}
+
+// SetStatus puts userKey's latest request in value, bypassing the status
+// machine and its history: a test's way of setting up a request that got
+// there some other way.
+func (s *Store) SetStatus(userKey string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.latest(userKey); r != nil {
+		r.Status = value
+		r.PStatus = value
+	}
+}
+
+func (s *Store) ChangeStatus(c types.StatusChange, w *types.Webhook) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.latest(c.UserKey)
+	if r == nil {
+		return false, sql.ErrNoRows
+	}
+	if r.Status != c.From {
+		return false, nil
+	}
+	r.Status = c.To
+	r.PStatus = c.To
+	c.Id = int64(len(s.history) + 1)
+	c.RequestId = int64(r.Id)
+	c.CreatedAt = time.Now().Format(time.DateTime)
+	s.history = append(s.history, c)
+	if w != nil {
+		w.Id = int64(len(s.webhooks) + 1)
+		w.Status = "pending"
+		s.webhooks = append(s.webhooks, webhook{Webhook: *w, due: time.Now()})
+	}
+	return true, nil
+}
+
+func (s *Store) StatusHistory(userKey string) (changes []types.StatusChange, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.history {
+		if c.UserKey == userKey {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+func (s *Store) LoadRequest(userKey string, p *types.PaymentRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.latest(userKey)
+	if r == nil {
+		return sql.ErrNoRows
+	}
+	*p = r.PaymentRequest
+	return nil
+}
+
+func (s *Store) SetTerminal(userKey, terminal string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.latest(userKey)
+	if r == nil {
+		return sql.ErrNoRows
+	}
+	r.Terminal = terminal
+	return nil
+}
+
+func (s *Store) FindRecentSuccessfulCharge(reference string) bool {
+	if reference == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := time.Now().Add(-time.Hour)
+	for _, r := range s.requests {
+		if r.Reference == reference && r.Status == "valid" && r.created.After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) GetStatus(userKey string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.latest(userKey)
+	if r == nil {
+		return "", sql.ErrNoRows
+	}
+	return r.Status, nil
+}
+
+func (s *Store) GetOrganization(userKey string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.latest(userKey)
+	if r == nil {
+		return "", sql.ErrNoRows
+	}
+	return r.Organization, nil
+}
+
+func (s *Store) Confirm(p *types.ConfirmRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.requests) - 1; i >= 0; i-- {
+		r := s.requests[i]
+		if r.Status == "valid" && r.UserKey == p.UserKey && r.Price == p.Price &&
+			r.Currency == p.Currency && r.SKU == p.SKU && r.Reference == p.Reference &&
+			r.Organization == p.Organization {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) UpdateRequestTemp(userKey string, p types.PeleCardResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.UserKey = userKey
+	s.callbacks = append(s.callbacks, p)
+	return nil
+}
+
+func (s *Store) UpdateRequest(p types.PaymentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, p)
+	return nil
+}
+
+// LoadPaymentResponse returns the latest response stored for userKey.
+func (s *Store) LoadPaymentResponse(userKey string, p *types.PaymentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.responses) - 1; i >= 0; i-- {
+		if s.responses[i].UserKey == userKey {
+			*p = s.responses[i]
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (s *Store) FindUserKeyByTransaction(transactionId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.responses {
+		if r.TransactionId == transactionId || r.TransactionPelecardId == transactionId {
+			return r.UserKey, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (s *Store) ReserveIdempotencyKey(r types.IdempotencyRecord, lease time.Duration) (types.IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.keys {
+		if k.Client != r.Client || k.Key != r.Key {
+			continue
+		}
+		expired := k.Status == "pending" && !time.Now().Before(k.leasedUntil)
+		same := k.Endpoint == r.Endpoint && k.Fingerprint == r.Fingerprint
+		if expired && same && k.UserKey != "" && s.latest(k.UserKey) == nil {
+			s.keys[i].leasedUntil = time.Now().Add(lease)
+			return k.IdempotencyRecord, true, nil
+		}
+		return k.IdempotencyRecord, false, nil
+	}
+	r.Id = int64(len(s.keys) + 1)
+	r.Status = "pending"
+	s.keys = append(s.keys, idempotencyKey{r, time.Now().Add(lease)})
+	return r, true, nil
+}
+
+func (s *Store) CompleteIdempotencyKey(id int64, httpStatus int, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.keys {
+		if s.keys[i].Id == id {
+			s.keys[i].Status = "done"
+			s.keys[i].HTTPStatus = httpStatus
+			s.keys[i].Body = body
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (s *Store) ListRequests(from, to time.Time) (rows []types.RequestSummary, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.requests {
+		if r.created.Before(from) || !r.created.Before(to) {
+			continue
+		}
+		rows = append(rows, s.summary(r))
+	}
+	return rows, nil
+}
+
+func (s *Store) QueryRequests(q types.RequestQuery) (rows []types.RequestSummary, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.requests) - 1; i >= 0 && len(rows) < q.Limit; i-- {
+		r := s.requests[i]
+		if !matches(q, r) || q.After > 0 && int64(r.Id) >= q.After {
+			continue
+		}
+		rows = append(rows, s.summary(r))
+	}
+	return rows, nil
+}
+
+func (s *Store) ExportRequests(q types.RequestQuery, each func(types.PaymentExport) error) error {
+	s.mu.Lock()
+	var rows []types.PaymentExport
+	for _, r := range s.requests {
+		if !matches(q, r) {
+			continue
+		}
+		row := types.PaymentExport{
+			Id: int64(r.Id), CreatedAt: r.CreatedAt, Organization: r.Organization, Reference: r.Reference,
+			UserKey: r.UserKey, Status: r.Status, SKU: r.SKU, Gateway: "pelecard",
+			Currency: r.Currency, Price: r.Price, Installments: r.Installments, VAT: r.VAT,
+		}
+		if r.PaypalOrderId != nil {
+			row.Gateway = "paypal"
+			row.TransactionId = *r.PaypalOrderId
+		}
+		for _, p := range s.responses {
+			if p.UserKey != r.UserKey {
+				continue
+			}
+			row.TransactionId = p.TransactionId
+			row.CardBrand = p.CreditCardBrand
+			if n := p.CreditCardNumber; len(n) >= 4 {
+				row.CardLast4 = n[len(n)-4:]
+			}
+			row.VoucherId = p.VoucherId
+			if n, err := strconv.Atoi(p.TotalPayments); err == nil {
+				row.Installments = n
+			}
+			break
+		}
+		rows = append(rows, row)
+	}
+	s.mu.Unlock()
+
+	for _, row := range rows {
+		if err := each(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether r passes q's filters, as the MySQL WHERE does.
+func matches(q types.RequestQuery, r request) bool {
+	switch {
+	case q.UserKey != "" && r.UserKey != q.UserKey,
+		q.Organization != "" && r.Organization != q.Organization,
+		!strings.HasPrefix(r.Reference, q.ReferencePrefix),
+		q.Status != "" && r.Status != q.Status,
+		q.Currency != "" && r.Currency != q.Currency,
+		q.SKU != "" && r.SKU != q.SKU,
+		!q.From.IsZero() && r.created.Before(q.From),
+		!q.To.IsZero() && !r.created.Before(q.To):
+		return false
+	}
+	return true
+}
+
+// summary lists r as the MySQL store does. The caller holds mu.
+func (s *Store) summary(r request) types.RequestSummary {
+	row := types.RequestSummary{
+		Id: int64(r.Id), UserKey: r.UserKey, Reference: r.Reference, Organization: r.Organization,
+		Status: r.Status, Price: r.Price, Currency: r.Currency, SKU: r.SKU, CreatedAt: r.CreatedAt,
+		Gateway: "pelecard",
+	}
+	if r.PaypalOrderId != nil {
+		row.Gateway = "paypal"
+		row.PaypalOrderId = *r.PaypalOrderId
+	}
+	for _, p := range s.responses {
+		if p.UserKey == r.UserKey {
+			row.TransactionId = p.TransactionId
+		}
+	}
+	return row
+}
+
+func (s *Store) ClaimWebhooks(limit int, lease time.Duration) (claimed []types.Webhook, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for i := range s.webhooks {
+		w := &s.webhooks[i]
+		if len(claimed) == limit {
+			break
+		}
+		if w.Status == "pending" && !w.due.After(now) {
+			w.due = now.Add(lease)
+			claimed = append(claimed, w.Webhook)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *Store) RetryWebhook(id int64, attempts int, after time.Duration, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.webhook(id)
+	if w == nil {
+		return sql.ErrNoRows
+	}
+	w.Attempts, w.LastError, w.due = attempts, lastError, time.Now().Add(after)
+	return nil
+}
+
+func (s *Store) CloseWebhook(id int64, attempts int, status string, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.webhook(id)
+	if w == nil {
+		return sql.ErrNoRows
+	}
+	w.Attempts, w.Status, w.LastError = attempts, status, lastError
+	return nil
+}
+
+// webhook returns the outbox row with id, or nil. The caller holds mu.
+func (s *Store) webhook(id int64) *webhook {
+	for i := range s.webhooks {
+		if s.webhooks[i].Id == id {
+			return &s.webhooks[i]
+		}
+	}
+	return nil
+}
+
+// Webhooks returns the outbox, oldest first.
+func (s *Store) Webhooks() (found []types.Webhook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.webhooks {
+		found = append(found, w.Webhook)
+	}
+	return
+}
+
+// MakeDue brings every pending webhook's next attempt forward to now, as if
+// its backoff had passed.
+func (s *Store) MakeDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.webhooks {
+		s.webhooks[i].due = time.Now()
+	}
+}
+
+// Backdate moves userKey's latest request back by d, as if it had been made
+// that long before.
+func (s *Store) Backdate(userKey string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.latest(userKey); r != nil {
+		r.created = r.created.Add(-d)
+		r.CreatedAt = r.created.Format(time.DateTime)
+	}
+}
+
+// Callbacks returns the gateway callbacks recorded for userKey, oldest first.
+func (s *Store) Callbacks(userKey string) (found []types.PeleCardResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.callbacks {
+		if c.UserKey == userKey {
+			found = append(found, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"github.com/MakeNowJust/heredoc"
+
+	"external_payments/types"
+)
+
+// ExportRequests reads the export row by row rather than selecting it whole,
+// so a year of payments is never in memory. Each request is joined to its own
+// latest Pelecard response and PayPal capture, by user key, so every column
+// of a row comes from the same answer and a shared reference never lends one
+// request another's money. q's paging is ignored.
+func (mysqlStore) ExportRequests(q types.RequestQuery, each func(types.PaymentExport) error) error {
+	where, args := requestFilter(q)
+	rows, err := db.Queryx(heredoc.Doc(`
+		SELECT r.id, r.created_at, r.organization, r.reference, r.user_key, r.status, r.sku,
+			CASE WHEN r.paypal_order_id IS NOT NULL OR pp.id IS NOT NULL
+			THEN 'paypal' ELSE 'pelecard' END AS gateway,
+			COALESCE(pr.transaction_id, pp.transaction_id, r.paypal_order_id, '') AS transaction_id,
+			r.currency, r.price,
+			COALESCE(NULLIF(pr.total_payments, ''), r.installments) AS installments,
+			r.vat,
+			COALESCE(pr.credit_card_brand, '') AS card_brand,
+			COALESCE(RIGHT(pr.credit_card_number, 4), '') AS card_last4,
+			COALESCE(pr.voucher_id, pp.voucher_id, '') AS voucher_id
+		FROM civicrm_bb_ext_requests r
+		LEFT JOIN civicrm_bb_ext_payment_responses pr ON pr.id = (
+			SELECT MAX(id) FROM civicrm_bb_ext_payment_responses WHERE user_key = r.user_key
+		)
+		LEFT JOIN civicrm_bb_ext_paypal pp ON pp.id = (
+			SELECT MAX(id) FROM civicrm_bb_ext_paypal WHERE user_key = r.user_key
+		)
+		WHERE `)+where+"\nORDER BY r.id\n", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p types.PaymentExport
+		if err = rows.StructScan(&p); err != nil {
+			return err
+		}
+		if err = each(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/go-sql-driver/mysql"
+
+	"external_payments/types"
+)
+
+// ReserveIdempotencyKey records r as pending until lease runs out, unless the
+// client already used the key. Then reserved is false and prior is the row
+// recorded first, pending or done, for the caller to replay or refuse.
+//
+// The unique key on (client, idem_key) decides between concurrent copies of
+// one request: exactly one insert succeeds. A row still pending after its
+// lease is given to the same request again only if its payment request was
+// never stored: the process died before it could have charged anything. Once
+// it was stored the charge may have gone through, and the key stays pending
+// until the request's status says how it ended.
+func (mysqlStore) ReserveIdempotencyKey(r types.IdempotencyRecord, lease time.Duration) (prior types.IdempotencyRecord, reserved bool, err error) {
+	res, err := db.Exec(heredoc.Doc(`
+		INSERT INTO civicrm_bb_ext_idempotency (client, idem_key, endpoint, fingerprint, user_key, leased_until)
+		VALUES (?, ?, ?, ?, ?, NOW() + INTERVAL ? SECOND)
+	`), r.Client, r.Key, r.Endpoint, r.Fingerprint, r.UserKey, int64(lease.Seconds()))
+	if err == nil {
+		r.Id, err = res.LastInsertId()
+		r.Status = "pending"
+		return r, err == nil, err
+	}
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) || me.Number != mysqlDuplicateEntry {
+		return prior, false, fmt.Errorf("insert idempotency key: %w", err)
+	}
+	err = db.Get(&prior, heredoc.Doc(`
+		SELECT id, client, idem_key, endpoint, fingerprint, user_key, status, http_status, COALESCE(body, '') AS body
+		FROM civicrm_bb_ext_idempotency
+		WHERE client = ? AND idem_key = ?
+	`), r.Client, r.Key)
+	if err != nil || prior.Status != "pending" || prior.UserKey == "" ||
+		prior.Endpoint != r.Endpoint || prior.Fingerprint != r.Fingerprint {
+		return prior, false, err
+	}
+	res, err = db.Exec(heredoc.Doc(`
+		UPDATE civicrm_bb_ext_idempotency k
+		SET k.leased_until = NOW() + INTERVAL ? SECOND
+		WHERE k.id = ? AND k.status = 'pending' AND (k.leased_until IS NULL OR k.leased_until <= NOW())
+		  AND NOT EXISTS (SELECT 1 FROM civicrm_bb_ext_requests r WHERE r.user_key = k.user_key)
+	`), int64(lease.Seconds()), prior.Id)
+	if err != nil {
+		return prior, false, fmt.Errorf("renew idempotency key: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return prior, n > 0, nil
+}
+
+// CompleteIdempotencyKey stores the answer a reserved request got.
+func (mysqlStore) CompleteIdempotencyKey(id int64, httpStatus int, body string) error {
+	return execInTx(`UPDATE civicrm_bb_ext_idempotency SET status = 'done', http_status = ?, body = ? WHERE id = ?`,
+		httpStatus, body, id)
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"github.com/MakeNowJust/heredoc"
+	"github.com/jmoiron/sqlx"
 
 	"external_payments/types"
 )
@@ -20,9 +21,10 @@ func StorePaypalCapture(req types.PaymentRequest, captureID, paymentDate, env st
 	query := heredoc.Doc(`
 		INSERT INTO civicrm_bb_ext_paypal (
 			name, price, currency, email, phone, street, city, country, details, sku, language,
-			reference, organization, transaction_id, payment_date, voucher_id, invoice, paypal_env, vat, tax_type, tax_id
+			reference, organization, transaction_id, payment_date, voucher_id, invoice, paypal_env, vat, tax_type, tax_id,
+			user_key
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', ?, ?, ?, ?, ?
 		)
 	`)
 	return execInTx(query,
@@ -30,5 +32,66 @@ func StorePaypalCapture(req types.PaymentRequest, captureID, paymentDate, env st
 		req.Street, req.City, req.Country, req.Details, req.SKU,
 		req.Language, req.Reference, req.Organization,
 		captureID, paymentDate, env, req.VAT, req.TaxType, req.TaxId,
+		req.UserKey,
 	)
 }
+
+// LoadPaypalCapture returns the payment StorePaypalCapture recorded for a
+// capture: what was taken, in which currency and for which organization.
+func LoadPaypalCapture(captureID string, p *types.PaypalRegister) error {
+	return db.Get(p, heredoc.Doc(`
+		SELECT name, price, currency, reference, organization, transaction_id
+		FROM civicrm_bb_ext_paypal
+		WHERE transaction_id = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`), captureID)
+}
+
+// FindPaypalCaptureId returns the latest capture recorded for reference and
+// organization. sql.ErrNoRows means there is none.
+func FindPaypalCaptureId(reference, organization string) (captureID string, err error) {
+	err = db.Get(&captureID, heredoc.Doc(`
+		SELECT transaction_id
+		FROM civicrm_bb_ext_paypal
+		WHERE reference = ? AND organization = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`), reference, organization)
+	return
+}
+
+// FindPaypalUserKey returns the request a capture paid: the latest paid
+// request under the reference and organization StorePaypalCapture recorded.
+func FindPaypalUserKey(reference, organization string) (userKey string, err error) {
+	err = db.Get(&userKey, heredoc.Doc(`
+		SELECT user_key
+		FROM civicrm_bb_ext_requests
+		WHERE reference = ? AND organization = ?
+		  AND status IN ('valid', 'partially-refunded', 'refunded')
+		ORDER BY id DESC
+		LIMIT 1
+	`), reference, organization)
+	return
+}
+
+// KnownPaypalCaptures returns which of ids we recorded as a capture in
+// civicrm_bb_ext_paypal. The refunds we made are KnownRefunds.
+func KnownPaypalCaptures(ids []string) (map[string]bool, error) {
+	known := map[string]bool{}
+	if len(ids) == 0 {
+		return known, nil
+	}
+	query, args, err := sqlx.In(`SELECT transaction_id FROM civicrm_bb_ext_paypal WHERE transaction_id IN (?)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	if err = db.Select(&found, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, id := range found {
+		known[id] = true
+	}
+	return known, nil
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+
+	"external_payments/types"
+)
+
+// convertedAmount is SQL for a contribution co's total_amount in the currency
+// d.code, at the rates of its receive_date: the latest on or before that day,
+// or the earliest for a contribution older than the table. A currency with no
+// rate imported at all falls back to the fixed rates the counters used before,
+// and is NULL only if it has none of those either.
+var convertedAmount = "co.total_amount * " + dollarRate("co.currency") + " / " + dollarRate("d.code")
+
+// dollarRate is SQL for what one unit of the currency in column was worth in
+// dollars when co was received. Each lookup is a range scan of the
+// (currency, rate_date) key that stops at its first row.
+func dollarRate(column string) string {
+	return fmt.Sprintf(`IF(%[1]s = 'USD', 1, COALESCE((
+		SELECT r.usd FROM civicrm_bb_ext_exchange_rates r
+		WHERE r.currency = %[1]s AND r.rate_date <= DATE(co.receive_date)
+		ORDER BY r.rate_date DESC
+		LIMIT 1
+	), (
+		SELECT r.usd FROM civicrm_bb_ext_exchange_rates r
+		WHERE r.currency = %[1]s
+		ORDER BY r.rate_date
+		LIMIT 1
+	), CASE %[1]s WHEN 'EUR' THEN 1.1 WHEN 'ILS' THEN 1 / 4.13 END))`, column)
+}
+
+// StoreRates saves imported rates. A rate already stored for the currency
+// and date is replaced, so importing a file again, or a corrected one, is
+// safe.
+func StoreRates(rates []types.ExchangeRate) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Preparex(`
+		INSERT INTO civicrm_bb_ext_exchange_rates (rate_date, currency, usd, source)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE usd = VALUES(usd), source = VALUES(source)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range rates {
+		if _, err := stmt.Exec(r.Date, r.Currency, r.USD, r.Source); err != nil {
+			return fmt.Errorf("%s %s: %w", r.Currency, r.Date, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"external_payments/types"
+)
+
+// ErrRefundExceedsCaptured is returned by ReserveRefund when the requested
+// amount, added to what is already refunded or in flight, is more than was
+// captured.
+var ErrRefundExceedsCaptured = errors.New("refund exceeds the remaining captured amount")
+
+// ErrRefundReferenceTaken is returned by ReserveRefund when another refund
+// by the same client with the same reference was recorded first: two copies
+// of one request raced, and the other copy is the one that goes to the
+// gateway.
+var ErrRefundReferenceTaken = errors.New("a refund with this reference already exists")
+
+// mysqlDuplicateEntry is returned when an insert breaks a unique key.
+const mysqlDuplicateEntry = 1062
+
+// LoadPaymentResponse returns the latest gateway response stored for a request.
+func (mysqlStore) LoadPaymentResponse(userKey string, p *types.PaymentResponse) (err error) {
+	err = db.Get(p, heredoc.Doc(`
+		SELECT user_key,
+			COALESCE(transaction_id, '') AS transaction_id,
+			COALESCE(credit_card_number, '') AS credit_card_number,
+			COALESCE(credit_card_brand, '') AS credit_card_brand,
+			COALESCE(voucher_id, '') AS voucher_id,
+			COALESCE(debit_total, '') AS debit_total,
+			COALESCE(debit_currency, '') AS debit_currency,
+			COALESCE(total_payments, '') AS total_payments,
+			COALESCE(transaction_pelecard_id, '') AS transaction_pelecard_id,
+			COALESCE(additional_details_param_x, '') AS additional_details_param_x,
+			token_sha256
+		FROM civicrm_bb_ext_payment_responses
+		WHERE user_key = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`), userKey)
+	return
+}
+
+// FindUserKeyByTransaction resolves a Pelecard transaction id to the request it
+// paid. Callers know the id from the charge response, which carries it under
+// either name depending on the flow.
+func (mysqlStore) FindUserKeyByTransaction(transactionId string) (userKey string, err error) {
+	err = db.Get(&userKey, heredoc.Doc(`
+		SELECT user_key
+		FROM civicrm_bb_ext_payment_responses
+		WHERE transaction_id = ? OR transaction_pelecard_id = ?
+		LIMIT 1
+	`), transactionId, transactionId)
+	return
+}
+
+// ReserveRefund records a pending refund, provided it fits in what remains of
+// the captured amount. Pending refunds count against the remainder, so two
+// concurrent requests cannot both pass the check and refund twice; the row
+// lock on the transaction's refunds serialises them.
+//
+// The gateway is called only after this succeeds, and the row is then settled
+// with SettleRefund whatever the outcome.
+func ReserveRefund(r types.Refund, captured float64) (id int64, refunded float64, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var amounts []float64
+	err = tx.Select(&amounts, heredoc.Doc(`
+		SELECT amount
+		FROM civicrm_bb_ext_refunds
+		WHERE gateway = ? AND transaction_id = ? AND status IN ('pending', 'done')
+		FOR UPDATE
+	`), r.Gateway, r.TransactionId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("load refunds: %w", err)
+	}
+	for _, a := range amounts {
+		refunded += a
+	}
+
+	// Compare in minor units: summed floats drift, and a refund of exactly the
+	// remainder must not be refused over a rounding error.
+	if cents(refunded)+cents(r.Amount) > cents(captured) {
+		return 0, refunded, ErrRefundExceedsCaptured
+	}
+
+	res, err := tx.Exec(heredoc.Doc(`
+		INSERT INTO civicrm_bb_ext_refunds (user_key, gateway, transaction_id, amount, currency, client, reference)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+	`), r.UserKey, r.Gateway, r.TransactionId, r.Amount, r.Currency, r.Client, r.Reference)
+	if err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == mysqlDuplicateEntry {
+			return 0, refunded, ErrRefundReferenceTaken
+		}
+		return 0, refunded, fmt.Errorf("insert refund: %w", err)
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, refunded, err
+	}
+	err = tx.Commit()
+	return id, refunded, err
+}
+
+// SettleRefund records the gateway's answer to a reserved refund. A failed
+// refund stops counting against the remainder.
+func SettleRefund(id int64, refundId string, failure error) error {
+	if failure != nil {
+		msg := failure.Error()
+		if len(msg) > 255 {
+			msg = msg[:255]
+		}
+		return execInTx(`UPDATE civicrm_bb_ext_refunds SET status = 'failed', error = ? WHERE id = ?`, msg, id)
+	}
+	return execInTx(`UPDATE civicrm_bb_ext_refunds SET status = 'done', refund_id = ? WHERE id = ?`, refundId, id)
+}
+
+// FindRefundByReference returns the refund client recorded under reference on
+// gateway, in whatever state it is in. sql.ErrNoRows means there is none: a
+// reference is the client's own name, and another client's is not seen.
+func FindRefundByReference(gateway, client, reference string) (r types.Refund, err error) {
+	err = db.Get(&r, heredoc.Doc(`
+		SELECT id, user_key, gateway, transaction_id, amount, currency,
+			COALESCE(refund_id, '') AS refund_id,
+			status,
+			COALESCE(reference, '') AS reference,
+			COALESCE(error, '') AS error,
+			COALESCE(client, '') AS client
+		FROM civicrm_bb_ext_refunds
+		WHERE gateway = ? AND client = ? AND reference = ?
+	`), gateway, client, reference)
+	return
+}
+
+// RefundedTotal sums the refunds the gateway has confirmed for a transaction.
+func RefundedTotal(gateway, transactionId string) (total float64, err error) {
+	err = db.Get(&total, heredoc.Doc(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM civicrm_bb_ext_refunds
+		WHERE gateway = ? AND transaction_id = ? AND status = 'done'
+	`), gateway, transactionId)
+	return
+}
+
+// KnownRefunds returns which of ids are refunds we made on gateway, as the
+// gateway numbered them.
+func KnownRefunds(gateway string, ids []string) (map[string]bool, error) {
+	known := map[string]bool{}
+	if len(ids) == 0 {
+		return known, nil
+	}
+	query, args, err := sqlx.In(`SELECT refund_id FROM civicrm_bb_ext_refunds WHERE gateway = ? AND refund_id IN (?)`,
+		gateway, ids)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	if err = db.Select(&found, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, id := range found {
+		known[id] = true
+	}
+	return known, nil
+}
+
+// CardTokenHash is what a payment response keeps of the card token that paid,
+// so a refund can be held to that card without the table holding tokens. It
+// is "" for no token.
+func CardTokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	return TokenHash(token)
+}
+
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
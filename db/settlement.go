@@ -0,0 +1,44 @@
+package db
+
+import (
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+
+	"external_payments/types"
+)
+
+// SettlementRows returns what a settlement report for [q.From, q.To) is summed
+// from: every request q selects, and every refund completed in the range
+// against a request q would select but for its date. A refund is counted on
+// the day it was made, not the day of the payment it returns.
+func SettlementRows(q types.RequestQuery) (rows []types.SettlementRow, err error) {
+	requests, args := requestFilter(q)
+
+	undated := q
+	undated.From, undated.To = time.Time{}, time.Time{}
+	refunds, refundArgs := requestFilter(undated)
+	args = append(args, q.From.Format(time.DateTime), q.To.Format(time.DateTime))
+	args = append(args, refundArgs...)
+
+	err = db.Select(&rows, heredoc.Doc(`
+		SELECT FALSE AS refund, r.organization,
+			CASE WHEN r.paypal_order_id IS NOT NULL
+				OR EXISTS (SELECT 1 FROM civicrm_bb_ext_paypal pp WHERE pp.user_key = r.user_key)
+			THEN 'paypal' ELSE 'pelecard' END AS gateway,
+			r.terminal, r.currency, r.status, r.price AS amount,
+			COALESCE((
+				SELECT h.reason FROM civicrm_bb_ext_request_status_history h
+				WHERE h.request_id = r.id ORDER BY h.id DESC LIMIT 1
+			), '') AS reason
+		FROM civicrm_bb_ext_requests r
+		WHERE `)+requests+"\n"+heredoc.Doc(`
+		UNION ALL
+		SELECT TRUE, r.organization, f.gateway, r.terminal, f.currency, f.status, f.amount, ''
+		FROM civicrm_bb_ext_refunds f
+		JOIN civicrm_bb_ext_requests r ON r.id = (
+			SELECT MAX(id) FROM civicrm_bb_ext_requests WHERE user_key = f.user_key
+		)
+		WHERE f.status = 'done' AND f.created_at >= ? AND f.created_at < ? AND `)+refunds, args...)
+	return
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/MakeNowJust/heredoc"
+
+	"external_payments/types"
+)
+
+// Status is where a payment request stands. It is written to both status and
+// pstatus on civicrm_bb_ext_requests.
+type Status string
+
+const (
+	StatusNew               Status = "new"
+	StatusInProcess         Status = "in-process"
+	StatusValid             Status = "valid"
+	StatusInvalid           Status = "invalid"
+	StatusError             Status = "error"
+	StatusCancel            Status = "cancel"
+	StatusRefunded          Status = "refunded"
+	StatusPartiallyRefunded Status = "partially-refunded"
+	StatusChargeback        Status = "chargeback"
+)
+
+// Statuses are all the statuses a request can be in.
+var Statuses = []Status{
+	StatusNew, StatusInProcess, StatusValid, StatusInvalid, StatusError, StatusCancel,
+	StatusRefunded, StatusPartiallyRefunded, StatusChargeback,
+}
+
+// transitions lists where each status may go. A request is paid or not once
+// it leaves new and in-process: a late error or cancel callback must not undo
+// a valid payment, and a failed one is not paid later by the same request. A
+// paid request can only be refunded or charged back.
+var transitions = map[Status][]Status{
+	StatusNew:               {StatusInProcess, StatusValid, StatusInvalid, StatusError, StatusCancel},
+	StatusInProcess:         {StatusValid, StatusInvalid, StatusError, StatusCancel},
+	StatusValid:             {StatusPartiallyRefunded, StatusRefunded, StatusChargeback},
+	StatusPartiallyRefunded: {StatusRefunded, StatusChargeback},
+}
+
+// ErrTransition is returned by Transition when the request's status may not
+// move to the one asked for.
+var ErrTransition = errors.New("status transition not allowed")
+
+// ErrStatusChanged is returned by Transition when the request's status
+// changed between reading it and writing the new one: another callback got
+// there first.
+var ErrStatusChanged = errors.New("status changed concurrently")
+
+// CanTransition reports whether a request in status from may move to to.
+func CanTransition(from, to Status) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// Transition moves userKey's request to status to, if its current status
+// allows it, and records the move with who made it and why. The write is a
+// compare-and-set on the status read, so of two callbacks racing one wins and
+// the other gets ErrStatusChanged. Moving to the status the request already
+// has does nothing and is not an error: a duplicate callback repeats it.
+//
+// A move that is refused is logged. Callers that carry on regardless need not
+// check the error.
+func Transition(userKey string, to Status, actor, reason string) error {
+	current, err := store.GetStatus(userKey)
+	if err != nil {
+		log.Printf("status %s → %s (%s): %v", userKey, to, actor, err)
+		return err
+	}
+	from := Status(current)
+	if from == to {
+		return nil
+	}
+	if !CanTransition(from, to) {
+		log.Printf("status %s: %s → %s refused (%s: %s)", userKey, from, to, actor, reason)
+		return fmt.Errorf("%w: %s → %s", ErrTransition, from, to)
+	}
+	return changeStatus(userKey, from, to, actor, reason)
+}
+
+// TransitionFrom is Transition for a caller that knows the status the
+// request must still be in: it moves only from from, and otherwise returns
+// ErrStatusChanged.
+func TransitionFrom(userKey string, from, to Status, actor, reason string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s → %s", ErrTransition, from, to)
+	}
+	return changeStatus(userKey, from, to, actor, reason)
+}
+
+// ForceStatus moves userKey's request to to from whatever status it is in,
+// for an operator repairing a payment the rules would not let move: one
+// refused that the gateway charged after all. The change is recorded like any
+// other; actor should name the operator.
+func ForceStatus(userKey string, to Status, actor, reason string) error {
+	current, err := store.GetStatus(userKey)
+	if err != nil {
+		return err
+	}
+	if Status(current) == to {
+		return nil
+	}
+	return changeStatus(userKey, Status(current), to, actor, reason)
+}
+
+// ClaimProcessing moves a request from new to in-process and reports whether
+// this caller did so; a duplicate callback gets false.
+func ClaimProcessing(userKey, actor string) bool {
+	return TransitionFrom(userKey, StatusNew, StatusInProcess, actor, "claimed") == nil
+}
+
+func changeStatus(userKey string, from, to Status, actor, reason string) error {
+	ok, err := store.ChangeStatus(types.StatusChange{
+		UserKey: userKey, From: string(from), To: string(to), Actor: actor, Reason: reason,
+	}, webhookFor(userKey, string(to)))
+	if err != nil {
+		log.Printf("status %s: %s → %s (%s): %v", userKey, from, to, actor, err)
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s is no longer %s", ErrStatusChanged, userKey, from)
+	}
+	return nil
+}
+
+// StatusHistory returns the status changes of userKey's requests, oldest
+// first.
+func StatusHistory(userKey string) ([]types.StatusChange, error) {
+	return store.StatusHistory(userKey)
+}
+
+// ChangeStatus moves the latest request for c.UserKey from c.From to c.To,
+// appends c to its history and puts webhook, if there is one, in the outbox,
+// in one transaction. It reports false, and writes nothing, if the request is
+// not in c.From. The row lock taken by the read serialises racing callers.
+func (mysqlStore) ChangeStatus(c types.StatusChange, webhook *types.Webhook) (changed bool, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !changed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var current struct {
+		Id     int64  `db:"id"`
+		Status string `db:"status"`
+	}
+	err = tx.Get(&current, heredoc.Doc(`
+		SELECT id, status FROM civicrm_bb_ext_requests
+		WHERE user_key = ?
+		ORDER BY id DESC
+		LIMIT 1
+		FOR UPDATE
+	`), c.UserKey)
+	if err != nil || current.Status != c.From {
+		return false, err
+	}
+	if _, err = tx.Exec(`UPDATE civicrm_bb_ext_requests SET status = ?, pstatus = ? WHERE id = ?`,
+		c.To, c.To, current.Id); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(heredoc.Doc(`
+		INSERT INTO civicrm_bb_ext_request_status_history (request_id, user_key, from_status, to_status, actor, reason)
+		VALUES (?, ?, ?, ?, ?, LEFT(?, 255))
+	`), current.Id, c.UserKey, c.From, c.To, c.Actor, c.Reason); err != nil {
+		return false, err
+	}
+	if webhook != nil {
+		if _, err = tx.Exec(heredoc.Doc(`
+			INSERT INTO civicrm_bb_ext_webhooks (event_id, user_key, url, webhook_salt, payload)
+			VALUES (?, ?, ?, ?, ?)
+		`), webhook.EventId, webhook.UserKey, webhook.URL, webhook.Salt, webhook.Payload); err != nil {
+			return false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (mysqlStore) StatusHistory(userKey string) (changes []types.StatusChange, err error) {
+	err = db.Select(&changes, heredoc.Doc(`
+		SELECT id, request_id, user_key, from_status, to_status, actor, reason, created_at
+		FROM civicrm_bb_ext_request_status_history
+		WHERE user_key = ?
+		ORDER BY id
+	`), userKey)
+	return
+}
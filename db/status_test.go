@@ -0,0 +1,107 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/types"
+)
+
+func newRequest(t *testing.T) *dbtest.Store {
+	t.Helper()
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	if err := store.StoreRequest(types.PaymentRequest{UserKey: "u-1", Reference: "1fam-1"}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// A late error callback must not undo a payment.
+func TestTransitionRefusesLeavingValid(t *testing.T) {
+	newRequest(t)
+	for _, to := range []db.Status{db.StatusInProcess, db.StatusValid} {
+		if err := db.Transition("u-1", to, "test", ""); err != nil {
+			t.Fatalf("→ %s: %v", to, err)
+		}
+	}
+	for _, to := range []db.Status{db.StatusError, db.StatusCancel, db.StatusInvalid, db.StatusNew} {
+		if err := db.Transition("u-1", to, "test", ""); !errors.Is(err, db.ErrTransition) {
+			t.Errorf("valid → %s: %v, want ErrTransition", to, err)
+		}
+	}
+	if status, _ := db.GetStatus("u-1"); status != "valid" {
+		t.Errorf("status %q", status)
+	}
+}
+
+func TestTransitionToSameStatus(t *testing.T) {
+	newRequest(t)
+	db.Transition("u-1", db.StatusValid, "test", "")
+	if err := db.Transition("u-1", db.StatusValid, "test", "again"); err != nil {
+		t.Errorf("repeat: %v", err)
+	}
+	if history, _ := db.StatusHistory("u-1"); len(history) != 1 {
+		t.Errorf("a repeat was recorded: %+v", history)
+	}
+}
+
+func TestTransitionFromChangedStatus(t *testing.T) {
+	newRequest(t)
+	if !db.ClaimProcessing("u-1", "first") {
+		t.Fatal("first claim failed")
+	}
+	if db.ClaimProcessing("u-1", "second") {
+		t.Error("a second claim succeeded")
+	}
+	err := db.TransitionFrom("u-1", db.StatusNew, db.StatusCancel, "late", "")
+	if !errors.Is(err, db.ErrStatusChanged) {
+		t.Errorf("from a stale status: %v, want ErrStatusChanged", err)
+	}
+}
+
+func TestStatusHistory(t *testing.T) {
+	newRequest(t)
+	db.Transition("u-1", db.StatusInProcess, "pelecard charge", "charging")
+	db.Transition("u-1", db.StatusValid, "pelecard charge", "charge approved")
+	db.Transition("u-1", db.StatusPartiallyRefunded, "refund", "refund r-1")
+	db.Transition("u-1", db.StatusRefunded, "refund", "refund r-2")
+
+	history, err := db.StatusHistory("u-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.StatusChange{
+		{From: "new", To: "in-process", Actor: "pelecard charge", Reason: "charging"},
+		{From: "in-process", To: "valid", Actor: "pelecard charge", Reason: "charge approved"},
+		{From: "valid", To: "partially-refunded", Actor: "refund", Reason: "refund r-1"},
+		{From: "partially-refunded", To: "refunded", Actor: "refund", Reason: "refund r-2"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history %+v", history)
+	}
+	for i, w := range want {
+		h := history[i]
+		if h.From != w.From || h.To != w.To || h.Actor != w.Actor || h.Reason != w.Reason || h.UserKey != "u-1" {
+			t.Errorf("change %d: %+v, want %+v", i, h, w)
+		}
+	}
+}
+
+// An operator can move a payment the rules would not, and it is recorded.
+func TestForceStatus(t *testing.T) {
+	newRequest(t)
+	db.Transition("u-1", db.StatusError, "pelecard callback", "error 033")
+	if err := db.ForceStatus("u-1", db.StatusValid, "operator:dana", "charged, see terminal report"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := db.GetStatus("u-1"); status != "valid" {
+		t.Errorf("status %q", status)
+	}
+	history, _ := db.StatusHistory("u-1")
+	if last := history[len(history)-1]; last.From != "error" || last.To != "valid" || last.Actor != "operator:dana" {
+		t.Errorf("recorded %+v", last)
+	}
+}
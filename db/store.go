@@ -0,0 +1,142 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"external_payments/types"
+)
+
+// Store keeps a payment request from StoreRequest to its final status, with
+// the status changes and gateway responses recorded along the way, the
+// idempotency keys the charge was sent under and the webhooks that tell the
+// caller how it ended. A webhook is queued by the status change it reports,
+// so there is never one without the other. It is the part of the database
+// the payment handlers cannot run without, and the only part tests need to
+// replace: production uses MySQL, and package dbtest keeps the same rows in
+// memory.
+type Store interface {
+	StoreRequest(p types.PaymentRequest) error
+	ChangeStatus(c types.StatusChange, webhook *types.Webhook) (bool, error)
+	StatusHistory(userKey string) ([]types.StatusChange, error)
+	LoadRequest(userKey string, p *types.PaymentRequest) error
+	SetTerminal(userKey, terminal string) error
+	FindRecentSuccessfulCharge(reference string) bool
+	GetStatus(userKey string) (string, error)
+	GetOrganization(userKey string) (string, error)
+	Confirm(p *types.ConfirmRequest) bool
+	UpdateRequestTemp(userKey string, p types.PeleCardResponse) error
+	UpdateRequest(p types.PaymentResponse) error
+	LoadPaymentResponse(userKey string, p *types.PaymentResponse) error
+	FindUserKeyByTransaction(transactionId string) (string, error)
+	ReserveIdempotencyKey(r types.IdempotencyRecord, lease time.Duration) (types.IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(id int64, httpStatus int, body string) error
+	ListRequests(from, to time.Time) ([]types.RequestSummary, error)
+	QueryRequests(q types.RequestQuery) ([]types.RequestSummary, error)
+	ExportRequests(q types.RequestQuery, each func(types.PaymentExport) error) error
+	ClaimWebhooks(limit int, lease time.Duration) ([]types.Webhook, error)
+	RetryWebhook(id int64, attempts int, after time.Duration, lastError string) error
+	CloseWebhook(id int64, attempts int, status string, lastError string) error
+}
+
+// mysqlStore is the Store behind the package-level db connection.
+type mysqlStore struct{}
+
+var store Store = mysqlStore{}
+
+// UseStore makes s the store behind the package functions and returns a func
+// that puts the previous one back. Tests call it before exercising a handler:
+//
+//	t.Cleanup(db.UseStore(dbtest.New()))
+func UseStore(s Store) (restore func()) {
+	previous := store
+	store = s
+	return func() { store = previous }
+}
+
+func StoreRequest(p types.PaymentRequest) error { return store.StoreRequest(p) }
+
+func LoadRequest(userKey string, p *types.PaymentRequest) error {
+	return store.LoadRequest(userKey, p)
+}
+
+// SetTerminal records which Pelecard terminal a request went to, for the
+// settlement report. A failure is logged; the payment goes on without it.
+func SetTerminal(userKey, terminal string) {
+	if err := store.SetTerminal(userKey, terminal); err != nil {
+		log.Printf("SetTerminal %s %s: %v", userKey, terminal, err)
+	}
+}
+
+// FindRecentSuccessfulCharge reports whether a charge for this reference
+// succeeded within the last hour.
+func FindRecentSuccessfulCharge(reference string) bool {
+	return store.FindRecentSuccessfulCharge(reference)
+}
+
+func GetStatus(userKey string) (string, error) { return store.GetStatus(userKey) }
+
+func GetOrganization(userKey string) (string, error) { return store.GetOrganization(userKey) }
+
+func Confirm(p *types.ConfirmRequest) bool { return store.Confirm(p) }
+
+func UpdateRequestTemp(userKey string, p types.PeleCardResponse) error {
+	return store.UpdateRequestTemp(userKey, p)
+}
+
+func UpdateRequest(p types.PaymentResponse) error { return store.UpdateRequest(p) }
+
+// LoadPaymentResponse returns the latest gateway response stored for a request.
+func LoadPaymentResponse(userKey string, p *types.PaymentResponse) error {
+	return store.LoadPaymentResponse(userKey, p)
+}
+
+// FindUserKeyByTransaction resolves a Pelecard transaction id to the request
+// it paid.
+func FindUserKeyByTransaction(transactionId string) (string, error) {
+	return store.FindUserKeyByTransaction(transactionId)
+}
+
+// ReserveIdempotencyKey records a keyed request as pending for lease. If the
+// client has used the key before, it returns that request's row instead, and
+// false, unless the row is the same request left pending past its lease.
+func ReserveIdempotencyKey(r types.IdempotencyRecord, lease time.Duration) (types.IdempotencyRecord, bool, error) {
+	return store.ReserveIdempotencyKey(r, lease)
+}
+
+// CompleteIdempotencyKey stores the answer a reserved request got.
+func CompleteIdempotencyKey(id int64, httpStatus int, body string) error {
+	return store.CompleteIdempotencyKey(id, httpStatus, body)
+}
+
+// ListRequests returns the requests created in [from, to), oldest first.
+func ListRequests(from, to time.Time) ([]types.RequestSummary, error) {
+	return store.ListRequests(from, to)
+}
+
+// QueryRequests returns the requests q selects, newest first.
+func QueryRequests(q types.RequestQuery) ([]types.RequestSummary, error) {
+	return store.QueryRequests(q)
+}
+
+// ExportRequests calls each for every request q selects, oldest first, one
+// row at a time. It stops at the first error each returns.
+func ExportRequests(q types.RequestQuery, each func(types.PaymentExport) error) error {
+	return store.ExportRequests(q, each)
+}
+
+// ClaimWebhooks returns due webhooks for this instance to send, see
+// mysqlStore.ClaimWebhooks.
+func ClaimWebhooks(limit int, lease time.Duration) ([]types.Webhook, error) {
+	return store.ClaimWebhooks(limit, lease)
+}
+
+// RetryWebhook records a failed attempt and puts the next one off by after.
+func RetryWebhook(id int64, attempts int, after time.Duration, lastError string) error {
+	return store.RetryWebhook(id, attempts, after, lastError)
+}
+
+// CloseWebhook marks a webhook delivered, or failed for good.
+func CloseWebhook(id int64, attempts int, status string, lastError string) error {
+	return store.CloseWebhook(id, attempts, status, lastError)
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"github.com/MakeNowJust/heredoc"
+
+	"external_payments/types"
+)
+
+// Trail is everything recorded about one UserKey, for an operator looking into
+// a payment: each request made under it, the gateway's callbacks and
+// responses, the PayPal captures and refunds, and every status change.
+type Trail struct {
+	Requests  []types.PaymentRequest
+	Callbacks []types.PeleCardResponse
+	Responses []types.PaymentResponse
+	Captures  []types.PaypalRegister
+	Refunds   []types.Refund
+	History   []types.StatusChange
+}
+
+// FindUserKeys returns the UserKeys of the requests whose UserKey or
+// Reference is key, newest first. A reference can be paid for under several
+// keys, one per attempt.
+func FindUserKeys(key string) (userKeys []string, err error) {
+	err = db.Select(&userKeys, heredoc.Doc(`
+		SELECT user_key
+		FROM civicrm_bb_ext_requests
+		WHERE user_key = ? OR reference = ?
+		GROUP BY user_key
+		ORDER BY MAX(id) DESC
+	`), key, key)
+	return
+}
+
+// LoadTrail reads userKey's Trail.
+func LoadTrail(userKey string) (t Trail, err error) {
+	if err = db.Select(&t.Requests, heredoc.Doc(`
+		SELECT * FROM civicrm_bb_ext_requests WHERE user_key = ? ORDER BY id
+	`), userKey); err != nil {
+		return
+	}
+	if err = db.Select(&t.Callbacks, heredoc.Doc(`
+		SELECT user_key,
+			COALESCE(pelecard_transaction_id, '') AS pelecard_transaction_id,
+			COALESCE(pelecard_status_code, '') AS pelecard_status_code,
+			COALESCE(param_x, '') AS param_x
+		FROM civicrm_bb_ext_pelecard_responses
+		WHERE user_key = ?
+	`), userKey); err != nil {
+		return
+	}
+	if err = db.Select(&t.Responses, heredoc.Doc(`
+		SELECT user_key,
+			COALESCE(transaction_id, '') AS transaction_id,
+			COALESCE(credit_card_number, '') AS credit_card_number,
+			COALESCE(credit_card_brand, '') AS credit_card_brand,
+			COALESCE(debit_code, '') AS debit_code,
+			COALESCE(debit_total, '') AS debit_total,
+			COALESCE(total_payments, '') AS total_payments,
+			COALESCE(transaction_pelecard_id, '') AS transaction_pelecard_id,
+			COALESCE(additional_details_param_x, '') AS additional_details_param_x
+		FROM civicrm_bb_ext_payment_responses
+		WHERE user_key = ?
+		ORDER BY id
+	`), userKey); err != nil {
+		return
+	}
+	if err = db.Select(&t.Refunds, heredoc.Doc(`
+		SELECT id, user_key, gateway, transaction_id, amount, currency,
+			COALESCE(refund_id, '') AS refund_id,
+			status,
+			COALESCE(reference, '') AS reference,
+			COALESCE(error, '') AS error,
+			COALESCE(client, '') AS client
+		FROM civicrm_bb_ext_refunds
+		WHERE user_key = ?
+		ORDER BY id
+	`), userKey); err != nil {
+		return
+	}
+	if t.History, err = StatusHistory(userKey); err != nil {
+		return
+	}
+
+	err = db.Select(&t.Captures, heredoc.Doc(`
+		SELECT name, price, currency, sku, reference, organization,
+			COALESCE(transaction_id, '') AS transaction_id,
+			COALESCE(payment_date, '') AS payment_date,
+			COALESCE(invoice, '') AS invoice
+		FROM civicrm_bb_ext_paypal
+		WHERE user_key = ?
+		ORDER BY id
+	`), userKey)
+	return
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json/v2"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+
+	"external_payments/types"
+)
+
+// webhookStatuses are the statuses a caller is told about: how the payment
+// ended. new and in-process are ours.
+var webhookStatuses = map[string]bool{
+	"valid":   true,
+	"invalid": true,
+	"error":   true,
+	"cancel":  true,
+}
+
+// webhookFor is the webhook for a request moving to status, or nil if status
+// is not one the caller is told about or the request has no callback. The
+// status change writes it to the outbox in its own transaction; it is not
+// sent from here: the payment flow does not wait on the caller's server, and
+// an event survives a restart until it is delivered.
+func webhookFor(userKey, status string) *types.Webhook {
+	if !webhookStatuses[status] {
+		return nil
+	}
+	var p types.PaymentRequest
+	if err := store.LoadRequest(userKey, &p); err != nil {
+		log.Printf("webhook %s %s: load request: %v", userKey, status, err)
+		return nil
+	}
+	if p.CallbackURL == "" {
+		return nil
+	}
+	if p.WebhookSalt == "" {
+		log.Printf("webhook %s %s: callback has no webhook secret; run -callback again for its key", userKey, status)
+		return nil
+	}
+	if u, err := url.Parse(p.CallbackURL); err != nil || !u.IsAbs() || (u.Scheme != "https" && u.Scheme != "http") {
+		log.Printf("webhook %s %s: callback %q is not an http(s) URL", userKey, status, p.CallbackURL)
+		return nil
+	}
+
+	// Pelecard's transaction id once the callback stored it, else the PayPal
+	// order. A PayPal token charge answers its capture id directly instead.
+	var transactionId string
+	var response types.PaymentResponse
+	if err := store.LoadPaymentResponse(userKey, &response); err == nil {
+		transactionId = response.TransactionId
+	} else if p.PaypalOrderId != nil {
+		transactionId = *p.PaypalOrderId
+	}
+
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	event := types.WebhookEvent{
+		Id:            hex.EncodeToString(raw),
+		Type:          "payment.status",
+		UserKey:       userKey,
+		Status:        status,
+		Reference:     p.Reference,
+		Amount:        p.Price,
+		Currency:      p.Currency,
+		Organization:  p.Organization,
+		TransactionId: transactionId,
+		OccurredAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("webhook %s %s: marshal: %v", userKey, status, err)
+		return nil
+	}
+	return &types.Webhook{
+		EventId: event.Id,
+		UserKey: userKey,
+		URL:     p.CallbackURL,
+		Salt:    p.WebhookSalt,
+		Payload: string(payload),
+	}
+}
+
+// ClaimWebhooks returns up to limit pending webhooks that are due, and puts
+// each off by lease, so another instance polling the outbox does not send it
+// too. A claimed webhook that is neither retried nor closed — the process died
+// mid-send — is due again once the lease runs out.
+func (mysqlStore) ClaimWebhooks(limit int, lease time.Duration) (claimed []types.Webhook, err error) {
+	var due []types.Webhook
+	err = db.Select(&due, heredoc.Doc(`
+		SELECT id, event_id, user_key, url, webhook_salt, payload, status, attempts, last_error
+		FROM civicrm_bb_ext_webhooks
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT ?
+	`), limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range due {
+		res, err := db.Exec(heredoc.Doc(`
+			UPDATE civicrm_bb_ext_webhooks
+			SET next_attempt_at = NOW() + INTERVAL ? SECOND
+			WHERE id = ? AND status = 'pending' AND next_attempt_at <= NOW()
+		`), int64(lease.Seconds()), w.Id)
+		if err != nil {
+			return claimed, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			claimed = append(claimed, w)
+		}
+	}
+	return claimed, nil
+}
+
+// RetryWebhook records a failed attempt and when to make the next one.
+func (mysqlStore) RetryWebhook(id int64, attempts int, after time.Duration, lastError string) error {
+	return execInTx(heredoc.Doc(`
+		UPDATE civicrm_bb_ext_webhooks
+		SET attempts = ?, last_error = LEFT(?, 255), next_attempt_at = NOW() + INTERVAL ? SECOND
+		WHERE id = ?
+	`), attempts, lastError, int64(after.Seconds()), id)
+}
+
+// CloseWebhook records the last attempt on a webhook: delivered, or failed for
+// good.
+func (mysqlStore) CloseWebhook(id int64, attempts int, status string, lastError string) error {
+	return execInTx(heredoc.Doc(`
+		UPDATE civicrm_bb_ext_webhooks
+		SET attempts = ?, status = ?, last_error = LEFT(?, 255)
+		WHERE id = ?
+	`), attempts, status, lastError, id)
+}
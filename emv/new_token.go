@@ -3,14 +3,14 @@ package emv
 import (
 	"encoding/json/v2"
 	"fmt"
-	"math"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
 	"external_payments/db"
-	"external_payments/pelecard"
+	"external_payments/gateway"
+	"external_payments/organizations"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
@@ -42,103 +42,50 @@ func NewToken(c *gin.Context) {
 		return
 	}
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
 	baseUrl := utils.BaseUrl()
 
 	// Request Pelecard
-	card := &pelecard.PeleCard{
+	page := gateway.Page{
+		Action:      types.Register,
+		RequireCVV:  true,
 		Language:    request.Language,
 		UserKey:     request.UserKey,
-		ParamX:      request.Reference,
-		GoodUrl:     baseUrl + "/emv/good_token",
-		ErrorUrl:    baseUrl + "/emv/error",
-		CancelUrl:   baseUrl + "/emv/cancel",
-		Total:       0,
-		Currency:    currency,
+		Reference:   request.Reference,
+		GoodURL:     baseUrl + "/emv/good_token",
+		ErrorURL:    baseUrl + "/emv/error",
+		CancelURL:   baseUrl + "/emv/cancel",
+		Amount:      0,
+		Currency:    request.Currency,
 		MaxPayments: 1,
 		MinPayments: 1,
-
-		CaptionSet: make(map[string]string),
+		Captions:    make(map[string]string),
 	}
-	if request.Organization == "ben2" {
-		card.LogoUrl = "https://checkout.kabbalah.info/logo1.png"
-		if request.Language == "HE" {
-			card.TopText = "BB כרטיסי אשראי"
-			card.BottomText = "© בני ברוך קבלה לעם"
-			card.CaptionSet["cs_submit"] = "שמור"
-		} else if request.Language == "RU" {
-			card.LogoUrl = "https://checkout.kabbalah.info/kabRu.jpeg"
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-			card.CaptionSet["cs_submit"] = "Сохранить"
-		} else if request.Language == "ES" {
-			card.TopText = "Bnei Baruch Kabbalah laAm"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.Language = "EN"
-			card.LogoUrl = "https://cabalacentroestudios.com/wp-content/uploads/2020/04/BB_logo_es.jpg"
-			card.CaptionSet["cs_header_payment"] = "Pago con tarjeta de crédito"
-			card.CaptionSet["cs_header_registeration"] = "Registro con tarjeta de crédito"
-			card.CaptionSet["cs_holdername"] = "Nombre en la tarjeta"
-			card.CaptionSet["cs_cardnumber"] = "Número de tarjeta de crédito"
-			card.CaptionSet["cs_expiration"] = "Fecha de expiración"
-			card.CaptionSet["cs_id"] = "Pasaporte"
-			card.CaptionSet["cs_cvv"] = "CW"
-			card.CaptionSet["cs_payments"] = "Número de pagos"
-			card.CaptionSet["cs_xparam"] = "Detalles adicionales"
-			card.CaptionSet["cs_total"] = "Total"
-			card.CaptionSet["cs_supported_cards"] = "Tarjetas aceptadas como pago en este sitio web"
-			card.CaptionSet["cs_mustfields"] = "Campos obligatorios"
-			card.CaptionSet["cs_submit"] = "Ahorrar"
-			card.CaptionSet["cs_cancel"] = "Cancelar"
-		} else {
-			card.Language = "EN"
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.CaptionSet["cs_submit"] = "Save"
-		}
-	} else if request.Organization == "meshp18" {
-		if request.Language == "HE" {
-			card.TopText = "משפחה בחיבור כרטיסי אשראי"
-			card.BottomText = "© משפחה בחיבור"
-			card.CaptionSet["cs_submit"] = "שמור"
-		} else if request.Language == "RU" {
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-			card.CaptionSet["cs_submit"] = "Сохранить"
-		} else {
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.CaptionSet["cs_submit"] = "Save"
-		}
-		card.LogoUrl = "https://www.1family.co.il/wp-content/uploads/2019/06/cropped-Screen-Shot-2019-06-16-at-00.12.07-140x82.png"
-	} else {
+	org, ok := organizations.Get(request.Organization)
+	if !ok {
 		msg := fmt.Sprintf("NewToken: Unknown Organization")
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadRequest, "Unknown Organization", c)
 		return
 	}
+	page.Brand(org.BrandingFor(request.Language, organizations.FlowNewToken))
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Regular)
+	if err != nil {
 		msg := fmt.Sprintf("NewToken: Pelecard Init %s", err.Error())
 		utils.LogMessage(msg)
 
 		utils.ErrorJson(http.StatusBadGateway, "PeleCard Init: "+err.Error(), c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Regular.String())
 
-	if err, url := card.GetRedirectUrl(types.Register, true); err != nil {
+	if redirect, err := provider.HostedPage(c.Request.Context(), page); err != nil {
 		msg := fmt.Sprintf("NewToken: Error GetRedirectUrl %s", err.Error())
 		utils.LogMessage(msg)
 
 		utils.ErrorJson(http.StatusBadGateway, "GetRedirectUrl "+err.Error(), c)
 	} else {
-		utils.OnRedirect(url, "", "success", c)
+		utils.OnRedirect(redirect.URL, "", "success", c)
 	}
 }
 
@@ -156,7 +103,7 @@ func GoodToken(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(form.UserKey, "valid")
+	db.Transition(form.UserKey, db.StatusInProcess, "pelecard callback", "token page returned")
 
 	org, err := db.GetOrganization(form.UserKey)
 	if err != nil {
@@ -165,8 +112,8 @@ func GoodToken(c *gin.Context) {
 		utils.ErrorJson(http.StatusInternalServerError, "GetOrganization: "+err.Error(), c)
 		return
 	}
-	card := &pelecard.PeleCard{}
-	if err := card.Init(org, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(org, gateway.Regular)
+	if err != nil {
 		m := fmt.Sprintf("Good Token: Approve Init Error %s", err.Error())
 		utils.LogMessage(m)
 		utils.ErrorJson(http.StatusBadGateway, "Approve Init: "+err.Error(), c)
@@ -180,33 +127,37 @@ func GoodToken(c *gin.Context) {
 		return
 	}
 
-	card.ConfirmationKey = form.ConfirmationKey
-	card.UserKey = request.UserKey
-	card.TotalX100 = fmt.Sprintf("%d", int(math.Round(request.Price*100)))
+	ctx := c.Request.Context()
 	var valid bool
-	if valid, err = card.ValidateByUniqueKey(); err != nil {
+	if valid, err = provider.Validate(ctx, gateway.Validation{
+		UserKey:         request.UserKey,
+		ConfirmationKey: form.ConfirmationKey,
+		Amount:          request.Price,
+		Currency:        request.Currency,
+	}); err != nil {
 		m := fmt.Sprintf("Good Token: ValidateByUniqueKey error %s", err.Error())
 		utils.LogMessage(m)
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "validation failed")
 		utils.ErrorJson(http.StatusBadGateway, "ValidateByUniqueKey "+err.Error(), c)
 		return
 	}
 	if !valid {
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "not confirmed")
 		utils.LogMessage("Good Token: Confirmation error")
 		utils.ErrorJson(http.StatusBadGateway, "Confirmation error", c)
 		return
 	}
+	db.Transition(form.UserKey, db.StatusValid, "pelecard callback", "confirmed")
 
-	var msg map[string]any
-	if err, msg = card.GetTransaction(form.PelecardTransactionId); err != nil {
+	transaction, err := provider.Transaction(ctx, form.PelecardTransactionId)
+	if err != nil {
 		m := fmt.Sprintf("Good Token: GetTransaction Error %s", err.Error())
 		utils.LogMessage(m)
 		utils.ErrorJson(http.StatusBadGateway, "GetTransaction: "+err.Error(), c)
 		return
 	}
 	var response = types.PaymentResponse{}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(transaction.Data)
 	_ = json.Unmarshal(body, &response)
 
 	// redirect to GoodURL
@@ -2,8 +2,8 @@ package emv
 
 import (
 	"encoding/json/v2"
+	"errors"
 	"fmt"
-	"math"
 	"net/http"
 	"strings"
 
@@ -11,12 +11,18 @@ import (
 	"github.com/google/go-querystring/query"
 
 	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/organizations"
 	"external_payments/pelecard"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
 )
 
+// pelecardProvider opens a Pelecard terminal. Tests swap it for a fake, so a
+// handler runs without Pelecard.
+var pelecardProvider = gateway.NewPelecard
+
 func ConfirmPayment(c *gin.Context) {
 	var err error
 	request := types.ConfirmRequest{}
@@ -66,118 +72,55 @@ func NewPayment(c *gin.Context) {
 		return
 	}
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
 	baseUrl := utils.BaseUrl()
 	goodUrl := baseUrl + "/emv/good"
 	errorUrl := baseUrl + "/emv/error"
 	cancelUrl := baseUrl + "/emv/cancel"
 
-	total := int(math.Round(request.Price * 100))
-
 	// Request Pelecard
-	card := &pelecard.PeleCard{
+	page := gateway.Page{
+		Action:      types.Charge,
+		RequireCVV:  true,
 		Language:    request.Language,
 		UserKey:     request.UserKey,
-		ParamX:      request.Reference,
-		GoodUrl:     goodUrl,
-		ErrorUrl:    errorUrl,
-		CancelUrl:   cancelUrl,
-		Total:       total,
-		Currency:    currency,
+		Reference:   request.Reference,
+		GoodURL:     goodUrl,
+		ErrorURL:    errorUrl,
+		CancelURL:   cancelUrl,
+		Amount:      request.Price,
+		Currency:    request.Currency,
 		MaxPayments: request.Installments,
 	}
-	if request.Organization == "ben2" {
-		card.LogoUrl = "https://checkout.kabbalah.info/logo1.png"
-		card.MinPayments = 1
-		if request.MaxPayments > 0 {
-			card.MaxPayments = request.MaxPayments
-		} else {
-			card.MaxPayments = 1
-		}
-		if request.Language == "HE" {
-			card.TopText = "BB כרטיסי אשראי"
-			card.BottomText = "© בני ברוך קבלה לעם"
-		} else if request.Language == "RU" {
-			card.LogoUrl = "https://checkout.kabbalah.info/kabRu.jpeg"
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else if request.Language == "ES" {
-			card.TopText = "Bnei Baruch Kabbalah laAm"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.Language = "EN"
-			card.LogoUrl = "https://cabalacentroestudios.com/wp-content/uploads/2020/04/BB_logo_es.jpg"
-			card.CaptionSet = make(map[string]string)
-			card.CaptionSet["cs_header_payment"] = "Pago con tarjeta de crédito"
-			card.CaptionSet["cs_header_registeration"] = "Registro con tarjeta de crédito"
-			card.CaptionSet["cs_holdername"] = "Nombre en la tarjeta"
-			card.CaptionSet["cs_cardnumber"] = "Número de tarjeta de crédito"
-			card.CaptionSet["cs_expiration"] = "Fecha de expiración"
-			card.CaptionSet["cs_id"] = "Pasaporte"
-			card.CaptionSet["cs_cvv"] = "CW"
-			card.CaptionSet["cs_payments"] = "Número de pagos"
-			card.CaptionSet["cs_xparam"] = "Detalles adicionales"
-			card.CaptionSet["cs_total"] = "Total"
-			card.CaptionSet["cs_supported_cards"] = "Tarjetas aceptadas como pago en este sitio web"
-			card.CaptionSet["cs_mustfields"] = "Campos obligatorios"
-			card.CaptionSet["cs_submit"] = "Pagar ahora"
-			card.CaptionSet["cs_cancel"] = "Cancelar"
-		} else {
-			card.Language = "EN"
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-	} else if request.Organization == "meshp18" {
-		if request.Language == "HE" {
-			card.TopText = "משפחה בחיבור כרטיסי אשראי"
-			card.BottomText = "© משפחה בחיבור"
-		} else if request.Language == "RU" {
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else {
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-		card.MinPayments = 1
-		if request.MaxPayments > 0 {
-			card.MaxPayments = request.MaxPayments
-		} else {
-			total = total / 100
-			if total < 100 {
-				card.MaxPayments = 1
-			} else {
-				card.MaxPayments = total/500 + 2
-			}
-			if card.MaxPayments > 10 {
-				card.MaxPayments = 10
-			}
-		}
-		card.LogoUrl = "https://www.1family.co.il/wp-content/uploads/2019/06/cropped-Screen-Shot-2019-06-16-at-00.12.07-140x82.png"
-	} else {
+	org, ok := organizations.Get(request.Organization)
+	if !ok {
 		msg := fmt.Sprintf("New Payment: Unknown Organization")
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadRequest, "Unknown Organization", c)
 		return
 	}
+	page.Brand(org.BrandingFor(request.Language, organizations.FlowEmv))
+	page.Offer(org.Installments.Plan(request.Currency, request.Price, request.SKU))
+	// A limit the caller sends overrides the policy's.
+	if request.MaxPayments > 0 {
+		page.MaxPayments = request.MaxPayments
+		page.MinPayments = min(page.MinPayments, page.MaxPayments)
+	}
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Regular)
+	if err != nil {
 		msg := fmt.Sprintf("New Payment: Pelecard Init %s", err.Error())
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadGateway, "PeleCard Init: "+err.Error(), c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Regular.String())
 
-	if err, url := card.GetRedirectUrl(types.Charge, true); err != nil {
+	if redirect, err := provider.HostedPage(c.Request.Context(), page); err != nil {
 		msg := fmt.Sprintf("New Payment: Error GetRedirectUrl %s", err.Error())
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadGateway, "GetRedirectUrl "+err.Error(), c)
 	} else {
-		utils.OnRedirect(url, "", "success", c)
+		utils.OnRedirect(redirect.URL, "", "success", c)
 	}
 }
 
@@ -188,29 +131,30 @@ func GoodPayment(c *gin.Context) {
 	m := fmt.Sprintf("Good Payment: %+v", form)
 	utils.LogMessage(m)
 
-	if status, _ := db.GetStatus(form.UserKey); status == "valid" || status == "in-process" {
-		m := fmt.Sprintf("Good Payment: duplicate callback ignored (status=%s) userKey=%s txId=%s", status, form.UserKey, form.PelecardTransactionId)
-		utils.LogMessage(m)
-		c.Status(http.StatusOK)
-		return
-	}
-
 	if form.PelecardStatusCode != "000" {
 		m := fmt.Sprintf("Good Payment: Pelecard error %s", form.PelecardStatusCode)
 		utils.LogMessage(m)
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "declined "+form.PelecardStatusCode)
 		utils.ErrorJson(http.StatusBadGateway, "Pelecard error: "+form.PelecardStatusCode+" "+pelecard.GetMessage(form.PelecardStatusCode), c)
 		return
 	}
 
+	if !db.ClaimProcessing(form.UserKey, "pelecard callback") {
+		utils.LogMessage(fmt.Sprintf("Good Payment: duplicate callback suppressed userKey=%s txId=%s", form.UserKey, form.PelecardTransactionId))
+		if goodURL, v, ok := utils.DuplicateCallback(form.UserKey); ok {
+			utils.OnSuccessPayment(goodURL, v.Encode(), form.Token, form.ApprovalNo, c)
+			return
+		}
+		utils.ErrorJson(http.StatusOK, "duplicate callback", c)
+		return
+	}
+
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		m := fmt.Sprintf("Good Payment: %s", err.Error())
 		utils.LogMessage(m)
 		utils.ErrorJson(http.StatusInternalServerError, "UpdateRequestTemp: "+err.Error(), c)
 		return
 	}
-
-	db.SetStatus(form.UserKey, "in-process")
 	// civicrm_bb_ext_requests
 	org, err := db.GetOrganization(form.UserKey)
 	if err != nil {
@@ -221,8 +165,8 @@ func GoodPayment(c *gin.Context) {
 	}
 
 	// approve params
-	card := &pelecard.PeleCard{}
-	if err := card.Init(org, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(org, gateway.Regular)
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: Approve Init Error %s", err.Error())
 		utils.LogMessage(m)
 
@@ -230,8 +174,9 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	var msg map[string]any
-	if err, msg = card.GetTransaction(form.PelecardTransactionId); err != nil {
+	ctx := c.Request.Context()
+	transaction, err := provider.Transaction(ctx, form.PelecardTransactionId)
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: GetTransaction Error %s", err.Error())
 		utils.LogMessage(m)
 
@@ -240,9 +185,10 @@ func GoodPayment(c *gin.Context) {
 	}
 
 	var response = types.PaymentResponse{}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(transaction.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = form.UserKey
+	response.TokenSHA256 = db.CardTokenHash(form.Token)
 	// update DB
 	if err = db.UpdateRequest(response); err != nil {
 		m := fmt.Sprintf("Good Payment: Update Request Error %s", err.Error())
@@ -261,29 +207,22 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
-		m := fmt.Sprintf("Good Payment: Validation Init %s", err.Error())
-		utils.LogMessage(m)
-
-		utils.ErrorJson(http.StatusBadGateway, "Validation Init "+err.Error(), c)
-		return
-	}
-	card.ConfirmationKey = form.ConfirmationKey
-	card.UserKey = request.UserKey
-	card.TotalX100 = fmt.Sprintf("%d", int(math.Round(request.Price*100)))
-	card.Token = form.Token
-	card.AuthorizationNumber = form.ApprovalNo
 	var valid bool
-	if valid, err = card.ValidateByUniqueKey(); err != nil {
+	if valid, err = provider.Validate(ctx, gateway.Validation{
+		UserKey:         request.UserKey,
+		ConfirmationKey: form.ConfirmationKey,
+		Amount:          request.Price,
+		Currency:        request.Currency,
+	}); err != nil {
 		m := fmt.Sprintf("Good Payment: ValidateByUniqueKey 1 error %s", err.Error())
 		utils.LogMessage(m)
 
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "validation failed")
 		utils.ErrorJson(http.StatusBadGateway, "ValidateByUniqueKey 1 "+err.Error(), c)
 		return
 	}
 	if !valid {
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "not confirmed")
 		m := fmt.Sprintf("Good Payment: Confirmation error 1")
 		utils.LogMessage(m)
 
@@ -291,10 +230,10 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(form.UserKey, "valid")
+	db.Transition(form.UserKey, db.StatusValid, "pelecard callback", "confirmed")
 	// redirect to GoodURL
 	v, _ := query.Values(response)
-	utils.OnSuccessPayment(request.GoodURL, v.Encode(), card.Token, card.AuthorizationNumber, c)
+	utils.OnSuccessPayment(request.GoodURL, v.Encode(), form.Token, form.ApprovalNo, c)
 }
 
 func Charge(c *gin.Context) {
@@ -313,6 +252,7 @@ func Charge(c *gin.Context) {
 	// Before validation: Organization is required, and a caller authenticated
 	// by key does not send it.
 	request.Organization = utils.ResolveOrganization(c, request.Organization)
+	request.CallbackURL, request.WebhookSalt = utils.ResolveCallback(c)
 
 	if errFound, errors := validation.ValidateStruct(request); errFound {
 		m := fmt.Sprintf("Charge: Validation Error: %+v", errors)
@@ -320,6 +260,11 @@ func Charge(c *gin.Context) {
 		utils.ErrorJson(http.StatusBadRequest, "Charge validateStruct "+strings.Join(errors, "\n"), c)
 		return
 	}
+	if err = utils.CheckPrefix(c, request.Reference); err != nil {
+		utils.LogMessage("Charge: " + err.Error())
+		utils.ErrorJson(http.StatusForbidden, "Charge "+err.Error(), c)
+		return
+	}
 	m := fmt.Sprintf("Charge: %+v", request)
 	utils.LogMessage(m)
 
@@ -337,74 +282,63 @@ func Charge(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "in-process")
+	db.Transition(request.UserKey, db.StatusInProcess, "pelecard charge", "charging")
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
+	charge := gateway.Charge{
+		UserKey:      request.UserKey,
+		Token:        request.Token,
+		ApprovalNo:   request.ApprovalNo,
+		Reference:    request.Reference,
+		Amount:       request.Price,
+		Currency:     request.Currency,
+		SkipApproval: true,
+		// Re-verify server-to-server before treating as paid.
+		Verify: true,
 	}
-	total := fmt.Sprintf("%d", int(math.Round(request.Price*100)))
-	card := &pelecard.PeleCard{
-		Token:               request.Token,
-		TotalX100:           total,
-		Currency:            currency,
-		AuthorizationNumber: request.ApprovalNo,
-		ParamX:              request.Reference,
-	}
-	terminals := []types.PelecardType{types.Regular}
+	terminals := []gateway.Terminal{gateway.Regular}
 	if request.IsRecurring {
-		terminals = []types.PelecardType{types.Recurrent, types.Regular}
+		terminals = []gateway.Terminal{gateway.Recurrent, gateway.Regular}
 	}
 
-	var msg map[string]any
+	var charged gateway.Result
 	var chargeErr error
-	for i, termType := range terminals {
-		if initErr := card.Init(request.Organization, termType, true); initErr != nil {
-			utils.LogMessage(fmt.Sprintf("Charge: Init terminal %v error: %s", termType, initErr))
+	for i, terminal := range terminals {
+		provider, initErr := pelecardProvider(request.Organization, terminal)
+		if initErr != nil {
+			utils.LogMessage(fmt.Sprintf("Charge: Init terminal %s error: %s", terminal, initErr))
 			chargeErr = initErr
 			continue
 		}
-		chargeErr, msg = card.ChargeByToken(true)
-		if chargeErr == nil {
+		charged, chargeErr = provider.ChargeToken(c.Request.Context(), charge)
+		db.SetTerminal(request.UserKey, terminal.String())
+		// Unverified means the charge may have gone through: trying another
+		// terminal could charge the donor twice.
+		if chargeErr == nil || errors.Is(chargeErr, gateway.ErrUnverified) {
 			break
 		}
 		if i < len(terminals)-1 {
-			utils.LogMessage(fmt.Sprintf("Charge: terminal %v failed, trying regular: %s", termType, chargeErr))
+			utils.LogMessage(fmt.Sprintf("Charge: terminal %s failed, trying regular: %s", terminal, chargeErr))
 		}
 	}
+	if errors.Is(chargeErr, gateway.ErrUnverified) {
+		// Leave in-process — ext2fix will reconcile via CheckGoodParamX.
+		utils.LogMessage(fmt.Sprintf("Charge: %s", chargeErr))
+		utils.ErrorJson(http.StatusOK, "Charge: "+chargeErr.Error(), c)
+		return
+	}
 	if chargeErr != nil {
-		db.SetStatus(request.UserKey, "invalid")
+		utils.SettleChargeFailure(request.UserKey, "pelecard charge", chargeErr)
 		utils.LogMessage(fmt.Sprintf("Charge: all terminals failed: %s", chargeErr))
-		utils.ErrorJson(http.StatusOK, "Charge error "+chargeErr.Error(), c)
+		utils.ChargeErrorJson("Charge error ", chargeErr, c)
 		return
 	}
 
 	var response = types.PaymentResponse{}
 
-	// Re-verify server-to-server before treating as paid.
-	txId, _ := msg["PelecardTransactionId"].(string)
-	if txId == "" {
-		// Leave in-process — ext2fix will reconcile via CheckGoodParamX.
-		utils.LogMessage("Charge: no PelecardTransactionId in ChargeByToken response")
-		utils.ErrorJson(http.StatusOK, "Charge: no transaction ID returned", c)
-		return
-	}
-	var txMsg map[string]any
-	if err, txMsg = card.GetTransDataByTrxId(txId); err != nil {
-		// Transient verify failure — leave in-process for ext2fix reconciliation.
-		m := fmt.Sprintf("Charge: GetTransaction verify failed %s", err.Error())
-		utils.LogMessage(m)
-		utils.ErrorJson(http.StatusOK, "Charge verify failed: "+err.Error(), c)
-		return
-	}
-	msg = txMsg
-
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(charged.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = request.UserKey
+	response.TokenSHA256 = db.CardTokenHash(request.Token)
 	utils.LogMessage(fmt.Sprintf("Charge OK: %+v", response))
 	// update DB
 	if err = db.UpdateRequest(response); err != nil {
@@ -415,7 +349,7 @@ func Charge(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "valid")
+	db.Transition(request.UserKey, db.StatusValid, "pelecard charge", "charge approved")
 	data, _ := json.Marshal(response)
 	var result = map[string]string{
 		"status": "success",
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Kind says what a failed charge means for the caller.
+type Kind string
+
+const (
+	// Declined is the payer's card or account refusing the charge. Retrying
+	// will not help; the payer has to act.
+	Declined Kind = "declined"
+	// Retryable is the gateway not answering, or answering that it could not
+	// process the request right now: timeouts, 5xx, network failures.
+	Retryable Kind = "retryable"
+	// Configuration is our side: missing credentials, a terminal not set up
+	// for the transaction, values the gateway rejects as malformed.
+	Configuration Kind = "configuration"
+)
+
+// Error is a charge the gateway did not make, classified. Code is the
+// gateway's own: a Pelecard status code, or a PayPal issue or capture status.
+// Message is the gateway's explanation in English.
+type Error struct {
+	Kind    Kind   `json:"kind"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// HTTPStatus is the status a charge endpoint answers with. A decline is an
+// ordinary outcome of charging a card and keeps 200, so callers that treat a
+// non-2xx as an incident are not paged for one.
+func (e *Error) HTTPStatus() int {
+	switch e.Kind {
+	case Declined:
+		return http.StatusOK
+	case Configuration:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
+// Classify returns err as an *Error. An error no provider classified is taken
+// to be the network's, and retryable.
+func Classify(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Kind: Retryable, Message: err.Error(), Err: err}
+}
@@ -0,0 +1,153 @@
+// Package gateway puts the payment gateways behind one interface, so a handler
+// opens a payment page, charges a token, looks up, validates or refunds a
+// payment the same way whichever gateway holds it.
+//
+// Pelecard is adapted here. PayPal's adapter lives in the paypal package with
+// the rest of the PayPal code, since it shares that package's client and
+// vault helpers.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"maps"
+
+	"external_payments/organizations"
+	"external_payments/types"
+)
+
+// ErrUnsupported is returned by an operation the gateway has no equivalent
+// for, such as validating a PayPal hosted-page result.
+var ErrUnsupported = errors.New("gateway: operation not supported")
+
+// ErrUnverified is returned, wrapped, by ChargeToken with Verify set when the
+// gateway accepted the charge but the server-to-server read-back failed. The
+// money may have moved: the caller should leave the payment in-process for
+// reconciliation rather than mark it invalid.
+var ErrUnverified = errors.New("charge not verified")
+
+// Provider is one gateway account: for Pelecard, one organization's terminal.
+type Provider interface {
+	// Name is the gateway's name as recorded in the database.
+	Name() string
+	// HostedPage prepares the gateway's payment page and returns where to send
+	// the payer.
+	HostedPage(ctx context.Context, page Page) (Redirect, error)
+	// ChargeToken charges a saved card or account without the payer present.
+	ChargeToken(ctx context.Context, charge Charge) (Result, error)
+	// Transaction returns what the gateway recorded for a transaction id.
+	Transaction(ctx context.Context, id string) (Result, error)
+	// Validate confirms that a hosted-page result came from the gateway and
+	// was for the amount requested.
+	Validate(ctx context.Context, v Validation) (bool, error)
+	// Refund returns all or part of a captured payment.
+	Refund(ctx context.Context, r Refund) (Result, error)
+}
+
+// Page describes the hosted payment page. Amount and Currency are as the
+// caller sent them; each adapter converts to its gateway's units.
+type Page struct {
+	Action     types.ActionType
+	RequireCVV bool
+
+	UserKey     string
+	Reference   string
+	Description string
+	Amount      float64
+	Currency    string
+
+	GoodURL   string
+	ErrorURL  string
+	CancelURL string
+
+	MinPayments int
+	MaxPayments int
+	// FirstPayment, in Currency, fixes the first of the payments; 0 splits
+	// the amount evenly. CreditFrom is the number of payments from
+	// which the deal is a credit deal; 0 offers none. Pelecard only.
+	FirstPayment float64
+	CreditFrom   int
+
+	// Branding, shown on Pelecard's page only.
+	Language   string
+	LogoURL    string
+	TopText    string
+	BottomText string
+	Captions   map[string]string
+
+	// Vault asks PayPal to keep the payer's account for later charges.
+	Vault bool
+}
+
+// Brand dresses the page in an organization's branding. A caption the page
+// already has is replaced only if b has its own.
+func (p *Page) Brand(b organizations.Branding) {
+	if b.PageLanguage != "" {
+		p.Language = b.PageLanguage
+	}
+	p.LogoURL = b.Logo
+	p.TopText = b.TopText
+	p.BottomText = b.BottomText
+	if len(b.Captions) > 0 && p.Captions == nil {
+		p.Captions = map[string]string{}
+	}
+	maps.Copy(p.Captions, b.Captions)
+}
+
+// Offer sets the installments the page offers to an organization's plan.
+func (p *Page) Offer(plan organizations.Plan) {
+	p.MinPayments = plan.MinPayments
+	p.MaxPayments = plan.MaxPayments
+	p.FirstPayment = plan.FirstPayment
+	p.CreditFrom = plan.CreditFrom
+}
+
+// Redirect is where to send the payer, and the gateway's id for what it
+// prepared, where it issues one.
+type Redirect struct {
+	URL string
+	Id  string
+}
+
+// Charge is a charge against a saved token.
+type Charge struct {
+	UserKey     string
+	Token       string
+	ApprovalNo  string
+	Reference   string
+	Description string
+	Amount      float64
+	Currency    string
+
+	// SkipApproval leaves ApprovalNo off the request: EMV terminals refuse a
+	// stale authorization number rather than ignore it.
+	SkipApproval bool
+	// Verify reads the transaction back server-to-server before reporting
+	// success, and returns that reading instead of the charge's answer.
+	Verify bool
+}
+
+// Validation identifies a hosted-page result to confirm.
+type Validation struct {
+	UserKey         string
+	ConfirmationKey string
+	Amount          float64
+	Currency        string
+}
+
+// Refund is a refund of a captured payment. Pelecard refunds the card behind
+// Token; PayPal refunds the capture TransactionId.
+type Refund struct {
+	TransactionId string
+	Token         string
+	Reference     string
+	Amount        float64
+	Currency      string
+}
+
+// Result is a gateway's answer: its id for the transaction, and the raw
+// fields it returned, which handlers store as they always have.
+type Result struct {
+	Id   string
+	Data map[string]any
+}
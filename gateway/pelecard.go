@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"external_payments/currency"
+	"external_payments/organizations"
+	"external_payments/pelecard"
+	"external_payments/types"
+)
+
+// Terminal selects one of an organization's Pelecard terminals.
+type Terminal int
+
+const (
+	// Regular is the organization's EMV terminal, used for hosted pages.
+	Regular Terminal = iota
+	// PreEMV is the organization's terminal from before EMV, which still
+	// holds the tokens issued on it.
+	PreEMV
+	// Recurrent is the shared terminal recurring tokens are issued on.
+	Recurrent
+)
+
+func (t Terminal) String() string {
+	switch t {
+	case PreEMV:
+		return "pre-EMV"
+	case Recurrent:
+		return "recurrent"
+	}
+	return "regular"
+}
+
+// Pelecard is a Provider for one organization's terminal.
+type Pelecard struct {
+	base     pelecard.PeleCard
+	terminal Terminal
+}
+
+// NewPelecard returns the Provider for an organization's terminal. It fails
+// when the terminal's credentials are not configured, before any call is made.
+func NewPelecard(organization string, terminal Terminal) (Provider, error) {
+	if org, ok := organizations.Get(organization); ok && !org.HasTerminal(terminal.String()) {
+		return nil, &Error{Kind: Configuration, Message: fmt.Sprintf("%s has no %s terminal", organization, terminal)}
+	}
+	p := &Pelecard{terminal: terminal}
+	var err error
+	switch terminal {
+	case PreEMV:
+		err = p.base.Init(organization, types.Regular, false)
+	case Recurrent:
+		err = p.base.Init(organization, types.Recurrent, true)
+	default:
+		err = p.base.Init(organization, types.Regular, true)
+	}
+	if err != nil {
+		return nil, &Error{Kind: Configuration, Message: err.Error(), Err: err}
+	}
+	return p, nil
+}
+
+func (p *Pelecard) Name() string { return "pelecard" }
+
+// card returns a fresh request carrying only the terminal's credentials:
+// PeleCard is a request body, and fields left over from one call would be
+// sent with the next.
+func (p *Pelecard) card() *pelecard.PeleCard {
+	return &pelecard.PeleCard{
+		Url:      p.base.Url,
+		Service:  p.base.Service,
+		User:     p.base.User,
+		Password: p.base.Password,
+		Terminal: p.base.Terminal,
+	}
+}
+
+func (p *Pelecard) HostedPage(_ context.Context, page Page) (Redirect, error) {
+	card := p.card()
+	card.Language = page.Language
+	card.UserKey = page.UserKey
+	card.ParamX = page.Reference
+	card.GoodUrl = page.GoodURL
+	card.ErrorUrl = page.ErrorURL
+	card.CancelUrl = page.CancelURL
+	cur, code, err := pelecardCurrency(page.Currency)
+	if err != nil {
+		return Redirect{}, err
+	}
+	card.Total = cur.MinorUnits(page.Amount)
+	card.Currency = code
+	card.MinPayments = page.MinPayments
+	card.MaxPayments = page.MaxPayments
+	if page.FirstPayment > 0 {
+		card.FirstPayment = strconv.Itoa(cur.MinorUnits(page.FirstPayment))
+	}
+	card.MinPaymentsForCredit = page.CreditFrom
+	card.LogoUrl = page.LogoURL
+	card.TopText = page.TopText
+	card.BottomText = page.BottomText
+	card.CaptionSet = page.Captions
+
+	err, url := card.GetRedirectUrl(page.Action, page.RequireCVV)
+	if err != nil {
+		return Redirect{}, err
+	}
+	return Redirect{URL: url}, nil
+}
+
+func (p *Pelecard) ChargeToken(_ context.Context, charge Charge) (Result, error) {
+	card := p.card()
+	card.UserKey = charge.UserKey
+	card.Token = charge.Token
+	card.AuthorizationNumber = charge.ApprovalNo
+	card.ParamX = charge.Reference
+	cur, code, err := pelecardCurrency(charge.Currency)
+	if err != nil {
+		return Result{}, err
+	}
+	card.TotalX100 = strconv.Itoa(cur.MinorUnits(charge.Amount))
+	card.Currency = code
+
+	err, msg := card.ChargeByToken(charge.SkipApproval)
+	if err != nil {
+		return Result{}, pelecardError(err)
+	}
+	id, _ := msg["PelecardTransactionId"].(string)
+	if !charge.Verify {
+		return Result{Id: id, Data: msg}, nil
+	}
+
+	if id == "" {
+		return Result{}, fmt.Errorf("%w: no PelecardTransactionId in the charge response", ErrUnverified)
+	}
+	if err, msg = card.GetTransDataByTrxId(id); err != nil {
+		return Result{Id: id}, fmt.Errorf("%w: %s", ErrUnverified, err)
+	}
+	return Result{Id: id, Data: msg}, nil
+}
+
+func (p *Pelecard) Transaction(_ context.Context, id string) (Result, error) {
+	err, msg := p.card().GetTransaction(id)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Id: id, Data: msg}, nil
+}
+
+func (p *Pelecard) Validate(_ context.Context, v Validation) (bool, error) {
+	card := p.card()
+	card.ConfirmationKey = v.ConfirmationKey
+	card.UserKey = v.UserKey
+	cur, _, err := pelecardCurrency(v.Currency)
+	if err != nil {
+		return false, err
+	}
+	card.TotalX100 = strconv.Itoa(cur.MinorUnits(v.Amount))
+	return card.ValidateByUniqueKey()
+}
+
+// Refund credits the card behind r.Token. Pelecard has no refund of a
+// transaction by its id, so the caller must make sure the token is the card
+// that paid.
+func (p *Pelecard) Refund(_ context.Context, r Refund) (Result, error) {
+	card := p.card()
+	card.Token = r.Token
+	card.ParamX = r.Reference
+	cur, code, err := pelecardCurrency(r.Currency)
+	if err != nil {
+		return Result{}, err
+	}
+	card.TotalX100 = strconv.Itoa(cur.MinorUnits(r.Amount))
+	card.Currency = code
+
+	err, msg := card.RefundByToken()
+	if err != nil {
+		return Result{}, pelecardError(err)
+	}
+	id, _ := msg["PelecardTransactionId"].(string)
+	return Result{Id: id, Data: msg}, nil
+}
+
+// pelecardCurrency looks up a currency Pelecard is to charge in. One it does
+// not take is a Configuration error, before anything is sent.
+func pelecardCurrency(code string) (currency.Currency, int, error) {
+	cur, err := currency.Lookup(code)
+	var pelecard int
+	if err == nil {
+		pelecard, err = cur.PelecardCode()
+	}
+	if err != nil {
+		return cur, 0, &Error{Kind: Configuration, Message: err.Error(), Err: err}
+	}
+	return cur, pelecard, nil
+}
+
+// pelecardRetryable are statuses for a charge Pelecard could not process
+// right now; the same charge may go through later.
+var pelecardRetryable = map[string]bool{
+	"009": true, "200": true, "301": true, "306": true, "500": true, "599": true,
+}
+
+// pelecardConfiguration are statuses about our terminal or credentials, or
+// the values we sent, rather than the payer's card.
+var pelecardConfiguration = map[string]bool{
+	"044": true, "045": true, "404": true, "501": true, "502": true, "503": true,
+	"505": true, "507": true, "509": true, "597": true, "598": true, "600": true,
+	"999": true,
+}
+
+// pelecardError classifies a failed services call. Statuses 106 to 129 are all
+// "the terminal is not authorized for ..." and count as configuration; any
+// other status is the card's.
+func pelecardError(err error) error {
+	var status *pelecard.StatusError
+	var page *pelecard.HTTPError
+	switch {
+	case errors.As(err, &status):
+		message := pelecard.GetMessage(status.Code)
+		if message == "" {
+			message = status.Message
+		}
+		e := &Error{Kind: Declined, Code: status.Code, Message: strings.TrimSpace(message), Err: err}
+		code, _ := strconv.Atoi(status.Code)
+		switch {
+		case pelecardRetryable[status.Code]:
+			e.Kind = Retryable
+		case pelecardConfiguration[status.Code], code >= 106 && code <= 129:
+			e.Kind = Configuration
+		}
+		return e
+	case errors.As(err, &page) && page.StatusCode < http.StatusInternalServerError:
+		return &Error{Kind: Configuration, Message: err.Error(), Err: err}
+	}
+	return &Error{Kind: Retryable, Message: err.Error(), Err: err}
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json/v2"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"external_payments/currency"
+	"external_payments/organizations"
+)
+
+// pelecardServer answers Pelecard calls with handler and points the test
+// organization's terminal at it.
+func pelecardServer(t *testing.T, handler http.HandlerFunc) Provider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv("test_PELECARD_USER", "user")
+	t.Setenv("test_PELECARD_PASSWORD", "pass")
+	t.Setenv("test_PELECARD_TERMINAL", "123")
+	t.Setenv("PELECARD_SERVICES_URL", server.URL)
+	t.Setenv("PELECARD_GW_URL", server.URL)
+
+	provider, err := NewPelecard("test", Regular)
+	if err != nil {
+		t.Fatalf("NewPelecard: %v", err)
+	}
+	return provider
+}
+
+func TestNewPelecardNeedsCredentials(t *testing.T) {
+	t.Setenv("nobody_PELECARD_USER", "")
+	if _, err := NewPelecard("nobody", Regular); err == nil {
+		t.Fatal("want an error for an organization with no credentials")
+	}
+}
+
+// The adapter, not the handler, turns a price into agorot and a currency into
+// Pelecard's code; an EMV charge leaves the stale approval number off.
+func TestPelecardChargeTokenConverts(t *testing.T) {
+	var sent map[string]any
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/DebitRegularType" {
+			t.Errorf("charge posted to %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &sent)
+		w.Write([]byte(`{"StatusCode":"000","ResultData":{"PelecardTransactionId":"tx-1"}}`))
+	})
+
+	result, err := provider.ChargeToken(context.Background(), Charge{
+		Token:        "tok1",
+		ApprovalNo:   "0123",
+		Amount:       19.99,
+		Currency:     "EUR",
+		SkipApproval: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Id != "tx-1" {
+		t.Errorf("Id = %q", result.Id)
+	}
+	if sent["Total"] != "1999" || sent["Currency"] != float64(978) || sent["Token"] != "tok1" {
+		t.Errorf("request = %v", sent)
+	}
+	if _, ok := sent["AuthorizationNumber"]; ok {
+		t.Errorf("AuthorizationNumber sent despite SkipApproval: %v", sent)
+	}
+}
+
+// The page offers the plan's installments; without a fixed first payment
+// Pelecard splits the amount itself.
+func TestPelecardHostedPageInstallments(t *testing.T) {
+	var sent []map[string]any
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.UnmarshalRead(r.Body, &body)
+		sent = append(sent, body)
+		w.Write([]byte(`{"URL":"https://pay.example/page"}`))
+	})
+
+	page := Page{Amount: 1200, Currency: "ILS"}
+	page.Offer(organizations.Plan{MinPayments: 1, MaxPayments: 12, FirstPayment: 300, CreditFrom: 7})
+	if _, err := provider.HostedPage(context.Background(), page); err != nil {
+		t.Fatal(err)
+	}
+	page.Offer(organizations.Plan{MinPayments: 1, MaxPayments: 1})
+	if _, err := provider.HostedPage(context.Background(), page); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("%d calls", len(sent))
+	}
+	if got := sent[0]; got["MaxPayments"] != float64(12) || got["FirstPayment"] != "30000" || got["MinPaymentsForCredit"] != float64(7) {
+		t.Errorf("installments page sent %v", got)
+	}
+	if got := sent[1]; got["FirstPayment"] != "auto" || got["MinPaymentsForCredit"] != nil {
+		t.Errorf("single payment page sent %v", got)
+	}
+}
+
+// A charge Pelecard accepted but that cannot be read back may still have
+// moved money, so it must be distinguishable from a decline.
+func TestPelecardChargeTokenUnverified(t *testing.T) {
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/DebitRegularType":
+			w.Write([]byte(`{"StatusCode":"000","ResultData":{"PelecardTransactionId":"tx-1"}}`))
+		default:
+			w.Write([]byte(`{"StatusCode":"599","ErrorMessage":"General error"}`))
+		}
+	})
+
+	_, err := provider.ChargeToken(context.Background(), Charge{Token: "tok1", Amount: 10, Currency: "ILS", Verify: true})
+	if !errors.Is(err, ErrUnverified) {
+		t.Fatalf("want ErrUnverified, got %v", err)
+	}
+}
+
+func TestPelecardChargeTokenDeclined(t *testing.T) {
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"StatusCode":"004","ErrorMessage":"Refusal by credit company."}`))
+	})
+
+	_, err := provider.ChargeToken(context.Background(), Charge{Token: "tok1", Amount: 10, Currency: "ILS", Verify: true})
+	if err == nil || errors.Is(err, ErrUnverified) {
+		t.Fatalf("want a plain decline, got %v", err)
+	}
+}
+
+// Callers retry outages and tell the donor about declines, so which is which
+// comes from Pelecard's status, and an error page is an outage.
+func TestPelecardChargeTokenClassifies(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		kind   Kind
+		code   string
+	}{
+		{"refused", 200, `{"StatusCode":"004","ErrorMessage":"x"}`, Declined, "004"},
+		{"expired", 200, `{"StatusCode":"036","ErrorMessage":"x"}`, Declined, "036"},
+		{"repeat", 200, `{"StatusCode":"599","ErrorMessage":"x"}`, Retryable, "599"},
+		{"password", 200, `{"StatusCode":"501","ErrorMessage":"x"}`, Configuration, "501"},
+		{"terminal", 200, `{"StatusCode":"115","ErrorMessage":"x"}`, Configuration, "115"},
+		{"unlisted", 200, `{"StatusCode":"777","ErrorMessage":"Something new"}`, Declined, "777"},
+		{"error page", 503, `<html>busy</html>`, Retryable, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+
+			_, err := provider.ChargeToken(context.Background(), Charge{Token: "tok1", Amount: 10, Currency: "ILS"})
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("want a *gateway.Error, got %v", err)
+			}
+			if e.Kind != tc.kind || e.Code != tc.code || e.Message == "" {
+				t.Errorf("got %+v, want kind %s code %q", e, tc.kind, tc.code)
+			}
+		})
+	}
+}
+
+func TestPelecardDeclineUsesMessageTable(t *testing.T) {
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"StatusCode":"006","ErrorMessage":"שגיאה"}`))
+	})
+
+	_, err := provider.ChargeToken(context.Background(), Charge{Token: "tok1", Amount: 10, Currency: "ILS"})
+	if e := Classify(err); e.Message != "Incorrect CVV/ID." {
+		t.Errorf("message = %q, want the English text", e.Message)
+	}
+}
+
+// A currency Pelecard does not take is refused before anything is sent,
+// rather than charged in shekels.
+func TestPelecardRefusesCurrency(t *testing.T) {
+	provider := pelecardServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("called %s", r.URL.Path)
+	})
+
+	for _, code := range []string{"GBP", "XYZ", ""} {
+		_, err := provider.ChargeToken(context.Background(), Charge{Token: "tok1", Amount: 10, Currency: code})
+		var gerr *Error
+		if !errors.As(err, &gerr) || gerr.Kind != Configuration || !errors.Is(err, currency.ErrUnsupported) {
+			t.Errorf("%q: %v", code, err)
+		}
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"external_payments/db"
+	"external_payments/organizations"
+	"external_payments/rates"
+	"external_payments/reconcile"
+	"external_payments/settlement"
+	"external_payments/types"
 )
 
 // usage is deliberately thin. It says what an operator has to type and
@@ -21,17 +33,47 @@ const usage = `external_payments
 
 Run with no arguments to start the server.
 
-  -createkey <name> <organization> <prefix> [notes]
-        issue a client token
+  -createkey <name> <organization> <prefix> [-scopes a,b] [notes]
+        issue a client token and its signing key; scopes default to all
+        of them
   -listkeys
         list clients
+  -rotatekey <id> [grace]
+        issue a new token for a client; the old one works for grace (default 72h)
   -revokekey <id>
         disable a client
+  -prefixmode <id> observe|enforce
+        log or refuse references outside the client's prefix
+  -signing <id> required|optional
+        refuse, or accept, the client's token without a request signature
+  -callback <id> <url>|-
+        post the client's payment results to url, signed with the
+        webhook secret it prints; - stops it
+  -reconcile <from> <to> [dry-run]
+        check Pelecard requests against the terminals' reports and mark
+        the ones Pelecard approved valid; dates are 2006-01-02 or
+        "2006-01-02 15:04"
+  -reconcilepaypal <from> <to>
+        report PayPal payments, refunds and chargebacks we have no record
+        of, and orders approved but never captured
+  -report daily <date> [file.xlsx]
+        sum the day's payments, refunds and declines per organization,
+        terminal, currency and gateway; JSON, or a spreadsheet to file
+  -importrates <file.csv>
+        store exchange rates from an ECB or Bank of Israel CSV; the
+        counters convert contributions at the rates of their day
+  -show <userKey|reference>
+        print what was recorded for a payment, redacted
+  -setstatus <userKey> <status> <reason>
+        put a payment in a status by hand; recorded in its history
+  -requery <userKey>
+        ask Pelecard for the transaction a payment recorded
   -h
         this text
 
-A token is shown once, when issued, and cannot be read back.
-Changes take effect on restart.
+A token is shown once, when issued, and cannot be read back. Signing keys
+need CLIENT_SECRET_KEY, the same here as on the server.
+A running server picks up changes within a minute, or at once on SIGHUP.
 
 See the repository for how clients are configured.
 `
@@ -49,9 +91,42 @@ func runCommand(args []string) {
 	case "-listkeys":
 		withDB(listKeys)
 
+	case "-rotatekey":
+		withDB(func() { rotateKey(args[1:]) })
+
 	case "-revokekey":
 		withDB(func() { revokeKey(args[1:]) })
 
+	case "-prefixmode":
+		withDB(func() { prefixMode(args[1:]) })
+
+	case "-signing":
+		withDB(func() { signing(args[1:]) })
+
+	case "-callback":
+		withDB(func() { callback(args[1:]) })
+
+	case "-reconcile":
+		withDB(func() { reconcileCommand(args[1:]) })
+
+	case "-reconcilepaypal":
+		withDB(func() { reconcilePaypal(args[1:]) })
+
+	case "-report":
+		withDB(func() { settlementReport(args[1:]) })
+
+	case "-importrates":
+		withDB(func() { importRates(args[1:]) })
+
+	case "-show":
+		withDB(func() { show(args[1:]) })
+
+	case "-setstatus":
+		withDB(func() { setStatus(args[1:]) })
+
+	case "-requery":
+		withDB(func() { requery(args[1:]) })
+
 	default:
 		fmt.Printf("unknown option %q\n\n", args[0])
 		fmt.Print(usage)
@@ -69,16 +144,16 @@ func withDB(fn func()) {
 
 // createKey mints a client token, prints it once and exits. The token is not
 // recoverable afterwards — only its hash is stored.
-// validOrganizations mirrors the values= tag on PaymentRequest.Organization in
-// types/types.go. A key scoped to anything else could never charge, so it is
-// caught here rather than discovered on the first payment.
-var validOrganizations = []string{"ben2", "meshp18"}
-
 func createKey(args []string) {
-	if len(args) < 3 {
-		fmt.Printf("usage: external_payments -createkey <name> <organization> <prefix> [notes]\n")
-		fmt.Printf("organization is one of: %s\n", strings.Join(validOrganizations, ", "))
+	scopes, args, err := scopesFlag(args)
+	if err != nil || len(args) < 3 {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("usage: external_payments -createkey <name> <organization> <prefix> [-scopes a,b] [notes]\n")
+		fmt.Printf("organization is one of: %s\n", strings.Join(organizations.Names(), ", "))
 		fmt.Printf("prefix is the caller's reference prefix, e.g. 1fam\n")
+		fmt.Printf("scopes are any of: %s\n", strings.Join(db.AllScopes, ", "))
 		os.Exit(2)
 	}
 	name, organization, prefix := args[0], args[1], args[2]
@@ -88,9 +163,11 @@ func createKey(args []string) {
 		os.Exit(2)
 	}
 
-	if !slices.Contains(validOrganizations, organization) {
+	// A key scoped to an unregistered organization could never charge, so it
+	// is caught here rather than discovered on the first payment.
+	if !organizations.Known(organization) {
 		fmt.Printf("unknown organization %q — expected one of: %s\n",
-			organization, strings.Join(validOrganizations, ", "))
+			organization, strings.Join(organizations.Names(), ", "))
 		os.Exit(2)
 	}
 
@@ -99,13 +176,8 @@ func createKey(args []string) {
 		notes = args[3]
 	}
 
-	raw := make([]byte, 32)
-	if _, err := rand.Read(raw); err != nil {
-		log.Fatalf("generate token: %v", err)
-	}
-	token := base64.RawURLEncoding.EncodeToString(raw)
-
-	id, err := db.CreateAPIClient(name, organization, prefix, token, notes)
+	token := newToken()
+	id, err := db.CreateAPIClient(name, organization, prefix, scopes, token, notes)
 	if err != nil {
 		log.Fatalf("create client: %v", err)
 	}
@@ -114,9 +186,103 @@ func createKey(args []string) {
 	fmt.Printf("name          %s\n", name)
 	fmt.Printf("organization  %s\n", organization)
 	fmt.Printf("prefix        %s\n", prefix)
+	fmt.Printf("scopes        %s\n", strings.Join(scopes, ","))
+	fmt.Printf("token         %s\n", token)
+	printSigningKey(token)
+	fmt.Println("\nStore it now — it cannot be read back.")
+	fmt.Println("A running server loads it within a minute, or at once on SIGHUP.")
+}
+
+// printSigningKey prints the key a client signs requests with, if this host
+// has the server's key to derive it.
+func printSigningKey(token string) {
+	if key := db.SigningKey(db.TokenHash(token)); key != "" {
+		fmt.Printf("signing key   %s\n", key)
+	} else {
+		fmt.Println("signing key   none: CLIENT_SECRET_KEY is not set here")
+	}
+}
+
+func newToken() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// defaultGrace is how long a rotated key's old token keeps working: long
+// enough for a site owner to be reached and deploy the new one.
+const defaultGrace = 72 * time.Hour
+
+// rotateKey issues a new token for a client, prints it once and exits. The
+// client's settings carry over to the new row; the old token expires after
+// the grace period.
+func rotateKey(args []string) {
+	if len(args) < 1 {
+		fmt.Println("usage: external_payments -rotatekey <id> [grace]    (see -listkeys)")
+		fmt.Println("grace is how long the old token keeps working, e.g. 24h; default 72h, 0 to end it now")
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("id must be a number: %v", err)
+	}
+	grace := defaultGrace
+	if len(args) > 1 {
+		if grace, err = time.ParseDuration(args[1]); err != nil || grace < 0 {
+			log.Fatalf("grace must be a duration such as 24h: %q", args[1])
+		}
+	}
+
+	token := newToken()
+	newID, err := db.RotateAPIClient(id, token, grace)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Printf("no enabled client with id %d\n", id)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("rotate client: %v", err)
+	}
+
+	fmt.Printf("id            %d (replaces %d)\n", newID, id)
 	fmt.Printf("token         %s\n", token)
+	printSigningKey(token)
+	fmt.Printf("old token     expires in %s\n", grace)
 	fmt.Println("\nStore it now — it cannot be read back.")
-	fmt.Println("Restart the service to load it.")
+	fmt.Println("A running server loads it within a minute, or at once on SIGHUP.")
+	fmt.Printf("Once -listkeys shows %d no longer in use, the caller has moved over.\n", id)
+}
+
+// scopesFlag takes "-scopes a,b" out of args, wherever it is, and checks each
+// scope is one the server knows. Without the flag a key gets every scope, as
+// keys did before there were scopes.
+func scopesFlag(args []string) (scopes []string, rest []string, err error) {
+	scopes = db.AllScopes
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-scopes" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			return nil, nil, fmt.Errorf("-scopes needs a value")
+		}
+		i++
+		scopes = nil
+		for _, s := range strings.Split(args[i], ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if !slices.Contains(db.AllScopes, s) {
+				return nil, nil, fmt.Errorf("unknown scope %q", s)
+			}
+			scopes = append(scopes, s)
+		}
+		if len(scopes) == 0 {
+			return nil, nil, fmt.Errorf("-scopes cannot be empty")
+		}
+	}
+	return scopes, rest, nil
 }
 
 func listKeys() {
@@ -128,20 +294,34 @@ func listKeys() {
 		fmt.Println("no clients")
 		return
 	}
-	fmt.Printf("%-4s %-20s %-12s %-10s %-9s %-20s %s\n",
-		"id", "name", "organization", "prefix", "state", "created", "last used")
+	fmt.Printf("%-4s %-20s %-12s %-10s %-8s %-8s %-9s %-20s %-20s %-20s %-16s %-8s %s\n",
+		"id", "name", "organization", "prefix", "mode", "signing", "state", "created", "expires",
+		"last used", "from ip", "replaces", "scopes")
 	for _, r := range rows {
 		state := "revoked"
-		if r.Enabled {
+		switch {
+		case r.Enabled && r.Expired:
+			state = "expired"
+		case r.Enabled:
 			state = "enabled"
 		}
-		last := "never"
-		if r.LastUsedAt != nil {
-			last = *r.LastUsedAt
+		signing := "optional"
+		if r.Signed {
+			signing = "required"
 		}
-		fmt.Printf("%-4d %-20s %-12s %-10s %-9s %-20s %s\n",
-			r.ID, r.Name, r.Organization, r.Prefix, state, r.CreatedAt, last)
+		fmt.Printf("%-4d %-20s %-12s %-10s %-8s %-8s %-9s %-20s %-20s %-20s %-16s %-8s %s\n",
+			r.ID, r.Name, r.Organization, r.Prefix, r.PrefixMode, signing, state, r.CreatedAt,
+			orNone(r.ExpiresAt, "never"), orNone(r.LastUsedAt, "never"), orNone(r.LastUsedIP, "-"),
+			orNone(r.RotatedFrom, "-"), r.Scopes)
+	}
+}
+
+// orNone formats an optional column, or none when it is NULL.
+func orNone[T any](v *T, none string) string {
+	if v == nil {
+		return none
 	}
+	return fmt.Sprint(*v)
 }
 
 func revokeKey(args []string) {
@@ -162,5 +342,234 @@ func revokeKey(args []string) {
 		os.Exit(1)
 	}
 	fmt.Printf("client %d revoked\n", id)
-	fmt.Println("Takes effect on restart.")
+	fmt.Println("A running server drops it within a minute, or at once on SIGHUP.")
+}
+
+// prefixMode moves a client between observe and enforce. Switch a client to
+// enforce once the log has no PREFIX MISMATCH lines for it.
+func prefixMode(args []string) {
+	if len(args) < 2 || (args[1] != db.PrefixObserve && args[1] != db.PrefixEnforce) {
+		fmt.Printf("usage: external_payments -prefixmode <id> %s|%s    (see -listkeys)\n",
+			db.PrefixObserve, db.PrefixEnforce)
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("id must be a number: %v", err)
+	}
+	ok, err := db.SetAPIClientPrefixMode(id, args[1])
+	if err != nil {
+		log.Fatalf("prefix mode: %v", err)
+	}
+	if !ok {
+		fmt.Printf("no client with id %d\n", id)
+		os.Exit(1)
+	}
+	fmt.Printf("client %d prefix mode %s\n", id, args[1])
+	fmt.Println("A running server picks it up within a minute, or at once on SIGHUP.")
+}
+
+// signing makes a client sign its requests, or lets it send the bearer token
+// alone. Require it once the client's requests are all signed: from then on a
+// leaked token is not enough to call us. The client signs with the signing
+// key printed with its token.
+func signing(args []string) {
+	if len(args) < 2 || (args[1] != "required" && args[1] != "optional") {
+		fmt.Println("usage: external_payments -signing <id> required|optional    (see -listkeys)")
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("id must be a number: %v", err)
+	}
+	ok, err := db.SetAPIClientRequireSignature(id, args[1] == "required")
+	if err != nil {
+		log.Fatalf("signing: %v", err)
+	}
+	if !ok {
+		fmt.Printf("no client with id %d\n", id)
+		os.Exit(1)
+	}
+	fmt.Printf("client %d signing %s\n", id, args[1])
+	fmt.Println("A running server picks it up within a minute, or at once on SIGHUP.")
+}
+
+// callback sets the URL the client's webhooks go to, and prints the secret
+// they are signed with, the same each time for a client. It is the only way
+// to set a callback: a request cannot.
+func callback(args []string) {
+	if len(args) < 2 {
+		fmt.Println("usage: external_payments -callback <id> <url>|-    (see -listkeys)")
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("id must be a number: %v", err)
+	}
+	callbackURL := args[1]
+	if callbackURL == "-" {
+		callbackURL = ""
+	} else if u, err := url.Parse(callbackURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		fmt.Printf("callback must be an https URL, got %q\n", callbackURL)
+		os.Exit(2)
+	}
+	salt, ok, err := db.SetAPIClientCallbackURL(id, callbackURL)
+	if err != nil {
+		log.Fatalf("callback: %v", err)
+	}
+	if !ok {
+		fmt.Printf("no client with id %d\n", id)
+		os.Exit(1)
+	}
+	if callbackURL == "" {
+		fmt.Printf("client %d callback removed\n", id)
+	} else {
+		fmt.Printf("client %d callback %s\n", id, callbackURL)
+		if secret := db.WebhookSecret(salt); secret != "" {
+			fmt.Printf("webhook secret  %s\n", secret)
+		} else {
+			fmt.Println("webhook secret  none: CLIENT_SECRET_KEY is not set here")
+		}
+	}
+	fmt.Println("A running server picks it up within a minute, or at once on SIGHUP.")
+}
+
+// reconcileCommand reconciles the requests made between two dates and prints
+// what it found. A date alone takes in the whole of that day.
+func reconcileCommand(args []string) {
+	if len(args) < 2 || (len(args) > 2 && args[2] != "dry-run") {
+		fmt.Println("usage: external_payments -reconcile <from> <to> [dry-run]")
+		os.Exit(2)
+	}
+	from, err := parseDate(args[0], false)
+	if err != nil {
+		log.Fatalf("from: %v", err)
+	}
+	to, err := parseDate(args[1], true)
+	if err != nil {
+		log.Fatalf("to: %v", err)
+	}
+	fix := len(args) == 2
+
+	report, err := reconcile.Pelecard(organizations.Names(), from, to, fix)
+	if err != nil {
+		log.Fatalf("reconcile: %v", err)
+	}
+	printReport(report)
+	if report.Count(reconcile.Paid) > 0 {
+		if fix {
+			fmt.Println("* marked valid")
+		} else {
+			fmt.Println("dry run: nothing was changed")
+		}
+	}
+}
+
+// reconcilePaypal reports what PayPal did with our payments that we have no
+// record of. Nothing is changed.
+func reconcilePaypal(args []string) {
+	if len(args) != 2 {
+		fmt.Println("usage: external_payments -reconcilepaypal <from> <to>")
+		os.Exit(2)
+	}
+	from, err := parseDate(args[0], false)
+	if err != nil {
+		log.Fatalf("from: %v", err)
+	}
+	to, err := parseDate(args[1], true)
+	if err != nil {
+		log.Fatalf("to: %v", err)
+	}
+	report, err := reconcile.Paypal(context.Background(), from, to)
+	if err != nil {
+		log.Fatalf("reconcile: %v", err)
+	}
+	printReport(report)
+}
+
+func printReport(report reconcile.Report) {
+	fmt.Printf("%d requests, %d transactions, %s to %s\n",
+		report.Requests, report.Transactions, report.From.Format(time.DateTime), report.To.Format(time.DateTime))
+	if len(report.Findings) == 0 {
+		fmt.Println("nothing to report")
+		return
+	}
+	fmt.Printf("%-10s  %-10s  %-20s  %-10s  %10s  %10s  %-20s  %s\n",
+		"KIND", "STATUS", "REFERENCE", "TERMINAL", "AMOUNT", "GATEWAY", "TRANSACTION", "USER KEY")
+	for _, f := range report.Findings {
+		kind := string(f.Kind)
+		if f.Fixed {
+			kind += "*"
+		}
+		fmt.Printf("%-10s  %-10s  %-20s  %-10s  %10.2f  %10.2f  %-20s  %s\n",
+			kind, f.Status, f.Reference, f.Terminal, f.Amount, f.GatewayAmount, f.TransactionId, f.UserKey)
+	}
+}
+
+// settlementReport prints a day's settlement summary as JSON, or writes it to
+// an .xlsx file.
+func settlementReport(args []string) {
+	if len(args) < 2 || len(args) > 3 || args[0] != "daily" {
+		fmt.Println("usage: external_payments -report daily <date> [file.xlsx]")
+		os.Exit(2)
+	}
+	day, err := time.ParseInLocation(time.DateOnly, args[1], time.Local)
+	if err != nil {
+		log.Fatalf("date: %v", err)
+	}
+	report, err := settlement.Daily(day, types.RequestQuery{})
+	if err != nil {
+		log.Fatalf("report: %v", err)
+	}
+	if len(args) == 2 {
+		body, _ := json.Marshal(report, jsontext.WithIndent("  "))
+		fmt.Println(string(body))
+		return
+	}
+	f, err := os.Create(args[2])
+	if err != nil {
+		log.Fatalf("report: %v", err)
+	}
+	defer f.Close()
+	if err = report.WriteXlsx(f); err != nil {
+		log.Fatalf("report: %v", err)
+	}
+	fmt.Printf("%d groups written to %s\n", len(report.Groups), args[2])
+}
+
+// importRates stores the rates in an ECB or Bank of Israel file. Dates the
+// file has no dollar rate for are listed, since nothing converts through them.
+func importRates(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: external_payments -importrates <file.csv>")
+		os.Exit(2)
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("rates: %v", err)
+	}
+	defer f.Close()
+	parsed, skipped, err := rates.Parse(f)
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("no USD rate, skipped: %s\n", strings.Join(skipped, ", "))
+	}
+	if err = db.StoreRates(parsed); err != nil {
+		log.Fatalf("rates: %v", err)
+	}
+	fmt.Printf("%d rates stored\n", len(parsed))
+}
+
+// parseDate reads a date or a date and time in the server's zone. A date
+// alone is the start of that day, or with endOfDay the start of the next.
+func parseDate(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s, time.Local)
 }
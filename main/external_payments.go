@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
@@ -18,15 +19,19 @@ import (
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 
+	"external_payments/api"
 	"external_payments/counters"
 	"external_payments/db"
 	"external_payments/emv"
 	"external_payments/hmarket"
+	"external_payments/organizations"
 	"external_payments/payment"
 	paypalhandler "external_payments/paypal"
+	"external_payments/reconcile"
 	renewcard "external_payments/renew-card"
 	"external_payments/token"
 	"external_payments/utils"
+	"external_payments/webhooks"
 )
 
 func main() {
@@ -45,6 +50,13 @@ func main() {
 		port = ":8080"
 	}
 
+	// The organizations built in can be replaced without a release.
+	if path := os.Getenv("ORGANIZATIONS_FILE"); path != "" {
+		if err := organizations.Load(path); err != nil {
+			log.Fatalf("organizations: %v", err)
+		}
+	}
+
 	if len(os.Args) > 1 {
 		runCommand(os.Args[1:])
 		return
@@ -54,18 +66,26 @@ func main() {
 		_ = db.Connect()
 		defer db.Disconnect()
 
-		// Loaded once: the request path does no database work. Adding or
-		// revoking a key therefore needs a restart.
+		// Held in memory: the request path does no database work. The
+		// watcher re-reads the table, so a new or revoked key takes effect
+		// without a restart.
 		internal := os.Getenv("INTERNAL_API_TOKEN") != ""
-		n, err := db.LoadAPIClients()
+		loaded, err := db.LoadAPIClients()
 		switch {
 		case err != nil:
 			log.Printf("api clients: load failed (%v); internal token set: %t", err, internal)
-		case n == 0 && !internal:
+		case loaded.Total == 0 && !internal:
 			log.Printf("api clients: none and no internal token — required routes will reject every caller")
 		default:
-			log.Printf("api clients: %d loaded, internal token set: %t", n, internal)
+			log.Printf("api clients: %d loaded, internal token set: %t", loaded.Total, internal)
+		}
+		if os.Getenv("CLIENT_SECRET_KEY") == "" {
+			log.Printf("api clients: CLIENT_SECRET_KEY not set — signed requests will be refused")
 		}
+		watchAPIClients()
+		watchOrganizations()
+		webhooks.Start(context.Background())
+		reconcile.Start(context.Background(), organizations.Names())
 	}
 
 	r := gin.New()
@@ -82,6 +102,10 @@ func main() {
 }
 
 func router(r *gin.Engine, isProd bool) {
+	// One limiter across the charge routes: a caller's ceiling is on charging,
+	// not on each endpoint separately.
+	chargeLimiter := utils.NewChargeLimiter(utils.ChargeLimitsFromEnv())
+
 	// Request for payment
 	payments := r.Group("/payments")
 	{
@@ -97,7 +121,9 @@ func router(r *gin.Engine, isProd bool) {
 		// keyed on an enumerable approval number, with the organization chosen
 		// by the caller. 4priority, the only caller, posts.
 		payments.GET("/transaction", utils.Gone)
-		payments.POST("/transaction", utils.RequireAPIClient(), payment.GetTransaction)
+		payments.POST("/transaction", utils.RequireAPIClient(), utils.RequireScope(db.ScopeTransactionRead), payment.GetTransaction)
+		payments.GET("/export", utils.RequireAPIClient(), utils.RequireScope(db.ScopeTransactionRead), api.ExportPayments)
+		payments.GET("/report/daily", utils.RequireAPIClient(), utils.RequireScope(db.ScopeTransactionRead), api.DailyReport)
 	}
 	renew := r.Group("/renew")
 	{
@@ -122,13 +148,18 @@ func router(r *gin.Engine, isProd bool) {
 		withToken.GET("/charge", utils.Gone)
 		// Observe, not require: VH and the WooCommerce plugin call these and
 		// have not been issued keys yet. Read AUTH OBSERVE lines to find every
-		// caller, issue their keys, then switch to RequireAPIClient.
-		withToken.POST("/charge", utils.ObserveAPIClient(), token.Charge)
-		withToken.POST("/chargex", utils.ObserveAPIClient(), token.ChargeX)
-		withToken.POST("/refund", token.Refund)
-		// New endpoint with no legacy callers, so it skips the observe phase
+		// caller, issue their keys, then switch to RequireAPIClient. A caller
+		// that does present a key is still held to its scopes.
+		//
+		// Every charge endpoint is rate limited per caller, and honours an
+		// Idempotency-Key, so a caller can retry a charge whose answer it
+		// never got.
+		withToken.POST("/charge", utils.ObserveAPIClient(), utils.RequireScope(db.ScopeCharge), utils.RateLimit(chargeLimiter), utils.Idempotent(), token.Charge)
+		withToken.POST("/chargex", utils.ObserveAPIClient(), utils.RequireScope(db.ScopeCharge), utils.RateLimit(chargeLimiter), utils.Idempotent(), token.ChargeX)
+		// New endpoints with no legacy callers, so they skip the observe phase
 		// entirely: the caller arrives already holding a key.
-		withToken.POST("/muhlafim", utils.RequireAPIClient(), token.Muhlafim)
+		withToken.POST("/refund", utils.RequireAPIClient(), utils.RequireScope(db.ScopeRefund), token.Refund)
+		withToken.POST("/muhlafim", utils.RequireAPIClient(), utils.RequireScope(db.ScopeMuhlafimRead), token.Muhlafim)
 		// Retired: unauthenticated card-validity probes. Routed to Gone so any
 		// remaining caller is identified in the log; delete after 2026-09-16.
 		withToken.POST("/authorize", utils.Gone)
@@ -147,7 +178,7 @@ func router(r *gin.Engine, isProd bool) {
 		withEmv.POST("/confirm", emv.ConfirmPayment)
 		// GET retired — see /token/charge above.
 		withEmv.GET("/charge", utils.Gone)
-		withEmv.POST("/charge", utils.ObserveAPIClient(), emv.Charge)
+		withEmv.POST("/charge", utils.ObserveAPIClient(), utils.RequireScope(db.ScopeCharge), utils.RateLimit(chargeLimiter), utils.Idempotent(), emv.Charge)
 		withEmv.GET("/new_token", emv.NewToken)
 		withEmv.POST("/new_token", emv.NewToken)
 		withEmv.POST("/good_token", emv.GoodToken)
@@ -179,7 +210,20 @@ func router(r *gin.Engine, isProd bool) {
 		withPaypal.GET("/cancel", paypalhandler.CancelPayment)
 		withPaypal.GET("/confirm", paypalhandler.Confirm)
 		withPaypal.POST("/confirm", paypalhandler.Confirm)
-		withPaypal.POST("/charge", utils.ObserveAPIClient(), paypalhandler.Charge)
+		withPaypal.POST("/charge", utils.ObserveAPIClient(), utils.RequireScope(db.ScopeCharge), utils.RateLimit(chargeLimiter), utils.Idempotent(), paypalhandler.Charge)
+		withPaypal.POST("/refund", utils.RequireAPIClient(), utils.RequireScope(db.ScopeRefund), paypalhandler.Refund)
+	}
+
+	// Read-only: a client's own payments, from our records.
+	apiGroup := r.Group("/api", utils.RequireAPIClient(), utils.RequireScope(db.ScopeTransactionRead))
+	{
+		apiGroup.GET("/payments", api.ListPayments)
+		apiGroup.GET("/payments/:userKey", api.GetPayment)
+	}
+
+	internal := r.Group("/internal", utils.RequireInternal())
+	{
+		internal.POST("/reload-clients", reloadClients)
 	}
 
 	projects := r.Group("/projects/:language/:project_name")
@@ -191,6 +235,11 @@ func router(r *gin.Engine, isProd bool) {
 		projects.GET("/counter", counters.Counter)
 		projects.GET("/statistics", counters.Statistics)
 	}
+	// The JSON counters take the project name where the widgets take the
+	// language. Gin wants one name for a wildcard in that position, so the
+	// routes call it :language and hand it over as project_name.
+	r.GET("/projects/:language/counter.json", projectParam, counters.CounterJSON)
+	r.GET("/projects/:language/statistics.json", projectParam, counters.StatisticsJSON)
 	r.Static("/assets", "./assets")
 
 	//for _, route := range r.Routes() {
@@ -198,6 +247,10 @@ func router(r *gin.Engine, isProd bool) {
 	//}
 }
 
+func projectParam(c *gin.Context) {
+	c.AddParam("project_name", c.Param("language"))
+}
+
 func formatAmount(number float64) string {
 	p := message.NewPrinter(language.English)
 	return p.Sprintf("%.0f", number)
@@ -223,8 +276,8 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Max-Age", "86400")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-None-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length, ETag")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if c.Request.Method == "OPTIONS" {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/organizations"
+	"external_payments/utils"
+)
+
+// defaultReloadInterval is how often API clients are re-read when
+// API_CLIENTS_RELOAD_INTERVAL is not set. A revoked key stops working within
+// this long.
+const defaultReloadInterval = time.Minute
+
+// reloadAPIClients re-reads the client table and logs what changed. A failed
+// reload keeps the clients already loaded: a database hiccup must not lock
+// every caller out.
+func reloadAPIClients(reason string) (db.APIClientChanges, error) {
+	changes, err := db.LoadAPIClients()
+	if err != nil {
+		log.Printf("api clients: reload on %s failed, keeping %d loaded: %v", reason, db.APIClientCount(), err)
+		return changes, err
+	}
+	if changes.Added > 0 || changes.Removed > 0 || changes.Changed > 0 || reason != "timer" {
+		log.Printf("api clients: reloaded on %s: %d loaded, %d added, %d removed, %d changed",
+			reason, changes.Total, changes.Added, changes.Removed, changes.Changed)
+	}
+	return changes, nil
+}
+
+// watchAPIClients reloads clients every API_CLIENTS_RELOAD_INTERVAL and on
+// SIGHUP. An interval of 0 turns the timer off; SIGHUP still works.
+func watchAPIClients() {
+	interval := defaultReloadInterval
+	if v := os.Getenv("API_CLIENTS_RELOAD_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("api clients: API_CLIENTS_RELOAD_INTERVAL=%q is not a duration, using %s", v, interval)
+		} else {
+			interval = d
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-tick:
+				_, _ = reloadAPIClients("timer")
+			case <-hup:
+				_, _ = reloadAPIClients("SIGHUP")
+			}
+		}
+	}()
+}
+
+// reloadClients is the internal endpoint behind POST /internal/reload-clients,
+// for a deploy script or an operator who revoked a key and cannot wait.
+func reloadClients(c *gin.Context) {
+	changes, err := reloadAPIClients("request")
+	if err != nil {
+		utils.ErrorJson(http.StatusInternalServerError, "reload api clients: "+err.Error(), c)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"loaded":  changes.Total,
+		"added":   changes.Added,
+		"removed": changes.Removed,
+		"changed": changes.Changed,
+	})
+}
+
+// watchOrganizations re-reads ORGANIZATIONS_FILE when it changes and on
+// SIGHUP, so installment terms and branding change without a deploy. A file
+// that does not load keeps the registry already loaded.
+func watchOrganizations() {
+	path := os.Getenv("ORGANIZATIONS_FILE")
+	if path == "" {
+		return
+	}
+	modified := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	reload := func(reason string) {
+		if err := organizations.Load(path); err != nil {
+			log.Printf("organizations: reload on %s failed, keeping %v: %v", reason, organizations.Names(), err)
+			return
+		}
+		log.Printf("organizations: reloaded on %s: %v", reason, organizations.Names())
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(defaultReloadInterval).C
+	loaded := modified()
+
+	go func() {
+		for {
+			select {
+			case <-tick:
+				if m := modified(); !m.Equal(loaded) {
+					loaded = m
+					reload("change")
+				}
+			case <-hup:
+				loaded = modified()
+				reload("SIGHUP")
+			}
+		}
+	}()
+}
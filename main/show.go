@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json/v2"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+
+	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/types"
+)
+
+// show prints what was recorded for a UserKey, or for every UserKey that paid
+// a reference. Card and personal data are redacted as they are in the log.
+func show(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: external_payments -show <userKey|reference>")
+		os.Exit(2)
+	}
+	userKeys, err := db.FindUserKeys(args[0])
+	if err != nil {
+		log.Fatalf("show: %v", err)
+	}
+	if len(userKeys) == 0 {
+		fmt.Printf("no request with user key or reference %q\n", args[0])
+		os.Exit(1)
+	}
+	for i, userKey := range userKeys {
+		if i > 0 {
+			fmt.Println()
+		}
+		trail, err := db.LoadTrail(userKey)
+		if err != nil {
+			log.Fatalf("show %s: %v", userKey, err)
+		}
+		printTrail(userKey, trail)
+	}
+}
+
+func printTrail(userKey string, t db.Trail) {
+	fmt.Printf("== %s\n", userKey)
+	for _, r := range t.Requests {
+		fmt.Printf("%-19s  request   %v\n", r.CreatedAt, r)
+	}
+	for _, c := range t.Callbacks {
+		fmt.Printf("%-19s  callback  %v\n", "", c)
+	}
+	for _, r := range t.Responses {
+		fmt.Printf("%-19s  response  %v\n", "", r)
+	}
+	for _, p := range t.Captures {
+		fmt.Printf("%-19s  paypal    %v\n", p.PaymentDate, p)
+	}
+	for _, r := range t.Refunds {
+		fmt.Printf("%-19s  refund    %s %s %.2f %s %s %s %s\n",
+			"", r.Gateway, r.TransactionId, r.Amount, r.Currency, r.Status, r.RefundId, r.Error)
+	}
+	for _, h := range t.History {
+		fmt.Printf("%-19s  status    %s → %s  %s: %s\n", h.CreatedAt, h.From, h.To, h.Actor, h.Reason)
+	}
+}
+
+// setStatus puts a request in a status by hand, whatever it is in now. It is
+// recorded in the request's history under the operator's name.
+func setStatus(args []string) {
+	if len(args) != 3 || strings.TrimSpace(args[2]) == "" {
+		fmt.Println("usage: external_payments -setstatus <userKey> <status> <reason>")
+		fmt.Printf("status is one of: %s\n", strings.Join(statusNames(), ", "))
+		os.Exit(2)
+	}
+	userKey, to, reason := args[0], db.Status(args[1]), args[2]
+	if !slices.Contains(db.Statuses, to) {
+		fmt.Printf("unknown status %q — expected one of: %s\n", to, strings.Join(statusNames(), ", "))
+		os.Exit(2)
+	}
+	from, err := db.GetStatus(userKey)
+	if err != nil {
+		fmt.Printf("no request with user key %q\n", userKey)
+		os.Exit(1)
+	}
+	actor := operator()
+	if err = db.ForceStatus(userKey, to, actor, reason); err != nil {
+		log.Fatalf("setstatus: %v", err)
+	}
+	log.Printf("setstatus: %s %s → %s by %s: %s", userKey, from, to, actor, reason)
+	if !db.CanTransition(db.Status(from), to) && db.Status(from) != to {
+		fmt.Printf("note: %s → %s is not a move a payment makes by itself\n", from, to)
+	}
+	fmt.Printf("%s %s → %s\n", userKey, from, to)
+}
+
+func statusNames() (names []string) {
+	for _, s := range db.Statuses {
+		names = append(names, string(s))
+	}
+	return
+}
+
+// operator names whoever runs the command, for the history.
+func operator() string {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return "operator:" + name
+}
+
+// requery asks Pelecard for the transaction a request recorded, and prints
+// its answer. Nothing is changed: if Pelecard approved a payment we did not
+// mark valid, -setstatus does that.
+func requery(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: external_payments -requery <userKey>")
+		os.Exit(2)
+	}
+	userKey := args[0]
+	trail, err := db.LoadTrail(userKey)
+	if err != nil {
+		log.Fatalf("requery: %v", err)
+	}
+	if len(trail.Requests) == 0 {
+		fmt.Printf("no request with user key %q\n", userKey)
+		os.Exit(1)
+	}
+	request := trail.Requests[len(trail.Requests)-1]
+	id := transactionId(trail)
+	if id == "" {
+		fmt.Printf("%s has no Pelecard transaction recorded; see -reconcile\n", userKey)
+		os.Exit(1)
+	}
+
+	// Ask the terminal the request was charged on; requests from before the
+	// terminal was recorded do not say, so ask each.
+	terminals := []gateway.Terminal{gateway.Regular, gateway.PreEMV, gateway.Recurrent}
+	if request.Terminal != "" {
+		terminals = slices.DeleteFunc(terminals, func(t gateway.Terminal) bool { return t.String() != request.Terminal })
+		if len(terminals) == 0 {
+			fmt.Printf("%s was charged on unknown terminal %q\n", userKey, request.Terminal)
+			os.Exit(1)
+		}
+	}
+	ctx := context.Background()
+	var lastErr error
+	for _, terminal := range terminals {
+		provider, err := gateway.NewPelecard(request.Organization, terminal)
+		if err != nil {
+			continue
+		}
+		result, err := provider.Transaction(ctx, id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var response types.PaymentResponse
+		body, _ := json.Marshal(result.Data)
+		_ = json.Unmarshal(body, &response)
+		fmt.Printf("%s on the %s terminal: %v\n", id, terminal, response)
+		fmt.Printf("request status %s\n", request.Status)
+		if request.Status == string(db.StatusNew) || request.Status == string(db.StatusInProcess) {
+			fmt.Printf("Pelecard has it; to mark it paid:\n  external_payments -setstatus %s valid \"<reason>\"\n", userKey)
+		}
+		log.Printf("requery: %s by %s: found %s on the %s terminal", userKey, operator(), id, terminal)
+		return
+	}
+	fmt.Printf("Pelecard does not have %s: %v\n", id, lastErr)
+	os.Exit(1)
+}
+
+// transactionId is the Pelecard transaction a request recorded: from the
+// stored response, else from the callback.
+func transactionId(t db.Trail) string {
+	for _, r := range slices.Backward(t.Responses) {
+		if r.TransactionId != "" {
+			return r.TransactionId
+		}
+		if r.TransactionPelecardId != "" {
+			return r.TransactionPelecardId
+		}
+	}
+	for _, c := range slices.Backward(t.Callbacks) {
+		if c.PelecardTransactionId != "" {
+			return c.PelecardTransactionId
+		}
+	}
+	return ""
+}
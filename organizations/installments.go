@@ -0,0 +1,114 @@
+package organizations
+
+import (
+	"strings"
+
+	"external_payments/currency"
+)
+
+// Installments is an organization's installment policy: its Terms, unless
+// one of its Rules matches the payment. The first rule that matches is used,
+// and its terms replace the organization's rather than adding to them.
+type Installments struct {
+	Terms `json:",inline"`
+	Rules []InstallmentRule `json:"rules"`
+}
+
+// Terms are the installments a payment page offers. Max, when set, is the
+// limit whatever the amount. Otherwise an amount below SingleBelow is paid at
+// once, and above it the limit is Base plus one payment per Step, up to Cap.
+// Amounts are in whole shekels, dollars or euros.
+type Terms struct {
+	Min         int `json:"min"`
+	Max         int `json:"max"`
+	SingleBelow int `json:"single_below"`
+	Step        int `json:"step"`
+	Base        int `json:"base"`
+	Cap         int `json:"cap"`
+	// FirstPayment fixes the first payment; the rest of the amount is split
+	// evenly over the others. 0 splits the whole amount evenly.
+	FirstPayment float64 `json:"first_payment"`
+	// CreditFrom is the number of payments from which Pelecard makes the deal
+	// a credit deal, paid to us at once and financed by the card company.
+	// 0 offers no credit deal.
+	CreditFrom int `json:"credit_from"`
+}
+
+// InstallmentRule gives other terms to the payments it matches. A field left
+// empty matches anything. SKU ending in * matches by prefix; Below is the
+// first amount the rule no longer matches.
+type InstallmentRule struct {
+	Currency string  `json:"currency"`
+	SKU      string  `json:"sku"`
+	From     float64 `json:"from"`
+	Below    float64 `json:"below"`
+	Terms    `json:",inline"`
+}
+
+// Plan is what a payment page offers: between MinPayments and MaxPayments
+// payments, with FirstPayment as the first when it is not 0, and a credit
+// deal from CreditFrom payments when that is not 0.
+type Plan struct {
+	MinPayments  int
+	MaxPayments  int
+	FirstPayment float64
+	CreditFrom   int
+}
+
+// Plan decides the installments for a payment of amount in a currency.
+func (i Installments) Plan(code string, amount float64, sku string) Plan {
+	terms := i.Terms
+	for _, r := range i.Rules {
+		if r.matches(code, amount, sku) {
+			terms = r.Terms
+			break
+		}
+	}
+	return terms.plan(amount)
+}
+
+func (r InstallmentRule) matches(code string, amount float64, sku string) bool {
+	if r.Currency != "" && currency.Normalize(r.Currency) != currency.Normalize(code) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(r.SKU, "*"); ok {
+		if !strings.HasPrefix(sku, prefix) {
+			return false
+		}
+	} else if r.SKU != "" && r.SKU != sku {
+		return false
+	}
+	if amount < r.From {
+		return false
+	}
+	return r.Below == 0 || amount < r.Below
+}
+
+// MaxPayments is the most payments amount may be split into.
+func (t Terms) MaxPayments(amount float64) int {
+	if t.Max > 0 {
+		return t.Max
+	}
+	units := int(amount)
+	if units < t.SingleBelow || t.Step <= 0 {
+		return 1
+	}
+	n := units/t.Step + t.Base
+	if t.Cap > 0 && n > t.Cap {
+		n = t.Cap
+	}
+	return max(n, 1)
+}
+
+func (t Terms) plan(amount float64) Plan {
+	p := Plan{MaxPayments: t.MaxPayments(amount)}
+	p.MinPayments = min(max(t.Min, 1), p.MaxPayments)
+	// A first payment that is the whole amount leaves nothing to split.
+	if t.FirstPayment > 0 && t.FirstPayment < amount && p.MaxPayments > 1 {
+		p.FirstPayment = t.FirstPayment
+	}
+	if t.CreditFrom > 0 && t.CreditFrom <= p.MaxPayments {
+		p.CreditFrom = t.CreditFrom
+	}
+	return p
+}
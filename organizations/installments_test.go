@@ -0,0 +1,42 @@
+package organizations
+
+import "testing"
+
+func TestPlan(t *testing.T) {
+	policy := Installments{
+		Terms: Terms{Max: 1},
+		Rules: []InstallmentRule{
+			{Currency: "ILS", SKU: "course-*", From: 1000, Terms: Terms{Min: 2, Max: 12, FirstPayment: 300, CreditFrom: 7}},
+			{Currency: "USD", Below: 50, Terms: Terms{Max: 1}},
+			{Currency: "USD", Terms: Terms{Max: 3, FirstPayment: 100}},
+		},
+	}
+	cases := []struct {
+		name     string
+		currency string
+		amount   float64
+		sku      string
+		want     Plan
+	}{
+		{"no rule", "EUR", 5000, "book", Plan{MinPayments: 1, MaxPayments: 1}},
+		{"NIS is ILS", "NIS", 2000, "course-kab", Plan{MinPayments: 2, MaxPayments: 12, FirstPayment: 300, CreditFrom: 7}},
+		{"sku prefix", "ILS", 2000, "book", Plan{MinPayments: 1, MaxPayments: 1}},
+		{"below from", "ILS", 999.99, "course-kab", Plan{MinPayments: 1, MaxPayments: 1}},
+		{"first rule that matches", "USD", 49.99, "book", Plan{MinPayments: 1, MaxPayments: 1}},
+		{"first payment is the whole amount", "USD", 50, "book", Plan{MinPayments: 1, MaxPayments: 3}},
+		{"first payment", "USD", 300, "book", Plan{MinPayments: 1, MaxPayments: 3, FirstPayment: 100}},
+	}
+	for _, c := range cases {
+		if got := policy.Plan(c.currency, c.amount, c.sku); got != c.want {
+			t.Errorf("%s: %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPlanTerms(t *testing.T) {
+	// Credit past the limit, or a minimum above it, is never offered.
+	got := Installments{Terms: Terms{Min: 5, Max: 3, CreditFrom: 4}}.Plan("ILS", 1000, "")
+	if want := (Plan{MinPayments: 3, MaxPayments: 3}); got != want {
+		t.Errorf("%+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+// Package organizations is the registry of the organizations we take payments
+// for: where their Pelecard credentials are, which terminals they use, how
+// their payment pages look in each language and how many installments they
+// offer. The registry built into the binary is organizations.json; a
+// deployment may replace it with its own file, so onboarding an organization
+// is a configuration change.
+package organizations
+
+import (
+	_ "embed"
+	"encoding/json/v2"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+//go:embed organizations.json
+var builtin []byte
+
+// Flow is a hosted-page flow, for captions that differ between them: the
+// submit button saves a card on new_token, and pays on payment.
+type Flow string
+
+const (
+	FlowPayment  Flow = "payment"
+	FlowToken    Flow = "token"
+	FlowEmv      Flow = "emv"
+	FlowNewToken Flow = "new_token"
+	FlowRenew    Flow = "renew"
+)
+
+// Organization is one organization's entry in the registry.
+type Organization struct {
+	Name string `json:"-"`
+	// EnvPrefix is the prefix of the organization's Pelecard variables,
+	// <prefix>_PELECARD_USER and so on. It is the name if not given.
+	EnvPrefix string `json:"env_prefix"`
+	// Terminals are the Pelecard terminals the organization has, as
+	// gateway.Terminal names them: regular, pre-EMV and recurrent.
+	Terminals []string `json:"terminals"`
+	// Logo is shown on the payment page unless the language has its own.
+	Logo string `json:"logo"`
+	// Branding is keyed by the request's language; the "" entry is used for
+	// a language that has none.
+	Branding     map[string]Branding `json:"branding"`
+	Installments Installments        `json:"installments"`
+}
+
+// Branding is how the payment page looks in one language.
+type Branding struct {
+	// PageLanguage is the language Pelecard draws the page in, when it is not
+	// the request's own: Pelecard has no Spanish page, so ES is drawn in
+	// English with Spanish captions.
+	PageLanguage string            `json:"page_language"`
+	Logo         string            `json:"logo"`
+	TopText      string            `json:"top_text"`
+	BottomText   string            `json:"bottom_text"`
+	Captions     map[string]string `json:"captions"`
+	// FlowCaptions override Captions on one flow.
+	FlowCaptions map[Flow]map[string]string `json:"flow_captions"`
+}
+
+// BrandingFor returns the page's look for a language on a flow: the language's
+// entry, or the default one, with the flow's captions over the language's.
+// The logo falls back to the organization's.
+func (o Organization) BrandingFor(language string, flow Flow) Branding {
+	b, ok := o.Branding[language]
+	if !ok {
+		b = o.Branding[""]
+	}
+	if b.Logo == "" {
+		b.Logo = o.Logo
+	}
+	captions := maps.Clone(b.Captions)
+	if overrides := b.FlowCaptions[flow]; len(overrides) > 0 {
+		if captions == nil {
+			captions = map[string]string{}
+		}
+		maps.Copy(captions, overrides)
+	}
+	b.Captions, b.FlowCaptions = captions, nil
+	return b
+}
+
+// HasTerminal reports whether the organization uses a terminal.
+func (o Organization) HasTerminal(terminal string) bool {
+	return slices.Contains(o.Terminals, terminal)
+}
+
+var registry atomic.Pointer[map[string]Organization]
+
+func init() {
+	orgs, err := parse(builtin)
+	if err != nil {
+		panic("organizations.json: " + err.Error())
+	}
+	registry.Store(&orgs)
+}
+
+// Load replaces the registry with the file at path. The registry is left as
+// it was if the file cannot be read or has no organizations.
+func Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	orgs, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	registry.Store(&orgs)
+	return nil
+}
+
+func parse(data []byte) (map[string]Organization, error) {
+	var orgs map[string]Organization
+	if err := json.Unmarshal(data, &orgs, json.RejectUnknownMembers(true)); err != nil {
+		return nil, err
+	}
+	if len(orgs) == 0 {
+		return nil, fmt.Errorf("no organizations")
+	}
+	for name, o := range orgs {
+		o.Name = name
+		if o.EnvPrefix == "" {
+			o.EnvPrefix = name
+		}
+		orgs[name] = o
+	}
+	return orgs, nil
+}
+
+// Get returns an organization by name.
+func Get(name string) (Organization, bool) {
+	o, ok := (*registry.Load())[name]
+	return o, ok
+}
+
+// Known reports whether name is a registered organization.
+func Known(name string) bool {
+	_, ok := Get(name)
+	return ok
+}
+
+// Names are the registered organizations, sorted.
+func Names() []string {
+	return slices.Sorted(maps.Keys(*registry.Load()))
+}
+
+// EnvPrefix is the prefix of an organization's Pelecard variables. An
+// organization that is not registered is its own prefix.
+func EnvPrefix(name string) string {
+	if o, ok := Get(name); ok {
+		return o.EnvPrefix
+	}
+	return name
+}
@@ -0,0 +1,91 @@
+package organizations
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBuiltin(t *testing.T) {
+	if got := Names(); !slices.Equal(got, []string{"ben2", "meshp18"}) {
+		t.Fatalf("names %v", got)
+	}
+	for _, name := range Names() {
+		o, _ := Get(name)
+		if o.EnvPrefix != name || len(o.Terminals) != 3 || o.Branding[""].TopText == "" {
+			t.Errorf("%s: %+v", name, o)
+		}
+	}
+	if Known("acme") || EnvPrefix("acme") != "acme" {
+		t.Error("unregistered organization")
+	}
+}
+
+func TestBrandingFor(t *testing.T) {
+	ben2, _ := Get("ben2")
+
+	b := ben2.BrandingFor("FR", FlowPayment)
+	if b.PageLanguage != "EN" || b.TopText != "BB Credit Cards" || b.Logo != ben2.Logo || b.Captions != nil {
+		t.Errorf("default %+v", b)
+	}
+	if b = ben2.BrandingFor("RU", FlowPayment); b.Logo != "https://checkout.kabbalah.info/kabRu.jpeg" {
+		t.Errorf("RU logo %q", b.Logo)
+	}
+
+	// The flow's captions go over the language's, without changing them for
+	// other flows.
+	es := ben2.BrandingFor("ES", FlowNewToken)
+	if es.Captions["cs_submit"] != "Ahorrar" || es.Captions["cs_cancel"] != "Cancelar" {
+		t.Errorf("ES new_token captions %v", es.Captions)
+	}
+	if es = ben2.BrandingFor("ES", FlowPayment); es.Captions["cs_submit"] != "Pagar ahora" {
+		t.Errorf("ES payment captions %v", es.Captions)
+	}
+	if he := ben2.BrandingFor("HE", FlowRenew); he.Captions["cs_submit"] != "Renew" || he.PageLanguage != "" {
+		t.Errorf("HE renew %+v", he)
+	}
+}
+
+func TestMaxPayments(t *testing.T) {
+	ben2, _ := Get("ben2")
+	meshp18, _ := Get("meshp18")
+
+	cases := []struct {
+		o      Organization
+		amount float64
+		want   int
+	}{
+		{ben2, 5000, 1},
+		{meshp18, 99.99, 1},
+		{meshp18, 100, 2},
+		{meshp18, 1500, 5},
+		{meshp18, 100000, 10},
+	}
+	for _, c := range cases {
+		if got := c.o.Installments.MaxPayments(c.amount); got != c.want {
+			t.Errorf("%s %.2f: %d, want %d", c.o.Name, c.amount, got, c.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	saved := registry.Load()
+	t.Cleanup(func() { registry.Store(saved) })
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "organizations.json")
+	os.WriteFile(path, []byte(`{"acme": {"env_prefix": "ACME", "terminals": ["regular"]}}`), 0o600)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !Known("acme") || Known("ben2") || EnvPrefix("acme") != "ACME" {
+		t.Errorf("loaded %v", Names())
+	}
+
+	// A file with a typo is refused, and the registry kept.
+	os.WriteFile(path, []byte(`{"acme": {"terminal": ["regular"]}}`), 0o600)
+	if err := Load(path); err == nil || !Known("acme") {
+		t.Errorf("bad file: %v, names %v", err, Names())
+	}
+}
@@ -3,7 +3,6 @@ package payment
 import (
 	"encoding/json/v2"
 	"fmt"
-	"math"
 	"net/http"
 	"strings"
 
@@ -11,12 +10,18 @@ import (
 	"github.com/google/go-querystring/query"
 
 	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/organizations"
 	"external_payments/pelecard"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
 )
 
+// pelecardProvider opens a Pelecard terminal. Tests swap it for a fake, so a
+// handler runs without Pelecard.
+var pelecardProvider = gateway.NewPelecard
+
 func ConfirmPayment(c *gin.Context) {
 	var err error
 	request := types.ConfirmRequest{}
@@ -46,6 +51,7 @@ func GetTransaction(c *gin.Context) {
 			return
 		}
 	}
+	request.Organization = utils.ResolveOrganization(c, request.Organization)
 	c.Status(http.StatusOK)
 	card := &pelecard.PeleCard{}
 	if err = card.Init(request.Organization, types.Regular, true); err != nil {
@@ -57,6 +63,13 @@ func GetTransaction(c *gin.Context) {
 		OnError(http.StatusBadGateway, "GetTransactionData "+err.Error(), c)
 		return
 	}
+	// The reference is only known once the transaction is found: a caller
+	// may look up its own payments, not another site's.
+	reference, _ := msg["AdditionalDetailsParamX"].(string)
+	if err = utils.CheckPrefix(c, reference); err != nil {
+		OnError(http.StatusForbidden, "GetTransactionData "+err.Error(), c)
+		return
+	}
 
 	body, _ := json.Marshal(msg)
 	c.Writer.WriteHeader(http.StatusOK)
@@ -84,104 +97,44 @@ func NewPayment(c *gin.Context) {
 		return
 	}
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
 	baseUrl := utils.BaseUrl()
 	goodUrl := baseUrl + "/payments/good"
 	errorUrl := baseUrl + "/payments/error"
 	cancelUrl := baseUrl + "/payments/cancel"
 
-	total := int(math.Round(request.Price * 100))
-
 	// Request Pelecard
-	card := &pelecard.PeleCard{
+	page := gateway.Page{
+		Action:      types.Charge,
+		RequireCVV:  true,
 		Language:    request.Language,
 		UserKey:     request.UserKey,
-		ParamX:      request.Reference,
-		GoodUrl:     goodUrl,
-		ErrorUrl:    errorUrl,
-		CancelUrl:   cancelUrl,
-		Total:       total,
-		Currency:    currency,
+		Reference:   request.Reference,
+		GoodURL:     goodUrl,
+		ErrorURL:    errorUrl,
+		CancelURL:   cancelUrl,
+		Amount:      request.Price,
+		Currency:    request.Currency,
 		MaxPayments: request.Installments,
 	}
-	if request.Organization == "ben2" {
-		card.LogoUrl = "https://checkout.kabbalah.info/logo1.png"
-		card.MinPayments = 1
-		card.MaxPayments = 1
-		if request.Language == "HE" {
-			card.TopText = "BB כרטיסי אשראי"
-			card.BottomText = "© בני ברוך קבלה לעם"
-		} else if request.Language == "RU" {
-			card.LogoUrl = "https://checkout.kabbalah.info/kabRu.jpeg"
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else if request.Language == "ES" {
-			card.TopText = "Bnei Baruch Kabbalah laAm"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.Language = "EN"
-			card.LogoUrl = "https://cabalacentroestudios.com/wp-content/uploads/2020/04/BB_logo_es.jpg"
-			card.CaptionSet = make(map[string]string)
-			card.CaptionSet["cs_header_payment"] = "Pago con tarjeta de crédito"
-			card.CaptionSet["cs_header_registeration"] = "Registro con tarjeta de crédito"
-			card.CaptionSet["cs_holdername"] = "Nombre en la tarjeta"
-			card.CaptionSet["cs_cardnumber"] = "Número de tarjeta de crédito"
-			card.CaptionSet["cs_expiration"] = "Fecha de expiración"
-			card.CaptionSet["cs_id"] = "Pasaporte"
-			card.CaptionSet["cs_cvv"] = "CW"
-			card.CaptionSet["cs_payments"] = "Número de pagos"
-			card.CaptionSet["cs_xparam"] = "Detalles adicionales"
-			card.CaptionSet["cs_total"] = "Total"
-			card.CaptionSet["cs_supported_cards"] = "Tarjetas aceptadas como pago en este sitio web"
-			card.CaptionSet["cs_mustfields"] = "Campos obligatorios"
-			card.CaptionSet["cs_submit"] = "Pagar ahora"
-			card.CaptionSet["cs_cancel"] = "Cancelar"
-		} else {
-			card.Language = "EN"
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-	} else if request.Organization == "meshp18" {
-		if request.Language == "HE" {
-			card.TopText = "משפחה בחיבור כרטיסי אשראי"
-			card.BottomText = "© משפחה בחיבור"
-		} else if request.Language == "RU" {
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else {
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-		card.MinPayments = 1
-		total = total / 100
-		if total < 100 {
-			card.MaxPayments = 1
-		} else {
-			card.MaxPayments = total/500 + 2
-		}
-		if card.MaxPayments > 10 {
-			card.MaxPayments = 10
-		}
-		card.LogoUrl = "https://www.1family.co.il/wp-content/uploads/2019/06/cropped-Screen-Shot-2019-06-16-at-00.12.07-140x82.png"
-	} else {
+	org, ok := organizations.Get(request.Organization)
+	if !ok {
 		OnError(http.StatusBadRequest, "Unknown Organization", c)
 		return
 	}
+	page.Brand(org.BrandingFor(request.Language, organizations.FlowPayment))
+	page.Offer(org.Installments.Plan(request.Currency, request.Price, request.SKU))
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Regular)
+	if err != nil {
 		OnError(http.StatusBadGateway, "Init"+err.Error(), c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Regular.String())
 
-	if err, url := card.GetRedirectUrl(types.Charge, true); err != nil {
+	if redirect, err := provider.HostedPage(c.Request.Context(), page); err != nil {
 		OnError(http.StatusBadGateway, "GetRedirectUrl"+err.Error(), c)
 	} else {
-		OnRedirect(url, "", c)
+		OnRedirect(redirect.URL, "", c)
 	}
 }
 
@@ -200,16 +153,19 @@ func GoodPayment(c *gin.Context) {
 
 	form := loadPeleCardForm(c)
 
-	if status, _ := db.GetStatus(form.UserKey); status == "valid" || status == "in-process" {
-		m := fmt.Sprintf("Good Payment: duplicate callback ignored (status=%s) userKey=%s txId=%s", status, form.UserKey, form.PelecardTransactionId)
-		utils.LogMessage(m)
-		c.Writer.WriteHeader(http.StatusOK)
+	if form.PelecardStatusCode != "000" {
+		OnError(http.StatusBadGateway, "Pelecard error: "+form.PelecardStatusCode+" "+pelecard.GetMessage(form.PelecardStatusCode), c)
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "declined "+form.PelecardStatusCode)
 		return
 	}
 
-	if form.PelecardStatusCode != "000" {
-		OnError(http.StatusBadGateway, "Pelecard error: "+form.PelecardStatusCode+" "+pelecard.GetMessage(form.PelecardStatusCode), c)
-		db.SetStatus(form.UserKey, "invalid")
+	if !db.ClaimProcessing(form.UserKey, "pelecard callback") {
+		utils.LogMessage(fmt.Sprintf("Good Payment: duplicate callback suppressed userKey=%s txId=%s", form.UserKey, form.PelecardTransactionId))
+		if goodURL, v, ok := utils.DuplicateCallback(form.UserKey); ok {
+			OnSuccess(goodURL, v.Encode(), c)
+			return
+		}
+		OnError(http.StatusOK, "duplicate callback", c)
 		return
 	}
 
@@ -217,8 +173,6 @@ func GoodPayment(c *gin.Context) {
 		OnError(http.StatusInternalServerError, "UpdateRequestTemp: "+err.Error(), c)
 		return
 	}
-
-	db.SetStatus(form.UserKey, "in-process")
 	// civicrm_bb_ext_requests
 	org, err := db.GetOrganization(form.UserKey)
 	if err != nil {
@@ -227,20 +181,21 @@ func GoodPayment(c *gin.Context) {
 	}
 
 	// approve params
-	card := &pelecard.PeleCard{}
-	if err := card.Init(org, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(org, gateway.Regular)
+	if err != nil {
 		OnError(http.StatusBadGateway, "Init"+err.Error(), c)
 		return
 	}
 
-	var msg map[string]any
-	if err, msg = card.GetTransaction(form.PelecardTransactionId); err != nil {
+	ctx := c.Request.Context()
+	transaction, err := provider.Transaction(ctx, form.PelecardTransactionId)
+	if err != nil {
 		OnError(http.StatusBadGateway, "GetTransaction "+err.Error(), c)
 		return
 	}
 
 	var response = types.PaymentResponse{}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(transaction.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = form.UserKey
 	// update DB
@@ -255,27 +210,25 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	if err := card.Init(request.Organization, types.Regular, true); err != nil {
-		OnError(http.StatusBadGateway, "Init "+err.Error(), c)
-		return
-	}
-	card.ConfirmationKey = form.ConfirmationKey
-	card.UserKey = request.UserKey
-	card.TotalX100 = fmt.Sprintf("%d", int(math.Round(request.Price*100)))
 	var valid bool
-	if valid, err = card.ValidateByUniqueKey(); err != nil {
-		db.SetStatus(form.UserKey, "invalid")
+	if valid, err = provider.Validate(ctx, gateway.Validation{
+		UserKey:         request.UserKey,
+		ConfirmationKey: form.ConfirmationKey,
+		Amount:          request.Price,
+		Currency:        request.Currency,
+	}); err != nil {
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "validation failed")
 		OnError(http.StatusBadGateway, "ValidateByUniqueKey "+err.Error(), c)
 		return
 	}
 	if !valid {
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "not confirmed")
 		OnError(http.StatusBadGateway, "Confirmation error ", c)
 		return
 	}
 
 	// redirect to GoodURL
-	db.SetStatus(form.UserKey, "valid")
+	db.Transition(form.UserKey, db.StatusValid, "pelecard callback", "confirmed")
 	v, _ := query.Values(response)
 	OnSuccess(request.GoodURL, v.Encode(), c)
 }
@@ -284,7 +237,7 @@ func ErrorPayment(c *gin.Context) {
 	var err error
 
 	form := loadPeleCardForm(c)
-	db.SetStatus(form.UserKey, "error")
+	db.Transition(form.UserKey, db.StatusError, "pelecard callback", "error "+form.PelecardStatusCode)
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		OnError(http.StatusInternalServerError, err.Error(), c)
 		return
@@ -302,7 +255,7 @@ func CancelPayment(c *gin.Context) {
 	var err error
 
 	form := loadPeleCardForm(c)
-	db.SetStatus(form.UserKey, "cancel")
+	db.Transition(form.UserKey, db.StatusCancel, "pelecard callback", "cancelled by payer")
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		OnError(http.StatusInternalServerError, err.Error(), c)
 		return
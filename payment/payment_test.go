@@ -0,0 +1,203 @@
+package payment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/pelecard/pelecardtest"
+	"external_payments/types"
+)
+
+const baseUrl = "https://ext.test"
+
+func newEngine(t *testing.T) (*gin.Engine, *pelecardtest.Server, *dbtest.Store) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	server := pelecardtest.New(t)
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	t.Setenv("EXT_BASE_URL", baseUrl)
+
+	r := gin.New()
+	r.POST("/payments/new", NewPayment)
+	r.POST("/payments/good", GoodPayment)
+	r.POST("/payments/error", ErrorPayment)
+	r.POST("/payments/cancel", CancelPayment)
+	return r, server, store
+}
+
+var location = regexp.MustCompile(`window.location = '([^']*)'`)
+
+// redirect returns where a handler's page sends the browser.
+func redirect(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	m := location.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("no redirect in %d %q", w.Code, w.Body.String())
+	}
+	return m[1]
+}
+
+// open starts a payment and returns the hosted page Pelecard offered.
+func open(t *testing.T, r *gin.Engine, userKey string) string {
+	t.Helper()
+	body := `{"UserKey":"` + userKey + `","GoodURL":"https://shop.test/good","ErrorURL":"https://shop.test/error",
+		"CancelURL":"https://shop.test/cancel","Name":"Payer","Price":12.5,"Currency":"USD",
+		"Email":"payer@example.com","Phone":"0500000000","SKU":"sku1","VAT":"n","Installments":1,
+		"Language":"EN","Reference":"ref-` + userKey + `","Organization":"ben2"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/payments/new", strings.NewReader(body)))
+	return redirect(t, w)
+}
+
+// post delivers Pelecard's callback to the handler it names.
+func post(t *testing.T, r *gin.Engine, callback pelecardtest.Callback) *httptest.ResponseRecorder {
+	t.Helper()
+	path := strings.TrimPrefix(callback.URL, baseUrl)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(callback.Form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPaymentGoodRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	page := open(t, r, "u-good")
+	w := post(t, r, server.Pay(t, page))
+
+	target, err := url.Parse(redirect(t, w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Host != "shop.test" || target.Path != "/good" || target.Query().Get("success") != "1" {
+		t.Errorf("payer sent to %s", target)
+	}
+	if got := target.Query().Get("debit_total"); got != "1250" {
+		t.Errorf("debit_total = %q, want the agorot Pelecard charged", got)
+	}
+	if status, _ := store.GetStatus("u-good"); status != "valid" {
+		t.Errorf("status = %q, want valid", status)
+	}
+	var request types.PaymentRequest
+	if store.LoadRequest("u-good", &request); request.Terminal != "regular" {
+		t.Errorf("terminal = %q, want regular", request.Terminal)
+	}
+}
+
+// A callback that does not match what Pelecard confirms is not a payment,
+// however it arrived.
+func TestPaymentGoodUnconfirmed(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	callback := server.Pay(t, open(t, r, "u-forged"))
+	callback.Form.Set("ConfirmationKey", "forged")
+	w := post(t, r, callback)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("code = %d, want 502", w.Code)
+	}
+	if status, _ := store.GetStatus("u-forged"); status != "invalid" {
+		t.Errorf("status = %q, want invalid", status)
+	}
+}
+
+func TestPaymentGoodGatewayTimeout(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	callback := server.Pay(t, open(t, r, "u-slow"))
+	server.Script("/GetTransaction", pelecardtest.Timeout)
+	w := post(t, r, callback)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("code = %d, want 502", w.Code)
+	}
+	if status, _ := store.GetStatus("u-slow"); status != "in-process" {
+		t.Errorf("status = %q, want in-process for reconciliation", status)
+	}
+}
+
+// A second copy of the callback, arriving while the first is still being
+// validated, leaves the request to the first: it asks Pelecard nothing, and
+// cannot fail a payment the first is about to mark valid.
+func TestPaymentGoodDuplicateWhileInProcess(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	callback := server.Pay(t, open(t, r, "u-twice"))
+	server.Script("/GetTransaction", pelecardtest.Timeout)
+	post(t, r, callback)
+	server.Script("/ValidateByUniqueKey", pelecardtest.Decline("033"))
+
+	w := post(t, r, callback)
+
+	target, err := url.Parse(redirect(t, w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Host != "shop.test" || target.Path != "/good" {
+		t.Errorf("payer sent to %s", target)
+	}
+	if status, _ := store.GetStatus("u-twice"); status != "in-process" {
+		t.Errorf("status = %q, want in-process, the first copy's to decide", status)
+	}
+	if calls := server.Calls("/GetTransaction"); len(calls) != 1 {
+		t.Errorf("GetTransaction called %d times, want once", len(calls))
+	}
+	if calls := server.Calls("/ValidateByUniqueKey"); len(calls) != 0 {
+		t.Errorf("ValidateByUniqueKey called %d times, want none", len(calls))
+	}
+}
+
+func TestPaymentErrorRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	w := post(t, r, server.Fail(t, open(t, r, "u-declined"), "004"))
+
+	target := redirect(t, w)
+	if !strings.HasPrefix(target, "https://shop.test/error?error=Refusal by credit company.") {
+		t.Errorf("payer sent to %s", target)
+	}
+	if status, _ := store.GetStatus("u-declined"); status != "error" {
+		t.Errorf("status = %q, want error", status)
+	}
+	if callbacks := store.Callbacks("u-declined"); len(callbacks) != 1 || callbacks[0].PelecardStatusCode != "004" {
+		t.Errorf("recorded callbacks = %+v", callbacks)
+	}
+}
+
+func TestPaymentCancelRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	w := post(t, r, server.Cancel(t, open(t, r, "u-cancel")))
+
+	if target := redirect(t, w); target != "https://shop.test/cancel" {
+		t.Errorf("payer sent to %s", target)
+	}
+	if status, _ := store.GetStatus("u-cancel"); status != "cancel" {
+		t.Errorf("status = %q, want cancel", status)
+	}
+}
+
+func TestNewPaymentGatewayRefuses(t *testing.T) {
+	r, server, _ := newEngine(t)
+	server.Script("/init", pelecardtest.Decline("598"))
+
+	body := `{"UserKey":"u-init","GoodURL":"g","ErrorURL":"e","CancelURL":"c","Name":"n","Price":1,
+		"Currency":"NIS","Email":"a@example.com","Phone":"1","SKU":"s","VAT":"n","Installments":1,
+		"Language":"HE","Reference":"r","Organization":"ben2"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/payments/new", strings.NewReader(body)))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("code = %d, want 502", w.Code)
+	}
+}
@@ -2,7 +2,11 @@ package paypal
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json/v2"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -11,6 +15,7 @@ import (
 	pp "github.com/plutov/paypal/v4"
 
 	"external_payments/db"
+	"external_payments/gateway"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
@@ -31,16 +36,31 @@ func Charge(c *gin.Context) {
 	// Before validation: Organization is required, and a caller authenticated
 	// by key does not send it.
 	request.Organization = utils.ResolveOrganization(c, request.Organization)
+	request.CallbackURL, request.WebhookSalt = utils.ResolveCallback(c)
 
 	if errFound, errors := validation.ValidateStruct(request); errFound {
 		utils.ErrorJson(http.StatusBadRequest, "validateStruct: "+strings.Join(errors, "\n"), c)
 		return
 	}
+	if err := utils.CheckPrefix(c, request.Reference); err != nil {
+		utils.LogMessage("[PayPal] Charge: " + err.Error())
+		utils.ErrorJson(http.StatusForbidden, err.Error(), c)
+		return
+	}
 	utils.LogMessage(fmt.Sprintf("[PayPal] Charge: %+v", request))
 
+	// A caller that sends an Idempotency-Key gets the original answer on a
+	// retry, from the middleware. Without one, the capture recorded for the
+	// reference is the answer; a reference paid some other way is refused.
 	if db.FindRecentSuccessfulCharge(request.Reference) {
-		utils.LogMessage(fmt.Sprintf("[PayPal] Charge: duplicate suppressed reference=%s", request.Reference))
-		utils.ResultJson(map[string]string{"status": "success", "capture_id": ""}, c)
+		captureID, err := db.FindPaypalCaptureId(request.Reference, request.Organization)
+		if err != nil || captureID == "" {
+			utils.LogMessage(fmt.Sprintf("[PayPal] Charge: reference=%s already paid, no capture: %v", request.Reference, err))
+			utils.ErrorJson(http.StatusConflict, "reference "+request.Reference+" was already charged", c)
+			return
+		}
+		utils.LogMessage(fmt.Sprintf("[PayPal] Charge: duplicate suppressed reference=%s capture=%s", request.Reference, captureID))
+		utils.ResultJson(map[string]string{"status": "success", "capture_id": captureID}, c)
 		return
 	}
 
@@ -48,18 +68,26 @@ func Charge(c *gin.Context) {
 		utils.ErrorJson(http.StatusInternalServerError, "StoreRequest: "+err.Error(), c)
 		return
 	}
-	db.SetStatus(request.UserKey, "in-process")
+	db.Transition(request.UserKey, db.StatusInProcess, "paypal charge", "charging")
 
 	ctx := c.Request.Context()
 
-	captureID, err := chargeVaultToken(ctx, request)
+	charged, err := paypalProvider.ChargeToken(ctx, gateway.Charge{
+		UserKey:     request.UserKey,
+		Token:       request.Token,
+		Reference:   request.Reference,
+		Description: request.Details,
+		Amount:      request.Price,
+		Currency:    request.Currency,
+	})
 	if err != nil {
 		utils.LogMessage(fmt.Sprintf("[PayPal] Charge error: %s", err))
-		db.SetStatus(request.UserKey, "invalid")
-		utils.ErrorJson(http.StatusOK, "charge failed: "+err.Error(), c)
+		utils.SettleChargeFailure(request.UserKey, "paypal charge", err)
+		utils.ChargeErrorJson("charge failed: ", err, c)
 		return
 	}
 
+	captureID := charged.Id
 	loc, _ := time.LoadLocation("Asia/Jerusalem")
 	paymentDate := time.Now().In(loc).Format("2006-01-02 15:04:05")
 	env := paypalEnv()
@@ -68,7 +96,7 @@ func Charge(c *gin.Context) {
 		utils.LogMessage(fmt.Sprintf("[PayPal] Charge StorePaypalCapture error: %s", err))
 	}
 
-	db.SetStatus(request.UserKey, "valid")
+	db.Transition(request.UserKey, db.StatusValid, "paypal charge", "captured "+captureID)
 	utils.LogMessage(fmt.Sprintf("[PayPal] Charge success: captureID=%s userKey=%s", captureID, request.UserKey))
 	utils.ResultJson(map[string]string{
 		"status":     "success",
@@ -76,6 +104,177 @@ func Charge(c *gin.Context) {
 	}, c)
 }
 
+// Refund returns all or part of a capture that Charge stored. TransactionId is
+// the capture id Charge answered with; Amount 0 refunds whatever remains. The
+// refund is recorded against the request the capture paid, whose status
+// becomes refunded or partially-refunded.
+//
+// Reference is required and names the refund among the caller's own: a
+// request that repeats one the same client recorded gets the first one's
+// answer and moves no money. PayPal is
+// given the same reference as its request id, so a retry that reaches it
+// anyway is deduplicated there too.
+func Refund(c *gin.Context) {
+	var request types.RefundRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ErrorJson(http.StatusBadRequest, "Refund Bind: "+err.Error(), c)
+		return
+	}
+
+	client, _ := utils.APIClientFor(c)
+	if client.Organization == "" {
+		utils.ErrorJson(http.StatusBadRequest,
+			"no organization: this endpoint needs a client key that carries one, not a shared internal token", c)
+		return
+	}
+	switch {
+	case request.TransactionId == "":
+		utils.ErrorJson(http.StatusBadRequest, "TransactionId cannot be blank: it is the capture id Charge returned", c)
+		return
+	case request.Reference == "":
+		utils.ErrorJson(http.StatusBadRequest, "Reference cannot be blank", c)
+		return
+	case request.Amount < 0:
+		utils.ErrorJson(http.StatusBadRequest, "Amount cannot be negative", c)
+		return
+	}
+
+	if prior, err := db.FindRefundByReference("paypal", client.Name, request.Reference); err == nil {
+		replayRefund(prior, request, c)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		utils.ErrorJson(http.StatusInternalServerError, "Refund FindRefundByReference: "+err.Error(), c)
+		return
+	}
+
+	var capture types.PaypalRegister
+	if err := db.LoadPaypalCapture(request.TransactionId, &capture); err != nil || capture.Organization != client.Organization {
+		utils.LogMessage(fmt.Sprintf("[PayPal] Refund: capture %s not found for client %q", request.TransactionId, client.Name))
+		utils.ErrorJson(http.StatusNotFound, "payment not found", c)
+		return
+	}
+	userKey, err := db.FindPaypalUserKey(capture.Reference, capture.Organization)
+	if err != nil {
+		utils.LogMessage(fmt.Sprintf("[PayPal] Refund: no paid request for capture %s reference=%s: %s",
+			request.TransactionId, capture.Reference, err))
+		utils.ErrorJson(http.StatusConflict, "payment has no request to record the refund against", c)
+		return
+	}
+
+	amount := request.Amount
+	if amount == 0 {
+		refunded, err := db.RefundedTotal("paypal", request.TransactionId)
+		if err != nil {
+			utils.ErrorJson(http.StatusInternalServerError, "Refund RefundedTotal: "+err.Error(), c)
+			return
+		}
+		amount = math.Round((capture.Price-refunded)*100) / 100
+		if amount <= 0 {
+			utils.ErrorJson(http.StatusConflict, "nothing left to refund", c)
+			return
+		}
+	}
+
+	refund := types.Refund{
+		UserKey:       userKey,
+		Gateway:       "paypal",
+		TransactionId: request.TransactionId,
+		Amount:        amount,
+		Currency:      capture.Currency,
+		Reference:     request.Reference,
+		Client:        client.Name,
+	}
+	id, refunded, err := db.ReserveRefund(refund, capture.Price)
+	switch {
+	case errors.Is(err, db.ErrRefundExceedsCaptured):
+		utils.ErrorJson(http.StatusBadRequest, fmt.Sprintf("Amount %.2f exceeds the remaining %.2f",
+			amount, capture.Price-refunded), c)
+		return
+	case errors.Is(err, db.ErrRefundReferenceTaken):
+		utils.ErrorJson(http.StatusConflict, "refund "+request.Reference+" is already in progress", c)
+		return
+	case err != nil:
+		utils.LogMessage(fmt.Sprintf("[PayPal] Refund ReserveRefund error: %s", err))
+		utils.ErrorJson(http.StatusInternalServerError, "Refund ReserveRefund: "+err.Error(), c)
+		return
+	}
+	utils.LogMessage(fmt.Sprintf("[PayPal] Refund: capture=%s %.2f %s of %.2f reference=%s client=%q",
+		request.TransactionId, amount, capture.Currency, capture.Price, request.Reference, client.Name))
+
+	result, err := paypalProvider.Refund(c.Request.Context(), gateway.Refund{
+		TransactionId: request.TransactionId,
+		Reference:     request.Reference,
+		Amount:        amount,
+		Currency:      capture.Currency,
+	})
+	if err != nil {
+		if gateway.Classify(err).Kind == gateway.Retryable {
+			// PayPal may have made the refund without our hearing back. The
+			// reservation stays pending, still counted against what is left
+			// to refund, so a retry cannot credit the payer twice.
+			utils.LogMessage(fmt.Sprintf("[PayPal] Refund: capture=%s outcome unknown, reservation %d left pending: %s",
+				request.TransactionId, id, err))
+		} else {
+			_ = db.SettleRefund(id, "", err)
+			utils.LogMessage(fmt.Sprintf("[PayPal] Refund error: %s", err))
+		}
+		utils.ErrorJson(http.StatusBadGateway, "refund failed: "+err.Error(), c)
+		return
+	}
+
+	refundID := result.Id
+	refund.RefundId = refundID
+	refund.Status = "done"
+	if err = db.SettleRefund(id, refundID, nil); err != nil {
+		// The money has moved. Say so, and leave the row pending for someone
+		// to settle by hand rather than answer as if nothing happened.
+		utils.LogMessage(fmt.Sprintf("[PayPal] Refund: capture=%s refunded as %s but SettleRefund failed: %s",
+			request.TransactionId, refundID, err))
+	}
+	utils.LogMessage(fmt.Sprintf("[PayPal] Refund success: capture=%s refundID=%s", request.TransactionId, refundID))
+
+	refund.Refunded = refunded + amount
+	refund.Remaining = math.Round((capture.Price-refund.Refunded)*100) / 100
+	if refund.Remaining <= 0 {
+		db.Transition(userKey, db.StatusRefunded, "paypal refund", "refund "+refundID)
+	} else {
+		db.Transition(userKey, db.StatusPartiallyRefunded, "paypal refund", "refund "+refundID)
+	}
+	data, _ := json.Marshal(refund)
+	utils.ResultJson(map[string]string{
+		"status": "success",
+		"data":   string(data),
+	}, c)
+}
+
+// replayRefund answers a request whose reference is already recorded with the
+// outcome of the first request under it. A reference reused for a different
+// capture or amount is refused rather than silently answered for the other.
+func replayRefund(prior types.Refund, request types.RefundRequest, c *gin.Context) {
+	if prior.TransactionId != request.TransactionId || (request.Amount != 0 && prior.Amount != request.Amount) {
+		utils.ErrorJson(http.StatusConflict, "Reference "+request.Reference+" was already used for a different refund", c)
+		return
+	}
+	utils.LogMessage(fmt.Sprintf("[PayPal] Refund: replay reference=%s status=%s", prior.Reference, prior.Status))
+
+	switch prior.Status {
+	case "pending":
+		utils.ErrorJson(http.StatusConflict, "refund "+request.Reference+" is already in progress", c)
+	case "failed":
+		utils.ErrorJson(http.StatusBadGateway, "refund failed: "+prior.Error, c)
+	default:
+		var capture types.PaypalRegister
+		_ = db.LoadPaypalCapture(prior.TransactionId, &capture)
+		prior.Refunded, _ = db.RefundedTotal("paypal", prior.TransactionId)
+		prior.Remaining = math.Round((capture.Price-prior.Refunded)*100) / 100
+		data, _ := json.Marshal(prior)
+		utils.ResultJson(map[string]string{
+			"status": "success",
+			"data":   string(data),
+		}, c)
+	}
+}
+
 func tokenPreview(t string) string {
 	if len(t) > 8 {
 		return t[:8] + "..."
@@ -85,30 +284,29 @@ func tokenPreview(t string) string {
 
 // chargeVaultToken charges via PayPal REST API using a saved vault token.
 // Used for new subscriptions created after vault support was added.
-func chargeVaultToken(ctx context.Context, req types.PaymentRequest) (string, error) {
+func chargeVaultToken(ctx context.Context, charge gateway.Charge) (string, error) {
+	currency, value, err := paypalAmount(charge.Currency, charge.Amount)
+	if err != nil {
+		return "", err
+	}
 	client, err := newClient(ctx)
 	if err != nil {
 		return "", fmt.Errorf("PayPal client: %w", err)
 	}
 
-	currency := req.Currency
-	if currency == "NIS" {
-		currency = "ILS"
-	}
-
-	utils.LogMessage(fmt.Sprintf("[PayPal] Vault charge: token=%s amt=%.2f currency=%s", tokenPreview(req.Token), req.Price, currency))
+	utils.LogMessage(fmt.Sprintf("[PayPal] Vault charge: token=%s amt=%.2f currency=%s", tokenPreview(charge.Token), charge.Amount, currency))
 
 	order, err := client.CreateOrder(ctx, pp.OrderIntentCapture, []pp.PurchaseUnitRequest{{
 		Amount: &pp.PurchaseUnitAmount{
 			Currency: currency,
-			Value:    fmt.Sprintf("%.2f", req.Price),
+			Value:    value,
 		},
-		Description: req.Details,
-		CustomID:    req.UserKey,
-		InvoiceID:   req.Reference,
+		Description: charge.Description,
+		CustomID:    charge.UserKey,
+		InvoiceID:   charge.Reference,
 	}}, &pp.PaymentSource{
 		Token: &pp.PaymentSourceToken{
-			ID:   req.Token,
+			ID:   charge.Token,
 			Type: "PAYMENT_METHOD_TOKEN",
 		},
 	}, nil)
@@ -134,7 +332,8 @@ func chargeVaultToken(ctx context.Context, req types.PaymentRequest) (string, er
 	utils.LogMessage(fmt.Sprintf("[PayPal] Vault CaptureOrder: status=%s", capture.Status))
 
 	if capture.Status != "COMPLETED" {
-		return "", fmt.Errorf("capture status: %s", capture.Status)
+		return "", &gateway.Error{Kind: gateway.Declined, Code: capture.Status,
+			Message: "capture status: " + capture.Status}
 	}
 
 	captureID := capture.ID
@@ -144,3 +343,36 @@ func chargeVaultToken(ctx context.Context, req types.PaymentRequest) (string, er
 	}
 	return captureID, nil
 }
+
+// refundCapture refunds amount of a capture through the REST Payments API and
+// returns PayPal's refund id. reference doubles as the PayPal-Request-Id, so
+// PayPal answers a repeated call with the refund it already made.
+func refundCapture(ctx context.Context, captureID string, amount float64, currency, reference string) (string, error) {
+	code, value, err := paypalAmount(currency, amount)
+	if err != nil {
+		return "", err
+	}
+	client, err := newClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("PayPal client: %w", err)
+	}
+
+	refund, err := client.RefundCaptureWithPaypalRequestId(ctx, captureID, pp.RefundCaptureRequest{
+		Amount: &pp.Money{
+			Currency: code,
+			Value:    value,
+		},
+		InvoiceID: reference,
+	}, reference)
+	if err != nil {
+		return "", fmt.Errorf("RefundCapture: %w", err)
+	}
+	utils.LogMessage(fmt.Sprintf("[PayPal] RefundCapture: id=%s status=%s", refund.ID, refund.Status))
+
+	// PENDING is a refund PayPal has accepted but not yet paid out, typically
+	// an eCheck capture; it completes on its own and needs no second call.
+	if refund.Status != "COMPLETED" && refund.Status != "PENDING" {
+		return "", fmt.Errorf("refund status: %s", refund.Status)
+	}
+	return refund.ID, nil
+}
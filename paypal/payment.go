@@ -12,6 +12,7 @@ import (
 	pp "github.com/plutov/paypal/v4"
 
 	"external_payments/db"
+	"external_payments/gateway"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
@@ -29,7 +30,8 @@ func newClient(ctx context.Context) (*pp.Client, error) {
 	c, err := pp.NewClient(clientID, os.Getenv("PAYPAL_CLIENT_SECRET"), base)
 	if err != nil {
 		utils.LogMessage(fmt.Sprintf("[PayPal] newClient NewClient error: %v", err))
-		return nil, err
+		// Only missing credentials fail here; nothing has been sent yet.
+		return nil, &gateway.Error{Kind: gateway.Configuration, Message: err.Error(), Err: err}
 	}
 	token, err := c.GetAccessToken(ctx)
 	if err != nil {
@@ -71,75 +73,32 @@ func NewPayment(c *gin.Context) {
 		return
 	}
 	utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment stored request userKey=%s", request.UserKey))
-	db.SetStatus(request.UserKey, "in-process")
+	db.Transition(request.UserKey, db.StatusInProcess, "paypal order", "order created")
 
-	ctx := c.Request.Context()
-	client, err := newClient(ctx)
-	if err != nil {
-		utils.ErrorJson(http.StatusOK, "PayPal client: "+err.Error(), c)
-		return
-	}
-
-	currency := request.Currency
-	if currency == "NIS" {
-		currency = "ILS"
-	}
-	price := fmt.Sprintf("%.2f", request.Price)
 	baseURL := utils.BaseUrl()
 	returnURL := fmt.Sprintf("%s/paypal/good?UserKey=%s", baseURL, request.UserKey)
 	cancelURL := fmt.Sprintf("%s/paypal/cancel?UserKey=%s", baseURL, request.UserKey)
 
-	utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment CreateOrder: currency=%s price=%s returnURL=%s cancelURL=%s isRecurring=%v",
-		currency, price, returnURL, cancelURL, request.IsRecurring))
-
-	var approveURL string
-	var orderID string
-
-	if request.IsRecurring {
-		approveURL, orderID, err = createVaultOrder(ctx, client, request, returnURL, cancelURL)
-		if err != nil {
-			utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment createVaultOrder error: %s", err))
-			utils.ErrorJson(http.StatusOK, "CreateVaultOrder: "+err.Error(), c)
-			return
-		}
-		utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment vault order created: id=%s approveURL=%s", orderID, approveURL))
-	} else {
-		order, orderErr := client.CreateOrder(ctx,
-			pp.OrderIntentCapture,
-			[]pp.PurchaseUnitRequest{{
-				Amount: &pp.PurchaseUnitAmount{
-					Currency: currency,
-					Value:    price,
-				},
-				Description: request.Details,
-				CustomID:    request.UserKey,
-				InvoiceID:   request.Reference,
-			}},
-			nil,
-			&pp.ApplicationContext{
-				ReturnURL: returnURL,
-				CancelURL: cancelURL,
-			},
-		)
-		if orderErr != nil {
-			utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment CreateOrder error: %s", orderErr))
-			utils.ErrorJson(http.StatusOK, "CreateOrder: "+orderErr.Error(), c)
-			return
-		}
-		utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment order created: id=%s status=%s", order.ID, order.Status))
-		orderID = order.ID
-		for _, link := range order.Links {
-			if link.Rel == "approve" {
-				approveURL = link.Href
-				break
-			}
-		}
-		if approveURL == "" {
-			utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment no approve link in order links: %+v", order.Links))
-			utils.ErrorJson(http.StatusOK, "PayPal: no approve link", c)
-			return
-		}
+	utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment CreateOrder: currency=%s price=%.2f returnURL=%s cancelURL=%s isRecurring=%v",
+		request.Currency, request.Price, returnURL, cancelURL, request.IsRecurring))
+
+	redirect, err := paypalProvider.HostedPage(c.Request.Context(), gateway.Page{
+		UserKey:     request.UserKey,
+		Reference:   request.Reference,
+		Description: request.Details,
+		Amount:      request.Price,
+		Currency:    request.Currency,
+		GoodURL:     returnURL,
+		CancelURL:   cancelURL,
+		Vault:       request.IsRecurring,
+	})
+	if err != nil {
+		utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment HostedPage error: %s", err))
+		utils.ErrorJson(http.StatusOK, err.Error(), c)
+		return
 	}
+	approveURL, orderID := redirect.URL, redirect.Id
+	utils.LogMessage(fmt.Sprintf("[PayPal] NewPayment order created: id=%s approveURL=%s", orderID, approveURL))
 
 	env := paypalEnv()
 	if err = db.SetPaypalOrderId(request.UserKey, orderID, env); err != nil {
@@ -224,7 +183,7 @@ func GoodPayment(c *gin.Context) {
 		utils.LogMessage("[PayPal] GoodPayment StorePaypalCapture OK")
 	}
 
-	db.SetStatus(userKey, "valid")
+	db.Transition(userKey, db.StatusValid, "paypal callback", "captured "+captureID)
 	utils.LogMessage(fmt.Sprintf("[PayPal] GoodPayment status set to valid userKey=%s", userKey))
 
 	sep := "?"
@@ -244,7 +203,7 @@ func GoodPayment(c *gin.Context) {
 func ErrorPayment(c *gin.Context) {
 	userKey := c.Query("UserKey")
 	utils.LogMessage(fmt.Sprintf("[PayPal] ErrorPayment: userKey=%s fullURL=%s", userKey, c.Request.URL.String()))
-	db.SetStatus(userKey, "error")
+	db.Transition(userKey, db.StatusError, "paypal callback", "error")
 
 	var request types.PaymentRequest
 	if err := db.LoadRequest(userKey, &request); err != nil {
@@ -259,7 +218,7 @@ func ErrorPayment(c *gin.Context) {
 func CancelPayment(c *gin.Context) {
 	userKey := c.Query("UserKey")
 	utils.LogMessage(fmt.Sprintf("[PayPal] CancelPayment: userKey=%s fullURL=%s", userKey, c.Request.URL.String()))
-	db.SetStatus(userKey, "cancel")
+	db.Transition(userKey, db.StatusCancel, "paypal callback", "cancelled by payer")
 
 	var request types.PaymentRequest
 	if err := db.LoadRequest(userKey, &request); err != nil {
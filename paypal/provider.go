@@ -0,0 +1,158 @@
+package paypal
+
+import (
+	"context"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"net/http"
+
+	pp "github.com/plutov/paypal/v4"
+
+	"external_payments/currency"
+	"external_payments/gateway"
+)
+
+// paypalAmount is an amount as PayPal takes it: the currency's ISO code, and
+// the amount with that currency's decimals. A currency PayPal does not take is
+// a Configuration error, before anything is sent.
+func paypalAmount(code string, amount float64) (string, string, error) {
+	cur, err := currency.Lookup(code)
+	if err == nil {
+		code, err = cur.PaypalCode()
+	}
+	if err != nil {
+		return "", "", &gateway.Error{Kind: gateway.Configuration, Message: err.Error(), Err: err}
+	}
+	return code, cur.Format(amount), nil
+}
+
+// paypalProvider is the gateway the handlers use. Tests swap it for a fake.
+var paypalProvider gateway.Provider = Provider{}
+
+// Provider is PayPal behind gateway.Provider. There is one PayPal account for
+// every organization, so unlike Pelecard it needs no configuration.
+type Provider struct{}
+
+func (Provider) Name() string { return "paypal" }
+
+// HostedPage creates an order and returns PayPal's approval page for it. With
+// Vault set the order also saves the payer's account, for ChargeToken later.
+func (Provider) HostedPage(ctx context.Context, page gateway.Page) (gateway.Redirect, error) {
+	code, value, err := paypalAmount(page.Currency, page.Amount)
+	if err != nil {
+		return gateway.Redirect{}, err
+	}
+	client, err := newClient(ctx)
+	if err != nil {
+		return gateway.Redirect{}, fmt.Errorf("PayPal client: %w", err)
+	}
+
+	if page.Vault {
+		approveURL, orderID, err := createVaultOrder(ctx, client, page, code, value)
+		if err != nil {
+			return gateway.Redirect{}, fmt.Errorf("CreateVaultOrder: %w", err)
+		}
+		return gateway.Redirect{URL: approveURL, Id: orderID}, nil
+	}
+
+	order, err := client.CreateOrder(ctx,
+		pp.OrderIntentCapture,
+		[]pp.PurchaseUnitRequest{{
+			Amount: &pp.PurchaseUnitAmount{
+				Currency: code,
+				Value:    value,
+			},
+			Description: page.Description,
+			CustomID:    page.UserKey,
+			InvoiceID:   page.Reference,
+		}},
+		nil,
+		&pp.ApplicationContext{
+			ReturnURL: page.GoodURL,
+			CancelURL: page.CancelURL,
+		},
+	)
+	if err != nil {
+		return gateway.Redirect{}, fmt.Errorf("CreateOrder: %w", err)
+	}
+	for _, link := range order.Links {
+		if link.Rel == "approve" {
+			return gateway.Redirect{URL: link.Href, Id: order.ID}, nil
+		}
+	}
+	return gateway.Redirect{}, fmt.Errorf("PayPal: no approve link in order %s", order.ID)
+}
+
+// ChargeToken charges a vault token. The result's Id is the capture id.
+func (Provider) ChargeToken(ctx context.Context, charge gateway.Charge) (gateway.Result, error) {
+	captureID, err := chargeVaultToken(ctx, charge)
+	if err != nil {
+		return gateway.Result{}, paypalError(err)
+	}
+	return gateway.Result{Id: captureID}, nil
+}
+
+// Transaction returns PayPal's record of a capture.
+func (Provider) Transaction(ctx context.Context, captureID string) (gateway.Result, error) {
+	client, err := newClient(ctx)
+	if err != nil {
+		return gateway.Result{}, fmt.Errorf("PayPal client: %w", err)
+	}
+	capture, err := client.CapturedDetail(ctx, captureID)
+	if err != nil {
+		return gateway.Result{}, fmt.Errorf("CapturedDetail: %w", err)
+	}
+
+	var data map[string]any
+	body, _ := json.Marshal(capture)
+	if err = json.Unmarshal(body, &data); err != nil {
+		return gateway.Result{}, err
+	}
+	return gateway.Result{Id: capture.ID, Data: data}, nil
+}
+
+// Validate is unsupported: PayPal confirms a payment by capturing the order
+// the payer approved, which GoodPayment does.
+func (Provider) Validate(context.Context, gateway.Validation) (bool, error) {
+	return false, gateway.ErrUnsupported
+}
+
+// Refund refunds a capture; TransactionId is the capture id.
+func (Provider) Refund(ctx context.Context, r gateway.Refund) (gateway.Result, error) {
+	refundID, err := refundCapture(ctx, r.TransactionId, r.Amount, r.Currency, r.Reference)
+	if err != nil {
+		return gateway.Result{}, err
+	}
+	return gateway.Result{Id: refundID}, nil
+}
+
+// paypalError classifies a failed PayPal call by the HTTP status PayPal
+// answered with. A 4xx other than an authentication failure is about this
+// payment: the token is unknown or revoked, or the account refused. Its code
+// is PayPal's first issue, such as INSTRUMENT_DECLINED.
+func paypalError(err error) error {
+	var classified *gateway.Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	var answer *pp.ErrorResponse
+	if !errors.As(err, &answer) || answer.Response == nil {
+		return &gateway.Error{Kind: gateway.Retryable, Message: err.Error(), Err: err}
+	}
+
+	e := &gateway.Error{Kind: gateway.Declined, Code: answer.Name, Message: answer.Message, Err: err}
+	if len(answer.Details) > 0 && answer.Details[0].Issue != "" {
+		e.Code = answer.Details[0].Issue
+		if answer.Details[0].Description != "" {
+			e.Message = answer.Details[0].Description
+		}
+	}
+	switch status := answer.Response.StatusCode; {
+	case status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		e.Kind = gateway.Retryable
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Kind = gateway.Configuration
+	}
+	return e
+}
@@ -0,0 +1,45 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	pp "github.com/plutov/paypal/v4"
+
+	"external_payments/gateway"
+)
+
+func answer(status int, issue string) error {
+	req, _ := http.NewRequest(http.MethodPost, "https://api.paypal.test/v2/checkout/orders", nil)
+	return fmt.Errorf("CreateOrder: %w", &pp.ErrorResponse{
+		Response: &http.Response{StatusCode: status, Request: req},
+		Name:     "UNPROCESSABLE_ENTITY",
+		Message:  "The requested action could not be performed.",
+		Details:  []pp.ErrorResponseDetail{{Issue: issue, Description: "The instrument was declined."}},
+	})
+}
+
+func TestPaypalErrorClassifies(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		kind gateway.Kind
+		code string
+	}{
+		{"declined", answer(http.StatusUnprocessableEntity, "INSTRUMENT_DECLINED"), gateway.Declined, "INSTRUMENT_DECLINED"},
+		{"outage", answer(http.StatusServiceUnavailable, ""), gateway.Retryable, "UNPROCESSABLE_ENTITY"},
+		{"throttled", answer(http.StatusTooManyRequests, ""), gateway.Retryable, "UNPROCESSABLE_ENTITY"},
+		{"credentials", answer(http.StatusUnauthorized, ""), gateway.Configuration, "UNPROCESSABLE_ENTITY"},
+		{"network", errors.New("dial tcp: i/o timeout"), gateway.Retryable, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := gateway.Classify(paypalError(tc.err))
+			if e.Kind != tc.kind || e.Code != tc.code {
+				t.Errorf("got %+v, want kind %s code %q", e, tc.kind, tc.code)
+			}
+		})
+	}
+}
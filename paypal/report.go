@@ -0,0 +1,63 @@
+package paypal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pp "github.com/plutov/paypal/v4"
+)
+
+// searchSpan is the longest range PayPal's transaction search takes at once.
+const searchSpan = 31 * 24 * time.Hour
+
+// SearchTransactions returns the transactions on the account in [from, to),
+// every page of them, from PayPal's transaction reporting. Longer ranges are
+// searched a month at a time.
+//
+// The report lags: PayPal says a transaction can take up to three hours to
+// appear in it.
+func SearchTransactions(ctx context.Context, from, to time.Time) (found []pp.SearchTransactionDetails, err error) {
+	client, err := newClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("PayPal client: %w", err)
+	}
+	pageSize := 500
+	for start := from; start.Before(to); start = start.Add(searchSpan) {
+		end := start.Add(searchSpan)
+		if end.After(to) {
+			end = to
+		}
+		for page := 1; ; page++ {
+			resp, err := client.ListTransactions(ctx, &pp.TransactionSearchRequest{
+				StartDate: start,
+				EndDate:   end,
+				PageSize:  &pageSize,
+				Page:      &page,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("ListTransactions %s–%s page %d: %w",
+					start.Format(time.DateOnly), end.Format(time.DateOnly), page, err)
+			}
+			found = append(found, resp.TransactionDetails...)
+			if page >= resp.TotalPages {
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// OrderStatus returns the status of an order: CREATED until the payer
+// approves it, APPROVED until it is captured, then COMPLETED.
+func OrderStatus(ctx context.Context, orderID string) (string, error) {
+	client, err := newClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("PayPal client: %w", err)
+	}
+	order, err := client.GetOrder(ctx, orderID)
+	if err != nil {
+		return "", fmt.Errorf("GetOrder %s: %w", orderID, err)
+	}
+	return order.Status, nil
+}
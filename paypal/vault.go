@@ -7,7 +7,7 @@ import (
 
 	pp "github.com/plutov/paypal/v4"
 
-	"external_payments/types"
+	"external_payments/gateway"
 )
 
 // Custom structs for PayPal Vault v3 (not in plutov/paypal v4 library).
@@ -69,28 +69,23 @@ type vaultCaptureResponse struct {
 
 // createVaultOrder creates a PayPal order with vault instruction so the customer's
 // PayPal account is saved for future server-side charges.
-func createVaultOrder(ctx context.Context, client *pp.Client, req types.PaymentRequest, returnURL, cancelURL string) (approveURL, orderID string, err error) {
-	currency := req.Currency
-	if currency == "NIS" {
-		currency = "ILS"
-	}
-
+func createVaultOrder(ctx context.Context, client *pp.Client, page gateway.Page, currency, value string) (approveURL, orderID string, err error) {
 	body := vaultOrderRequest{
 		Intent: pp.OrderIntentCapture,
 		PurchaseUnits: []pp.PurchaseUnitRequest{{
 			Amount: &pp.PurchaseUnitAmount{
 				Currency: currency,
-				Value:    fmt.Sprintf("%.2f", req.Price),
+				Value:    value,
 			},
-			Description: req.Details,
-			CustomID:    req.UserKey,
-			InvoiceID:   req.Reference,
+			Description: page.Description,
+			CustomID:    page.UserKey,
+			InvoiceID:   page.Reference,
 		}},
 		PaymentSource: vaultPaymentSource{
 			Paypal: vaultPaypalSource{
 				ExperienceContext: vaultExperienceContext{
-					ReturnURL: returnURL,
-					CancelURL: cancelURL,
+					ReturnURL: page.GoodURL,
+					CancelURL: page.CancelURL,
 				},
 				Attributes: vaultAttributes{
 					Vault: vaultConfig{
@@ -11,6 +11,7 @@ import (
 	"os"
 	time "time"
 
+	"external_payments/organizations"
 	"external_payments/types"
 )
 
@@ -21,10 +22,40 @@ var ErrNoData = errors.New("pelecard: data does not exist")
 
 const statusNoData = "904"
 
+// StatusError is a services call Pelecard answered with a status other than
+// 000. Code is the status, to look up in the messages table with GetMessage.
+type StatusError struct {
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// HTTPError is a services call that did not reach Pelecard's application:
+// the answer was an HTTP error page, not a status.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("pelecard: HTTP %d", e.StatusCode)
+}
+
 var pelecardClient = &http.Client{
 	Timeout: 30 * time.Second,
 }
 
+// SetTimeout changes how long a call to Pelecard may take and returns a func
+// that restores the previous limit. Tests use it to script a gateway that
+// never answers without waiting out the production thirty seconds.
+func SetTimeout(d time.Duration) (restore func()) {
+	previous := pelecardClient.Timeout
+	pelecardClient.Timeout = d
+	return func() { pelecardClient.Timeout = previous }
+}
+
 type PeleCard struct {
 	Url     string `json:"-"`
 	Service string `json:"-"`
@@ -48,6 +79,9 @@ type PeleCard struct {
 	Currency    int `json:",omitempty"`
 	MinPayments int `json:",omitempty"`
 	MaxPayments int `json:",omitempty"`
+	// MinPaymentsForCredit is the number of payments from which the deal is
+	// a credit deal. Left out, there is none.
+	MinPaymentsForCredit int `json:",omitzero"`
 
 	ActionType                 string          `json:",omitempty"`
 	CreateToken                string          `json:",omitempty"`
@@ -87,13 +121,14 @@ type service struct {
 }
 
 func (p *PeleCard) Init(organization string, peleCard types.PelecardType, new bool) (err error) {
-	p.User = os.Getenv(organization + "_PELECARD_USER")
-	p.Password = os.Getenv(organization + "_PELECARD_PASSWORD")
+	prefix := organizations.EnvPrefix(organization)
+	p.User = os.Getenv(prefix + "_PELECARD_USER")
+	p.Password = os.Getenv(prefix + "_PELECARD_PASSWORD")
 	if peleCard == types.Regular {
 		if new {
-			p.Terminal = os.Getenv(organization + "_PELECARD_TERMINAL")
+			p.Terminal = os.Getenv(prefix + "_PELECARD_TERMINAL")
 		} else {
-			p.Terminal = os.Getenv(organization + "_PELECARD_TERMINAL_PREEMV")
+			p.Terminal = os.Getenv(prefix + "_PELECARD_TERMINAL_PREEMV")
 		}
 	} else {
 		p.Terminal = os.Getenv("PELECARD_RECURR_TERMINAL")
@@ -214,6 +249,33 @@ func (p *PeleCard) GetTransactionData(createDate string, approvalNo string) (err
 	return fmt.Errorf("unable to find transaction around %s with approval %s", createDate, approvalNo), nil
 }
 
+// ListTransactions returns the transactions Pelecard recorded on this terminal
+// in the given window, as it reports them. Dates are Pelecard's
+// "DD/MM/YYYY HH:MM". A window with none is an empty list, not an error.
+func (p *PeleCard) ListTransactions(startDate string, endDate string) (err error, result []map[string]any) {
+	s := &service{
+		TerminalNumber: p.Terminal,
+		User:           p.User,
+		Password:       p.Password,
+		StartDate:      startDate,
+		EndDate:        endDate,
+	}
+
+	var data []any
+	if err, data = p.servicesArr("/GetTransData", s); err != nil {
+		if errors.Is(err, ErrNoData) {
+			return nil, nil
+		}
+		return err, nil
+	}
+	for _, d := range data {
+		if tx, ok := d.(map[string]any); ok {
+			result = append(result, tx)
+		}
+	}
+	return nil, result
+}
+
 // FetchMuhlafim returns the card replacements Pelecard recorded for this
 // terminal in the given window, keyed by the token being replaced. Dates are
 // Pelecard's "DD/MM/YYYY HH:MM".
@@ -270,7 +332,9 @@ func (p *PeleCard) GetRedirectUrl(actionType types.ActionType, requireCVV bool)
 	p.EmailField = "hide"
 	p.TelField = "hide"
 	p.FeedbackDataTransferMethod = "POST"
-	p.FirstPayment = "auto"
+	if p.FirstPayment == "" {
+		p.FirstPayment = "auto"
+	}
 	p.ShopNo = 1000
 	p.SetFocus = "CC"
 	p.HiddenPelecardLogo = true
@@ -302,6 +366,24 @@ func (p *PeleCard) ChargeByToken(skipAuthorizationNumber bool) (err error, resul
 	return
 }
 
+// RefundByToken credits p.TotalX100 to the card behind p.Token. It is the
+// mirror of ChargeByToken: Pelecard refunds a card on a terminal, not a
+// transaction, so the token must belong to this terminal.
+func (p *PeleCard) RefundByToken() (err error, result map[string]any) {
+	s := &service{
+		TerminalNumber: p.Terminal,
+		User:           p.User,
+		Password:       p.Password,
+		ShopNumber:     "1000",
+		Token:          p.Token,
+		Total:          p.TotalX100,
+		Currency:       p.Currency,
+		ParamX:         p.ParamX,
+	}
+	err, result = p.services("/RefundRegularType", s)
+	return
+}
+
 func (p *PeleCard) AuthorizeCreditCard() (err error, result map[string]any) {
 	s := &service{
 		TerminalNumber: os.Getenv("PELECARD_RECURR_TERMINAL"),
@@ -367,19 +449,23 @@ func (p *PeleCard) services(action string, data *service) (err error, result map
 		return
 	}
 	defer resp.Body.Close()
+	// An error page decodes to nothing, which would otherwise pass for a
+	// success with no result.
+	if resp.StatusCode != http.StatusOK {
+		err = &HTTPError{StatusCode: resp.StatusCode}
+		return
+	}
 	var body map[string]any
 	json.UnmarshalRead(resp.Body, &body)
-	if status, ok := body["StatusCode"]; ok {
-		if status == "000" {
-			err = nil
-			result = body["ResultData"].(map[string]any)
-		} else {
-			if msg, ok := body["ErrorMessage"]; ok {
-				err = fmt.Errorf("%s: %s", status, msg)
-			} else {
-				err = fmt.Errorf("%s: %s", status, body["ErrorMessage"])
-			}
-		}
+	status, ok := body["StatusCode"].(string)
+	switch {
+	case !ok:
+		err = fmt.Errorf("pelecard: %s answered without a status", action)
+	case status == "000":
+		result, _ = body["ResultData"].(map[string]any)
+	default:
+		message, _ := body["ErrorMessage"].(string)
+		err = &StatusError{Code: status, Message: message}
 	}
 
 	return
@@ -405,11 +491,8 @@ func (p *PeleCard) servicesArr(action string, data *service) (err error, result
 		} else if status == statusNoData {
 			err = ErrNoData
 		} else {
-			if msg, ok := body["ErrorMessage"]; ok {
-				err = fmt.Errorf("%s: %s", status, msg)
-			} else {
-				err = fmt.Errorf("%s: %s", status, body["ErrorMessage"])
-			}
+			message, _ := body["ErrorMessage"].(string)
+			err = &StatusError{Code: fmt.Sprint(status), Message: message}
 		}
 	}
 
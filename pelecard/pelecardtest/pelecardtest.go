@@ -0,0 +1,497 @@
+// Package pelecardtest runs a fake Pelecard in-process, so the payment flows
+// can be tested end to end without the real gateway.
+//
+// New starts the server and points the Pelecard environment variables of
+// both organizations at it. A handler under test then talks to it exactly as
+// it talks to Pelecard: it opens a hosted page with /init, and the test plays
+// the payer with Pay, Fail or Cancel, which return the callback Pelecard would
+// post back. Token charges, refunds and the reports answer from the
+// transactions the server has seen.
+//
+// Every endpoint approves unless told otherwise. Script queues outcomes for
+// one endpoint: a decline with any status code from Pelecard's message table,
+// 904 for "no data", or a timeout.
+package pelecardtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json/v2"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"external_payments/pelecard"
+	"external_payments/types"
+)
+
+// Credentials and terminals New puts in the environment. The terminals are
+// distinct, so a test can tell from a Transaction which one a handler used.
+const (
+	User     = "pelecardtest"
+	Password = "secret"
+
+	RecurrentTerminal = "recurrent"
+)
+
+// Organizations are the organizations New configures.
+var Organizations = []string{"ben2", "meshp18"}
+
+// RegularTerminal and PreEMVTerminal name an organization's own terminals.
+func RegularTerminal(organization string) string { return organization + "-regular" }
+func PreEMVTerminal(organization string) string  { return organization + "-preemv" }
+
+// ClientTimeout is how long the Pelecard client waits while a server is
+// running, so a scripted Timeout fails quickly.
+const ClientTimeout = time.Second
+
+// Outcome is how an endpoint answers one call.
+type Outcome struct {
+	// Code is the Pelecard status code; "000" approves.
+	Code string
+	// Hang holds the call until the client gives up.
+	Hang bool
+}
+
+var (
+	Approve = Outcome{Code: "000"}
+	NoData  = Outcome{Code: "904"}
+	Timeout = Outcome{Hang: true}
+)
+
+// Decline answers with code, which should be one of Pelecard's, so the
+// message the handler shows is the real one.
+func Decline(code string) Outcome {
+	return Outcome{Code: code}
+}
+
+// Transaction is a payment, charge or refund the server approved.
+type Transaction struct {
+	Id              string
+	Terminal        string
+	UserKey         string
+	ParamX          string
+	Token           string
+	ApprovalNo      string
+	ConfirmationKey string
+	Total           int
+	Currency        int
+	Refund          bool
+	Created         time.Time
+}
+
+// Callback is what Pelecard posts back when the payer leaves the hosted page:
+// the form, to the good, error or cancel URL the page was opened with.
+type Callback struct {
+	URL  string
+	Form url.Values
+}
+
+// Call is one request the server received.
+type Call struct {
+	Path string
+	Body map[string]any
+}
+
+type page struct {
+	Terminal    string
+	UserKey     string
+	ParamX      string
+	GoodUrl     string
+	ErrorUrl    string
+	CancelUrl   string
+	Total       int
+	Currency    int
+	CreateToken string
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	script       map[string][]Outcome
+	pages        map[string]page
+	transactions []Transaction
+	replacements []types.MuhlafimEntry
+	calls        []Call
+	closing      chan struct{}
+}
+
+// New starts a server and configures Pelecard to use it until the test ends.
+func New(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{
+		script:  map[string][]Outcome{},
+		pages:   map[string]page{},
+		closing: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(func() {
+		close(s.closing)
+		s.Close()
+	})
+	t.Cleanup(pelecard.SetTimeout(ClientTimeout))
+
+	t.Setenv("PELECARD_GW_URL", s.URL)
+	t.Setenv("PELECARD_SERVICES_URL", s.URL)
+	t.Setenv("PELECARD_RECURR_TERMINAL", RecurrentTerminal)
+	for _, org := range Organizations {
+		t.Setenv(org+"_PELECARD_USER", User)
+		t.Setenv(org+"_PELECARD_PASSWORD", Password)
+		t.Setenv(org+"_PELECARD_TERMINAL", RegularTerminal(org))
+		t.Setenv(org+"_PELECARD_TERMINAL_PREEMV", PreEMVTerminal(org))
+	}
+	return s
+}
+
+// Script queues outcomes for the endpoint at path, such as "/DebitRegularType".
+// Each call takes the next one; once they run out, the endpoint approves.
+func (s *Server) Script(path string, outcomes ...Outcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script[path] = append(s.script[path], outcomes...)
+}
+
+// Replace records a card replacement for the Muhlafim report.
+func (s *Server) Replace(entry types.MuhlafimEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replacements = append(s.replacements, entry)
+}
+
+// Record adds a transaction the server approved outside the test's flows: a
+// charge whose answer never reached the handler, or one made elsewhere on the
+// terminal. Id and Created are filled in if empty.
+func (s *Server) Record(tx Transaction) Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx.Id == "" {
+		tx.Id = fmt.Sprintf("rec-%d", len(s.transactions)+1)
+	}
+	if tx.Created.IsZero() {
+		tx.Created = time.Now()
+	}
+	s.transactions = append(s.transactions, tx)
+	return tx
+}
+
+// Transactions returns what the server approved, oldest first.
+func (s *Server) Transactions() []Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Transaction(nil), s.transactions...)
+}
+
+// Calls returns the requests made to path, oldest first.
+func (s *Server) Calls(path string) (found []Call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.calls {
+		if c.Path == path {
+			found = append(found, c)
+		}
+	}
+	return
+}
+
+// Pay completes the hosted page at pageURL: the card is charged, or only
+// registered for J2/J5 pages, and the callback goes to the good URL.
+func (s *Server) Pay(t testing.TB, pageURL string) Callback {
+	t.Helper()
+	p := s.page(t, pageURL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.record(Transaction{
+		Terminal:        p.Terminal,
+		UserKey:         p.UserKey,
+		ParamX:          p.ParamX,
+		Total:           p.Total,
+		Currency:        p.Currency,
+		ConfirmationKey: newId(),
+	})
+	form := form(tx.Id, "000", p)
+	form.Set("ConfirmationKey", tx.ConfirmationKey)
+	form.Set("ApprovalNo", tx.ApprovalNo)
+	if p.CreateToken == "True" {
+		form.Set("Token", tx.Token)
+	}
+	return Callback{URL: p.GoodUrl, Form: form}
+}
+
+// Fail completes the hosted page at pageURL with a card Pelecard refused with
+// code; the callback goes to the error URL.
+func (s *Server) Fail(t testing.TB, pageURL string, code string) Callback {
+	t.Helper()
+	p := s.page(t, pageURL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Callback{URL: p.ErrorUrl, Form: form(newId(), code, p)}
+}
+
+// Cancel leaves the hosted page at pageURL with the cancel button.
+func (s *Server) Cancel(t testing.TB, pageURL string) Callback {
+	t.Helper()
+	p := s.page(t, pageURL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Callback{URL: p.CancelUrl, Form: form("", "555", p)}
+}
+
+func (s *Server) page(t testing.TB, pageURL string) page {
+	t.Helper()
+	id := pageURL[strings.LastIndexByte(pageURL, '/')+1:]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pages[id]
+	if !ok {
+		t.Fatalf("pelecardtest: no hosted page at %q", pageURL)
+	}
+	return p
+}
+
+func form(transactionId, code string, p page) url.Values {
+	return url.Values{
+		"PelecardTransactionId": {transactionId},
+		"PelecardStatusCode":    {code},
+		"UserKey":               {p.UserKey},
+		"ParamX":                {p.ParamX},
+	}
+}
+
+// record assigns tx an id, approval number and token, and keeps it. The
+// caller holds mu.
+func (s *Server) record(tx Transaction) Transaction {
+	n := len(s.transactions) + 1
+	tx.Id = fmt.Sprintf("pt-%04d", n)
+	tx.ApprovalNo = fmt.Sprintf("%07d", n)
+	if tx.Token == "" {
+		tx.Token = fmt.Sprintf("tok-%04d", n)
+	}
+	tx.Created = time.Now()
+	s.transactions = append(s.transactions, tx)
+	return tx
+}
+
+func (s *Server) find(id string) (Transaction, bool) {
+	for _, tx := range s.transactions {
+		if tx.Id == id {
+			return tx, true
+		}
+	}
+	return Transaction{}, false
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	data, _ := io.ReadAll(r.Body)
+	_ = json.Unmarshal(data, &body)
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Path: r.URL.Path, Body: body})
+	outcome := Approve
+	if queue := s.script[r.URL.Path]; len(queue) > 0 {
+		outcome, s.script[r.URL.Path] = queue[0], queue[1:]
+	}
+	s.mu.Unlock()
+
+	if outcome.Hang {
+		select {
+		case <-r.Context().Done():
+		case <-s.closing:
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/init":
+		s.init(w, body, outcome)
+	case "/GetTransaction":
+		if outcome.Code != Approve.Code {
+			writeStatus(w, outcome.Code, nil)
+			return
+		}
+		s.transaction(w, str(body, "TransactionId"))
+	case "/GetTransDataByTrxId":
+		if outcome.Code != Approve.Code {
+			writeStatus(w, outcome.Code, nil)
+			return
+		}
+		s.transaction(w, str(body, "DebitTrxId"))
+	case "/ValidateByUniqueKey":
+		s.validate(w, body, outcome)
+	case "/DebitRegularType", "/RefundRegularType":
+		if outcome.Code != Approve.Code {
+			writeStatus(w, outcome.Code, nil)
+			return
+		}
+		s.debit(w, body, r.URL.Path == "/RefundRegularType")
+	case "/GetTransData":
+		if outcome.Code != Approve.Code {
+			writeStatus(w, outcome.Code, nil)
+			return
+		}
+		s.transData(w, body)
+	case "/GetTerminalMuhlafim":
+		if outcome.Code != Approve.Code {
+			writeStatus(w, outcome.Code, nil)
+			return
+		}
+		if len(s.replacements) == 0 {
+			writeStatus(w, NoData.Code, nil)
+			return
+		}
+		writeStatus(w, Approve.Code, s.replacements)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) init(w http.ResponseWriter, body map[string]any, outcome Outcome) {
+	if outcome.Code != Approve.Code {
+		code, _ := strconv.Atoi(outcome.Code)
+		writeJSON(w, map[string]any{
+			"URL":   "",
+			"Error": map[string]any{"ErrCode": code, "ErrMsg": pelecard.GetMessage(outcome.Code)},
+		})
+		return
+	}
+	id := newId()
+	s.pages[id] = page{
+		Terminal:    str(body, "terminal"),
+		UserKey:     str(body, "UserKey"),
+		ParamX:      str(body, "ParamX"),
+		GoodUrl:     str(body, "GoodUrl"),
+		ErrorUrl:    str(body, "ErrorUrl"),
+		CancelUrl:   str(body, "CancelUrl"),
+		Total:       num(body, "Total"),
+		Currency:    num(body, "Currency"),
+		CreateToken: str(body, "CreateToken"),
+	}
+	writeJSON(w, map[string]any{
+		"URL":   s.URL + "/page/" + id,
+		"Error": map[string]any{"ErrCode": 0, "ErrMsg": ""},
+	})
+}
+
+func (s *Server) transaction(w http.ResponseWriter, id string) {
+	tx, ok := s.find(id)
+	if !ok {
+		writeStatus(w, NoData.Code, nil)
+		return
+	}
+	writeStatus(w, Approve.Code, resultData(tx))
+}
+
+// validate answers "1" when the confirmation key, user key and amount are
+// those of a payment made on the hosted page, as Pelecard does.
+func (s *Server) validate(w http.ResponseWriter, body map[string]any, outcome Outcome) {
+	answer := "0"
+	if outcome.Code == Approve.Code {
+		for _, tx := range s.transactions {
+			if tx.ConfirmationKey != "" && tx.ConfirmationKey == str(body, "ConfirmationKey") &&
+				tx.UserKey == str(body, "UniqueKey") && strconv.Itoa(tx.Total) == str(body, "TotalX100") {
+				answer = "1"
+				break
+			}
+		}
+	}
+	_, _ = w.Write([]byte(answer))
+}
+
+func (s *Server) debit(w http.ResponseWriter, body map[string]any, refund bool) {
+	total, _ := strconv.Atoi(str(body, "Total"))
+	tx := s.record(Transaction{
+		Terminal: str(body, "TerminalNumber"),
+		ParamX:   str(body, "ParamX"),
+		Token:    str(body, "Token"),
+		Total:    total,
+		Currency: num(body, "Currency"),
+		Refund:   refund,
+	})
+	writeStatus(w, Approve.Code, resultData(tx))
+}
+
+// transData lists the transactions in the window, in Pelecard's report
+// format. An empty window is 904, as it is on the real terminal.
+func (s *Server) transData(w http.ResponseWriter, body map[string]any) {
+	const layout = "02/01/2006 15:04"
+	start, _ := time.ParseInLocation(layout, str(body, "startDate"), time.Local)
+	end, _ := time.ParseInLocation(layout, str(body, "endDate"), time.Local)
+	var found []map[string]any
+	for _, tx := range s.transactions {
+		if tx.Terminal == str(body, "TerminalNumber") && !tx.Created.Before(start) && tx.Created.Before(end) {
+			found = append(found, resultData(tx))
+		}
+	}
+	if len(found) == 0 {
+		writeStatus(w, NoData.Code, nil)
+		return
+	}
+	writeStatus(w, Approve.Code, found)
+}
+
+// resultData is a transaction as Pelecard reports it: strings throughout,
+// the card masked to its last four digits.
+func resultData(tx Transaction) map[string]any {
+	return map[string]any{
+		"PelecardTransactionId":   tx.Id,
+		"TransactionId":           tx.Id,
+		"StatusCode":              Approve.Code,
+		"DebitApproveNumber":      tx.ApprovalNo,
+		"VoucherId":               "v" + tx.ApprovalNo,
+		"Token":                   tx.Token,
+		"CreditCardNumber":        "458000******1234",
+		"CreditCardExpDate":       "1230",
+		"CreditCardBrand":         "2",
+		"DebitTotal":              strconv.Itoa(tx.Total),
+		"DebitCurrency":           strconv.Itoa(tx.Currency),
+		"TotalPayments":           "1",
+		"AdditionalDetailsParamX": tx.ParamX,
+		"TransactionInitTime":     tx.Created.Format("02/01/2006 15:04:05"),
+		"TransactionUpdateTime":   tx.Created.Format("02/01/2006 15:04:05"),
+	}
+}
+
+// writeStatus answers in the services format. Codes other than 000 carry the
+// message from Pelecard's table.
+func writeStatus(w http.ResponseWriter, code string, result any) {
+	answer := map[string]any{"StatusCode": code}
+	if code == Approve.Code {
+		answer["ResultData"] = result
+	} else if message := pelecard.GetMessage(code); message != "" {
+		answer["ErrorMessage"] = message
+	} else {
+		answer["ErrorMessage"] = "Data not exist."
+	}
+	writeJSON(w, answer)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.MarshalWrite(w, v)
+}
+
+func str(body map[string]any, key string) string {
+	s, _ := body[key].(string)
+	return s
+}
+
+func num(body map[string]any, key string) int {
+	n, _ := body[key].(float64)
+	return int(n)
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,52 @@
+package pelecard
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A refund goes to the credit endpoint with the token and amount, and never to
+// the debit one.
+func TestRefundByTokenSendsCredit(t *testing.T) {
+	var path, got string
+	card, done := muhlafimCard(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+		w.Write([]byte(`{"StatusCode":"000","ResultData":{"PelecardTransactionId":"rf-1"}}`))
+	})
+	defer done()
+	card.Token = "tok1"
+	card.TotalX100 = "1250"
+	card.Currency = 2
+
+	err, result := card.RefundByToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if path != "/RefundRegularType" {
+		t.Errorf("refund posted to %s", path)
+	}
+	if result["PelecardTransactionId"] != "rf-1" {
+		t.Errorf("result = %v", result)
+	}
+	for _, want := range []string{`"tok1"`, `"1250"`, `"123"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("request body %s missing %s", got, want)
+		}
+	}
+}
+
+func TestRefundByTokenGatewayError(t *testing.T) {
+	card, done := muhlafimCard(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"StatusCode":"506","ErrorMessage":"Token number abnormal"}`))
+	})
+	defer done()
+
+	err, _ := card.RefundByToken()
+	if err == nil || !strings.HasPrefix(err.Error(), "506") {
+		t.Fatalf("want a 506 error, got %v", err)
+	}
+}
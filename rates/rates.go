@@ -0,0 +1,164 @@
+// Package rates reads published exchange rates into the rates table the
+// counters convert contributions with. Two formats are read:
+//
+//   - the European Central Bank's reference rates, eurofxref.csv or
+//     eurofxref-hist.csv: a Date column, then one column per currency with
+//     its units per euro;
+//   - the Bank of Israel's representative rates as its series export them:
+//     BASE_CURRENCY, TIME_PERIOD and OBS_VALUE columns, with shekels per unit
+//     of the base currency.
+//
+// Either way a date's rates are kept against the dollar, so that date needs
+// the dollar's own rate in the file.
+package rates
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"external_payments/types"
+)
+
+// ErrFormat is returned for a file that is neither of the formats read.
+var ErrFormat = errors.New("rates: not an ECB or Bank of Israel CSV")
+
+// quote is what one unit of a currency was worth on a date in the source's
+// own currency: euros for the ECB, shekels for the Bank of Israel.
+type quote struct {
+	date     string
+	currency string
+	value    float64
+}
+
+// Parse reads a file in either format into rates against the dollar, sorted
+// by date and currency. A date without the dollar's rate is skipped, and
+// reported in skipped.
+func Parse(r io.Reader) (rates []types.ExchangeRate, skipped []string, err error) {
+	rd := csv.NewReader(r)
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	records, err := rd.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("rates: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, ErrFormat
+	}
+	header := records[0]
+	for i := range header {
+		header[i] = strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+
+	switch {
+	case header[0] == "DATE":
+		quotes, err := parseECB(header, records[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		rates, skipped = againstDollar(quotes, "EUR", "ecb")
+	case slices.Contains(header, "BASE_CURRENCY") && slices.Contains(header, "TIME_PERIOD") &&
+		slices.Contains(header, "OBS_VALUE"):
+		quotes, err := parseBOI(header, records[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		rates, skipped = againstDollar(quotes, "ILS", "boi")
+	default:
+		return nil, nil, ErrFormat
+	}
+	return rates, skipped, nil
+}
+
+// parseECB reads units of each currency per euro. The ECB writes N/A, or
+// nothing, for a currency it did not quote that day.
+func parseECB(header []string, records [][]string) (quotes []quote, err error) {
+	for n, record := range records {
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		date, err := parseDate(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("rates: line %d: %w", n+2, err)
+		}
+		for i := 1; i < len(record) && i < len(header); i++ {
+			value, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+			if header[i] == "" || err != nil || value <= 0 {
+				continue
+			}
+			quotes = append(quotes, quote{date: date, currency: header[i], value: 1 / value})
+		}
+	}
+	return quotes, nil
+}
+
+// parseBOI reads shekels per unit of each base currency.
+func parseBOI(header []string, records [][]string) (quotes []quote, err error) {
+	base, period, value := slices.Index(header, "BASE_CURRENCY"), slices.Index(header, "TIME_PERIOD"),
+		slices.Index(header, "OBS_VALUE")
+	counter := slices.Index(header, "COUNTER_CURRENCY")
+	for n, record := range records {
+		if len(record) <= max(base, period, value) {
+			continue
+		}
+		if counter >= 0 && counter < len(record) && !strings.EqualFold(strings.TrimSpace(record[counter]), "ILS") {
+			return nil, fmt.Errorf("rates: line %d: rate against %s, not ILS", n+2, record[counter])
+		}
+		date, err := parseDate(record[period])
+		if err != nil {
+			return nil, fmt.Errorf("rates: line %d: %w", n+2, err)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[value]), 64)
+		if err != nil || v <= 0 {
+			continue
+		}
+		quotes = append(quotes, quote{date: date, currency: strings.ToUpper(strings.TrimSpace(record[base])), value: v})
+	}
+	return quotes, nil
+}
+
+func parseDate(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.DateOnly, "02 January 2006", "02/01/2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(time.DateOnly), nil
+		}
+	}
+	return "", fmt.Errorf("date %q", s)
+}
+
+// againstDollar turns a source's quotes, each the value of one unit of a
+// currency in the source's own, into dollars. The source's currency is worth
+// one of itself.
+func againstDollar(quotes []quote, own, source string) (rates []types.ExchangeRate, skipped []string) {
+	byDate := map[string]map[string]float64{}
+	for _, q := range quotes {
+		if byDate[q.date] == nil {
+			byDate[q.date] = map[string]float64{own: 1}
+		}
+		byDate[q.date][q.currency] = q.value
+	}
+	for _, date := range slices.Sorted(maps.Keys(byDate)) {
+		values := byDate[date]
+		dollar, ok := values["USD"]
+		if !ok {
+			skipped = append(skipped, date)
+			continue
+		}
+		for _, code := range slices.Sorted(maps.Keys(values)) {
+			if code == "USD" {
+				continue
+			}
+			rates = append(rates, types.ExchangeRate{
+				Date: date, Currency: code, USD: values[code] / dollar, Source: source,
+			})
+		}
+	}
+	return rates, skipped
+}
@@ -0,0 +1,86 @@
+package rates
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"external_payments/types"
+)
+
+func rate(t *testing.T, rates []types.ExchangeRate, date, currency string) float64 {
+	t.Helper()
+	for _, r := range rates {
+		if r.Date == date && r.Currency == currency {
+			return r.USD
+		}
+	}
+	t.Fatalf("no %s rate on %s in %v", currency, date, rates)
+	return 0
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestParseECB(t *testing.T) {
+	file := "Date,USD,JPY,ILS,CYP,\n" +
+		"2024-01-05,1.0921,158.05,4.0,N/A,\n" +
+		"2024-01-04,1.0953,,4.02,N/A,\n"
+	rates, skipped, err := Parse(strings.NewReader(file))
+	if err != nil || len(skipped) != 0 {
+		t.Fatal(err, skipped)
+	}
+	if got := rate(t, rates, "2024-01-05", "EUR"); !near(got, 1.0921) {
+		t.Errorf("EUR = %v", got)
+	}
+	if got := rate(t, rates, "2024-01-05", "ILS"); !near(got, 1.0921/4.0) {
+		t.Errorf("ILS = %v", got)
+	}
+	if len(rates) != 5 || rates[0].Date != "2024-01-04" || rates[0].Source != "ecb" {
+		t.Errorf("rates %v", rates)
+	}
+}
+
+// The daily file has spaces after the commas and spelled-out dates.
+func TestParseECBDaily(t *testing.T) {
+	rates, _, err := Parse(strings.NewReader("Date, USD, ILS, \n05 January 2024, 1.0921, 4.0, \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rate(t, rates, "2024-01-05", "ILS"); !near(got, 1.0921/4.0) {
+		t.Errorf("ILS = %v", got)
+	}
+}
+
+func TestParseBOI(t *testing.T) {
+	file := "SERIES_CODE,BASE_CURRENCY,COUNTER_CURRENCY,TIME_PERIOD,OBS_VALUE\n" +
+		"RER_USD_ILS,USD,ILS,2024-01-05,3.7\n" +
+		"RER_EUR_ILS,EUR,ILS,2024-01-05,4.04\n" +
+		"RER_EUR_ILS,EUR,ILS,2024-01-08,4.05\n"
+	rates, skipped, err := Parse(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rate(t, rates, "2024-01-05", "ILS"); !near(got, 1/3.7) {
+		t.Errorf("ILS = %v", got)
+	}
+	if got := rate(t, rates, "2024-01-05", "EUR"); !near(got, 4.04/3.7) {
+		t.Errorf("EUR = %v", got)
+	}
+	// Without the dollar that day there is nothing to convert through.
+	if len(skipped) != 1 || skipped[0] != "2024-01-08" {
+		t.Errorf("skipped %v", skipped)
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	for _, file := range []string{"", "currency,rate\nUSD,1\n"} {
+		if _, _, err := Parse(strings.NewReader(file)); !errors.Is(err, ErrFormat) {
+			t.Errorf("%q: %v", file, err)
+		}
+	}
+	file := "BASE_CURRENCY,COUNTER_CURRENCY,TIME_PERIOD,OBS_VALUE\nUSD,EUR,2024-01-05,0.9\n"
+	if _, _, err := Parse(strings.NewReader(file)); err == nil {
+		t.Error("rates against a currency other than the shekel were read")
+	}
+}
@@ -0,0 +1,168 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pp "github.com/plutov/paypal/v4"
+
+	"external_payments/db"
+	"external_payments/paypal"
+	"external_payments/types"
+)
+
+const (
+	// Unrecorded is a PayPal capture of one of our requests that
+	// civicrm_bb_ext_paypal does not have, so it never reached Priority.
+	Unrecorded Kind = "unrecorded"
+	// Uncaptured is an order the payer approved that was never captured: the
+	// payer was sent back to us and the capture failed or never ran.
+	Uncaptured Kind = "uncaptured"
+	// Refunded is a refund of one of our payments that we did not make: it
+	// was done in the PayPal dashboard.
+	Refunded Kind = "refunded"
+	// Chargeback is a payment the payer's bank or PayPal took back.
+	Chargeback Kind = "chargeback"
+)
+
+// PayPal's side of a reconciliation, and what we recorded of it. Tests
+// replace them; they need PayPal credentials and the database otherwise.
+var (
+	searchPaypal      = paypal.SearchTransactions
+	paypalOrderStatus = paypal.OrderStatus
+	knownCaptures     = db.KnownPaypalCaptures
+)
+
+// PayPal transaction event codes: T00xx are payments, T1107 a refund, T1106
+// and T1201 money taken back by a reversal or a chargeback.
+const (
+	paypalRefund     = "T1107"
+	paypalReversal   = "T1106"
+	paypalChargeback = "T1201"
+)
+
+// Paypal reconciles the PayPal requests created in [from, to) against PayPal's
+// transaction report. It changes nothing: each finding needs a person, either
+// to record a payment in Priority or to undo one there.
+//
+// A payment or refund is ours if its custom field, where we put the UserKey,
+// names one of our requests; the invoice id, our reference, is reported with
+// it. The request may be older than from: a refund or chargeback comes weeks
+// after the payment. Anything else on the account is someone else's and is
+// left alone.
+func Paypal(ctx context.Context, from, to time.Time) (Report, error) {
+	report := Report{From: from, To: to}
+
+	requests, err := db.ListRequests(from, to)
+	if err != nil {
+		return report, fmt.Errorf("list requests: %w", err)
+	}
+	requests = slices.DeleteFunc(requests, func(r types.RequestSummary) bool { return r.Gateway != "paypal" })
+	report.Requests = len(requests)
+	byUserKey := map[string]types.RequestSummary{}
+	for _, r := range requests {
+		byUserKey[r.UserKey] = r
+	}
+
+	transactions, err := searchPaypal(ctx, from, to.Add(Settle))
+	if err != nil {
+		return report, err
+	}
+	report.Transactions = len(transactions)
+
+	ids := make([]string, 0, len(transactions))
+	for _, t := range transactions {
+		ids = append(ids, t.TransactionInfo.TransactionID)
+	}
+	known, err := knownCaptures(ids)
+	if err != nil {
+		return report, fmt.Errorf("recorded captures: %w", err)
+	}
+	refunds, err := knownRefunds("paypal", ids)
+	if err != nil {
+		return report, fmt.Errorf("recorded refunds: %w", err)
+	}
+
+	captured := map[string]bool{}
+	for _, t := range transactions {
+		info := t.TransactionInfo
+		r, ours := byUserKey[info.CustomField]
+		if !ours {
+			if r, ours = loadRequest(info.CustomField); !ours {
+				continue
+			}
+		}
+		f := Finding{
+			UserKey: r.UserKey, Reference: info.InvoiceID, Organization: r.Organization,
+			Status: r.Status, Amount: r.Price, Currency: r.Currency,
+			TransactionId: info.TransactionID, GatewayAmount: paypalAmount(info.TransactionAmount),
+		}
+		switch code := info.TransactionEventCode; {
+		case strings.HasPrefix(code, "T00"):
+			if info.TransactionStatus != "S" {
+				continue
+			}
+			captured[r.UserKey] = true
+			if known[info.TransactionID] {
+				continue
+			}
+			f.Kind = Unrecorded
+		case code == paypalRefund:
+			if refunds[info.TransactionID] {
+				continue
+			}
+			f.Kind = Refunded
+		case code == paypalReversal || code == paypalChargeback:
+			f.Kind = Chargeback
+		default:
+			continue
+		}
+		report.Findings = append(report.Findings, f)
+	}
+
+	for _, r := range requests {
+		if r.PaypalOrderId == "" || r.Status == "valid" || captured[r.UserKey] || !stale(r.CreatedAt) {
+			continue
+		}
+		status, err := paypalOrderStatus(ctx, r.PaypalOrderId)
+		if err != nil {
+			return report, err
+		}
+		if status != "APPROVED" {
+			continue
+		}
+		report.Findings = append(report.Findings, Finding{
+			Kind: Uncaptured, UserKey: r.UserKey, Reference: r.Reference, Organization: r.Organization,
+			Status: r.Status, Amount: r.Price, Currency: r.Currency, TransactionId: r.PaypalOrderId,
+		})
+	}
+
+	for _, f := range report.Findings {
+		log.Printf("reconcile paypal: %s user_key=%s reference=%s status=%s transaction=%s",
+			f.Kind, f.UserKey, f.Reference, f.Status, f.TransactionId)
+	}
+	return report, nil
+}
+
+// loadRequest finds a request from before the window by its UserKey.
+func loadRequest(userKey string) (types.RequestSummary, bool) {
+	var p types.PaymentRequest
+	if userKey == "" || db.LoadRequest(userKey, &p) != nil {
+		return types.RequestSummary{}, false
+	}
+	return types.RequestSummary{
+		UserKey: p.UserKey, Reference: p.Reference, Organization: p.Organization,
+		Status: p.Status, Price: p.Price, Currency: p.Currency, CreatedAt: p.CreatedAt, Gateway: "paypal",
+	}, true
+}
+
+// paypalAmount reads a PayPal amount, which is signed: a refund is negative.
+func paypalAmount(m pp.Money) float64 {
+	v, _ := strconv.ParseFloat(m.Value, 64)
+	return v
+}
@@ -0,0 +1,128 @@
+package reconcile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pp "github.com/plutov/paypal/v4"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/types"
+)
+
+// fakePaypal stands in for PayPal and for the captures and refunds we recorded.
+type fakePaypal struct {
+	transactions []pp.SearchTransactionDetails
+	orders       map[string]string
+	known        map[string]bool
+	refunds      []string
+}
+
+func (f *fakePaypal) use(t *testing.T) {
+	search, status, known := searchPaypal, paypalOrderStatus, knownCaptures
+	t.Cleanup(func() { searchPaypal, paypalOrderStatus, knownCaptures = search, status, known })
+	searchPaypal = func(context.Context, time.Time, time.Time) ([]pp.SearchTransactionDetails, error) {
+		return f.transactions, nil
+	}
+	paypalOrderStatus = func(_ context.Context, orderID string) (string, error) { return f.orders[orderID], nil }
+	knownCaptures = func([]string) (map[string]bool, error) { return f.known, nil }
+	recordedRefunds(t, f.refunds...)
+}
+
+func (f *fakePaypal) add(id, code, userKey, reference, amount string) {
+	f.transactions = append(f.transactions, pp.SearchTransactionDetails{TransactionInfo: pp.SearchTransactionInfo{
+		TransactionID: id, TransactionEventCode: code, TransactionStatus: "S",
+		CustomField: userKey, InvoiceID: reference,
+		TransactionAmount: pp.Money{Currency: "USD", Value: amount},
+	}})
+}
+
+func paypalRequest(t *testing.T, store *dbtest.Store, userKey, reference, status string) {
+	t.Helper()
+	order := "order-" + userKey
+	err := store.StoreRequest(types.PaymentRequest{
+		UserKey: userKey, Reference: reference, Price: 50, Currency: "USD", Organization: "ben2",
+		PaypalOrderId: &order,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetStatus(userKey, status)
+	store.Backdate(userKey, 2*time.Hour)
+}
+
+func TestPaypal(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	fake := &fakePaypal{
+		orders:  map[string]string{"order-u-approved": "APPROVED", "order-u-abandoned": "CREATED"},
+		known:   map[string]bool{"cap-recorded": true},
+		refunds: []string{"ref-ours"},
+	}
+	fake.use(t)
+
+	paypalRequest(t, store, "u-recorded", "1fam-1", "valid")
+	fake.add("cap-recorded", "T0006", "u-recorded", "1fam-1", "50.00")
+	// Captured, but the capture never made it into civicrm_bb_ext_paypal.
+	paypalRequest(t, store, "u-unrecorded", "1fam-2", "in-process")
+	fake.add("cap-unrecorded", "T0006", "u-unrecorded", "1fam-2", "50.00")
+	// Approved on PayPal; the capture failed.
+	paypalRequest(t, store, "u-approved", "1fam-3", "error")
+	// The payer never approved.
+	paypalRequest(t, store, "u-abandoned", "1fam-4", "in-process")
+	// Refunded through us, refunded in the dashboard, charged back.
+	fake.add("ref-ours", "T1107", "u-recorded", "1fam-1", "-10.00")
+	fake.add("ref-dashboard", "T1107", "u-recorded", "1fam-1", "-20.00")
+	fake.add("cb-1", "T1201", "u-recorded", "1fam-1", "-50.00")
+	// Someone else's payment on the same account.
+	fake.add("cap-other", "T0006", "", "INV-9", "5.00")
+
+	report, err := Paypal(context.Background(), time.Now().Add(-3*time.Hour), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]Kind{}
+	for _, f := range report.Findings {
+		got[f.TransactionId] = f.Kind
+	}
+	want := map[string]Kind{
+		"cap-unrecorded":   Unrecorded,
+		"order-u-approved": Uncaptured,
+		"ref-dashboard":    Refunded,
+		"cb-1":             Chargeback,
+	}
+	if len(got) != len(want) {
+		t.Errorf("findings %+v", report.Findings)
+	}
+	for id, kind := range want {
+		if got[id] != kind {
+			t.Errorf("%s: %q, want %q", id, got[id], kind)
+		}
+	}
+	if status, _ := db.GetStatus("u-unrecorded"); status != "in-process" {
+		t.Errorf("u-unrecorded is %q: PayPal findings are reported, not fixed", status)
+	}
+}
+
+// A dashboard refund of a payment made before the window is still ours.
+func TestPaypalRefundOfOlderPayment(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	fake := &fakePaypal{}
+	fake.use(t)
+
+	paypalRequest(t, store, "u-old", "1fam-1", "valid")
+	store.Backdate("u-old", 30*24*time.Hour)
+	fake.add("ref-late", "T1107", "u-old", "1fam-1", "-50.00")
+
+	report, err := Paypal(context.Background(), time.Now().Add(-24*time.Hour), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count(Refunded) != 1 || report.Findings[0].UserKey != "u-old" || report.Findings[0].GatewayAmount != -50 {
+		t.Errorf("findings %+v", report.Findings)
+	}
+}
@@ -0,0 +1,382 @@
+// Package reconcile compares our payment requests with the gateway's own
+// record of what it charged.
+//
+// A request can be left in new or in-process for good: the process dies
+// between marking it in-process and recording the outcome, or the callback
+// arrives and the lookup that confirms it fails. The payer was charged, or
+// was not, and nobody is told. Reconciling reads Pelecard's transaction report
+// for each organization's terminals, matches it to civicrm_bb_ext_requests,
+// and marks a stuck request valid when Pelecard approved it. Every other
+// disagreement is reported, not fixed: deciding that a payment we refused was
+// taken after all, or that one we took is not there, needs a person.
+//
+// Paypal does the same against PayPal's transaction search, and only reports.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"external_payments/currency"
+	"external_payments/db"
+	"external_payments/pelecard"
+	"external_payments/types"
+)
+
+// Kind is what a Finding says is wrong.
+type Kind string
+
+const (
+	// Paid is a request stuck in new or in-process that the gateway approved.
+	// It is marked valid when fixing.
+	Paid Kind = "paid"
+	// Refused is a request we marked invalid, error or cancel that the
+	// gateway approved: the payer was charged and told otherwise.
+	Refused Kind = "refused"
+	// Amount is a matched request whose gateway total differs from ours. A
+	// stuck one is left for a person rather than marked valid.
+	Amount Kind = "amount"
+	// Missing is a request with a transaction id the gateway does not list.
+	Missing Kind = "missing"
+	// Stuck is a request in new or in-process with no gateway transaction,
+	// older than Settle.
+	Stuck Kind = "stuck"
+	// Unknown is a gateway transaction no request accounts for.
+	Unknown Kind = "unknown"
+)
+
+// Settle is how long a request may stay in new or in-process before it counts
+// as stuck: a payer can sit on the hosted page that long.
+const Settle = 30 * time.Minute
+
+// Finding is one disagreement between a request and the gateway. Either side
+// may be missing: Unknown has no request, Stuck and Missing no transaction.
+type Finding struct {
+	Kind          Kind
+	UserKey       string
+	Reference     string
+	Organization  string
+	Status        string
+	Amount        float64
+	Currency      string
+	Terminal      string
+	TransactionId string
+	GatewayAmount float64
+	// Fixed is set when the request was corrected, rather than reported.
+	Fixed bool
+}
+
+// Report is what a reconciliation found.
+type Report struct {
+	From, To     time.Time
+	Requests     int
+	Transactions int
+	Findings     []Finding
+}
+
+// Count returns how many findings are of kind.
+func (r Report) Count(kind Kind) (n int) {
+	for _, f := range r.Findings {
+		if f.Kind == kind {
+			n++
+		}
+	}
+	return
+}
+
+// transaction is a row of Pelecard's report. Pelecard gives a transaction two
+// ids; a request records TransactionId, and either may be quoted back to us.
+type transaction struct {
+	Id         string
+	AltId      string
+	Terminal   string
+	ParamX     string
+	ApprovalNo string
+	Total      float64
+	Created    time.Time
+	matched    bool
+	// organizations use the terminal; the recurring one is shared.
+	organizations []string
+}
+
+// knownRefunds is the refunds we made, which both gateways' reports list
+// beside the payments. Tests replace it; it needs the database otherwise.
+var knownRefunds = db.KnownRefunds
+
+// pelecardLayout is how Pelecard writes times in its report; its window
+// parameters are the same to the minute.
+const (
+	pelecardLayout = "02/01/2006 15:04:05"
+	windowLayout   = "02/01/2006 15:04"
+)
+
+// Pelecard reconciles the Pelecard requests created in [from, to) against the
+// transactions on the organizations' terminals. With fix set, a stuck request
+// the gateway approved is marked valid; otherwise it is only reported.
+//
+// The report is fetched a little past to, so a request made just before to
+// still finds a charge that completed just after it. If any terminal cannot
+// be read the whole run fails: a partial report would call every payment on
+// that terminal unknown.
+func Pelecard(organizations []string, from, to time.Time, fix bool) (Report, error) {
+	report := Report{From: from, To: to}
+
+	requests, err := db.ListRequests(from, to)
+	if err != nil {
+		return report, fmt.Errorf("list requests: %w", err)
+	}
+	requests = slices.DeleteFunc(requests, func(r types.RequestSummary) bool { return r.Gateway != "pelecard" })
+	report.Requests = len(requests)
+
+	transactions, err := fetch(organizations, from, to.Add(Settle))
+	if err != nil {
+		return report, err
+	}
+	report.Transactions = len(transactions)
+
+	// Our own refunds are set aside before matching: one is listed under the
+	// payment's ParamX, and must not be taken for the payment itself.
+	var ids []string
+	for _, tx := range transactions {
+		ids = append(ids, tx.Id)
+		if tx.AltId != "" {
+			ids = append(ids, tx.AltId)
+		}
+	}
+	refunds, err := knownRefunds("pelecard", ids)
+	if err != nil {
+		return report, fmt.Errorf("recorded refunds: %w", err)
+	}
+	transactions = slices.DeleteFunc(transactions, func(tx *transaction) bool {
+		return refunds[tx.Id] || (tx.AltId != "" && refunds[tx.AltId])
+	})
+
+	byId := map[string]*transaction{}
+	byReference := map[string][]*transaction{}
+	for _, tx := range transactions {
+		byId[tx.Id] = tx
+		if tx.AltId != "" {
+			byId[tx.AltId] = tx
+		}
+		byReference[tx.ParamX] = append(byReference[tx.ParamX], tx)
+	}
+
+	// First the requests whose transaction id we recorded, so that a failed
+	// attempt does not take the transaction of the retry that paid for the
+	// same reference.
+	found := make([]*transaction, len(requests))
+	for i, r := range requests {
+		if tx := byId[r.TransactionId]; r.TransactionId != "" && tx != nil {
+			tx.matched = true
+			found[i] = tx
+		}
+	}
+	// A reference is only ours on our own terminals: another organization
+	// may use the same one.
+	for i, r := range requests {
+		if found[i] != nil || r.TransactionId != "" {
+			continue
+		}
+		for _, tx := range byReference[r.Reference] {
+			if !tx.matched && slices.Contains(tx.organizations, r.Organization) {
+				tx.matched = true
+				found[i] = tx
+				break
+			}
+		}
+	}
+
+	for i, r := range requests {
+		if f, ok := compare(r, found[i], fix); ok {
+			report.Findings = append(report.Findings, f)
+		}
+	}
+
+	// Whatever is left over is unknown, even under a reference we know: a
+	// second charge for one request is exactly what must be reported.
+	for _, tx := range transactions {
+		if tx.matched || tx.Created.Before(from) || !tx.Created.Before(to) {
+			continue
+		}
+		report.Findings = append(report.Findings, Finding{
+			Kind: Unknown, Reference: tx.ParamX, Terminal: tx.Terminal,
+			TransactionId: tx.Id, GatewayAmount: tx.Total,
+		})
+	}
+
+	for _, f := range report.Findings {
+		log.Printf("reconcile: %s user_key=%s reference=%s status=%s transaction=%s terminal=%s fixed=%t",
+			f.Kind, f.UserKey, f.Reference, f.Status, f.TransactionId, f.Terminal, f.Fixed)
+	}
+	return report, nil
+}
+
+// Start reconciles in the background every RECONCILE_INTERVAL (a Go
+// duration), over the day up to Settle ago, fixing what it may. Unset, it does
+// not run: reconciling reads every terminal's report, and once an hour is
+// plenty.
+func Start(ctx context.Context, organizations []string) {
+	v := os.Getenv("RECONCILE_INTERVAL")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		log.Printf("reconcile: RECONCILE_INTERVAL=%q is not a duration, not running", v)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				to := time.Now().Add(-Settle)
+				report, err := Pelecard(organizations, to.Add(-24*time.Hour), to, true)
+				if err != nil {
+					log.Printf("reconcile: %v", err)
+					continue
+				}
+				log.Printf("reconcile: %d requests, %d transactions, %d findings",
+					report.Requests, report.Transactions, len(report.Findings))
+			}
+		}
+	}()
+}
+
+// compare decides what, if anything, is wrong with request r given the
+// transaction matched to it, and fixes it if it may.
+func compare(r types.RequestSummary, tx *transaction, fix bool) (Finding, bool) {
+	f := Finding{
+		UserKey: r.UserKey, Reference: r.Reference, Organization: r.Organization,
+		Status: r.Status, Amount: r.Price, Currency: r.Currency, TransactionId: r.TransactionId,
+	}
+	pending := r.Status == "new" || r.Status == "in-process"
+
+	if tx == nil {
+		switch {
+		case r.TransactionId != "" && r.Status == "valid":
+			f.Kind = Missing
+		case pending && !stale(r.CreatedAt):
+			return f, false
+		case pending:
+			f.Kind = Stuck
+		default:
+			return f, false
+		}
+		return f, true
+	}
+
+	f.Terminal, f.TransactionId, f.GatewayAmount = tx.Terminal, tx.Id, tx.Total
+	switch r.Status {
+	case "new", "in-process":
+		if !sameAmount(r, tx) {
+			f.Kind = Amount
+			break
+		}
+		f.Kind = Paid
+		if fix {
+			f.Fixed = markValid(r)
+		}
+	case "invalid", "error", "cancel":
+		f.Kind = Refused
+	default:
+		if sameAmount(r, tx) {
+			return f, false
+		}
+		f.Kind = Amount
+	}
+	return f, true
+}
+
+// sameAmount reports whether the gateway took what r asked for.
+func sameAmount(r types.RequestSummary, tx *transaction) bool {
+	cur, err := currency.Lookup(r.Currency)
+	return err == nil && cur.MinorUnits(r.Price) == cur.MinorUnits(tx.Total)
+}
+
+// markValid moves a stuck request to valid, unless it has moved on by itself
+// since it was listed: a late callback must not be overwritten.
+func markValid(r types.RequestSummary) bool {
+	return db.TransitionFrom(r.UserKey, db.Status(r.Status), db.StatusValid, "reconcile", "approved on "+r.TransactionId) == nil
+}
+
+func stale(createdAt string) bool {
+	created, err := time.ParseInLocation(time.DateTime, createdAt, time.Local)
+	return err != nil || time.Since(created) > Settle
+}
+
+// fetch reads the report of every terminal the organizations use, a day at a
+// time. The recurring terminal is shared, so each terminal is read once, and
+// its transactions are listed as every organization's.
+func fetch(organizations []string, from, to time.Time) (transactions []*transaction, err error) {
+	owners := map[string][]string{}
+	for _, org := range organizations {
+		for _, t := range []struct {
+			kind types.PelecardType
+			new  bool
+		}{{types.Regular, true}, {types.Regular, false}, {types.Recurrent, true}} {
+			card := &pelecard.PeleCard{}
+			if err := card.Init(org, t.kind, t.new); err != nil {
+				// A terminal this deployment does not have, such as a
+				// pre-EMV one that was retired.
+				continue
+			}
+			read := len(owners[card.Terminal]) > 0
+			owners[card.Terminal] = append(owners[card.Terminal], org)
+			if read {
+				continue
+			}
+
+			for start := from; start.Before(to); start = start.Add(24 * time.Hour) {
+				end := start.Add(24 * time.Hour)
+				if end.After(to) {
+					end = to
+				}
+				err, rows := card.ListTransactions(start.Format(windowLayout), end.Format(windowLayout))
+				if err != nil {
+					return nil, fmt.Errorf("terminal %s %s–%s: %w",
+						card.Terminal, start.Format(windowLayout), end.Format(windowLayout), err)
+				}
+				for _, row := range rows {
+					transactions = append(transactions, parse(card.Terminal, row))
+				}
+			}
+		}
+	}
+	for _, tx := range transactions {
+		tx.organizations = owners[tx.Terminal]
+	}
+	return transactions, nil
+}
+
+// parse reads a row of the report. Pelecard sends strings throughout; totals
+// are in agorot or cents.
+func parse(terminal string, row map[string]any) *transaction {
+	str := func(key string) string {
+		s, _ := row[key].(string)
+		return s
+	}
+	tx := &transaction{
+		Id:         str("PelecardTransactionId"),
+		Terminal:   terminal,
+		ParamX:     str("AdditionalDetailsParamX"),
+		ApprovalNo: str("DebitApproveNumber"),
+	}
+	if tx.AltId = str("TransactionId"); tx.Id == "" {
+		tx.Id, tx.AltId = tx.AltId, ""
+	}
+	if total, err := strconv.ParseFloat(str("DebitTotal"), 64); err == nil {
+		tx.Total = math.Round(total) / 100
+	}
+	tx.Created, _ = time.ParseInLocation(pelecardLayout, str("TransactionInitTime"), time.Local)
+	return tx
+}
@@ -0,0 +1,232 @@
+package reconcile
+
+import (
+	"testing"
+	"time"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/pelecard/pelecardtest"
+	"external_payments/types"
+)
+
+// setup stores a ben2 request for reference in status, made two hours ago.
+func setup(t *testing.T, store *dbtest.Store, userKey, reference, status string) {
+	t.Helper()
+	err := store.StoreRequest(types.PaymentRequest{
+		UserKey: userKey, Reference: reference, Price: 180, Currency: "NIS", Organization: "ben2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetStatus(userKey, status)
+	store.Backdate(userKey, 2*time.Hour)
+}
+
+// recordedRefunds stands in for the refunds we made: ids.
+func recordedRefunds(t *testing.T, ids ...string) {
+	t.Helper()
+	saved := knownRefunds
+	t.Cleanup(func() { knownRefunds = saved })
+	knownRefunds = func(string, []string) (map[string]bool, error) {
+		known := map[string]bool{}
+		for _, id := range ids {
+			known[id] = true
+		}
+		return known, nil
+	}
+}
+
+func findings(r Report) map[string]Finding {
+	byKey := map[string]Finding{}
+	for _, f := range r.Findings {
+		key := f.UserKey
+		if key == "" {
+			key = f.TransactionId
+		}
+		byKey[key] = f
+	}
+	return byKey
+}
+
+func TestPelecard(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	recordedRefunds(t)
+	pele := pelecardtest.New(t)
+	charged := time.Now().Add(-2 * time.Hour)
+
+	// The payer was charged, and the callback that would have said so was lost.
+	setup(t, store, "u-paid", "1fam-1", "in-process")
+	pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-1", Total: 18000, Created: charged})
+	// Charged, but the payer was shown an error.
+	setup(t, store, "u-refused", "1fam-2", "error")
+	pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-2", Total: 18000, Created: charged})
+	// Never reached Pelecard.
+	setup(t, store, "u-stuck", "1fam-3", "in-process")
+	// Still on the hosted page.
+	if err := store.StoreRequest(types.PaymentRequest{UserKey: "u-fresh", Reference: "1fam-4", Organization: "ben2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Charged on the terminal by hand.
+	walkIn := pele.Record(pelecardtest.Transaction{Terminal: "ben2-preemv", ParamX: "walk-in", Total: 5000, Created: charged})
+
+	report, err := Pelecard(pelecardtest.Organizations, time.Now().Add(-3*time.Hour), time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 4 || report.Transactions != 3 {
+		t.Errorf("read %d requests and %d transactions, want 4 and 3", report.Requests, report.Transactions)
+	}
+
+	got := findings(report)
+	for key, want := range map[string]Kind{
+		"u-paid":    Paid,
+		"u-refused": Refused,
+		"u-stuck":   Stuck,
+		walkIn.Id:   Unknown,
+	} {
+		if got[key].Kind != want {
+			t.Errorf("%s: %q, want %q", key, got[key].Kind, want)
+		}
+	}
+	if len(report.Findings) != 4 {
+		t.Errorf("findings %+v", report.Findings)
+	}
+
+	if !got["u-paid"].Fixed {
+		t.Error("a stuck request Pelecard approved was not fixed")
+	}
+	if status, _ := db.GetStatus("u-paid"); status != "valid" {
+		t.Errorf("u-paid is %q, want valid", status)
+	}
+	if status, _ := db.GetStatus("u-refused"); status != "error" {
+		t.Errorf("u-refused is %q: a refused payment is for a person to decide", status)
+	}
+}
+
+func TestPelecardDryRun(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	recordedRefunds(t)
+	pele := pelecardtest.New(t)
+	setup(t, store, "u-paid", "1fam-1", "in-process")
+	pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-1", Total: 18000, Created: time.Now().Add(-2 * time.Hour)})
+
+	report, err := Pelecard(pelecardtest.Organizations, time.Now().Add(-3*time.Hour), time.Now(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count(Paid) != 1 || report.Findings[0].Fixed {
+		t.Errorf("findings %+v", report.Findings)
+	}
+	if status, _ := db.GetStatus("u-paid"); status != "in-process" {
+		t.Errorf("a dry run changed the status to %q", status)
+	}
+}
+
+// A valid request whose recorded transaction is matched by id is checked for
+// its amount, and one Pelecard does not list is missing.
+func TestPelecardByTransactionId(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	recordedRefunds(t)
+	pele := pelecardtest.New(t)
+	charged := time.Now().Add(-2 * time.Hour)
+
+	tx := pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-1", Total: 9000, Created: charged})
+	setup(t, store, "u-short", "1fam-1", "valid")
+	setup(t, store, "u-gone", "1fam-2", "valid")
+	for userKey, id := range map[string]string{"u-short": tx.Id, "u-gone": "999"} {
+		if err := store.UpdateRequest(types.PaymentResponse{UserKey: userKey, TransactionId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Pelecard(pelecardtest.Organizations, time.Now().Add(-3*time.Hour), time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := findings(report)
+	if f := got["u-short"]; f.Kind != Amount || f.GatewayAmount != 90 || f.Amount != 180 {
+		t.Errorf("u-short: %+v", f)
+	}
+	if f := got["u-gone"]; f.Kind != Missing {
+		t.Errorf("u-gone: %+v", f)
+	}
+}
+
+// A request matched only by its reference is fixed only when the transaction
+// is on its organization's terminal and for its amount, and a second charge
+// under a matched reference is reported rather than taken for the first.
+func TestPelecardByReference(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	pele := pelecardtest.New(t)
+	charged := time.Now().Add(-2 * time.Hour)
+
+	setup(t, store, "u-short", "1fam-1", "in-process")
+	short := pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-1", Total: 9000, Created: charged})
+	setup(t, store, "u-elsewhere", "1fam-2", "in-process")
+	other := pele.Record(pelecardtest.Transaction{Terminal: "meshp18-regular", ParamX: "1fam-2", Total: 18000, Created: charged})
+	setup(t, store, "u-twice", "1fam-3", "in-process")
+	pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-3", Total: 18000, Created: charged})
+	second := pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-3", Total: 18000, Created: charged})
+	refund := pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-3", Total: 18000, Created: charged, Refund: true})
+	recordedRefunds(t, refund.Id)
+
+	report, err := Pelecard(pelecardtest.Organizations, time.Now().Add(-3*time.Hour), time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := findings(report)
+	for key, want := range map[string]Kind{
+		"u-short":     Amount,
+		"u-elsewhere": Stuck,
+		other.Id:      Unknown,
+		"u-twice":     Paid,
+		second.Id:     Unknown,
+	} {
+		if got[key].Kind != want {
+			t.Errorf("%s: %q, want %q", key, got[key].Kind, want)
+		}
+	}
+	if len(report.Findings) != 5 {
+		t.Errorf("findings %+v", report.Findings)
+	}
+	if f := got["u-short"]; f.Fixed || f.TransactionId != short.Id {
+		t.Errorf("u-short: %+v", f)
+	}
+	for userKey, want := range map[string]string{"u-short": "in-process", "u-elsewhere": "in-process", "u-twice": "valid"} {
+		if status, _ := db.GetStatus(userKey); status != want {
+			t.Errorf("%s is %q, want %q", userKey, status, want)
+		}
+	}
+}
+
+// A refund we made is listed under the payment's reference; a stuck request
+// under the same reference must not be taken as paid by it.
+func TestPelecardSkipsRefunds(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	pele := pelecardtest.New(t)
+
+	setup(t, store, "u-retry", "1fam-1", "in-process")
+	refund := pele.Record(pelecardtest.Transaction{Terminal: "ben2-regular", ParamX: "1fam-1", Total: 18000,
+		Created: time.Now().Add(-2 * time.Hour), Refund: true})
+	recordedRefunds(t, refund.Id)
+
+	report, err := Pelecard(pelecardtest.Organizations, time.Now().Add(-3*time.Hour), time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := findings(report)["u-retry"]; f.Kind != Stuck || f.TransactionId != "" {
+		t.Errorf("u-retry: %+v", f)
+	}
+	if len(report.Findings) != 1 {
+		t.Errorf("findings %+v", report.Findings)
+	}
+	if status, _ := db.GetStatus("u-retry"); status != "in-process" {
+		t.Errorf("u-retry is %q, want in-process", status)
+	}
+}
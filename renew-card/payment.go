@@ -3,13 +3,14 @@ package renew_card
 import (
 	"encoding/json/v2"
 	"fmt"
-	"math"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
 	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/organizations"
 	"external_payments/payment"
 	"external_payments/pelecard"
 	"external_payments/types"
@@ -17,6 +18,10 @@ import (
 	"external_payments/validation"
 )
 
+// pelecardProvider opens a Pelecard terminal. Tests swap it for a fake, so a
+// handler runs without Pelecard.
+var pelecardProvider = gateway.NewPelecard
+
 func RenewCard(c *gin.Context) {
 	var err error
 	request := types.PaymentRequest{}
@@ -42,110 +47,48 @@ func RenewCard(c *gin.Context) {
 		return
 	}
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
-
-	total := int(math.Round(request.Price * 100))
-
 	// Request Pelecard
 	baseUrl := utils.BaseUrl()
 
-	card := &pelecard.PeleCard{
+	page := gateway.Page{
+		Action:      types.Register,
+		RequireCVV:  false,
 		Language:    request.Language,
 		UserKey:     request.UserKey,
-		ParamX:      request.Reference,
-		GoodUrl:     baseUrl + "/renew/good",
-		ErrorUrl:    baseUrl + "/renew/error",
-		CancelUrl:   baseUrl + "/renew/cancel",
-		Total:       total,
-		Currency:    currency,
+		Reference:   request.Reference,
+		GoodURL:     baseUrl + "/renew/good",
+		ErrorURL:    baseUrl + "/renew/error",
+		CancelURL:   baseUrl + "/renew/cancel",
+		Amount:      request.Price,
+		Currency:    request.Currency,
 		MaxPayments: request.Installments,
-		CaptionSet:  make(map[string]string),
+		Captions:    make(map[string]string),
 	}
-	if request.Organization == "ben2" {
-		card.LogoUrl = "https://checkout.kabbalah.info/logo1.png"
-		card.MinPayments = 1
-		card.MaxPayments = 1
-		if request.Language == "HE" {
-			card.TopText = "BB כרטיסי אשראי"
-			card.BottomText = "© בני ברוך קבלה לעם"
-			card.CaptionSet["cs_submit"] = "Renew"
-			card.CaptionSet["cs_cancel"] = "Cancel"
-		} else if request.Language == "RU" {
-			card.LogoUrl = "https://checkout.kabbalah.info/kabRu.jpeg"
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else if request.Language == "ES" {
-			card.TopText = "Bnei Baruch Kabbalah laAm"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.Language = "EN"
-			card.LogoUrl = "https://cabalacentroestudios.com/wp-content/uploads/2020/04/BB_logo_es.jpg"
-			card.CaptionSet["cs_header_payment"] = "Pago con tarjeta de crédito"
-			card.CaptionSet["cs_header_registeration"] = "Registro con tarjeta de crédito"
-			card.CaptionSet["cs_holdername"] = "Nombre en la tarjeta"
-			card.CaptionSet["cs_cardnumber"] = "Número de tarjeta de crédito"
-			card.CaptionSet["cs_expiration"] = "Fecha de expiración"
-			card.CaptionSet["cs_id"] = "Pasaporte"
-			card.CaptionSet["cs_cvv"] = "CW"
-			card.CaptionSet["cs_payments"] = "Número de pagos"
-			card.CaptionSet["cs_xparam"] = "Detalles adicionales"
-			card.CaptionSet["cs_total"] = "Total"
-			card.CaptionSet["cs_supported_cards"] = "Tarjetas aceptadas como pago en este sitio web"
-			card.CaptionSet["cs_mustfields"] = "Campos obligatorios"
-			card.CaptionSet["cs_submit"] = "Pagar ahora"
-			card.CaptionSet["cs_cancel"] = "Cancelar"
-		} else {
-			card.Language = "EN"
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-	} else if request.Organization == "meshp18" {
-		if request.Language == "HE" {
-			card.TopText = "משפחה בחיבור כרטיסי אשראי"
-			card.BottomText = "© משפחה בחיבור"
-		} else if request.Language == "RU" {
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else {
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-		card.MinPayments = 1
-		total = total / 100
-		if total < 100 {
-			card.MaxPayments = 1
-		} else {
-			card.MaxPayments = total/500 + 2
-		}
-		if card.MaxPayments > 10 {
-			card.MaxPayments = 10
-		}
-		card.LogoUrl = "https://www.1family.co.il/wp-content/uploads/2019/06/cropped-Screen-Shot-2019-06-16-at-00.12.07-140x82.png"
-	} else {
+	org, ok := organizations.Get(request.Organization)
+	if !ok {
 		msg := fmt.Sprintf("New Payment: Unknown Organization")
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusOK, "Unknown Organization", c)
 		return
 	}
+	page.Brand(org.BrandingFor(request.Language, organizations.FlowRenew))
+	page.Offer(org.Installments.Plan(request.Currency, request.Price, request.SKU))
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Regular)
+	if err != nil {
 		msg := fmt.Sprintf("New Payment: Pelecard Init %s", err.Error())
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadGateway, "PeleCard Init: "+err.Error(), c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Regular.String())
 
-	if err, url := card.GetRedirectUrl(types.Register, false); err != nil {
+	if redirect, err := provider.HostedPage(c.Request.Context(), page); err != nil {
 		msg := fmt.Sprintf("New Payment: Error GetRedirectUrl %s", err.Error())
 		utils.LogMessage(msg)
 		utils.ErrorJson(http.StatusBadGateway, "GetRedirectUrl "+err.Error(), c)
 	} else {
-		utils.OnRedirect(url, "", "success", c)
+		utils.OnRedirect(redirect.URL, "", "success", c)
 	}
 }
 
@@ -159,7 +102,7 @@ func GoodJ2(c *gin.Context) {
 	if form.PelecardStatusCode != "000" {
 		m := fmt.Sprintf("Good J2: Pelecard error %s", form.PelecardStatusCode)
 		utils.LogMessage(m)
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "declined "+form.PelecardStatusCode)
 		utils.ErrorJson(http.StatusBadGateway, "Pelecard error: "+form.PelecardStatusCode+" "+pelecard.GetMessage(form.PelecardStatusCode), c)
 		return
 	}
@@ -171,7 +114,7 @@ func GoodJ2(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(form.UserKey, "valid")
+	db.Transition(form.UserKey, db.StatusValid, "pelecard callback", "card renewed")
 
 	org, err := db.GetOrganization(form.UserKey)
 	if err != nil {
@@ -182,16 +125,16 @@ func GoodJ2(c *gin.Context) {
 	}
 
 	// approve params
-	card := &pelecard.PeleCard{}
-	if err := card.Init(org, types.Regular, true); err != nil {
+	provider, err := pelecardProvider(org, gateway.Regular)
+	if err != nil {
 		m := fmt.Sprintf("Good J2: Approve Init Error %s", err.Error())
 		utils.LogMessage(m)
 		utils.ErrorJson(http.StatusBadGateway, "Approve Init: "+err.Error(), c)
 		return
 	}
 
-	var msg map[string]any
-	if err, msg = card.GetTransaction(form.PelecardTransactionId); err != nil {
+	transaction, err := provider.Transaction(c.Request.Context(), form.PelecardTransactionId)
+	if err != nil {
 		m := fmt.Sprintf("Good J2: GetTransaction Error %s", err.Error())
 		utils.LogMessage(m)
 
@@ -200,7 +143,7 @@ func GoodJ2(c *gin.Context) {
 	}
 
 	var response = types.PaymentResponse{}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(transaction.Data)
 	_ = json.Unmarshal(body, &response)
 
 	var request types.PaymentRequest
@@ -0,0 +1,142 @@
+// Package settlement sums a day's payments the way finance reads them off the
+// Pelecard portal: per organization, terminal, currency and gateway, with the
+// day's refunds and its declines by Pelecard status code.
+package settlement
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+
+	"external_payments/db"
+	"external_payments/types"
+)
+
+// settlementRows reads the rows a report is summed from. Tests replace it.
+var settlementRows = db.SettlementRows
+
+// Group is one line of the report. Terminal is the Pelecard terminal as
+// gateway.Terminal names it; it is empty for PayPal, and for requests made
+// before terminals were recorded.
+type Group struct {
+	Organization string  `json:"organization"`
+	Gateway      string  `json:"gateway"`
+	Terminal     string  `json:"terminal"`
+	Currency     string  `json:"currency"`
+	Count        int     `json:"count"`
+	Total        float64 `json:"total"`
+	Refunds      int     `json:"refunds"`
+	RefundTotal  float64 `json:"refund_total"`
+	// Declines counts the group's refused payments by Pelecard status code,
+	// or by the reason recorded when there was no code.
+	Declines map[string]int `json:"declines"`
+}
+
+// Report is a day's settlement summary.
+type Report struct {
+	Date   string  `json:"date"`
+	Groups []Group `json:"groups"`
+}
+
+// paid are the statuses of a request that was charged, whatever happened
+// to it since.
+var paid = []string{
+	string(db.StatusValid), string(db.StatusPartiallyRefunded),
+	string(db.StatusRefunded), string(db.StatusChargeback),
+}
+
+var declined = []string{string(db.StatusInvalid), string(db.StatusError)}
+
+// Daily reports the day that starts at day, in the server's zone, for the
+// requests q selects. q's dates are replaced by the day's.
+func Daily(day time.Time, q types.RequestQuery) (Report, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	q.From, q.To = start, start.AddDate(0, 0, 1)
+	rows, err := settlementRows(q)
+	if err != nil {
+		return Report{}, err
+	}
+
+	groups := map[[4]string]*Group{}
+	for _, r := range rows {
+		key := [4]string{r.Organization, r.Gateway, r.Terminal, r.Currency}
+		g := groups[key]
+		if g == nil {
+			g = &Group{
+				Organization: r.Organization, Gateway: r.Gateway, Terminal: r.Terminal, Currency: r.Currency,
+				Declines: map[string]int{},
+			}
+		}
+		switch {
+		case r.Refund:
+			g.Refunds++
+			g.RefundTotal += r.Amount
+		case slices.Contains(paid, r.Status):
+			g.Count++
+			g.Total += r.Amount
+		case slices.Contains(declined, r.Status):
+			g.Declines[declineCode(r)]++
+		default:
+			// Still open, or cancelled by the payer: not settled either way.
+			continue
+		}
+		groups[key] = g
+	}
+
+	report := Report{Date: start.Format(time.DateOnly), Groups: []Group{}}
+	for _, g := range groups {
+		report.Groups = append(report.Groups, *g)
+	}
+	slices.SortFunc(report.Groups, func(a, b Group) int {
+		return cmp.Or(
+			cmp.Compare(a.Organization, b.Organization), cmp.Compare(a.Gateway, b.Gateway),
+			cmp.Compare(a.Terminal, b.Terminal), cmp.Compare(a.Currency, b.Currency))
+	})
+	return report, nil
+}
+
+// declineCode is the Pelecard status code in a refused request's reason,
+// recorded as "declined 033" or "error 033". Without one it is the reason
+// itself, or the status when none was given.
+func declineCode(r types.SettlementRow) string {
+	for _, prefix := range []string{"declined ", "error "} {
+		if code, ok := strings.CutPrefix(r.Reason, prefix); ok && code != "" {
+			return code
+		}
+	}
+	return cmp.Or(r.Reason, r.Status)
+}
+
+var headers = []any{
+	"Organization", "Gateway", "Terminal", "Currency", "Count", "Total", "Refunds", "Refund Total", "Declines",
+}
+
+// WriteXlsx writes the report as a spreadsheet, one row per group. Declines
+// are listed in one cell, code×count.
+func (r Report) WriteXlsx(w io.Writer) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := "Sheet1"
+
+	f.SetCellValue(sheet, "A1", "Settlement "+r.Date)
+	_ = f.SetSheetRow(sheet, "A2", &headers)
+	for i, g := range r.Groups {
+		declines := []string{}
+		for _, code := range slices.Sorted(maps.Keys(g.Declines)) {
+			declines = append(declines, fmt.Sprintf("%s×%d", code, g.Declines[code]))
+		}
+		row := []any{
+			g.Organization, g.Gateway, g.Terminal, g.Currency,
+			g.Count, g.Total, g.Refunds, g.RefundTotal, strings.Join(declines, ", "),
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+3)
+		_ = f.SetSheetRow(sheet, cell, &row)
+	}
+	return f.Write(w)
+}
@@ -0,0 +1,85 @@
+package settlement
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+
+	"external_payments/types"
+)
+
+func fake(t *testing.T, rows []types.SettlementRow) *types.RequestQuery {
+	t.Helper()
+	var asked types.RequestQuery
+	previous := settlementRows
+	t.Cleanup(func() { settlementRows = previous })
+	settlementRows = func(q types.RequestQuery) ([]types.SettlementRow, error) {
+		asked = q
+		return rows, nil
+	}
+	return &asked
+}
+
+func TestDaily(t *testing.T) {
+	asked := fake(t, []types.SettlementRow{
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Status: "valid", Amount: 10},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Status: "refunded", Amount: 20},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Status: "invalid", Amount: 5, Reason: "declined 033"},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Status: "error", Amount: 5, Reason: "error 033"},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Status: "invalid", Amount: 5, Reason: "not confirmed"},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD", Refund: true, Status: "done", Amount: 20},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "recurrent", Currency: "ILS", Status: "valid", Amount: 100},
+		{Organization: "ben2", Gateway: "pelecard", Terminal: "recurrent", Currency: "ILS", Status: "in-process", Amount: 100},
+		{Organization: "ben2", Gateway: "paypal", Currency: "USD", Status: "cancel", Amount: 7},
+		{Organization: "meshp18", Gateway: "paypal", Currency: "EUR", Status: "valid", Amount: 30},
+	})
+
+	report, err := Daily(time.Date(2026, 3, 4, 15, 30, 0, 0, time.Local), types.RequestQuery{Organization: "ben2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Date != "2026-03-04" || asked.Organization != "ben2" ||
+		asked.From.Hour() != 0 || asked.To.Sub(asked.From) != 24*time.Hour {
+		t.Errorf("asked for %+v, reported %s", asked, report.Date)
+	}
+	if len(report.Groups) != 3 {
+		t.Fatalf("groups %+v", report.Groups)
+	}
+
+	regular := report.Groups[1]
+	if regular.Terminal != "regular" || regular.Count != 2 || regular.Total != 30 ||
+		regular.Refunds != 1 || regular.RefundTotal != 20 {
+		t.Errorf("regular %+v", regular)
+	}
+	if regular.Declines["033"] != 2 || regular.Declines["not confirmed"] != 1 {
+		t.Errorf("declines %v", regular.Declines)
+	}
+	if recurrent := report.Groups[0]; recurrent.Terminal != "recurrent" || recurrent.Count != 1 || recurrent.Total != 100 {
+		t.Errorf("recurrent %+v: an open request was counted", recurrent)
+	}
+	if meshp18 := report.Groups[2]; meshp18.Organization != "meshp18" || meshp18.Gateway != "paypal" {
+		t.Errorf("groups are not sorted: %+v", report.Groups)
+	}
+}
+
+func TestWriteXlsx(t *testing.T) {
+	report := Report{Date: "2026-03-04", Groups: []Group{{
+		Organization: "ben2", Gateway: "pelecard", Terminal: "regular", Currency: "USD",
+		Count: 2, Total: 30, Declines: map[string]int{"033": 2, "036": 1},
+	}}}
+	var buf bytes.Buffer
+	if err := report.WriteXlsx(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, _ := f.GetRows("Sheet1")
+	if len(rows) != 3 || rows[2][0] != "ben2" || rows[2][8] != "033×2, 036×1" {
+		t.Errorf("rows %v", rows)
+	}
+}
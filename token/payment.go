@@ -2,8 +2,8 @@ package token
 
 import (
 	"encoding/json/v2"
+	"errors"
 	"fmt"
-	"math"
 	"net/http"
 	"strings"
 
@@ -11,15 +11,17 @@ import (
 	"github.com/google/go-querystring/query"
 
 	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/organizations"
 	"external_payments/pelecard"
 	"external_payments/types"
 	"external_payments/utils"
 	"external_payments/validation"
 )
 
-func Refund(c *gin.Context) {
-
-}
+// pelecardProvider opens a Pelecard terminal. Tests swap it for a fake, so a
+// handler runs without Pelecard.
+var pelecardProvider = gateway.NewPelecard
 
 func ConfirmPayment(c *gin.Context) {
 	var err error
@@ -70,112 +72,52 @@ func NewPayment(c *gin.Context) {
 		return
 	}
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
 	baseUrl := utils.BaseUrl()
 	goodUrl := baseUrl + "/token/good"
 	errorUrl := baseUrl + "/token/error"
 	cancelUrl := baseUrl + "/token/cancel"
 
-	total := int(math.Round(request.Price * 100))
-
 	// Request Pelecard
-	card := &pelecard.PeleCard{
+	page := gateway.Page{
+		Action:      types.Authorize,
+		RequireCVV:  true,
 		Language:    request.Language,
 		UserKey:     request.UserKey,
-		ParamX:      request.Reference,
-		GoodUrl:     goodUrl,
-		ErrorUrl:    errorUrl,
-		CancelUrl:   cancelUrl,
-		Total:       total,
-		Currency:    currency,
+		Reference:   request.Reference,
+		GoodURL:     goodUrl,
+		ErrorURL:    errorUrl,
+		CancelURL:   cancelUrl,
+		Amount:      request.Price,
+		Currency:    request.Currency,
 		MaxPayments: request.Installments,
 	}
-	if request.Organization == "ben2" {
-		card.LogoUrl = "https://checkout.kabbalah.info/logo1.png"
-		card.MinPayments = 1
-		card.MaxPayments = 1
-		if request.Language == "HE" {
-			card.TopText = "BB כרטיסי אשראי"
-			card.BottomText = "© בני ברוך קבלה לעם"
-		} else if request.Language == "RU" {
-			card.LogoUrl = "https://checkout.kabbalah.info/kabRu.jpeg"
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else if request.Language == "ES" {
-			card.TopText = "Bnei Baruch Kabbalah laAm"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-			card.Language = "EN"
-			card.LogoUrl = "http://cabalacentroestudios.com/wp-content/uploads/2020/04/BB_logo_es.jpg"
-			card.CaptionSet = make(map[string]string)
-			card.CaptionSet["cs_header_payment"] = "Pago con tarjeta de crédito"
-			card.CaptionSet["cs_header_registeration"] = "Registro con tarjeta de crédito"
-			card.CaptionSet["cs_holdername"] = "Nombre en la tarjeta"
-			card.CaptionSet["cs_cardnumber"] = "Número de tarjeta de crédito"
-			card.CaptionSet["cs_expiration"] = "Fecha de expiración"
-			card.CaptionSet["cs_id"] = "Pasaporte"
-			card.CaptionSet["cs_cvv"] = "CW"
-			card.CaptionSet["cs_payments"] = "Número de pagos"
-			card.CaptionSet["cs_xparam"] = "Detalles adicionales"
-			card.CaptionSet["cs_total"] = "Total"
-			card.CaptionSet["cs_supported_cards"] = "Tarjetas aceptadas como pago en este sitio web"
-			card.CaptionSet["cs_mustfields"] = "Campos obligatorios"
-			card.CaptionSet["cs_submit"] = "Pagar ahora"
-			card.CaptionSet["cs_cancel"] = "Cancelar"
-		} else {
-			card.Language = "EN"
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-	} else if request.Organization == "meshp18" {
-		if request.Language == "HE" {
-			card.TopText = "משפחה בחיבור כרטיסי אשראי"
-			card.BottomText = "© משפחה בחיבור"
-		} else if request.Language == "RU" {
-			card.TopText = "Бней Барух Каббала лаАм"
-			card.BottomText = "© Бней Барух Каббала лаАм"
-		} else {
-			card.TopText = "BB Credit Cards"
-			card.BottomText = "© Bnei Baruch Kabbalah laAm"
-		}
-		card.MinPayments = 1
-		total = total / 100
-		if total < 100 {
-			card.MaxPayments = 1
-		} else {
-			card.MaxPayments = total/500 + 2
-		}
-		if card.MaxPayments > 10 {
-			card.MaxPayments = 10
-		}
-		card.LogoUrl = "https://www.1family.co.il/wp-content/uploads/2019/06/cropped-Screen-Shot-2019-06-16-at-00.12.07-140x82.png"
-	} else {
+	org, ok := organizations.Get(request.Organization)
+	if !ok {
 		msg := fmt.Sprintf("New Payment: Unknown Organization")
 		logMessage(msg)
 		ErrorJson(http.StatusBadRequest, "Unknown Organization", c)
 		return
 	}
+	page.Brand(org.BrandingFor(request.Language, organizations.FlowToken))
+	page.Offer(org.Installments.Plan(request.Currency, request.Price, request.SKU))
 
-	if err = card.Init(request.Organization, types.Recurrent, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Recurrent)
+	if err != nil {
 		msg := fmt.Sprintf("New Payment: Pelecard Init %s", err.Error())
 		logMessage(msg)
 
 		ErrorJson(http.StatusBadGateway, "PeleCard Init: "+err.Error(), c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Recurrent.String())
 
-	if err, url := card.GetRedirectUrl(types.Authorize, true); err != nil {
+	if redirect, err := provider.HostedPage(c.Request.Context(), page); err != nil {
 		msg := fmt.Sprintf("New Payment: Error GetRedirectUrl %s", err.Error())
 		logMessage(msg)
 
 		ErrorJson(http.StatusBadGateway, "GetRedirectUrl "+err.Error(), c)
 	} else {
-		OnRedirect(url, "", "success", c)
+		OnRedirect(redirect.URL, "", "success", c)
 	}
 }
 
@@ -201,13 +143,13 @@ func GoodPayment(c *gin.Context) {
 	if form.PelecardStatusCode != "000" {
 		m := fmt.Sprintf("Good Payment: Pelecard error %s", form.PelecardStatusCode)
 		logMessage(m)
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "declined "+form.PelecardStatusCode)
 		ErrorJson(http.StatusBadGateway, "Pelecard error: "+form.PelecardStatusCode+" "+pelecard.GetMessage(form.PelecardStatusCode), c)
 		return
 	}
 
 	// Atomically claim this callback — only one concurrent call can proceed.
-	if !db.ClaimProcessing(form.UserKey) {
+	if !db.ClaimProcessing(form.UserKey, "pelecard callback") {
 		status, _ := db.GetStatus(form.UserKey)
 		logMessage(fmt.Sprintf("Good Payment: duplicate callback suppressed status=%s userKey=%s", status, form.UserKey))
 		if status == "valid" {
@@ -238,8 +180,8 @@ func GoodPayment(c *gin.Context) {
 	}
 
 	// approve params
-	card := &pelecard.PeleCard{}
-	if err := card.Init(org, types.Recurrent, true); err != nil {
+	recurrent, err := pelecardProvider(org, gateway.Recurrent)
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: Approve Init Error %s", err.Error())
 		logMessage(m)
 
@@ -247,8 +189,9 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	var msg map[string]any
-	if err, msg = card.GetTransaction(form.PelecardTransactionId); err != nil {
+	ctx := c.Request.Context()
+	transaction, err := recurrent.Transaction(ctx, form.PelecardTransactionId)
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: GetTransaction Error %s", err.Error())
 		logMessage(m)
 
@@ -257,9 +200,10 @@ func GoodPayment(c *gin.Context) {
 	}
 
 	var response = types.PaymentResponse{}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(transaction.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = form.UserKey
+	response.TokenSHA256 = db.CardTokenHash(form.Token)
 	// update DB
 	if err = db.UpdateRequest(response); err != nil {
 		m := fmt.Sprintf("Good Payment: Update Request Error %s", err.Error())
@@ -278,88 +222,67 @@ func GoodPayment(c *gin.Context) {
 		return
 	}
 
-	if err = card.Init(request.Organization, types.Regular, true); err != nil {
+	regular, err := pelecardProvider(request.Organization, gateway.Regular)
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: Validation Init %s", err.Error())
 		logMessage(m)
 
 		ErrorJson(http.StatusBadGateway, "Validation Init "+err.Error(), c)
 		return
 	}
-	card.ConfirmationKey = form.ConfirmationKey
-	card.UserKey = request.UserKey
-	card.TotalX100 = fmt.Sprintf("%d", int(math.Round(request.Price*100)))
-	card.Token = form.Token
-	card.AuthorizationNumber = form.ApprovalNo
 	var valid bool
-	if valid, err = card.ValidateByUniqueKey(); err != nil {
+	if valid, err = regular.Validate(ctx, gateway.Validation{
+		UserKey:         request.UserKey,
+		ConfirmationKey: form.ConfirmationKey,
+		Amount:          request.Price,
+		Currency:        request.Currency,
+	}); err != nil {
 		m := fmt.Sprintf("Good Payment: ValidateByUniqueKey 1 error %s", err.Error())
 		logMessage(m)
 
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "validation failed")
 		ErrorJson(http.StatusBadGateway, "ValidateByUniqueKey 1 "+err.Error(), c)
 		return
 	}
 	if !valid {
-		db.SetStatus(form.UserKey, "invalid")
-		m := fmt.Sprintf("Good Payment: Confirmation error 1 %s", err.Error())
-		logMessage(m)
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "not confirmed")
+		logMessage("Good Payment: Confirmation error 1")
 
 		ErrorJson(http.StatusBadGateway, "Confirmation error 1 ", c)
 		return
 	}
 
-	// Charge donor for the first time
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
-	card = &pelecard.PeleCard{
-		Currency:            currency,
-		UserKey:             request.UserKey,
-		Token:               form.Token,
-		AuthorizationNumber: form.ApprovalNo,
-		ParamX:              form.ParamX,
-		TotalX100:           fmt.Sprintf("%d", int(math.Round(request.Price*100))),
-	}
-	if err := card.Init(org, types.Recurrent, true); err != nil {
-		m := fmt.Sprintf("Good Payment: ApproveInit %s", err.Error())
+	// Charge donor for the first time, then re-verify server-to-server
+	// before treating it as paid.
+	_, err = recurrent.ChargeToken(ctx, gateway.Charge{
+		UserKey:    request.UserKey,
+		Token:      form.Token,
+		ApprovalNo: form.ApprovalNo,
+		Reference:  form.ParamX,
+		Amount:     request.Price,
+		Currency:   request.Currency,
+		Verify:     true,
+	})
+	if errors.Is(err, gateway.ErrUnverified) {
+		// Leave in-process — ext2fix will reconcile via CheckGoodParamX.
+		m := fmt.Sprintf("Good Payment: First Charge %s", err.Error())
 		logMessage(m)
-
-		ErrorJson(http.StatusBadGateway, "Approve Init: "+err.Error(), c)
+		ErrorJson(http.StatusOK, "First Charge: "+err.Error(), c)
 		return
 	}
-	if err, msg = card.ChargeByToken(false); err != nil {
+	if err != nil {
 		m := fmt.Sprintf("Good Payment: First Charge %s", err.Error())
 		logMessage(m)
 
-		db.SetStatus(form.UserKey, "invalid")
+		db.Transition(form.UserKey, db.StatusInvalid, "pelecard callback", "first charge failed")
 		ErrorJson(http.StatusOK, "First Charge error ", c)
 		return
 	}
 
-	// Re-verify server-to-server before treating as paid.
-	txId, _ := msg["PelecardTransactionId"].(string)
-	if txId == "" {
-		// Leave in-process — ext2fix will reconcile via CheckGoodParamX.
-		logMessage("Good Payment: no PelecardTransactionId in ChargeByToken response")
-		ErrorJson(http.StatusOK, "First Charge: no transaction ID returned", c)
-		return
-	}
-	if err, msg = card.GetTransDataByTrxId(txId); err != nil {
-		// Transient verify failure — leave in-process for ext2fix reconciliation.
-		m := fmt.Sprintf("Good Payment: GetTransaction verify failed %s", err.Error())
-		logMessage(m)
-		ErrorJson(http.StatusOK, "First Charge verify failed: "+err.Error(), c)
-		return
-	}
-
-	db.SetStatus(form.UserKey, "valid")
+	db.Transition(form.UserKey, db.StatusValid, "pelecard callback", "first charge approved")
 	// redirect to GoodURL
 	v, _ := query.Values(response)
-	OnSuccess(request.GoodURL, v.Encode(), card.Token, card.AuthorizationNumber, c)
+	OnSuccess(request.GoodURL, v.Encode(), form.Token, form.ApprovalNo, c)
 }
 
 func Charge(c *gin.Context) {
@@ -378,6 +301,7 @@ func Charge(c *gin.Context) {
 	// Before validation: Organization is required, and a caller authenticated
 	// by key does not send it.
 	request.Organization = utils.ResolveOrganization(c, request.Organization)
+	request.CallbackURL, request.WebhookSalt = utils.ResolveCallback(c)
 
 	if errFound, errors := validation.ValidateStruct(request); errFound {
 		m := fmt.Sprintf("Charge: Validation Error: %+v", errors)
@@ -385,6 +309,11 @@ func Charge(c *gin.Context) {
 		ErrorJson(http.StatusBadRequest, "Charge validateStruct "+strings.Join(errors, "\n"), c)
 		return
 	}
+	if err = utils.CheckPrefix(c, request.Reference); err != nil {
+		logMessage("Charge: " + err.Error())
+		ErrorJson(http.StatusForbidden, "Charge "+err.Error(), c)
+		return
+	}
 	m := fmt.Sprintf("Charge: %+v", request)
 	logMessage(m)
 
@@ -396,45 +325,40 @@ func Charge(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "in-process")
+	db.Transition(request.UserKey, db.StatusInProcess, "pelecard charge", "charging")
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
-	total := fmt.Sprintf("%d", int(math.Round(request.Price*100)))
-	card := &pelecard.PeleCard{
-		Token:               request.Token,
-		TotalX100:           total,
-		Currency:            currency,
-		AuthorizationNumber: request.ApprovalNo,
-		ParamX:              request.Reference,
-	}
-	if err = card.Init(request.Organization, types.Recurrent, true); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.Recurrent)
+	if err != nil {
 		m := fmt.Sprintf("Charge: pelecard init %s", err.Error())
 		logMessage(m)
 
-		ErrorJson(http.StatusBadGateway, "Charge PeleCard Init: "+err.Error(), c)
+		utils.ChargeErrorJson("Charge PeleCard Init: ", err, c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.Recurrent.String())
 
-	var msg map[string]any
 	var response = types.PaymentResponse{}
 
-	if err, msg = card.ChargeByToken(false); err != nil {
-		db.SetStatus(request.UserKey, "invalid")
+	charge, err := provider.ChargeToken(c.Request.Context(), gateway.Charge{
+		UserKey:    request.UserKey,
+		Token:      request.Token,
+		ApprovalNo: request.ApprovalNo,
+		Reference:  request.Reference,
+		Amount:     request.Price,
+		Currency:   request.Currency,
+	})
+	if err != nil {
+		utils.SettleChargeFailure(request.UserKey, "pelecard charge", err)
 		m := fmt.Sprintf("Charge: Charge Error %s", err.Error())
 		logMessage(m)
 
-		ErrorJson(http.StatusOK, "Charge error ", c)
+		utils.ChargeErrorJson("Charge error ", err, c)
 		return
 	}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(charge.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = request.UserKey
+	response.TokenSHA256 = db.CardTokenHash(request.Token)
 	logMessage(fmt.Sprintf("Charge OK: %+v", response))
 	// update DB
 	if err = db.UpdateRequest(response); err != nil {
@@ -445,7 +369,7 @@ func Charge(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "valid")
+	db.Transition(request.UserKey, db.StatusValid, "pelecard charge", "charge approved")
 	data, _ := json.Marshal(response)
 	var result = map[string]string{
 		"status": "success",
@@ -468,6 +392,7 @@ func ChargeX(c *gin.Context) {
 	}
 
 	request.Organization = utils.ResolveOrganization(c, request.Organization)
+	request.CallbackURL, request.WebhookSalt = utils.ResolveCallback(c)
 
 	if errFound, errors := validation.ValidateStruct(request); errFound {
 		m := fmt.Sprintf("ChargeX: Validation Error: %+v", errors)
@@ -475,6 +400,11 @@ func ChargeX(c *gin.Context) {
 		ErrorJson(http.StatusBadRequest, "Charge validateStruct "+strings.Join(errors, "\n"), c)
 		return
 	}
+	if err = utils.CheckPrefix(c, request.Reference); err != nil {
+		logMessage("Charge: " + err.Error())
+		ErrorJson(http.StatusForbidden, "Charge "+err.Error(), c)
+		return
+	}
 	m := fmt.Sprintf("Charge: %+v", request)
 	logMessage(m)
 
@@ -486,45 +416,40 @@ func ChargeX(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "in-process")
+	db.Transition(request.UserKey, db.StatusInProcess, "pelecard charge", "charging")
 
-	currency := 1 // ILS
-	switch request.Currency {
-	case "USD":
-		currency = 2
-	case "EUR":
-		currency = 978
-	}
-	total := fmt.Sprintf("%d", int(math.Round(request.Price*100)))
-	card := &pelecard.PeleCard{
-		Token:               request.Token,
-		TotalX100:           total,
-		Currency:            currency,
-		AuthorizationNumber: request.ApprovalNo,
-		ParamX:              request.Reference,
-	}
-	if err = card.Init(request.Organization, types.Regular, false); err != nil {
+	provider, err := pelecardProvider(request.Organization, gateway.PreEMV)
+	if err != nil {
 		m := fmt.Sprintf("Charge: pelecard init %s", err.Error())
 		logMessage(m)
 
-		ErrorJson(http.StatusBadGateway, "Charge PeleCard Init: "+err.Error(), c)
+		utils.ChargeErrorJson("Charge PeleCard Init: ", err, c)
 		return
 	}
+	db.SetTerminal(request.UserKey, gateway.PreEMV.String())
 
-	var msg map[string]any
 	var response = types.PaymentResponse{}
 
-	if err, msg = card.ChargeByToken(false); err != nil {
-		db.SetStatus(request.UserKey, "invalid")
+	charge, err := provider.ChargeToken(c.Request.Context(), gateway.Charge{
+		UserKey:    request.UserKey,
+		Token:      request.Token,
+		ApprovalNo: request.ApprovalNo,
+		Reference:  request.Reference,
+		Amount:     request.Price,
+		Currency:   request.Currency,
+	})
+	if err != nil {
+		utils.SettleChargeFailure(request.UserKey, "pelecard charge", err)
 		m := fmt.Sprintf("Charge: Charge Error %s", err.Error())
 		logMessage(m)
 
-		ErrorJson(http.StatusOK, "Charge error ", c)
+		utils.ChargeErrorJson("Charge error ", err, c)
 		return
 	}
-	body, _ := json.Marshal(msg)
+	body, _ := json.Marshal(charge.Data)
 	_ = json.Unmarshal(body, &response)
 	response.UserKey = request.UserKey
+	response.TokenSHA256 = db.CardTokenHash(request.Token)
 	logMessage(fmt.Sprintf("Charge OK: %+v", response))
 	// update DB
 	if err = db.UpdateRequest(response); err != nil {
@@ -535,7 +460,7 @@ func ChargeX(c *gin.Context) {
 		return
 	}
 
-	db.SetStatus(request.UserKey, "valid")
+	db.Transition(request.UserKey, db.StatusValid, "pelecard charge", "charge approved")
 	data, _ := json.Marshal(response)
 	var result = map[string]string{
 		"status": "success",
@@ -545,13 +470,9 @@ func ChargeX(c *gin.Context) {
 }
 
 // ErrorJson answers with a status matching the cause. The body shape is
-// unchanged: callers read {"status":"error"} rather than the code.
-//
-// Charge outcomes deliberately keep http.StatusOK. This service cannot yet
-// tell a declined card from a gateway outage, and VH treats a non-2xx as a
-// gateway error — which still falls back token to EMV, but raises a Sentry
-// exception. Every decline would page someone. Once decline codes are
-// structured, the outage case can move to 502.
+// unchanged: callers read {"status":"error"} rather than the code. Charge
+// failures go through utils.ChargeErrorJson, which adds the classification
+// and keeps http.StatusOK for declines only.
 func ErrorJson(status int, message string, c *gin.Context) {
 	msg := map[string]string{
 		"status": "error",
@@ -568,7 +489,7 @@ func ErrorPayment(c *gin.Context) {
 	form := loadPeleCardForm(c)
 	m := fmt.Sprintf("ErrorPayment: %+v", form)
 	logMessage(m)
-	db.SetStatus(form.UserKey, "error")
+	db.Transition(form.UserKey, db.StatusError, "pelecard callback", "error "+form.PelecardStatusCode)
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		m := fmt.Sprintf("ErrorPayment: UpdateRequestTemp %s", err.Error())
 		logMessage(m)
@@ -591,7 +512,7 @@ func CancelPayment(c *gin.Context) {
 	var err error
 
 	form := loadPeleCardForm(c)
-	db.SetStatus(form.UserKey, "cancel")
+	db.Transition(form.UserKey, db.StatusCancel, "pelecard callback", "cancelled by payer")
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		ErrorJson(http.StatusOK, err.Error(), c)
 		return
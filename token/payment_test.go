@@ -0,0 +1,198 @@
+package token
+
+import (
+	"encoding/json/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/pelecard/pelecardtest"
+	"external_payments/types"
+)
+
+const baseUrl = "https://ext.test"
+
+func newEngine(t *testing.T) (*gin.Engine, *pelecardtest.Server, *dbtest.Store) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	server := pelecardtest.New(t)
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	t.Setenv("EXT_BASE_URL", baseUrl)
+
+	r := gin.New()
+	r.POST("/token/new", NewPayment)
+	r.POST("/token/good", GoodPayment)
+	r.POST("/token/error", ErrorPayment)
+	r.POST("/token/cancel", CancelPayment)
+	r.POST("/token/charge", Charge)
+	return r, server, store
+}
+
+func paymentBody(userKey string) string {
+	return `{"UserKey":"` + userKey + `","GoodURL":"https://shop.test/good","ErrorURL":"https://shop.test/error",
+		"CancelURL":"https://shop.test/cancel","Name":"Payer","Price":30,"Currency":"NIS",
+		"Email":"payer@example.com","Phone":"0500000000","SKU":"sku1","VAT":"n","Installments":1,
+		"Language":"HE","Reference":"ref-` + userKey + `","Organization":"ben2","Token":"tok-saved"}`
+}
+
+func serve(r *gin.Engine, path string, body string, contentType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func answer(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	var got map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("answer %q: %v", w.Body.String(), err)
+	}
+	return got
+}
+
+// open starts a recurring payment and returns the hosted page Pelecard offered.
+func open(t *testing.T, r *gin.Engine, userKey string) string {
+	t.Helper()
+	w := serve(r, "/token/new", paymentBody(userKey), "application/json")
+	page := answer(t, w)["url"]
+	if page == "" {
+		t.Fatalf("no hosted page in %d %q", w.Code, w.Body.String())
+	}
+	return page
+}
+
+func callback(r *gin.Engine, c pelecardtest.Callback) *httptest.ResponseRecorder {
+	return serve(r, strings.TrimPrefix(c.URL, baseUrl), c.Form.Encode(), "application/x-www-form-urlencoded")
+}
+
+var location = regexp.MustCompile(`window.location = '([^']*)'`)
+
+// The good callback registers the card, then charges it once on the recurring
+// terminal and confirms that charge before the payer sees success.
+func TestTokenGoodRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	w := callback(r, server.Pay(t, open(t, r, "u-good")))
+
+	m := location.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("no redirect in %d %q", w.Code, w.Body.String())
+	}
+	target, _ := url.Parse(m[1])
+	if target.Path != "/good" || target.Query().Get("token") == "" {
+		t.Errorf("payer sent to %s", target)
+	}
+	if status, _ := store.GetStatus("u-good"); status != "valid" {
+		t.Errorf("status = %q, want valid", status)
+	}
+	charges := server.Calls("/DebitRegularType")
+	if len(charges) != 1 || charges[0].Body["TerminalNumber"] != pelecardtest.RecurrentTerminal {
+		t.Errorf("first charge calls = %+v", charges)
+	}
+}
+
+// A first charge that went through but cannot be confirmed is left for
+// reconciliation rather than marked either way.
+func TestTokenGoodFirstChargeUnverified(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	c := server.Pay(t, open(t, r, "u-unverified"))
+	server.Script("/GetTransDataByTrxId", pelecardtest.NoData)
+	callback(r, c)
+
+	if status, _ := store.GetStatus("u-unverified"); status != "in-process" {
+		t.Errorf("status = %q, want in-process", status)
+	}
+}
+
+func TestTokenErrorRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	w := callback(r, server.Fail(t, open(t, r, "u-declined"), "006"))
+
+	if !strings.Contains(w.Body.String(), "https://shop.test/error?error=Incorrect CVV/ID.") {
+		t.Errorf("answer %q", w.Body.String())
+	}
+	if status, _ := store.GetStatus("u-declined"); status != "error" {
+		t.Errorf("status = %q, want error", status)
+	}
+}
+
+func TestTokenCancelRoundTrip(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	callback(r, server.Cancel(t, open(t, r, "u-cancel")))
+
+	if status, _ := store.GetStatus("u-cancel"); status != "cancel" {
+		t.Errorf("status = %q, want cancel", status)
+	}
+}
+
+func TestChargeApproved(t *testing.T) {
+	r, server, store := newEngine(t)
+
+	w := serve(r, "/token/charge", paymentBody("u-charge"), "application/json")
+
+	if got := answer(t, w); got["status"] != "success" {
+		t.Fatalf("answer %+v", got)
+	}
+	if status, _ := store.GetStatus("u-charge"); status != "valid" {
+		t.Errorf("status = %q, want valid", status)
+	}
+	tx := server.Transactions()
+	if len(tx) != 1 || tx[0].Token != "tok-saved" || tx[0].Total != 3000 {
+		t.Errorf("transactions = %+v", tx)
+	}
+	// A refund is held to the card that paid.
+	var response types.PaymentResponse
+	if err := store.LoadPaymentResponse("u-charge", &response); err != nil || response.TokenSHA256 != db.CardTokenHash("tok-saved") {
+		t.Errorf("response %+v, %v: charging token not recorded", response, err)
+	}
+}
+
+func TestChargeDeclined(t *testing.T) {
+	r, server, store := newEngine(t)
+	server.Script("/DebitRegularType", pelecardtest.Decline("004"))
+
+	w := serve(r, "/token/charge", paymentBody("u-refused"), "application/json")
+
+	if w.Code != http.StatusOK {
+		t.Errorf("code = %d, want 200 for a decline", w.Code)
+	}
+	got := answer(t, w)
+	if got["status"] != "error" || got["kind"] != "declined" || got["code"] != "004" ||
+		got["message"] != "Refusal by credit company." {
+		t.Fatalf("answer %+v", got)
+	}
+	if status, _ := store.GetStatus("u-refused"); status != "invalid" {
+		t.Errorf("status = %q, want invalid", status)
+	}
+}
+
+func TestChargeTimeoutIsRetryable(t *testing.T) {
+	r, server, store := newEngine(t)
+	server.Script("/DebitRegularType", pelecardtest.Timeout)
+
+	w := serve(r, "/token/charge", paymentBody("u-slow"), "application/json")
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("code = %d, want 502 for an outage", w.Code)
+	}
+	if got := answer(t, w); got["kind"] != "retryable" {
+		t.Fatalf("answer %+v", got)
+	}
+	// The charge may have gone through: reconciling settles it, not us.
+	if status, _ := store.GetStatus("u-slow"); status != "in-process" {
+		t.Errorf("status = %q, want in-process", status)
+	}
+}
@@ -0,0 +1,212 @@
+package token
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/gateway"
+	"external_payments/types"
+	"external_payments/utils"
+)
+
+// Refund credits a captured Pelecard payment, in full or in part, and records
+// the credit against the original request, whose status becomes refunded or
+// partially-refunded. The answer has the same shape as Charge.
+//
+// Only the organization on the caller's key can be refunded: a payment that
+// belongs to another organization is reported as not found, so the caller
+// learns nothing about it. The token must be the card the payment was charged
+// to; the refund is never sent to any other.
+func Refund(c *gin.Context) {
+	var err error
+
+	var request types.RefundRequest
+	if err = c.ShouldBindJSON(&request); err != nil {
+		ErrorJson(http.StatusBadRequest, "Refund Bind "+err.Error(), c)
+		return
+	}
+
+	client, _ := utils.APIClientFor(c)
+	if client.Organization == "" {
+		ErrorJson(http.StatusBadRequest,
+			"no organization: this endpoint needs a client key that carries one, not a shared internal token", c)
+		return
+	}
+	if request.Token == "" {
+		ErrorJson(http.StatusBadRequest, "Token cannot be blank: Pelecard refunds the card it charged", c)
+		return
+	}
+	if request.Amount < 0 {
+		ErrorJson(http.StatusBadRequest, "Amount cannot be negative", c)
+		return
+	}
+
+	userKey := request.UserKey
+	if userKey == "" {
+		if request.TransactionId == "" {
+			ErrorJson(http.StatusBadRequest, "UserKey or TransactionId is required", c)
+			return
+		}
+		if userKey, err = db.FindUserKeyByTransaction(request.TransactionId); err != nil {
+			logMessage(fmt.Sprintf("Refund: transaction %s not found: %s", request.TransactionId, err))
+			ErrorJson(http.StatusNotFound, "payment not found", c)
+			return
+		}
+	}
+
+	var original types.PaymentRequest
+	if err = db.LoadRequest(userKey, &original); err != nil || original.Organization != client.Organization {
+		logMessage(fmt.Sprintf("Refund: %s not found for client %q", userKey, client.Name))
+		ErrorJson(http.StatusNotFound, "payment not found", c)
+		return
+	}
+	if original.Status != "valid" && original.Status != "partially-refunded" {
+		ErrorJson(http.StatusConflict, "payment is "+original.Status+", not refundable", c)
+		return
+	}
+
+	var response types.PaymentResponse
+	if err = db.LoadPaymentResponse(userKey, &response); err != nil {
+		logMessage(fmt.Sprintf("Refund: LoadPaymentResponse %s: %s", userKey, err))
+		ErrorJson(http.StatusConflict, "payment has no gateway response to refund", c)
+		return
+	}
+	// Pelecard credits whatever card the token names, so the token has to be
+	// the one that paid. A payment recorded without one cannot be refunded
+	// here at all.
+	paidWith := []byte(db.CardTokenHash(request.Token))
+	if response.TokenSHA256 == "" || subtle.ConstantTimeCompare([]byte(response.TokenSHA256), paidWith) != 1 {
+		logMessage(fmt.Sprintf("Refund: %s token is not the card that paid, client=%q", userKey, client.Name))
+		ErrorJson(http.StatusConflict, "Token is not the card this payment was charged to", c)
+		return
+	}
+	transactionId := response.TransactionId
+	if transactionId == "" {
+		transactionId = response.TransactionPelecardId
+	}
+
+	amount := request.Amount
+	if amount == 0 {
+		refunded, err := db.RefundedTotal("pelecard", transactionId)
+		if err != nil {
+			ErrorJson(http.StatusInternalServerError, "Refund RefundedTotal "+err.Error(), c)
+			return
+		}
+		amount = math.Round((original.Price-refunded)*100) / 100
+		if amount <= 0 {
+			ErrorJson(http.StatusConflict, "nothing left to refund", c)
+			return
+		}
+	}
+
+	refund := types.Refund{
+		UserKey:       userKey,
+		Gateway:       "pelecard",
+		TransactionId: transactionId,
+		Amount:        amount,
+		Currency:      original.Currency,
+		Client:        client.Name,
+	}
+	id, refunded, err := db.ReserveRefund(refund, original.Price)
+	if errors.Is(err, db.ErrRefundExceedsCaptured) {
+		ErrorJson(http.StatusBadRequest, fmt.Sprintf("Amount %.2f exceeds the remaining %.2f",
+			amount, original.Price-refunded), c)
+		return
+	}
+	if err != nil {
+		logMessage(fmt.Sprintf("Refund: ReserveRefund %s", err))
+		ErrorJson(http.StatusInternalServerError, "Refund ReserveRefund "+err.Error(), c)
+		return
+	}
+	logMessage(fmt.Sprintf("Refund: %s %.2f %s of %.2f, client=%q", userKey, amount, original.Currency, original.Price, client.Name))
+
+	order := gateway.Refund{
+		TransactionId: transactionId,
+		Token:         request.Token,
+		Reference:     original.Reference,
+		Amount:        amount,
+		Currency:      original.Currency,
+	}
+	result, err := refundOnTerminals(c.Request.Context(), original, order)
+	if err != nil {
+		if gateway.Classify(err).Kind == gateway.Retryable {
+			// Pelecard may have made the refund without our hearing back. The
+			// reservation stays pending, still counted against what is left
+			// to refund, so a retry cannot credit the payer twice.
+			logMessage(fmt.Sprintf("Refund: %s outcome unknown, reservation %d left pending: %s", userKey, id, err))
+		} else {
+			_ = db.SettleRefund(id, "", err)
+			logMessage(fmt.Sprintf("Refund: %s failed: %s", userKey, err))
+		}
+		ErrorJson(http.StatusBadGateway, "Refund error "+err.Error(), c)
+		return
+	}
+
+	refund.RefundId = result.Id
+	refund.Status = "done"
+	if err = db.SettleRefund(id, refund.RefundId, nil); err != nil {
+		// The money has moved. Say so, and leave the row pending for someone
+		// to settle by hand rather than answer as if nothing happened.
+		logMessage(fmt.Sprintf("Refund: %s refunded as %s but SettleRefund failed: %s", userKey, refund.RefundId, err))
+	}
+
+	refund.Refunded = refunded + amount
+	refund.Remaining = math.Round((original.Price-refund.Refunded)*100) / 100
+	if refund.Remaining <= 0 {
+		db.Transition(userKey, db.StatusRefunded, "refund", "refund "+refund.RefundId)
+	} else {
+		db.Transition(userKey, db.StatusPartiallyRefunded, "refund", "refund "+refund.RefundId)
+	}
+
+	data, _ := json.Marshal(refund)
+	ResultJson(map[string]string{
+		"status": "success",
+		"data":   string(data),
+	}, c)
+}
+
+// refundOnTerminals refunds order on the terminal original was charged on.
+// Requests from before the terminal was recorded try each terminal in turn,
+// moving on only when one was not set up or did not know the token: after any
+// other error the refund may have been made, and a later terminal's decline
+// would hide that.
+func refundOnTerminals(ctx context.Context, original types.PaymentRequest, order gateway.Refund) (gateway.Result, error) {
+	terminals := []gateway.Terminal{gateway.Recurrent, gateway.Regular, gateway.PreEMV}
+	if original.Terminal != "" {
+		terminals = slices.DeleteFunc(terminals, func(t gateway.Terminal) bool { return t.String() != original.Terminal })
+		if len(terminals) == 0 {
+			return gateway.Result{}, &gateway.Error{Kind: gateway.Configuration,
+				Message: fmt.Sprintf("%s was charged on unknown terminal %q", original.UserKey, original.Terminal)}
+		}
+	}
+	var result gateway.Result
+	var err error
+	for _, terminal := range terminals {
+		provider, initErr := pelecardProvider(original.Organization, terminal)
+		if initErr != nil {
+			err = initErr
+			continue
+		}
+		result, err = provider.Refund(ctx, order)
+		if err == nil || !unknownToken(err) {
+			return result, err
+		}
+		logMessage(fmt.Sprintf("Refund: %s terminal does not know the token: %s", terminal, err))
+	}
+	return result, err
+}
+
+// unknownToken is Pelecard declining a token the terminal did not issue.
+func unknownToken(err error) bool {
+	e := gateway.Classify(err)
+	return e.Kind == gateway.Declined && e.Code == "506"
+}
@@ -0,0 +1,50 @@
+package token
+
+import (
+	"context"
+	"testing"
+
+	"external_payments/gateway"
+	"external_payments/pelecard/pelecardtest"
+	"external_payments/types"
+)
+
+var refundOrder = gateway.Refund{TransactionId: "tx-1", Token: "tok-saved", Reference: "ref-1", Amount: 10, Currency: "NIS"}
+
+// terminals lists the terminal of each refund the server was sent.
+func terminals(server *pelecardtest.Server) (found []string) {
+	for _, call := range server.Calls("/RefundRegularType") {
+		terminal, _ := call.Body["TerminalNumber"].(string)
+		found = append(found, terminal)
+	}
+	return found
+}
+
+// A request that records its terminal is refunded there and nowhere else.
+func TestRefundOnRecordedTerminal(t *testing.T) {
+	server := pelecardtest.New(t)
+	original := types.PaymentRequest{UserKey: "u-1", Organization: "ben2", Terminal: gateway.Regular.String()}
+
+	if _, err := refundOnTerminals(context.Background(), original, refundOrder); err != nil {
+		t.Fatal(err)
+	}
+	if got := terminals(server); len(got) != 1 || got[0] != pelecardtest.RegularTerminal("ben2") {
+		t.Errorf("refunded on %v", got)
+	}
+}
+
+// Without a recorded terminal, a terminal that does not know the token passes
+// the refund on, but a timeout stops it: the refund may have been made.
+func TestRefundTimeoutStopsAtTerminal(t *testing.T) {
+	server := pelecardtest.New(t)
+	server.Script("/RefundRegularType", pelecardtest.Decline("506"), pelecardtest.Timeout)
+	original := types.PaymentRequest{UserKey: "u-1", Organization: "ben2"}
+
+	_, err := refundOnTerminals(context.Background(), original, refundOrder)
+	if err == nil || gateway.Classify(err).Kind != gateway.Retryable {
+		t.Fatalf("err = %v, want retryable", err)
+	}
+	if got := terminals(server); len(got) != 2 || got[1] != pelecardtest.RegularTerminal("ben2") {
+		t.Errorf("refunded on %v, want recurrent then regular only", got)
+	}
+}
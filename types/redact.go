@@ -44,3 +44,12 @@ func (p PeleCardResponse) String() string {
 		p.UserKey, p.ParamX, p.PelecardTransactionId, p.PelecardStatusCode,
 		last4(p.Token))
 }
+
+// String redacts the payer's personal data (name, email, phone, address) from
+// a PayPal payment, keeping what identifies it: the reference and capture.
+func (p PaypalRegister) String() string {
+	return fmt.Sprintf("{Reference:%s Organization:%s Price:%.2f %s SKU:%s "+
+		"TransactionId:%s PaymentDate:%s Invoice:%s}",
+		p.Reference, p.Organization, p.Price, p.Currency, p.SKU,
+		p.TransactionId, p.PaymentDate, p.Invoice)
+}
@@ -76,3 +76,26 @@ func TestLast4(t *testing.T) {
 		}
 	}
 }
+
+func TestPaypalRegisterStringOmitsSensitiveFields(t *testing.T) {
+	p := PaypalRegister{
+		Name:          "Israel Israeli",
+		Email:         "donor@example.com",
+		Phone:         "+972500000000",
+		Street:        "Hertzl 1",
+		City:          "Petah Tikva",
+		Reference:     "m-456",
+		TransactionId: "CAP-1",
+	}
+
+	out := fmt.Sprintf("%+v", p)
+
+	for _, secret := range []string{p.Name, p.Email, p.Phone, p.Street, p.City} {
+		if strings.Contains(out, secret) {
+			t.Errorf("PaypalRegister log output leaks %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "m-456") || !strings.Contains(out, "CAP-1") {
+		t.Errorf("PaypalRegister log output lost its correlation keys: %s", out)
+	}
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type PelecardType string
 type ActionType string
 
@@ -16,7 +18,7 @@ type PaypalRegister struct {
 
 	Name         string  `json:"Name" form:"Name" db:"name" validate:"string,required"`
 	Price        float64 `json:"Price" form:"Price" db:"price" validate:"float,min=0"`
-	Currency     string  `json:"Currency" form:"Currency" db:"currency" validate:"string,required,values=USD|EUR|NIS|ILS"`
+	Currency     string  `json:"Currency" form:"Currency" db:"currency" validate:"string,required,currency"`
 	Email        string  `json:"Email" form:"Email" db:"email" validate:"email,required"`
 	Phone        string  `json:"Phone" form:"Phone" db:"phone" validate:"string,required"`
 	Street       string  `json:"Street" form:"Street" db:"street" validate:"string"`
@@ -26,7 +28,7 @@ type PaypalRegister struct {
 	SKU          string  `json:"SKU" form:"SKU" db:"sku" validate:"string,required"`
 	Language     string  `json:"Language" form:"Language" db:"language" validate:"string,required,values=EN|HE|RU"`
 	Reference    string  `json:"Reference" form:"Reference" db:"reference" validate:"string,required"`
-	Organization string  `json:"Organization" form:"Organization" db:"organization" validate:"string,required,values=ben2|meshp18"`
+	Organization string  `json:"Organization" form:"Organization" db:"organization" validate:"string,required,organization"`
 
 	TransactionId string `db:"transaction_id" url:"transaction_id"`
 	PaymentDate   string `db:"payment_date" url:"payment_date"`
@@ -52,6 +54,9 @@ type PaymentRequest struct {
 	PStatus       string  `json:"-" db:"pstatus"`
 	PaypalOrderId *string `json:"-" db:"paypal_order_id"`
 	PaypalEnv     *string `json:"-" db:"paypal_env"`
+	// Terminal is the Pelecard terminal the request went to, as
+	// gateway.Terminal names it; empty for PayPal and for older requests.
+	Terminal string `json:"-" db:"terminal"`
 
 	// Part for Pelecard
 	GoodURL       string `json:"GoodURL" form:"GoodURL" db:"good_url" validate:"string,required"`
@@ -61,11 +66,19 @@ type PaymentRequest struct {
 	Token         string `json:"Token" form:"Token" db:"-"`
 	IsRecurring   bool   `json:"IsRecurring" form:"IsRecurring" db:"is_recurring"`
 	PluginVersion string `json:"PluginVersion" form:"PluginVersion" db:"-"`
+	// CallbackURL is where the result is posted, whatever the payer's
+	// browser does; see package webhooks. It is the one set on the caller's
+	// key with -callback, never one the request names: we would sign and post
+	// to any address we were sent.
+	CallbackURL string `json:"-" form:"-" db:"callback_url"`
+	// WebhookSalt is the key's too, and picks the secret the webhooks are
+	// signed with; see db.WebhookSecret.
+	WebhookSalt string `json:"-" form:"-" db:"webhook_salt"`
 
 	// Part for Priority
 	Name         string  `json:"Name" form:"Name" db:"name" validate:"string,required"`
 	Price        float64 `json:"Price" form:"Price" db:"price" validate:"float,min=0"`
-	Currency     string  `json:"Currency" form:"Currency" db:"currency" validate:"string,required,values=USD|EUR|NIS|ILS"`
+	Currency     string  `json:"Currency" form:"Currency" db:"currency" validate:"string,required,currency"`
 	Email        string  `json:"Email" form:"Email" db:"email" validate:"email,required"`
 	Phone        string  `json:"Phone" form:"Phone" db:"phone" validate:"string,required"`
 	Street       string  `json:"Street" form:"Street" db:"street" validate:"string"`
@@ -79,7 +92,7 @@ type PaymentRequest struct {
 	MaxPayments  int     `json:"MaxPayments" form:"MaxPayments" db:"-" validate:"number,min=0,max=12"`
 	Language     string  `json:"Language" form:"Language" db:"language" validate:"string,required,values=EN|HE|RU|ES"`
 	Reference    string  `json:"Reference" form:"Reference" db:"reference" validate:"string,required"`
-	Organization string  `json:"Organization" form:"Organization" db:"organization" validate:"string,required,values=ben2|meshp18"`
+	Organization string  `json:"Organization" form:"Organization" db:"organization" validate:"string,required,organization"`
 	IsVisual     bool    `json:"IsVisual" form:"IsVisual" db:"is_visual"`
 	TaxType      string  `json:"TaxType" form:"TaxType" db:"tax_type"`
 	TaxId        string  `json:"TaxId" form:"TaxId" db:"tax_id"`
@@ -120,6 +133,173 @@ type MuhlafimEntry struct {
 	NewExpirationDate string `json:"NewExpirationDate"`
 }
 
+// RefundRequest identifies a captured payment by UserKey or by the gateway's
+// transaction id, whichever the caller kept. Amount 0 refunds whatever remains.
+//
+// Pelecard credits a card, not a transaction, so the refund needs the token
+// the payment was charged with. PayPal refunds the capture itself and needs
+// Reference instead: the caller's own name for the refund, which makes a
+// retried request answer with the first one's result rather than refund twice.
+type RefundRequest struct {
+	UserKey       string  `json:"UserKey"`
+	TransactionId string  `json:"TransactionId"`
+	Token         string  `json:"Token"`
+	Amount        float64 `json:"Amount"`
+	Reference     string  `json:"Reference"`
+}
+
+// Refund is one row of civicrm_bb_ext_refunds: a credit against a captured
+// payment, settled or not.
+type Refund struct {
+	Id            int64   `json:"-" db:"id"`
+	UserKey       string  `json:"UserKey" db:"user_key"`
+	Gateway       string  `json:"Gateway" db:"gateway"`
+	TransactionId string  `json:"TransactionId" db:"transaction_id"`
+	Amount        float64 `json:"Amount" db:"amount"`
+	Currency      string  `json:"Currency" db:"currency"`
+	RefundId      string  `json:"RefundId" db:"refund_id"`
+	Status        string  `json:"Status" db:"status"`
+	Reference     string  `json:"Reference,omitempty" db:"reference"`
+	Error         string  `json:"Error,omitempty" db:"error"`
+	Client        string  `json:"-" db:"client"`
+
+	// Running totals for the original payment, reported with a new refund.
+	Refunded  float64 `json:"Refunded" db:"-"`
+	Remaining float64 `json:"Remaining" db:"-"`
+}
+
+// IdempotencyRecord is one row of civicrm_bb_ext_idempotency: a charge a
+// client sent under an Idempotency-Key, and once it finished, the answer.
+// Fingerprint is a hash of the request, so a key reused for a different
+// request is told apart from a retry.
+type IdempotencyRecord struct {
+	Id          int64  `db:"id"`
+	Client      string `db:"client"`
+	Key         string `db:"idem_key"`
+	Endpoint    string `db:"endpoint"`
+	Fingerprint string `db:"fingerprint"`
+	UserKey     string `db:"user_key"`
+	Status      string `db:"status"`
+	HTTPStatus  int    `db:"http_status"`
+	Body        string `db:"body"`
+}
+
+// RequestSummary is a payment request as listed rather than processed: who,
+// how much, how it stands, and the gateway's id for it once there is one.
+// Gateway is "paypal" or "pelecard".
+type RequestSummary struct {
+	Id            int64   `db:"id"`
+	UserKey       string  `db:"user_key"`
+	Reference     string  `db:"reference"`
+	Organization  string  `db:"organization"`
+	Status        string  `db:"status"`
+	Price         float64 `db:"price"`
+	Currency      string  `db:"currency"`
+	SKU           string  `db:"sku"`
+	CreatedAt     string  `db:"created_at"`
+	TransactionId string  `db:"transaction_id"`
+	Gateway       string  `db:"gateway"`
+	PaypalOrderId string  `db:"paypal_order_id"`
+}
+
+// RequestQuery selects requests for the payments API. An empty field matches
+// anything. Matches come newest first, at most Limit of them, and After
+// continues a listing below the request with that id.
+type RequestQuery struct {
+	UserKey         string
+	Organization    string
+	ReferencePrefix string
+	Status          string
+	Currency        string
+	SKU             string
+	From, To        time.Time
+	After           int64
+	Limit           int
+}
+
+// PaymentExport is a request as finance sees it: what was asked for, joined
+// with what Pelecard or PayPal made of it. The card is carried by its last
+// four digits only. Installments are the gateway's when it reported them, else
+// the request's.
+type PaymentExport struct {
+	Id            int64   `db:"id"`
+	CreatedAt     string  `db:"created_at"`
+	Organization  string  `db:"organization"`
+	Reference     string  `db:"reference"`
+	UserKey       string  `db:"user_key"`
+	Status        string  `db:"status"`
+	SKU           string  `db:"sku"`
+	Gateway       string  `db:"gateway"`
+	TransactionId string  `db:"transaction_id"`
+	Currency      string  `db:"currency"`
+	Price         float64 `db:"price"`
+	Installments  int     `db:"installments"`
+	VAT           string  `db:"vat"`
+	CardBrand     string  `db:"card_brand"`
+	CardLast4     string  `db:"card_last4"`
+	VoucherId     string  `db:"voucher_id"`
+}
+
+// SettlementRow is one line of a settlement report before it is summed: a
+// request created in the day, or a refund made in it, with the request's
+// organization, gateway, terminal and currency. Reason is why the request
+// last changed status, which for a decline carries Pelecard's code.
+type SettlementRow struct {
+	Refund       bool    `db:"refund"`
+	Organization string  `db:"organization"`
+	Gateway      string  `db:"gateway"`
+	Terminal     string  `db:"terminal"`
+	Currency     string  `db:"currency"`
+	Status       string  `db:"status"`
+	Amount       float64 `db:"amount"`
+	Reason       string  `db:"reason"`
+}
+
+// StatusChange is one row of civicrm_bb_ext_request_status_history: a request
+// moved From one status To another, by Actor, the flow that moved it, for
+// Reason.
+type StatusChange struct {
+	Id        int64  `db:"id"`
+	RequestId int64  `db:"request_id"`
+	UserKey   string `db:"user_key"`
+	From      string `db:"from_status"`
+	To        string `db:"to_status"`
+	Actor     string `db:"actor"`
+	Reason    string `db:"reason"`
+	CreatedAt string `db:"created_at"`
+}
+
+// Webhook is one row of civicrm_bb_ext_webhooks, the outbox: an event waiting
+// to be posted to a caller, or the record of one that was. Status is pending
+// until the caller accepts it, then delivered, or failed once the retries run
+// out.
+type Webhook struct {
+	Id        int64  `db:"id"`
+	EventId   string `db:"event_id"`
+	UserKey   string `db:"user_key"`
+	URL       string `db:"url"`
+	Salt      string `db:"webhook_salt"`
+	Payload   string `db:"payload"`
+	Status    string `db:"status"`
+	Attempts  int    `db:"attempts"`
+	LastError string `db:"last_error"`
+}
+
+// WebhookEvent is the body of a webhook: a request reaching one of the
+// statuses a caller acts on.
+type WebhookEvent struct {
+	Id            string  `json:"id"`
+	Type          string  `json:"type"`
+	UserKey       string  `json:"user_key"`
+	Status        string  `json:"status"`
+	Reference     string  `json:"reference"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Organization  string  `json:"organization"`
+	TransactionId string  `json:"transaction_id,omitempty"`
+	OccurredAt    string  `json:"occurred_at"`
+}
+
 type PaymentResponse struct {
 	UserKey                  string `db:"user_key" url:"user_key"`
 	TransactionId            string `db:"transaction_id" url:"transaction_id"`
@@ -146,6 +326,9 @@ type PaymentResponse struct {
 	JParam                   string `db:"j_param" url:"j_param"`
 	TransactionPelecardId    string `db:"transaction_pelecard_id" url:"transaction_pelecard_id"`
 	DebitCurrency            string `db:"debit_currency" url:"debit_currency"`
+	// TokenSHA256 is the hash of the card token that paid, which a refund
+	// must name; empty when the payment was not made with one.
+	TokenSHA256 string `db:"token_sha256" url:"-" json:"-"`
 }
 
 type Project struct {
@@ -154,11 +337,27 @@ type Project struct {
 	Target    float64 `db:"target"`
 	StartDate string  `db:"start_date"`
 	Url       string  `db:"url"`
+	// DisplayCurrency is the currency the project's counter and statistics
+	// are shown in, and its target set in.
+	DisplayCurrency string `db:"display_currency"`
 }
 
 type ProjectTotals struct {
 	Contributors float64 `db:"contributors"`
 	Total        float64 `db:"total"`
+	// Unconverted are the contributions left out of Contributors and Total
+	// for want of an exchange rate for their currency.
+	Unconverted float64 `db:"unconverted"`
+}
+
+// ExchangeRate is what one unit of Currency was worth in dollars on Date.
+// Rates are kept against the dollar whatever the source quotes them against,
+// so any two currencies convert through it.
+type ExchangeRate struct {
+	Date     string  `db:"rate_date"`
+	Currency string  `db:"currency"`
+	USD      float64 `db:"usd"`
+	Source   string  `db:"source"`
 }
 
 type ProjectRange struct {
@@ -18,7 +18,8 @@ import (
 const APIClientKey = "api_client"
 
 // RequireAPIClient rejects a caller that does not present a valid token in
-// "Authorization: Bearer <token>". It always enforces — a route guarded with
+// "Authorization: Bearer <token>", or sign the request with it (see Sign).
+// It always enforces — a route guarded with
 // this is never open, whatever is or is not configured.
 func RequireAPIClient() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -35,6 +36,44 @@ func RequireAPIClient() gin.HandlerFunc {
 	}
 }
 
+// RequireInternal admits only our own services, by the shared internal token.
+// It guards operations on the service itself rather than on a payment, which
+// no client key should reach.
+func RequireInternal() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if client, ok := resolveClient(c); ok && client.Internal {
+			c.Set(APIClientKey, client)
+			c.Next()
+			return
+		}
+
+		LogMessage(fmt.Sprintf("AUTH DENIED: %s %s ip=%s internal token required",
+			c.Request.Method, c.Request.URL.Path, c.ClientIP()))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// RequireScope refuses, with 403, a client whose key does not carry scope.
+// Register it after RequireAPIClient or ObserveAPIClient, which identify the
+// client; a request without one is theirs to admit or refuse, and passes here.
+//
+// Scopes narrow what a key can do, so an integration that only reads
+// transactions holds a key that cannot charge a card.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := APIClientFor(c)
+		if !ok || client.HasScope(scope) {
+			c.Next()
+			return
+		}
+
+		LogMessage(fmt.Sprintf("SCOPE DENIED: client=%q scope=%s has=%q %s %s ip=%s",
+			client.Name, scope, client.Scopes,
+			c.Request.Method, c.Request.URL.Path, c.ClientIP()))
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "key lacks scope " + scope})
+	}
+}
+
 // ObserveAPIClient resolves a token if one is presented and lets every request
 // through either way, logging callers that did not authenticate.
 //
@@ -65,12 +104,31 @@ func presentedToken(c *gin.Context) string {
 }
 
 func resolveClient(c *gin.Context) (db.APIClient, bool) {
+	if c.GetHeader(SignatureHeader) != "" {
+		client, err := VerifySignature(c)
+		if err != nil {
+			LogMessage(fmt.Sprintf("AUTH SIGNATURE: %s %s ip=%s key_id=%q: %s",
+				c.Request.Method, c.Request.URL.Path, c.ClientIP(), c.GetHeader(KeyIDHeader), err))
+			return db.APIClient{}, false
+		}
+		db.TouchAPIClient(client.ID, c.ClientIP())
+		return client, true
+	}
+
 	token := presentedToken(c)
 	if token == "" {
 		return db.APIClient{}, false
 	}
 
 	if client, ok := db.LookupAPIClient(token); ok {
+		// A client moved to signing has its token refused on its own, so a
+		// copy of it in a log or a proxy is no use to anyone.
+		if client.RequireSignature {
+			LogMessage(fmt.Sprintf("AUTH SIGNATURE: %s %s ip=%s client=%q sent a bearer token, signature required",
+				c.Request.Method, c.Request.URL.Path, c.ClientIP(), client.Name))
+			return db.APIClient{}, false
+		}
+		db.TouchAPIClient(client.ID, c.ClientIP())
 		return client, true
 	}
 
@@ -80,7 +138,7 @@ func resolveClient(c *gin.Context) (db.APIClient, bool) {
 	// has to carry the organization.
 	if internal := os.Getenv("INTERNAL_API_TOKEN"); internal != "" &&
 		subtle.ConstantTimeCompare([]byte(token), []byte(internal)) == 1 {
-		return db.APIClient{Name: "internal"}, true
+		return db.APIClient{Name: "internal", Internal: true}, true
 	}
 
 	return db.APIClient{}, false
@@ -128,3 +186,40 @@ func ResolveOrganization(c *gin.Context, fromBody string) string {
 
 	return client.Organization
 }
+
+// CheckPrefix holds a request's reference to the prefix on the caller's key.
+// A reference outside it is logged; if the client is in db.PrefixEnforce mode
+// an error is returned as well, and the handler refuses the request with 403.
+//
+// Clients start in observe mode and are moved to enforce one at a time, once
+// the log shows they send only their own references — the same path as
+// ObserveAPIClient to RequireAPIClient, per client rather than per route.
+//
+// A request without a key, or with the internal token, has no prefix to hold.
+func CheckPrefix(c *gin.Context, reference string) error {
+	client, ok := APIClientFor(c)
+	if !ok || client.Prefix == "" || strings.HasPrefix(reference, client.Prefix) {
+		return nil
+	}
+
+	enforce := client.PrefixMode == db.PrefixEnforce
+	LogMessage(fmt.Sprintf(
+		"PREFIX MISMATCH: client=%q prefix=%s reference=%s enforce=%t %s %s ip=%s",
+		client.Name, client.Prefix, reference, enforce,
+		c.Request.Method, c.Request.URL.Path, c.ClientIP()))
+	if !enforce {
+		return nil
+	}
+	return fmt.Errorf("reference %q does not start with %q", reference, client.Prefix)
+}
+
+// ResolveCallback decides where a request's webhooks go, and the salt of the
+// secret they are signed with: those set on the caller's key, or none for a
+// caller without one. A URL in the request is not taken, even from a keyed
+// caller. We sign what we post, so a caller who could name the address could
+// have us post signed requests into our own network, or take over another
+// site's notifications.
+func ResolveCallback(c *gin.Context) (callbackURL, webhookSalt string) {
+	client, _ := APIClientFor(c)
+	return client.CallbackURL, client.WebhookSalt
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"testing"
 
@@ -55,3 +56,109 @@ func TestResolveOrganizationNeitherSide(t *testing.T) {
 		t.Errorf("nothing to resolve should stay empty so validation rejects it, got %q", got)
 	}
 }
+
+// Webhooks go only where the caller's key says: a caller without a key, or
+// whose key has no callback, gets none.
+func TestResolveCallback(t *testing.T) {
+	for _, tc := range []struct {
+		client    *db.APIClient
+		url, salt string
+	}{
+		{nil, "", ""},
+		{&db.APIClient{Name: "1family"}, "", ""},
+		{&db.APIClient{Name: "1family", CallbackURL: "https://1family.test/hook", WebhookSalt: "s1"},
+			"https://1family.test/hook", "s1"},
+	} {
+		if url, salt := ResolveCallback(ctxWithClient(tc.client)); url != tc.url || salt != tc.salt {
+			t.Errorf("client %+v: %q %q, want %q %q", tc.client, url, salt, tc.url, tc.salt)
+		}
+	}
+}
+
+// A client row named "internal" is still a client: only the shared token
+// reaches internal routes.
+func TestRequireInternal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("INTERNAL_API_TOKEN", "shared-secret")
+	r := gin.New()
+	r.POST("/internal/reload-clients", RequireInternal(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"shared-secret", http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"someone-else", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/internal/reload-clients", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("token %q: code %d, want %d", tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+// Observe mode only logs, so a client can be moved to enforce without taking
+// its payments down first.
+func TestCheckPrefixObserveLetsMismatchThrough(t *testing.T) {
+	c := ctxWithClient(&db.APIClient{Name: "1family", Prefix: "1fam", PrefixMode: db.PrefixObserve})
+	if err := CheckPrefix(c, "mesh-123"); err != nil {
+		t.Errorf("observe mode must not refuse, got %v", err)
+	}
+}
+
+func TestCheckPrefixEnforceRefusesMismatch(t *testing.T) {
+	c := ctxWithClient(&db.APIClient{Name: "1family", Prefix: "1fam", PrefixMode: db.PrefixEnforce})
+	if err := CheckPrefix(c, "mesh-123"); err == nil {
+		t.Error("enforce mode must refuse another site's reference")
+	}
+	if err := CheckPrefix(c, "1fam-123"); err != nil {
+		t.Errorf("enforce mode must accept the client's own reference, got %v", err)
+	}
+}
+
+// Callers without a key, and our own services, have no prefix to hold.
+func TestCheckPrefixWithoutPrefix(t *testing.T) {
+	if err := CheckPrefix(ctxWithClient(nil), "anything"); err != nil {
+		t.Errorf("unauthenticated caller: %v", err)
+	}
+	if err := CheckPrefix(ctxWithClient(&db.APIClient{Name: "internal", Internal: true}), "anything"); err != nil {
+		t.Errorf("internal caller: %v", err)
+	}
+}
+
+// 4priority reads transactions; its key must not be able to charge.
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	reader := db.APIClient{Name: "4priority", Scopes: db.ScopeTransactionRead}
+
+	for _, tc := range []struct {
+		client *db.APIClient
+		scope  string
+		want   int
+	}{
+		{&reader, db.ScopeTransactionRead, http.StatusOK},
+		{&reader, db.ScopeCharge, http.StatusForbidden},
+		{&db.APIClient{Name: "internal", Internal: true}, db.ScopeCharge, http.StatusOK},
+		// No key on an observe route: authentication is not this middleware's call.
+		{nil, db.ScopeCharge, http.StatusOK},
+	} {
+		r := gin.New()
+		r.POST("/", func(c *gin.Context) {
+			if tc.client != nil {
+				c.Set(APIClientKey, *tc.client)
+			}
+		}, RequireScope(tc.scope), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		if w.Code != tc.want {
+			t.Errorf("client %+v scope %s: code %d, want %d", tc.client, tc.scope, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/types"
+)
+
+// IdempotencyHeader names the request header that carries a caller's key.
+// IdempotencyField is the body field for callers that cannot set headers.
+const (
+	IdempotencyHeader = "Idempotency-Key"
+	IdempotencyField  = "IdempotencyKey"
+)
+
+// idempotencyLease is how long a keyed request may run before it is taken to
+// have died with its process: far longer than a charge takes to answer.
+// Tests shorten it.
+var idempotencyLease = 10 * time.Minute
+
+// Idempotent makes a charge endpoint safe to retry. A request that carries a
+// key is answered once by the handler; any later request with the same key
+// gets that first answer back, declines included, and charges nothing.
+//
+// While the first request is still running, a repeat is refused with 409: it
+// may yet charge, and the caller must wait for its answer rather than race it.
+// A 5xx is not kept as the answer, since the charge may have gone through
+// regardless, and neither is a request that died without answering. Repeats
+// are refused until the payment's status settles, by reconciling or a status
+// lookup, and are then answered with that status. Only a request that died
+// before its payment was stored, having charged nothing, runs again once
+// idempotencyLease has passed.
+//
+// A key reused for a different request is refused with 422, so a caller bug
+// cannot replay one donor's charge as another's.
+//
+// Keys belong to the API client that sent them. A request without a key goes
+// straight to the handler, as before.
+//
+// Register after the auth middleware, which identifies the client.
+func Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			ErrorJson(http.StatusBadRequest, "read body: "+err.Error(), c)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		key, fingerprint, userKey := idempotencyKey(c, body)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			ErrorJson(http.StatusBadRequest, IdempotencyHeader+" is longer than 255 characters", c)
+			c.Abort()
+			return
+		}
+
+		client, _ := APIClientFor(c)
+		record, reserved, err := db.ReserveIdempotencyKey(types.IdempotencyRecord{
+			Client:      client.Name,
+			Key:         key,
+			Endpoint:    c.FullPath(),
+			Fingerprint: fingerprint,
+			UserKey:     userKey,
+		}, idempotencyLease)
+		if err != nil {
+			LogMessage(fmt.Sprintf("IDEMPOTENCY: reserve %q for client %q: %s", key, client.Name, err))
+			ErrorJson(http.StatusInternalServerError, "idempotency: "+err.Error(), c)
+			c.Abort()
+			return
+		}
+
+		if !reserved {
+			replayIdempotent(record, key, fingerprint, c)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+		if recorder.Status() >= http.StatusInternalServerError {
+			LogMessage(fmt.Sprintf("IDEMPOTENCY: %q answered %d, left pending until %s settles",
+				key, recorder.Status(), userKey))
+			return
+		}
+		if err = db.CompleteIdempotencyKey(record.Id, recorder.Status(), recorder.body.String()); err != nil {
+			// The answer has gone out; a retry will now be told the request
+			// is still in progress, which is safe, if unhelpful.
+			LogMessage(fmt.Sprintf("IDEMPOTENCY: complete %q for client %q: %s", key, client.Name, err))
+		}
+	}
+}
+
+func replayIdempotent(record types.IdempotencyRecord, key, fingerprint string, c *gin.Context) {
+	switch {
+	case record.Endpoint != c.FullPath() || record.Fingerprint != fingerprint:
+		ErrorJson(http.StatusUnprocessableEntity, IdempotencyHeader+" "+key+" was already used for a different request", c)
+	case record.Status != "done":
+		status, err := db.GetStatus(record.UserKey)
+		if record.UserKey == "" || err != nil || status == string(db.StatusNew) || status == string(db.StatusInProcess) {
+			ErrorJson(http.StatusConflict, "a request with "+IdempotencyHeader+" "+key+" is still in progress", c)
+			return
+		}
+		record.HTTPStatus, record.Body = settledAnswer(record.UserKey, status)
+		if err = db.CompleteIdempotencyKey(record.Id, record.HTTPStatus, record.Body); err != nil {
+			LogMessage(fmt.Sprintf("IDEMPOTENCY: complete %q from status %s: %s", key, status, err))
+		}
+		LogMessage(fmt.Sprintf("IDEMPOTENCY: %q settled as %s", key, status))
+		c.Header("Idempotent-Replayed", "true")
+		c.Writer.WriteHeader(record.HTTPStatus)
+		_, _ = c.Writer.Write([]byte(record.Body))
+	default:
+		LogMessage(fmt.Sprintf("IDEMPOTENCY: replay %q %s [%d]", key, record.Endpoint, record.HTTPStatus))
+		c.Header("Idempotent-Replayed", "true")
+		c.Writer.WriteHeader(record.HTTPStatus)
+		_, _ = c.Writer.Write([]byte(record.Body))
+	}
+}
+
+// settledAnswer is the answer for a keyed request that never gave one, from
+// the status its payment settled in.
+func settledAnswer(userKey, status string) (int, string) {
+	answer := map[string]string{"status": "success", "user_key": userKey, "payment_status": status}
+	switch db.Status(status) {
+	case db.StatusInvalid, db.StatusError, db.StatusCancel:
+		answer["status"] = "error"
+		answer["error"] = "payment is " + status
+	}
+	body, _ := json.Marshal(answer)
+	return http.StatusOK, string(body)
+}
+
+// idempotencyKey returns the request's key, from the header or else the body,
+// a fingerprint of the request without it, and the UserKey the request pays
+// for. The body is normalised first, so a retry that orders its fields
+// differently is still the same request.
+func idempotencyKey(c *gin.Context, body []byte) (key, fingerprint, userKey string) {
+	key = c.GetHeader(IdempotencyHeader)
+
+	canonical := body
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err == nil {
+		if v, ok := fields[IdempotencyField].(string); ok && key == "" {
+			key = v
+		}
+		userKey, _ = fields["UserKey"].(string)
+		delete(fields, IdempotencyField)
+		canonical, _ = json.Marshal(fields)
+	} else if form, err := url.ParseQuery(string(body)); err == nil {
+		if key == "" {
+			key = form.Get(IdempotencyField)
+		}
+		userKey = form.Get("UserKey")
+		form.Del(IdempotencyField)
+		canonical = []byte(form.Encode())
+	}
+
+	sum := sha256.Sum256(append([]byte(c.FullPath()+"\n"), canonical...))
+	return key, hex.EncodeToString(sum[:]), userKey
+}
+
+// responseRecorder keeps a copy of what the handler writes.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/types"
+)
+
+// idempotentEngine routes /charge through Idempotent to a handler that counts
+// its calls and answers with the count.
+func idempotentEngine(t *testing.T) (*gin.Engine, *int) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(db.UseStore(dbtest.New()))
+	calls := 0
+	r := gin.New()
+	r.POST("/charge", Idempotent(), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"status": "success", "call": calls})
+	})
+	return r, &calls
+}
+
+func charge(r *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/charge", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotentReplaysFirstAnswer(t *testing.T) {
+	r, calls := idempotentEngine(t)
+
+	first := charge(r, "k1", `{"Price":10,"Token":"t"}`)
+	// Same request, fields in another order.
+	second := charge(r, "k1", `{"Token":"t","Price":10}`)
+
+	if *calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", *calls)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay not marked")
+	}
+}
+
+func TestIdempotentKeyInBody(t *testing.T) {
+	r, calls := idempotentEngine(t)
+
+	charge(r, "", `{"Price":10,"IdempotencyKey":"k2"}`)
+	charge(r, "", `{"IdempotencyKey":"k2","Price":10}`)
+
+	if *calls != 1 {
+		t.Errorf("handler ran %d times, want 1", *calls)
+	}
+}
+
+func TestIdempotentWithoutKey(t *testing.T) {
+	r, calls := idempotentEngine(t)
+
+	charge(r, "", `{"Price":10}`)
+	charge(r, "", `{"Price":10}`)
+
+	if *calls != 2 {
+		t.Errorf("handler ran %d times, want 2", *calls)
+	}
+}
+
+func TestIdempotentKeyReusedForOtherRequest(t *testing.T) {
+	r, calls := idempotentEngine(t)
+
+	charge(r, "k3", `{"Price":10}`)
+	w := charge(r, "k3", `{"Price":99}`)
+
+	if w.Code != http.StatusUnprocessableEntity || *calls != 1 {
+		t.Errorf("code = %d after %d calls, want 422 after 1", w.Code, *calls)
+	}
+}
+
+// A retry that arrives while the first request is still charging must not
+// charge too.
+func TestIdempotentInFlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(db.UseStore(dbtest.New()))
+	r := gin.New()
+	var retry *httptest.ResponseRecorder
+	r.POST("/charge", Idempotent(), func(c *gin.Context) {
+		if retry == nil {
+			retry = charge(r, "k4", `{"Price":10}`)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	})
+
+	charge(r, "k4", `{"Price":10}`)
+
+	if retry.Code != http.StatusConflict {
+		t.Errorf("retry code = %d, want 409", retry.Code)
+	}
+}
+
+// A key left pending past its lease by a request that died before storing its
+// payment, so charged nothing, is given to the next copy of the request rather
+// than refused for good; a different request under it is still refused.
+func TestIdempotentLeaseExpires(t *testing.T) {
+	lease := idempotencyLease
+	t.Cleanup(func() { idempotencyLease = lease })
+	idempotencyLease = 0
+
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(db.UseStore(dbtest.New()))
+	r := gin.New()
+	calls := 0
+	var retry, other *httptest.ResponseRecorder
+	r.POST("/charge", Idempotent(), func(c *gin.Context) {
+		if calls++; calls == 1 {
+			other = charge(r, "k5", `{"Price":20,"UserKey":"u-5"}`)
+			retry = charge(r, "k5", `{"Price":10,"UserKey":"u-5"}`)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	})
+
+	charge(r, "k5", `{"Price":10,"UserKey":"u-5"}`)
+
+	if other.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other request code = %d, want 422", other.Code)
+	}
+	if retry.Code != http.StatusOK || calls != 2 {
+		t.Errorf("retry code = %d after %d calls, want 200 after 2", retry.Code, calls)
+	}
+}
+
+// A request that stored its payment may have charged, so its key is not given
+// up when the lease runs out: repeats are refused until the status settles,
+// and then get that status back without charging again.
+func TestIdempotentLeaseExpiresAfterStore(t *testing.T) {
+	lease := idempotencyLease
+	t.Cleanup(func() { idempotencyLease = lease })
+	idempotencyLease = 0
+
+	gin.SetMode(gin.TestMode)
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	r := gin.New()
+	calls := 0
+	var pending *httptest.ResponseRecorder
+	r.POST("/charge", Idempotent(), func(c *gin.Context) {
+		if calls++; calls == 1 {
+			_ = store.StoreRequest(types.PaymentRequest{UserKey: "u-6"})
+			pending = charge(r, "k6", `{"Price":10,"UserKey":"u-6"}`)
+			// The process dies here, before the gateway answers.
+			c.JSON(http.StatusBadGateway, gin.H{"status": "error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	})
+
+	charge(r, "k6", `{"Price":10,"UserKey":"u-6"}`)
+	if pending.Code != http.StatusConflict {
+		t.Errorf("repeat while charging = %d, want 409", pending.Code)
+	}
+	if w := charge(r, "k6", `{"Price":10,"UserKey":"u-6"}`); w.Code != http.StatusConflict {
+		t.Errorf("repeat after a 502 = %d, want 409", w.Code)
+	}
+
+	store.SetStatus("u-6", string(db.StatusValid))
+	settled := charge(r, "k6", `{"Price":10,"UserKey":"u-6"}`)
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if settled.Code != http.StatusOK || !strings.Contains(settled.Body.String(), `"payment_status":"valid"`) {
+		t.Errorf("settled repeat = %d %s, want 200 with its status", settled.Code, settled.Body)
+	}
+	if again := charge(r, "k6", `{"Price":10,"UserKey":"u-6"}`); again.Body.String() != settled.Body.String() {
+		t.Errorf("second settled repeat = %s, want %s", again.Body, settled.Body)
+	}
+}
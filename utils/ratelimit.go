@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/currency"
+)
+
+// ChargeLimits are the ceilings on one caller's charges. A zero count, or a
+// currency with no amount, is not limited.
+//
+// They are read from the environment when the limiter is built:
+//
+//	CHARGE_LIMIT_PER_MINUTE   charges per minute, e.g. 30
+//	CHARGE_LIMIT_PER_DAY      charges per day, e.g. 2000
+//	CHARGE_AMOUNT_PER_MINUTE  total per currency per minute, e.g. ILS:20000,USD:5000
+//	CHARGE_AMOUNT_PER_DAY     total per currency per day, e.g. ILS:500000,USD:150000
+type ChargeLimits struct {
+	PerMinute       int
+	PerDay          int
+	AmountPerMinute map[string]float64
+	AmountPerDay    map[string]float64
+}
+
+// ChargeLimitsFromEnv reads ChargeLimits from the environment. A value that
+// does not parse is logged and left unlimited, rather than keeping the server
+// from starting.
+func ChargeLimitsFromEnv() ChargeLimits {
+	return ChargeLimits{
+		PerMinute:       envCount("CHARGE_LIMIT_PER_MINUTE"),
+		PerDay:          envCount("CHARGE_LIMIT_PER_DAY"),
+		AmountPerMinute: envAmounts("CHARGE_AMOUNT_PER_MINUTE"),
+		AmountPerDay:    envAmounts("CHARGE_AMOUNT_PER_DAY"),
+	}
+}
+
+func envCount(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		LogMessage(fmt.Sprintf("RATE LIMIT: %s=%q is not a count, not limiting", name, v))
+		return 0
+	}
+	return n
+}
+
+func envAmounts(name string) map[string]float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	amounts := map[string]float64{}
+	for _, pair := range strings.Split(v, ",") {
+		currency, amount, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		f, err := strconv.ParseFloat(amount, 64)
+		if !ok || err != nil || f < 0 {
+			LogMessage(fmt.Sprintf("RATE LIMIT: %s entry %q is not CURRENCY:AMOUNT, skipped", name, pair))
+			continue
+		}
+		amounts[limitCurrency(currency)] = f
+	}
+	return amounts
+}
+
+// limitCurrency folds NIS into ILS, so a caller cannot double its ceiling by
+// spelling the shekel both ways.
+func limitCurrency(code string) string {
+	return currency.Normalize(code)
+}
+
+// window is one caller's use of a fixed period, minute or day.
+type window struct {
+	start  time.Time
+	count  int
+	amount map[string]float64
+}
+
+func (w *window) roll(start time.Time) {
+	if !w.start.Equal(start) {
+		*w = window{start: start, amount: map[string]float64{}}
+	}
+}
+
+type usage struct {
+	minute window
+	day    window
+}
+
+// ChargeLimiter counts charges per caller in fixed minute and day windows.
+// Counts are kept in memory: a restart forgets them, and each instance counts
+// on its own. That is enough to stop a card-testing burst, which is what it is
+// for; it is not an accounting of what a caller has spent.
+type ChargeLimiter struct {
+	limits ChargeLimits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	callers   map[string]*usage
+	lastSweep time.Time
+}
+
+// NewChargeLimiter returns a limiter enforcing limits.
+func NewChargeLimiter(limits ChargeLimits) *ChargeLimiter {
+	return &ChargeLimiter{limits: limits, now: time.Now, callers: map[string]*usage{}}
+}
+
+// Allow counts a charge of amount in currency against caller, unless that
+// would take it over a ceiling. Then nothing is counted, and it returns how
+// long until the window that refused it ends, and which window that was.
+func (l *ChargeLimiter) Allow(caller string, amount float64, currency string) (retryAfter time.Duration, refused string) {
+	now := l.now().UTC()
+	minute := now.Truncate(time.Minute)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	currency = limitCurrency(currency)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(day)
+
+	u := l.callers[caller]
+	if u == nil {
+		u = &usage{}
+		l.callers[caller] = u
+	}
+	u.minute.roll(minute)
+	u.day.roll(day)
+
+	switch {
+	case over(u.minute, l.limits.PerMinute, l.limits.AmountPerMinute, amount, currency):
+		return minute.Add(time.Minute).Sub(now), "minute"
+	case over(u.day, l.limits.PerDay, l.limits.AmountPerDay, amount, currency):
+		return day.AddDate(0, 0, 1).Sub(now), "day"
+	}
+
+	for _, w := range []*window{&u.minute, &u.day} {
+		w.count++
+		w.amount[currency] += amount
+	}
+	return 0, ""
+}
+
+func over(w window, count int, amounts map[string]float64, amount float64, currency string) bool {
+	if count > 0 && w.count+1 > count {
+		return true
+	}
+	ceiling, ok := amounts[currency]
+	return ok && w.amount[currency]+amount > ceiling
+}
+
+// sweep drops callers not seen today, at most every ten minutes, so one-off
+// IPs do not accumulate.
+func (l *ChargeLimiter) sweep(day time.Time) {
+	if l.now().Sub(l.lastSweep) < 10*time.Minute {
+		return
+	}
+	l.lastSweep = l.now()
+	for caller, u := range l.callers {
+		if u.day.start.Before(day) {
+			delete(l.callers, caller)
+		}
+	}
+}
+
+// RateLimit refuses, with 429 and Retry-After, a caller that has gone over
+// the limiter's ceilings. A caller is its API client, or its IP when it sent
+// no key. The internal token is not limited: it is our own services, and a
+// recurring-charge run would hit any ceiling set for a website.
+//
+// Register after the auth middleware, which identifies the client, and before
+// Idempotent, so a refusal is not stored as the key's answer. A retry that
+// gets a stored answer back still counts.
+func RateLimit(l *ChargeLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := APIClientFor(c)
+		if ok && client.Internal {
+			c.Next()
+			return
+		}
+		caller := "ip:" + c.ClientIP()
+		if ok {
+			caller = "client:" + client.Name
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			ErrorJson(http.StatusBadRequest, "read body: "+err.Error(), c)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		amount, currency := chargeAmount(body)
+
+		retryAfter, refused := l.Allow(caller, amount, currency)
+		if refused == "" {
+			c.Next()
+			return
+		}
+
+		seconds := int(retryAfter.Round(time.Second).Seconds())
+		if seconds < 1 {
+			seconds = 1
+		}
+		LogMessage(fmt.Sprintf("RATE LIMIT: %s over its per-%s ceiling, amount=%.2f %s retry_after=%ds %s %s ua=%q",
+			caller, refused, amount, currency, seconds,
+			c.Request.Method, c.Request.URL.Path, c.Request.UserAgent()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		ErrorJson(http.StatusTooManyRequests, "too many charges this "+refused+", retry after "+strconv.Itoa(seconds)+"s", c)
+		c.Abort()
+	}
+}
+
+// chargeAmount reads Price and Currency from a charge request, sent as JSON
+// or as a form. A request it cannot read counts as an amount of 0; the handler
+// refuses it anyway.
+func chargeAmount(body []byte) (float64, string) {
+	var fields struct {
+		Price    json.Number
+		Currency string
+	}
+	if err := json.Unmarshal(body, &fields); err == nil {
+		price, _ := fields.Price.Float64()
+		return price, fields.Currency
+	}
+	if form, err := url.ParseQuery(string(body)); err == nil {
+		price, _ := strconv.ParseFloat(form.Get("Price"), 64)
+		return price, form.Get("Currency")
+	}
+	return 0, ""
+}
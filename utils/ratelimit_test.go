@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+)
+
+func limiterAt(limits ChargeLimits, now *time.Time) *ChargeLimiter {
+	l := NewChargeLimiter(limits)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestChargeLimiterCountPerMinute(t *testing.T) {
+	now := time.Date(2026, 3, 1, 10, 0, 15, 0, time.UTC)
+	l := limiterAt(ChargeLimits{PerMinute: 2}, &now)
+
+	for i := 0; i < 2; i++ {
+		if _, refused := l.Allow("ip:1.2.3.4", 10, "USD"); refused != "" {
+			t.Fatalf("charge %d refused", i+1)
+		}
+	}
+	retry, refused := l.Allow("ip:1.2.3.4", 10, "USD")
+	if refused != "minute" || retry != 45*time.Second {
+		t.Errorf("third charge: refused=%q retry=%s, want minute and 45s", refused, retry)
+	}
+	if _, refused = l.Allow("ip:5.6.7.8", 10, "USD"); refused != "" {
+		t.Error("another caller must have its own count")
+	}
+
+	now = now.Add(time.Minute)
+	if _, refused = l.Allow("ip:1.2.3.4", 10, "USD"); refused != "" {
+		t.Error("a new minute must start a new count")
+	}
+}
+
+// Amounts are per currency, and NIS and ILS are the same shekel.
+func TestChargeLimiterAmountPerDay(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	l := limiterAt(ChargeLimits{AmountPerDay: map[string]float64{"ILS": 1000}}, &now)
+
+	if _, refused := l.Allow("client:1family", 600, "NIS"); refused != "" {
+		t.Fatal("first charge refused")
+	}
+	retry, refused := l.Allow("client:1family", 600, "ILS")
+	if refused != "day" || retry != time.Hour {
+		t.Errorf("over the day's amount: refused=%q retry=%s, want day and 1h", refused, retry)
+	}
+	if _, refused = l.Allow("client:1family", 5000, "USD"); refused != "" {
+		t.Error("a currency with no ceiling must not be limited")
+	}
+	if _, refused = l.Allow("client:1family", 400, "NIS"); refused != "" {
+		t.Error("a refused charge must not count toward the ceiling")
+	}
+}
+
+func TestRateLimitAnswers429(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	now := time.Date(2026, 3, 1, 10, 0, 50, 0, time.UTC)
+	l := limiterAt(ChargeLimits{PerMinute: 1}, &now)
+
+	var client *db.APIClient
+	r := gin.New()
+	r.POST("/token/charge", func(c *gin.Context) {
+		if client != nil {
+			c.Set(APIClientKey, *client)
+		}
+	}, RateLimit(l), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	charge := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/token/charge",
+			strings.NewReader(`{"Price":30,"Currency":"NIS"}`))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := charge(); w.Code != http.StatusOK {
+		t.Fatalf("first charge: %d", w.Code)
+	}
+	w := charge()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("second charge: %d Retry-After=%q, want 429 and 10", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// A key is its own caller, whatever IP it comes from; the internal token
+	// is not limited at all.
+	client = &db.APIClient{Name: "1family"}
+	if w = charge(); w.Code != http.StatusOK {
+		t.Errorf("keyed caller: %d", w.Code)
+	}
+	client = &db.APIClient{Name: "internal", Internal: true}
+	for i := 0; i < 3; i++ {
+		if w = charge(); w.Code != http.StatusOK {
+			t.Errorf("internal caller: %d", w.Code)
+		}
+	}
+}
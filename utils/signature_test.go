@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"external_payments/db"
+)
+
+const vhToken = "vh-token"
+
+func signedEngine(t *testing.T, requireSignature bool) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("CLIENT_SECRET_KEY", "server-key")
+	t.Cleanup(db.UseAPIClients(db.APIClient{
+		ID: 7, Name: "vh", Organization: "ben2", TokenSHA256: db.TokenHash(vhToken),
+		RequireSignature: requireSignature,
+	}))
+
+	r := gin.New()
+	r.POST("/token/refund", RequireAPIClient(), func(c *gin.Context) {
+		client, _ := APIClientFor(c)
+		c.String(http.StatusOK, client.Name)
+	})
+	return r
+}
+
+// signed builds a request signed the way a caller would: with the signing
+// key issued with its token.
+func signed(body, nonce string, at time.Time) *http.Request {
+	return signedWith(db.SigningKey(db.TokenHash(vhToken)), body, nonce, at)
+}
+
+func signedWith(key, body, nonce string, at time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/token/refund", strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(KeyIDHeader, "7")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(key, http.MethodPost, "/token/refund", timestamp, nonce, []byte(body)))
+	return req
+}
+
+func serveSigned(r *gin.Engine, req *http.Request) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSignedRequestAccepted(t *testing.T) {
+	r := signedEngine(t, true)
+	if code := serveSigned(r, signed(`{"TransactionId":"1"}`, "n-accepted", time.Now())); code != http.StatusOK {
+		t.Errorf("code %d, want 200", code)
+	}
+}
+
+// What the client table holds is not enough to sign: a request signed with
+// the token's hash is refused, and without the server's key nothing is
+// accepted.
+func TestSignedRequestNeedsServerKey(t *testing.T) {
+	r := signedEngine(t, true)
+	if code := serveSigned(r, signedWith(db.TokenHash(vhToken), `{}`, "n-hash", time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("signed with the token hash: code %d, want 401", code)
+	}
+
+	req := signed(`{}`, "n-no-key", time.Now())
+	t.Setenv("CLIENT_SECRET_KEY", "")
+	if code := serveSigned(r, req); code != http.StatusUnauthorized {
+		t.Errorf("no server key: code %d, want 401", code)
+	}
+}
+
+func TestSignedRequestNonceReused(t *testing.T) {
+	r := signedEngine(t, true)
+	serveSigned(r, signed(`{}`, "n-reused", time.Now()))
+	if code := serveSigned(r, signed(`{}`, "n-reused", time.Now())); code != http.StatusUnauthorized {
+		t.Errorf("replay: code %d, want 401", code)
+	}
+}
+
+func TestSignedRequestStale(t *testing.T) {
+	r := signedEngine(t, true)
+	if code := serveSigned(r, signed(`{}`, "n-stale", time.Now().Add(-10*time.Minute))); code != http.StatusUnauthorized {
+		t.Errorf("stale: code %d, want 401", code)
+	}
+}
+
+// The signature covers the body: an amount changed in flight is caught.
+func TestSignedRequestBodyAltered(t *testing.T) {
+	r := signedEngine(t, true)
+	req := signed(`{"Amount":10}`, "n-altered", time.Now())
+	req.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Amount":1000}`)).Body
+	if code := serveSigned(r, req); code != http.StatusUnauthorized {
+		t.Errorf("altered body: code %d, want 401", code)
+	}
+}
+
+// Bearer callers keep working until their client is moved to signing.
+func TestBearerTokenAndRequireSignature(t *testing.T) {
+	for _, tc := range []struct {
+		requireSignature bool
+		want             int
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusUnauthorized},
+	} {
+		r := signedEngine(t, tc.requireSignature)
+		req := httptest.NewRequest(http.MethodPost, "/token/refund", nil)
+		req.Header.Set("Authorization", "Bearer "+vhToken)
+		if code := serveSigned(r, req); code != tc.want {
+			t.Errorf("require signature %t: code %d, want %d", tc.requireSignature, code, tc.want)
+		}
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/go-querystring/query"
 
 	"external_payments/db"
+	"external_payments/gateway"
 	"external_payments/pelecard"
 	"external_payments/types"
 )
@@ -75,13 +78,8 @@ func OnRedirectURL(url string, msg string, status string, c *gin.Context) {
 }
 
 // ErrorJson answers with a status matching the cause. The body shape is
-// unchanged: callers read {"status":"error"} rather than the code.
-//
-// Charge outcomes deliberately keep http.StatusOK. This service cannot yet
-// tell a declined card from a gateway outage, and VH treats a non-2xx as a
-// gateway error — which still falls back token to EMV, but raises a Sentry
-// exception. Every decline would page someone. Once decline codes are
-// structured, the outage case can move to 502.
+// unchanged: callers read {"status":"error"} rather than the code. A charge
+// the gateway did not make is answered with ChargeErrorJson instead.
 func ErrorJson(status int, message string, c *gin.Context) {
 	msg := map[string]string{
 		"status": "error",
@@ -92,6 +90,54 @@ func ErrorJson(status int, message string, c *gin.Context) {
 	_, _ = c.Writer.Write(js)
 }
 
+// ChargeErrorJson answers a charge the gateway did not make. Besides the usual
+// status and error, the body carries the classification: kind is declined,
+// retryable or configuration, with the gateway's code and message.
+//
+// Only a decline keeps http.StatusOK. VH treats a non-2xx as a gateway error
+// and raises a Sentry exception, which is right for an outage (502) or for
+// our own configuration (500), but every declined card would page someone.
+func ChargeErrorJson(prefix string, err error, c *gin.Context) {
+	e := gateway.Classify(err)
+	msg := map[string]string{
+		"status":  "error",
+		"error":   prefix + err.Error(),
+		"kind":    string(e.Kind),
+		"code":    e.Code,
+		"message": e.Message,
+	}
+	js, _ := json.Marshal(msg)
+	c.Writer.WriteHeader(e.HTTPStatus())
+	_, _ = c.Writer.Write(js)
+}
+
+// ChargeFailure is the status history's reason for a charge the gateway did
+// not make. A decline is recorded as "declined <code>", as the hosted-page
+// callbacks record theirs, so the settlement report counts declines by code
+// whichever flow charged.
+func ChargeFailure(err error) string {
+	if e := gateway.Classify(err); e.Kind == gateway.Declined && e.Code != "" {
+		return "declined " + e.Code
+	}
+	return "charge failed"
+}
+
+// SettleChargeFailure records on userKey's request what a failed charge says
+// about it. A decline is invalid and a configuration error, refused before
+// anything was sent, is error. Anything else may have charged without our
+// hearing back, so the request stays in-process for reconciling to settle,
+// as an unverified callback does.
+func SettleChargeFailure(userKey, actor string, err error) {
+	switch gateway.Classify(err).Kind {
+	case gateway.Declined:
+		db.Transition(userKey, db.StatusInvalid, actor, ChargeFailure(err))
+	case gateway.Configuration:
+		db.Transition(userKey, db.StatusError, actor, ChargeFailure(err))
+	default:
+		LogMessage(fmt.Sprintf("%s: %s outcome unknown, left in-process: %s", actor, userKey, err))
+	}
+}
+
 func ResultJson(msg map[string]string, c *gin.Context) {
 	js, _ := json.Marshal(msg)
 	c.Writer.WriteHeader(http.StatusOK)
@@ -122,7 +168,7 @@ func ErrorPayment(c *gin.Context) {
 	form := LoadPeleCardForm(c)
 	m := fmt.Sprintf("ErrorPayment: %+v", form)
 	LogMessage(m)
-	db.SetStatus(form.UserKey, "error")
+	db.Transition(form.UserKey, db.StatusError, "pelecard callback", "error "+form.PelecardStatusCode)
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		m := fmt.Sprintf("ErrorPayment: UpdateRequestTemp %s", err.Error())
 		LogMessage(m)
@@ -145,7 +191,7 @@ func CancelPayment(c *gin.Context) {
 	var err error
 
 	form := LoadPeleCardForm(c)
-	db.SetStatus(form.UserKey, "cancel")
+	db.Transition(form.UserKey, db.StatusCancel, "pelecard callback", "cancelled by payer")
 	if err = db.UpdateRequestTemp(form.UserKey, form); err != nil {
 		ErrorJson(http.StatusOK, err.Error(), c)
 		return
@@ -159,6 +205,30 @@ func CancelPayment(c *gin.Context) {
 	OnRedirectURL(request.CancelURL, "", "cancel", c)
 }
 
+// DuplicateCallback is where a copy of Pelecard's callback that lost
+// db.ClaimProcessing to another copy sends the payer. Pelecard approved the
+// payment and the copy that claimed it decides the request, so this one
+// neither asks Pelecard again nor changes the status: the payer goes on to
+// GoodURL, with the response the other copy stored if it has finished. It
+// returns false if the other copy already failed the request, or it cannot be
+// loaded.
+func DuplicateCallback(userKey string) (goodURL string, values url.Values, ok bool) {
+	status, err := db.GetStatus(userKey)
+	if err != nil || (status != string(db.StatusValid) && status != string(db.StatusInProcess)) {
+		return "", nil, false
+	}
+	var request types.PaymentRequest
+	if err = db.LoadRequest(userKey, &request); err != nil {
+		return "", nil, false
+	}
+	response := types.PaymentResponse{UserKey: userKey}
+	if status == string(db.StatusValid) {
+		_ = db.LoadPaymentResponse(userKey, &response)
+	}
+	values, _ = query.Values(response)
+	return request.GoodURL, values, true
+}
+
 func OnRedirect(url string, msg string, status string, c *gin.Context) {
 	var target string
 	if msg == "" {
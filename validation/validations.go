@@ -6,6 +6,9 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+
+	"external_payments/currency"
+	"external_payments/organizations"
 )
 
 const tagName = "validate" // Name of the struct tag used for validation
@@ -54,6 +57,10 @@ func (v BoolValidator) Validate(val any) (bool, error) {
 type StringValidator struct {
 	Required bool
 	Values   string
+	// Organization requires a registered organization's name.
+	Organization bool
+	// Currency requires a currency we take.
+	Currency bool
 }
 
 func (v StringValidator) Validate(val any) (bool, error) {
@@ -71,6 +78,14 @@ func (v StringValidator) Validate(val any) (bool, error) {
 		}
 	}
 
+	if v.Organization && !organizations.Known(value) {
+		return false, fmt.Errorf("is not a known organization")
+	}
+
+	if v.Currency && !currency.Supported(value) {
+		return false, fmt.Errorf("is not a supported currency")
+	}
+
 	return true, nil
 }
 
@@ -170,6 +185,10 @@ func getValidatorFromTag(tag string) Validator {
 		for _, flag := range args[1:] {
 			if string(flag) == "required" {
 				validator.Required = true
+			} else if string(flag) == "organization" {
+				validator.Organization = true
+			} else if string(flag) == "currency" {
+				validator.Currency = true
 			} else {
 				results := valuesRegex.FindStringSubmatch(string(flag))
 				if len(results) > 0 {
@@ -29,3 +29,16 @@ func TestValidateStruct_PositivePricePasses(t *testing.T) {
 		t.Fatalf("expected no validation error for positive price, got %v", errs)
 	}
 }
+
+type organizationRequest struct {
+	Organization string `validate:"string,required,organization"`
+}
+
+func TestValidateStruct_Organization(t *testing.T) {
+	if found, errs := ValidateStruct(organizationRequest{Organization: "meshp18"}); found {
+		t.Fatalf("registered organization refused: %v", errs)
+	}
+	if found, _ := ValidateStruct(organizationRequest{Organization: "acme"}); !found {
+		t.Fatalf("expected validation error for an unknown organization")
+	}
+}
@@ -0,0 +1,181 @@
+// Package webhooks posts payment results to the caller's server.
+//
+// Callers otherwise learn a result from the payer's browser, redirected to
+// GoodURL or ErrorURL, and a payer who closes the tab after paying leaves the
+// site never knowing. db.Transition writes an event to the outbox when a
+// request ends; the Dispatcher here sends it, and keeps retrying until the
+// caller answers 2xx or the attempts run out.
+//
+// Each webhook is a POST of a types.WebhookEvent as JSON, with headers
+//
+//	X-Webhook-Id         the event id; a retry repeats it, so the caller can
+//	                     drop one it has already handled
+//	X-Webhook-Timestamp  Unix seconds at sending
+//	X-Webhook-Signature  hex(hmac_sha256(secret, timestamp + "." + body))
+//
+// The secret is the client's own, printed by -callback when its callback is
+// set (see db.WebhookSecret), so a client can check a webhook came from us
+// and not from another client.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"external_payments/db"
+	"external_payments/types"
+)
+
+const (
+	// maxAttempts is how many times a webhook is sent before it is marked
+	// failed. With backoff doubling from firstBackoff, the last attempt is
+	// some fifteen hours after the first.
+	maxAttempts  = 12
+	firstBackoff = 30 * time.Second
+	maxBackoff   = 6 * time.Hour
+
+	// lease is how long a claimed webhook is held by one instance. It must
+	// outlast a send, which the client timeout bounds.
+	lease   = 2 * time.Minute
+	timeout = 15 * time.Second
+	batch   = 50
+)
+
+// Dispatcher sends due webhooks from the outbox.
+type Dispatcher struct {
+	client *http.Client
+}
+
+// New returns a Dispatcher.
+func New() *Dispatcher {
+	return &Dispatcher{client: &http.Client{Timeout: timeout}}
+}
+
+// Start runs a Dispatcher in the background, polling the outbox every
+// WEBHOOK_POLL_INTERVAL (a Go duration, default 10s). Without
+// CLIENT_SECRET_KEY nothing is sent: there are no secrets to sign with, and
+// an unsigned webhook would tell the caller nothing it could trust. Events
+// still queue, and go out once the key is set.
+func Start(ctx context.Context) {
+	if os.Getenv("CLIENT_SECRET_KEY") == "" {
+		log.Printf("webhooks: CLIENT_SECRET_KEY not set, not sending")
+		return
+	}
+	interval := 10 * time.Second
+	if v := os.Getenv("WEBHOOK_POLL_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("webhooks: WEBHOOK_POLL_INTERVAL=%q is not a duration, using %s", v, interval)
+		}
+	}
+
+	d := New()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.Run(ctx)
+			}
+		}
+	}()
+}
+
+// Run sends the webhooks due now and returns how many were delivered.
+func (d *Dispatcher) Run(ctx context.Context) (delivered int) {
+	due, err := db.ClaimWebhooks(batch, lease)
+	if err != nil {
+		log.Printf("webhooks: claim: %v", err)
+		return 0
+	}
+	for _, w := range due {
+		if d.deliver(ctx, w) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, w types.Webhook) bool {
+	attempts := w.Attempts + 1
+	err := d.send(ctx, w)
+	switch {
+	case err == nil:
+		err = db.CloseWebhook(w.Id, attempts, "delivered", "")
+	case attempts >= maxAttempts:
+		log.Printf("webhooks: %s to %s failed for good after %d attempts: %v", w.EventId, w.URL, attempts, err)
+		err = db.CloseWebhook(w.Id, attempts, "failed", err.Error())
+		return false
+	default:
+		log.Printf("webhooks: %s to %s attempt %d: %v", w.EventId, w.URL, attempts, err)
+		err = db.RetryWebhook(w.Id, attempts, Backoff(attempts), err.Error())
+		return false
+	}
+	if err != nil {
+		log.Printf("webhooks: %s: record delivery: %v", w.EventId, err)
+	}
+	return true
+}
+
+func (d *Dispatcher) send(ctx context.Context, w types.Webhook) error {
+	secret := db.WebhookSecret(w.Salt)
+	if secret == "" {
+		return errors.New("no webhook secret")
+	}
+	body := []byte(w.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", w.EventId)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", Sign([]byte(secret), timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the X-Webhook-Signature of body sent at timestamp. A caller
+// verifies a webhook by computing the same and comparing in constant time.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff is how long to wait after a webhook's nth failed attempt: doubling
+// from firstBackoff, up to maxBackoff.
+func Backoff(attempts int) time.Duration {
+	d := firstBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
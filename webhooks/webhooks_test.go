@@ -0,0 +1,204 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json/v2"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"external_payments/db"
+	"external_payments/db/dbtest"
+	"external_payments/types"
+)
+
+// receiver is a caller's webhook endpoint. It answers with the codes it is
+// given, in turn, and 200 once they run out.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	answers  []int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, answers ...int) *receiver {
+	r := &receiver{answers: answers}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received = append(r.received, req)
+		r.bodies = append(r.bodies, body)
+		code := http.StatusOK
+		if len(r.answers) > 0 {
+			code, r.answers = r.answers[0], r.answers[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func paid(t *testing.T, store *dbtest.Store, callbackURL string) {
+	t.Helper()
+	t.Setenv("CLIENT_SECRET_KEY", "server-key")
+	err := store.StoreRequest(types.PaymentRequest{
+		UserKey: "u-1", Reference: "1fam-42", Price: 180, Currency: "NIS",
+		Organization: "ben2", CallbackURL: callbackURL, WebhookSalt: "salt-1fam",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransitionQueuesOutcomeOnce(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	paid(t, store, "https://shop.test/hook")
+
+	db.Transition("u-1", db.StatusInProcess, "test", "")
+	db.Transition("u-1", db.StatusValid, "test", "")
+	db.Transition("u-1", db.StatusValid, "test", "")
+
+	queued := store.Webhooks()
+	if len(queued) != 1 {
+		t.Fatalf("queued %d webhooks, want 1 for the move to valid", len(queued))
+	}
+	var event types.WebhookEvent
+	if err := json.Unmarshal([]byte(queued[0].Payload), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != "valid" || event.Reference != "1fam-42" || event.Amount != 180 || event.Id != queued[0].EventId {
+		t.Errorf("event %+v", event)
+	}
+}
+
+func TestTransitionWithoutCallbackQueuesNothing(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	paid(t, store, "")
+
+	db.Transition("u-1", db.StatusValid, "test", "")
+
+	if queued := store.Webhooks(); len(queued) != 0 {
+		t.Errorf("queued %+v", queued)
+	}
+}
+
+// brokenStore fails every status change, as a database that goes away
+// mid-write does.
+type brokenStore struct{ *dbtest.Store }
+
+func (brokenStore) ChangeStatus(types.StatusChange, *types.Webhook) (bool, error) {
+	return false, errors.New("connection lost")
+}
+
+// The event is written with the status change or not at all: a change that
+// fails leaves no event behind.
+func TestWebhookOnlyWithStatusChange(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(brokenStore{store}))
+	paid(t, store, "https://shop.test/hook")
+
+	if err := db.Transition("u-1", db.StatusValid, "test", ""); err == nil {
+		t.Fatal("status change succeeded on a broken store")
+	}
+	if queued := store.Webhooks(); len(queued) != 0 {
+		t.Errorf("queued %+v without the status change", queued)
+	}
+}
+
+// A request whose key's callback predates webhook secrets has nothing to be
+// signed with, and nothing is queued for it.
+func TestTransitionWithoutWebhookSaltQueuesNothing(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	store.StoreRequest(types.PaymentRequest{UserKey: "u-1", CallbackURL: "https://shop.test/hook"})
+
+	db.Transition("u-1", db.StatusValid, "test", "")
+
+	if queued := store.Webhooks(); len(queued) != 0 {
+		t.Errorf("queued %+v", queued)
+	}
+}
+
+// A caller that is down gets the event again after a backoff, with the same
+// id, until it takes it.
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	hook := newReceiver(t, http.StatusServiceUnavailable)
+	paid(t, store, hook.URL)
+	db.Transition("u-1", db.StatusCancel, "test", "")
+	d := New()
+
+	if n := d.Run(context.Background()); n != 0 {
+		t.Fatalf("delivered %d on a 503", n)
+	}
+	if n := d.Run(context.Background()); n != 0 {
+		t.Fatalf("retried %d before the backoff", n)
+	}
+	w := store.Webhooks()[0]
+	if w.Status != "pending" || w.Attempts != 1 || w.LastError != "answered 503" {
+		t.Errorf("after a 503: %+v", w)
+	}
+
+	store.MakeDue()
+	if n := d.Run(context.Background()); n != 1 {
+		t.Fatalf("delivered %d on retry", n)
+	}
+	if w = store.Webhooks()[0]; w.Status != "delivered" || w.Attempts != 2 {
+		t.Errorf("after delivery: %+v", w)
+	}
+
+	last := hook.received[1]
+	if last.Header.Get("X-Webhook-Id") != hook.received[0].Header.Get("X-Webhook-Id") {
+		t.Error("a retry must repeat the event id")
+	}
+	secret := []byte(db.WebhookSecret("salt-1fam"))
+	want := Sign(secret, last.Header.Get("X-Webhook-Timestamp"), hook.bodies[1])
+	if last.Header.Get("X-Webhook-Signature") != want {
+		t.Error("signature does not verify")
+	}
+	// Another client's secret does not verify it: each signs with its own.
+	if Sign([]byte(db.WebhookSecret("salt-other")), last.Header.Get("X-Webhook-Timestamp"), hook.bodies[1]) == want {
+		t.Error("signature verifies with another client's secret")
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	store := dbtest.New()
+	t.Cleanup(db.UseStore(store))
+	hook := newReceiver(t)
+	hook.Close() // nobody listening
+	paid(t, store, hook.URL)
+	db.Transition("u-1", db.StatusError, "test", "")
+	d := New()
+
+	for i := 0; i < maxAttempts; i++ {
+		store.MakeDue()
+		d.Run(context.Background())
+	}
+	if w := store.Webhooks()[0]; w.Status != "failed" || w.Attempts != maxAttempts {
+		t.Errorf("after %d attempts: %+v", maxAttempts, w)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		5:  8 * time.Minute,
+		11: 6 * time.Hour,
+		30: 6 * time.Hour,
+	} {
+		if got := Backoff(attempts); got != want {
+			t.Errorf("Backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}